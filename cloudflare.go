@@ -1,25 +1,92 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 )
 
+// ownershipMarker is added to the description of the Cloudflare objects created by this controller; objects without it
+// are never deleted
+const ownershipMarker = "Created by estafette-cloudflare-loadbalancer"
+
+// clusterIDRegex matches the cluster ids that can be used in the names of pools and origins; they can't contain dashes,
+// so the cluster id always ends at the first dash, and cluster prod with pool eu-web can't be mistaken for cluster
+// prod-eu with pool web
+var clusterIDRegex = regexp.MustCompile(`^[a-zA-Z0-9]*$`)
+
 // CloudflareAPIClient handles communications with the Cloudflare API
 type CloudflareAPIClient interface {
-	GetOrCreateLoadBalancerMonitor(string, string, string) (cloudflare.LoadBalancerMonitor, error)
-	GetOrCreateLoadBalancerPool(string, []Node, cloudflare.LoadBalancerMonitor) (cloudflare.LoadBalancerPool, error)
-	GetOrCreateLoadBalancer(string, string, cloudflare.LoadBalancerPool) (cloudflare.LoadBalancer, error)
+	GetLoadBalancerMonitor(context.Context, string, string, string) (cloudflare.LoadBalancerMonitor, bool, error)
+	GetOrCreateLoadBalancerMonitor(context.Context, string, string, cloudflare.LoadBalancerMonitor) (cloudflare.LoadBalancerMonitor, error)
+	GetLoadBalancerPools(context.Context, string) ([]cloudflare.LoadBalancerPool, error)
+	GetOrCreateLoadBalancerPools(context.Context, string, []Node, cloudflare.LoadBalancerMonitor, int) ([]cloudflare.LoadBalancerPool, error)
+	GetZoneNames(context.Context) ([]string, error)
+	GetLoadBalancers(context.Context, string) ([]cloudflare.LoadBalancer, error)
+	GetLoadBalancer(context.Context, string, string) (cloudflare.LoadBalancer, bool, error)
+	GetOrCreateLoadBalancer(context.Context, string, string, cloudflare.LoadBalancer, []cloudflare.LoadBalancerPool) (cloudflare.LoadBalancer, error)
+	GetDNSRecords(context.Context, string, string) ([]cloudflare.DNSRecord, error)
+	GetOrCreateDNSRecords(context.Context, string, string, []Node) ([]cloudflare.DNSRecord, error)
+	DeleteLoadBalancerMonitor(context.Context, string, string, string) error
+	DeleteLoadBalancerPools(context.Context, string) error
+	DeleteLoadBalancer(context.Context, string, string, string) error
+	DeleteDNSRecords(context.Context, string, string) error
+}
+
+// cloudflareAPI holds the calls to the Cloudflare api client that are used, so they can be replaced in dry-run mode
+type cloudflareAPI interface {
+	ListZones(...string) ([]cloudflare.Zone, error)
+	ListLoadBalancerPools() ([]cloudflare.LoadBalancerPool, error)
+	CreateLoadBalancerPool(cloudflare.LoadBalancerPool) (cloudflare.LoadBalancerPool, error)
+	ModifyLoadBalancerPool(cloudflare.LoadBalancerPool) (cloudflare.LoadBalancerPool, error)
+	DeleteLoadBalancerPool(string) error
+	ListLoadBalancerMonitors() ([]cloudflare.LoadBalancerMonitor, error)
+	CreateLoadBalancerMonitor(cloudflare.LoadBalancerMonitor) (cloudflare.LoadBalancerMonitor, error)
+	ModifyLoadBalancerMonitor(cloudflare.LoadBalancerMonitor) (cloudflare.LoadBalancerMonitor, error)
+	DeleteLoadBalancerMonitor(string) error
+	ListLoadBalancers(string) ([]cloudflare.LoadBalancer, error)
+	CreateLoadBalancer(string, cloudflare.LoadBalancer) (cloudflare.LoadBalancer, error)
+	ModifyLoadBalancer(string, cloudflare.LoadBalancer) (cloudflare.LoadBalancer, error)
+	DeleteLoadBalancer(string, string) error
+	DNSRecords(string, cloudflare.DNSRecord) ([]cloudflare.DNSRecord, error)
+	CreateDNSRecord(string, cloudflare.DNSRecord) (*cloudflare.DNSRecordResponse, error)
+	DeleteDNSRecord(string, string) error
 }
 
 type cloudflareAPIClientImpl struct {
-	apiClient *cloudflare.API
+	apiClient       *cloudflare.API
+	timeout         time.Duration
+	limiter         *tokenBucket
+	maxRetries      int
+	dryRun          bool
+	clusterID       string
+	adoptDNSRecords bool
 }
 
-// NewCloudflareAPIClient returns an instance of CloudflareAPIClient
-func NewCloudflareAPIClient(key, email, organizationID string) (CloudflareAPIClient, error) {
+// NewCloudflareAPIClient returns an instance of CloudflareAPIClient; each call to the Cloudflare API times out after the
+// timeout, retryable failures are retried up to maxRetries times and all calls together stay below rateLimit requests
+// per second; in dry-run mode nothing is changed, instead the changes are added to the plan attached to the context; a
+// cluster id prefixes the names of the pools, monitors and origins, so several clusters can add their own pools to the
+// same load balancer; with adoptDNSRecords unmarked a records pointing to a node are taken over by dns load balancers
+func NewCloudflareAPIClient(key, email, organizationID string, timeout time.Duration, rateLimit float64, maxRetries int, dryRun bool, clusterID string, adoptDNSRecords bool) (CloudflareAPIClient, error) {
+
+	if rateLimit <= 0 {
+		return nil, fmt.Errorf("Cloudflare API rate limit should be larger than 0, not %v", rateLimit)
+	}
+	if !clusterIDRegex.MatchString(clusterID) {
+		return nil, fmt.Errorf("Cluster id should only contain letters and digits, not '%v'", clusterID)
+	}
 
 	// init cloudflare api client
 	apiClient, err := cloudflare.New(key, email)
@@ -36,91 +103,324 @@ func NewCloudflareAPIClient(key, email, organizationID string) (CloudflareAPICli
 
 	// return instance of CloudflareAPIClient
 	return &cloudflareAPIClientImpl{
-		apiClient: apiClient,
+		apiClient:       apiClient,
+		timeout:         timeout,
+		limiter:         newTokenBucket(rateLimit, int(math.Max(1, rateLimit))),
+		maxRetries:      maxRetries,
+		dryRun:          dryRun,
+		clusterID:       clusterID,
+		adoptDNSRecords: adoptDNSRecords,
 	}, nil
 }
 
-func (cl *cloudflareAPIClientImpl) GetOrCreateLoadBalancerPool(poolName string, nodes []Node, monitor cloudflare.LoadBalancerMonitor) (pool cloudflare.LoadBalancerPool, err error) {
+// getAPIClient returns a copy of the api client that sends its requests with the context, so they're aborted once the
+// context is cancelled, and through the rate limiting and retrying transport; in dry-run mode its changes are added to
+// the plan instead
+func (cl *cloudflareAPIClientImpl) getAPIClient(ctx context.Context) cloudflareAPI {
+
+	apiClient := *cl.apiClient
+
+	// setting the http client never fails
+	_ = cloudflare.HTTPClient(&http.Client{
+		Transport: &cloudflareTransport{
+			ctx:        ctx,
+			transport:  http.DefaultTransport,
+			limiter:    cl.limiter,
+			timeout:    cl.timeout,
+			maxRetries: cl.maxRetries,
+		},
+	})(&apiClient)
+
+	if cl.dryRun {
+		return &dryRunCloudflareAPI{API: &apiClient, plan: getPlan(ctx)}
+	}
+
+	return &apiClient
+}
+
+// GetLoadBalancerPools returns the existing pools for a pool name, including the extra pools it's sharded into
+func (cl *cloudflareAPIClientImpl) GetLoadBalancerPools(ctx context.Context, poolName string) (pools []cloudflare.LoadBalancerPool, err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	loadBalancerPools, err := apiClient.ListLoadBalancerPools()
+	if err != nil {
+		log.Error().Err(err).Msg("Error retrieving load balancer pools")
+		return
+	}
+
+	pools = []cloudflare.LoadBalancerPool{}
+	for _, lbp := range loadBalancerPools {
+		if isOwnPool(cl.getPoolName(poolName), lbp) {
+			pools = append(pools, cl.withNodeNames(lbp))
+		}
+	}
+
+	return
+}
+
+func (cl *cloudflareAPIClientImpl) GetOrCreateLoadBalancerPools(ctx context.Context, poolName string, nodes []Node, monitor cloudflare.LoadBalancerMonitor, maxOriginsPerPool int) (pools []cloudflare.LoadBalancerPool, err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	if maxOriginsPerPool < 1 {
+		err = fmt.Errorf("Maximum number of origins per pool should be at least 1, not %v", maxOriginsPerPool)
+		return
+	}
 
 	// retrieve load balancer pools
-	loadBalancerPools, err := cl.apiClient.ListLoadBalancerPools()
+	loadBalancerPools, err := apiClient.ListLoadBalancerPools()
 	if err != nil {
 		log.Error().Err(err).Msg("Error retrieving load balancer pools")
 		return
 	}
 	log.Debug().Interface("loadBalancerPools", loadBalancerPools).Msg("Retrieved load balancer pools")
 
-	// check if load balancer exists
-	loadBalancerPoolExists := false
-	if len(loadBalancerPools) > 0 {
-		for _, lbp := range loadBalancerPools {
-			if lbp.Name == poolName {
-				loadBalancerPoolExists = true
-				pool = lbp
-			}
+	// check which pools for this pool name already exist
+	poolName = cl.getPoolName(poolName)
+	existingPools := map[string]cloudflare.LoadBalancerPool{}
+	for _, lbp := range loadBalancerPools {
+		if isOwnPool(poolName, lbp) {
+			existingPools[lbp.Name] = lbp
+		}
+	}
+
+	// shard the nodes across as many pools as needed to stay within the maximum number of origins per pool
+	shardCount := (len(nodes) + maxOriginsPerPool - 1) / maxOriginsPerPool
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	poolNames := []string{}
+	for i := 0; i < shardCount; i++ {
+		poolNames = append(poolNames, getPoolShardName(poolName, i))
+	}
+	surplusPoolNames := []string{}
+	for name := range existingPools {
+		if !contains(poolNames, name) {
+			surplusPoolNames = append(surplusPoolNames, name)
+		}
+	}
+	sort.Strings(surplusPoolNames)
+
+	// origins are assigned by node name, so they stay in the pool they're in
+	existingPoolsWithNodeNames := map[string]cloudflare.LoadBalancerPool{}
+	for name, pool := range existingPools {
+		existingPoolsWithNodeNames[name] = cl.withNodeNames(pool)
+	}
+	assignedNodes := assignNodesToPools(nodes, poolNames, existingPoolsWithNodeNames, maxOriginsPerPool)
+
+	pools = []cloudflare.LoadBalancerPool{}
+	for _, name := range poolNames {
+		pool, poolExists := existingPools[name]
+
+		var updatedPool cloudflare.LoadBalancerPool
+		updatedPool, err = cl.createOrUpdateLoadBalancerPool(ctx, name, assignedNodes[name], monitor, pool, poolExists)
+		if err != nil {
+			return
 		}
+		pools = append(pools, cl.withNodeNames(updatedPool))
 	}
 
-	// truncate the nodes list to 5 nodes
-	if len(nodes) > 5 {
-		nodes = nodes[0:5]
+	// disable pools that are no longer needed, so they get removed from the load balancer; pools disabled by a previous
+	// reconcile are deleted, which Cloudflare refuses as long as a load balancer still refers to them
+	for _, name := range surplusPoolNames {
+		log.Info().Msgf("Load balancer pool %v is no longer needed for %v nodes with at most %v origins per pool", name, len(nodes), maxOriginsPerPool)
+
+		if !existingPools[name].Enabled {
+			log.Info().Msgf("Deleting load balancer pool with name %v", name)
+			deleteErr := apiClient.DeleteLoadBalancerPool(existingPools[name].ID)
+			if deleteErr == nil {
+				loadBalancerTotals.With(prometheus.Labels{"status": "deleted"}).Inc()
+				continue
+			}
+			log.Warn().Err(deleteErr).Msgf("Failed deleting load balancer pool with name %v, it's probably still used by a load balancer; retrying on the next reconcile", name)
+		}
+
+		var disabledPool cloudflare.LoadBalancerPool
+		disabledPool, err = cl.disableLoadBalancerPool(ctx, existingPools[name])
+		if err != nil {
+			return
+		}
+		pools = append(pools, cl.withNodeNames(disabledPool))
 	}
 
-	// create list of origins from nodes
+	return
+}
+
+func (cl *cloudflareAPIClientImpl) createOrUpdateLoadBalancerPool(ctx context.Context, poolName string, nodes []Node, monitor cloudflare.LoadBalancerMonitor, pool cloudflare.LoadBalancerPool, loadBalancerPoolExists bool) (cloudflare.LoadBalancerPool, error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	// create list of origins from nodes; origins of draining nodes are disabled
 	origins := []cloudflare.LoadBalancerOrigin{}
 	for _, node := range nodes {
 		origins = append(origins, cloudflare.LoadBalancerOrigin{
-			Name:    node.Name,
+			Name:    cl.getOriginName(node.Name),
 			Address: node.ExternalIP,
-			Enabled: true,
+			Enabled: !node.Draining,
 		})
 	}
 	log.Debug().Interface("nodes", nodes).Interface("origins", origins).Msg("Created origins from nodes")
 
+	var err error
 	if !loadBalancerPoolExists {
 		// create load balancer pool
-		pool, err = cl.apiClient.CreateLoadBalancerPool(cloudflare.LoadBalancerPool{
-			Name:    poolName,
-			Origins: origins,
-			Enabled: true,
-			Monitor: monitor.ID,
+		pool, err = apiClient.CreateLoadBalancerPool(cloudflare.LoadBalancerPool{
+			Name:        poolName,
+			Description: ownershipMarker,
+			Origins:     origins,
+			Enabled:     true,
+			Monitor:     monitor.ID,
 		})
 		if err != nil {
 			log.Error().Err(err).Msgf("Error creating load balancer pool with name %v", poolName)
-			return
+			return pool, err
 		}
+		loadBalancerTotals.With(prometheus.Labels{"status": "created"}).Inc()
 	} else {
-		// update load balancer pool
-		pool.Origins = origins
-		pool.Monitor = monitor.ID
-		pool, err = cl.apiClient.ModifyLoadBalancerPool(pool)
+		desiredPool := pool
+		desiredPool.Origins = origins
+		desiredPool.Monitor = monitor.ID
+		desiredPool.Enabled = true
+
+		// only update load balancer pool if it differs from the desired state
+		diff := diffLoadBalancerPool(pool, desiredPool)
+		if !diff.HasChanges() {
+			log.Debug().Msgf("Load balancer pool with name %v is up to date", poolName)
+			loadBalancerTotals.With(prometheus.Labels{"status": "unchanged"}).Inc()
+			return pool, nil
+		}
+
+		log.Info().Interface("diff", diff).Msgf("Updating load balancer pool with name %v", poolName)
+		pool, err = apiClient.ModifyLoadBalancerPool(desiredPool)
 		if err != nil {
 			log.Error().Err(err).Msgf("Error updating load balancer pool with name %v", poolName)
-			return
+			return pool, err
 		}
+		loadBalancerTotals.With(prometheus.Labels{"status": "updated"}).Inc()
 	}
 	log.Debug().Interface("loadBalancerPool", pool).Msgf("Load balancer pool object for name %v", poolName)
 
+	return pool, nil
+}
+
+func (cl *cloudflareAPIClientImpl) disableLoadBalancerPool(ctx context.Context, pool cloudflare.LoadBalancerPool) (cloudflare.LoadBalancerPool, error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	if !pool.Enabled {
+		loadBalancerTotals.With(prometheus.Labels{"status": "unchanged"}).Inc()
+		return pool, nil
+	}
+
+	desiredPool := pool
+	desiredPool.Enabled = false
+
+	log.Info().Interface("diff", diffLoadBalancerPool(pool, desiredPool)).Msgf("Disabling load balancer pool with name %v", pool.Name)
+	pool, err := apiClient.ModifyLoadBalancerPool(desiredPool)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error disabling load balancer pool with name %v", pool.Name)
+		return pool, err
+	}
+	loadBalancerTotals.With(prometheus.Labels{"status": "updated"}).Inc()
+
+	return pool, nil
+}
+
+// GetZoneNames returns the names of all zones the account has access to
+func (cl *cloudflareAPIClientImpl) GetZoneNames(ctx context.Context) (zoneNames []string, err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	zones, err := apiClient.ListZones()
+	if err != nil {
+		log.Error().Err(err).Msg("Error retrieving zones")
+		return
+	}
+
+	zoneNames = []string{}
+	for _, zone := range zones {
+		zoneNames = append(zoneNames, zone.Name)
+	}
+
 	return
 }
 
-func (cl *cloudflareAPIClientImpl) GetOrCreateLoadBalancer(loadbalancerName, zoneName string, pool cloudflare.LoadBalancerPool) (loadBalancer cloudflare.LoadBalancer, err error) {
+// GetLoadBalancers returns the existing load balancers in a zone
+func (cl *cloudflareAPIClientImpl) GetLoadBalancers(ctx context.Context, zoneName string) (loadBalancers []cloudflare.LoadBalancer, err error) {
+
+	apiClient := cl.getAPIClient(ctx)
 
 	// get zone id
-	zones, err := cl.apiClient.ListZones(zoneName)
+	zoneID, err := cl.getZoneID(ctx, zoneName)
 	if err != nil {
-		log.Error().Err(err).Msgf("Error retrieving zone %v", zoneName)
 		return
 	}
-	if len(zones) == 0 {
-		log.Error().Err(err).Msgf("Zero zones returned when retrieving zone %v", zoneName)
+
+	loadBalancers, err = apiClient.ListLoadBalancers(zoneID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error retrieving load balancers for zone id %v", zoneID)
+		return
+	}
+
+	return
+}
+
+// GetLoadBalancer returns the existing load balancer <lbName>.<zoneName>, if any
+func (cl *cloudflareAPIClientImpl) GetLoadBalancer(ctx context.Context, loadbalancerName, zoneName string) (loadBalancer cloudflare.LoadBalancer, exists bool, err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	// get zone id
+	zoneID, err := cl.getZoneID(ctx, zoneName)
+	if err != nil {
+		return
+	}
+
+	loadBalancers, err := apiClient.ListLoadBalancers(zoneID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error retrieving load balancers for zone id %v", zoneID)
+		return
+	}
+
+	lbName := fmt.Sprintf("%v.%v", loadbalancerName, zoneName)
+	for _, lb := range loadBalancers {
+		if lb.Name == lbName {
+			return lb, true, nil
+		}
+	}
+
+	return
+}
+
+// GetOrCreateLoadBalancer ensures the load balancer exists with the description, proxied and ttl settings of the desired
+// load balancer, the active pools as default pools and a valid fallback pool; empty or disabled pools are removed from the
+// default pools, while pools not passed in are left in place
+func (cl *cloudflareAPIClientImpl) GetOrCreateLoadBalancer(ctx context.Context, loadbalancerName, zoneName string, desiredLoadBalancer cloudflare.LoadBalancer, pools []cloudflare.LoadBalancerPool) (loadBalancer cloudflare.LoadBalancer, err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	lbName := fmt.Sprintf("%v.%v", loadbalancerName, zoneName)
+
+	// split the pools into active ones and ones without any enabled origins
+	activePoolIDs := []string{}
+	inactivePoolIDs := []string{}
+	for _, pool := range pools {
+		if isActivePool(pool) {
+			activePoolIDs = append(activePoolIDs, pool.ID)
+		} else {
+			inactivePoolIDs = append(inactivePoolIDs, pool.ID)
+		}
+	}
+
+	// get zone id
+	zoneID, err := cl.getZoneID(ctx, zoneName)
+	if err != nil {
 		return
 	}
-	zoneID := zones[0].ID
-	log.Debug().Msgf("Zone ID for zone %v is %v", zoneName, zoneID)
 
 	// retrieve load balancers for zone
-	loadBalancers, err := cl.apiClient.ListLoadBalancers(zoneID)
+	loadBalancers, err := apiClient.ListLoadBalancers(zoneID)
 	if err != nil {
 		log.Error().Err(err).Msgf("Error retrieving load balancers for zone id %v", zoneID)
 		return
@@ -128,7 +428,6 @@ func (cl *cloudflareAPIClientImpl) GetOrCreateLoadBalancer(loadbalancerName, zon
 	log.Debug().Interface("loadBalancers", loadBalancers).Msgf("Retrieved load balancers for zone %v", zoneID)
 
 	// check if load balancer exists
-	lbName := fmt.Sprintf("%v.%v", loadbalancerName, zoneName)
 	loadBalancerExists := false
 	if len(loadBalancers) > 0 {
 		for _, lb := range loadBalancers {
@@ -140,22 +439,64 @@ func (cl *cloudflareAPIClientImpl) GetOrCreateLoadBalancer(loadbalancerName, zon
 	}
 
 	if !loadBalancerExists {
+		if len(activePoolIDs) == 0 {
+			err = fmt.Errorf("At least one pool with enabled origins is needed to create load balancer %v", lbName)
+			log.Error().Err(err).Msgf("Error creating load balancer with name %v", lbName)
+			return
+		}
+
 		// create loadbalancer
-		loadBalancer, err = cl.apiClient.CreateLoadBalancer(zoneID, cloudflare.LoadBalancer{
-			Name:         lbName,
-			Description:  "Created by estafette-cloudflare-loadbalancer",
-			FallbackPool: pool.ID,
-			DefaultPools: []string{pool.ID},
-			Proxied:      true,
-		})
+		desiredLoadBalancer.Name = lbName
+		desiredLoadBalancer.Description = withOptionalOwnershipMarker(desiredLoadBalancer.Description)
+		desiredLoadBalancer.FallbackPool = activePoolIDs[0]
+		desiredLoadBalancer.DefaultPools = activePoolIDs
+		desiredLoadBalancer.RegionPools = getSteeredPools(nil, desiredLoadBalancer.RegionPools, activePoolIDs, inactivePoolIDs)
+		desiredLoadBalancer.PopPools = getSteeredPools(nil, desiredLoadBalancer.PopPools, activePoolIDs, inactivePoolIDs)
+		if desiredLoadBalancer.Proxied {
+			desiredLoadBalancer.TTL = 0
+		}
+
+		loadBalancer, err = apiClient.CreateLoadBalancer(zoneID, desiredLoadBalancer)
 		if err != nil {
 			log.Error().Err(err).Msgf("Error creating load balancer with name %v", lbName)
 			return
 		}
 	} else {
-		if !contains(loadBalancer.DefaultPools, pool.ID) {
-			loadBalancer.DefaultPools = append(loadBalancer.DefaultPools, pool.ID)
-			cl.apiClient.ModifyLoadBalancer(zoneID, loadBalancer)
+		updatedLoadBalancer := loadBalancer
+
+		// only manage the description of load balancers created by this controller
+		if isOwned(loadBalancer.Description) {
+			updatedLoadBalancer.Description = withOptionalOwnershipMarker(desiredLoadBalancer.Description)
+		}
+
+		// the ttl only applies to load balancers that aren't proxied
+		updatedLoadBalancer.Proxied = desiredLoadBalancer.Proxied
+		if !desiredLoadBalancer.Proxied {
+			updatedLoadBalancer.TTL = desiredLoadBalancer.TTL
+		}
+
+		// pools of other clusters or added by hand are never removed or moved
+		defaultPools := mergePools(loadBalancer.DefaultPools, activePoolIDs, inactivePoolIDs)
+		if len(defaultPools) > 0 {
+			updatedLoadBalancer.DefaultPools = defaultPools
+		} else {
+			log.Warn().Msgf("None of the pools for load balancer %v have enabled origins, keeping its current default pools", lbName)
+		}
+
+		// merge the active pools into the configured regions and PoPs, the same way as into the default pools
+		if len(activePoolIDs) > 0 {
+			updatedLoadBalancer.RegionPools = getSteeredPools(loadBalancer.RegionPools, desiredLoadBalancer.RegionPools, activePoolIDs, inactivePoolIDs)
+			updatedLoadBalancer.PopPools = getSteeredPools(loadBalancer.PopPools, desiredLoadBalancer.PopPools, activePoolIDs, inactivePoolIDs)
+		}
+
+		// keep the fallback pool valid
+		if !contains(updatedLoadBalancer.DefaultPools, updatedLoadBalancer.FallbackPool) && len(updatedLoadBalancer.DefaultPools) > 0 {
+			updatedLoadBalancer.FallbackPool = updatedLoadBalancer.DefaultPools[0]
+		}
+
+		if !loadBalancersEqual(loadBalancer, updatedLoadBalancer) {
+			log.Info().Interface("loadBalancer", loadBalancer).Interface("desiredLoadBalancer", updatedLoadBalancer).Msgf("Updating load balancer with name %v", lbName)
+			loadBalancer, err = apiClient.ModifyLoadBalancer(zoneID, updatedLoadBalancer)
 			if err != nil {
 				log.Error().Err(err).Msgf("Error updating load balancer with name %v", lbName)
 				return
@@ -167,57 +508,836 @@ func (cl *cloudflareAPIClientImpl) GetOrCreateLoadBalancer(loadbalancerName, zon
 	return
 }
 
-func (cl *cloudflareAPIClientImpl) GetOrCreateLoadBalancerMonitor(poolName, zoneName, path string) (monitor cloudflare.LoadBalancerMonitor, err error) {
+// GetLoadBalancerMonitor returns the existing monitor for a pool and health check path, if any
+func (cl *cloudflareAPIClientImpl) GetLoadBalancerMonitor(ctx context.Context, poolName, zoneName, path string) (monitor cloudflare.LoadBalancerMonitor, exists bool, err error) {
 
-	monitors, err := cl.apiClient.ListLoadBalancerMonitors()
+	apiClient := cl.getAPIClient(ctx)
+
+	monitors, err := apiClient.ListLoadBalancerMonitors()
 	if err != nil {
 		log.Error().Err(err).Msg("Error retrieving load balancer monitors")
 		return
 	}
 
-	// check if load balancer exists
-	monitorDescription := fmt.Sprintf("%v.%v%v", poolName, zoneName, path)
-	monitorExists := false
-	if len(monitors) > 0 {
-		for _, mon := range monitors {
-			if mon.Description == monitorDescription {
-				monitorExists = true
-				monitor = mon
-			}
-		}
+	monitor, exists = findLoadBalancerMonitor(monitors, fmt.Sprintf("%v.%v%v", cl.getPoolName(poolName), zoneName, path))
+
+	return
+}
+
+func (cl *cloudflareAPIClientImpl) GetOrCreateLoadBalancerMonitor(ctx context.Context, poolName, zoneName string, desiredMonitor cloudflare.LoadBalancerMonitor) (monitor cloudflare.LoadBalancerMonitor, err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	monitors, err := apiClient.ListLoadBalancerMonitors()
+	if err != nil {
+		log.Error().Err(err).Msg("Error retrieving load balancer monitors")
+		return
 	}
 
+	// check if monitor exists
+	monitorDescription := fmt.Sprintf("%v.%v%v", cl.getPoolName(poolName), zoneName, desiredMonitor.Path)
+	monitor, monitorExists := findLoadBalancerMonitor(monitors, monitorDescription)
+
 	if !monitorExists {
 		// create monitor
-		monitor, err = cl.apiClient.CreateLoadBalancerMonitor(cloudflare.LoadBalancerMonitor{
-			Type:            "https",
-			Description:     monitorDescription,
-			Method:          "GET",
-			Path:            path,
-			Timeout:         5,
-			Retries:         2,
-			Interval:        60,
-			ExpectedCodes:   "200",
-			FollowRedirects: false,
-			AllowInsecure:   true,
-		})
+		desiredMonitor.Description = withOwnershipMarker(monitorDescription)
+		monitor, err = apiClient.CreateLoadBalancerMonitor(desiredMonitor)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed creating monitor with description %v", monitorDescription)
 			return
 		}
 
 	} else {
-		// update monitor
-		// monitor, err = cl.apiClient.ModifyLoadBalancerMonitor(monitor)
-		// if err != nil {
-		// 	log.Error().Err(err).Msgf("Failed updating monitor with description %v", monitorDescription)
-		// 	return
-		// }
+		// keep identity of the existing monitor
+		desiredMonitor.ID = monitor.ID
+		desiredMonitor.CreatedOn = monitor.CreatedOn
+		desiredMonitor.ModifiedOn = monitor.ModifiedOn
+		desiredMonitor.Description = monitor.Description
+
+		if !loadBalancerMonitorsEqual(monitor, desiredMonitor) {
+			// update monitor
+			log.Info().Interface("monitor", monitor).Interface("desiredMonitor", desiredMonitor).Msgf("Monitor with description %v has drifted, updating it", monitorDescription)
+			monitor, err = apiClient.ModifyLoadBalancerMonitor(desiredMonitor)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed updating monitor with description %v", monitorDescription)
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// GetDNSRecords returns the existing a records for <lbName>.<zoneName> that were created by this controller
+func (cl *cloudflareAPIClientImpl) GetDNSRecords(ctx context.Context, loadbalancerName, zoneName string) (records []cloudflare.DNSRecord, err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	// get zone id
+	zoneID, err := cl.getZoneID(ctx, zoneName)
+	if err != nil {
+		return
+	}
+
+	records, _, _, err = cl.getDNSRecords(apiClient, zoneID, fmt.Sprintf("%v.%v", loadbalancerName, zoneName))
+
+	return
+}
+
+// GetOrCreateDNSRecords ensures there's an a record <lbName>.<zoneName> for each node and deletes the ones created by
+// this controller that no longer point to a node; dns records have no description, so each record it creates is marked
+// as owned by a txt record with the same name, and records without one are left untouched, unless they point to a node
+// and adopting dns records is enabled, in which case they get marked instead
+func (cl *cloudflareAPIClientImpl) GetOrCreateDNSRecords(ctx context.Context, loadbalancerName, zoneName string, nodes []Node) (records []cloudflare.DNSRecord, err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	// get zone id
+	zoneID, err := cl.getZoneID(ctx, zoneName)
+	if err != nil {
+		return
+	}
+
+	// retrieve existing a records for <lbName>.<zoneName>
+	dnsRecordName := fmt.Sprintf("%v.%v", loadbalancerName, zoneName)
+	ownRecords, otherRecords, markers, err := cl.getDNSRecords(apiClient, zoneID, dnsRecordName)
+	if err != nil {
+		return
+	}
+	log.Debug().Interface("dnsRecords", ownRecords).Interface("otherDNSRecords", otherRecords).Msgf("Retrieved dns records with name %v", dnsRecordName)
+
+	// collect the external ips of all nodes
+	nodeIPs := []string{}
+	for _, node := range nodes {
+		if node.ExternalIP == "" {
+			log.Warn().Msgf("Node %v has no external ip, skipping it for dns record %v", node.Name, dnsRecordName)
+			continue
+		}
+		nodeIPs = append(nodeIPs, node.ExternalIP)
+	}
+
+	// delete records that no longer point to an existing node
+	records = []cloudflare.DNSRecord{}
+	existingIPs := []string{}
+	for _, record := range ownRecords {
+		if contains(nodeIPs, record.Content) && !contains(existingIPs, record.Content) {
+			existingIPs = append(existingIPs, record.Content)
+			records = append(records, record)
+			continue
+		}
+
+		log.Info().Msgf("Deleting dns record %v pointing to %v", dnsRecordName, record.Content)
+		err = apiClient.DeleteDNSRecord(zoneID, record.ID)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error deleting dns record %v pointing to %v", dnsRecordName, record.Content)
+			return
+		}
+	}
+
+	// records pointing to a node may have been created before they got marked, but may just as well belong to someone
+	// else, so they're only taken over when adopting is enabled; either way no second record is created for the node
+	for _, record := range otherRecords {
+		if !contains(nodeIPs, record.Content) || contains(existingIPs, record.Content) {
+			log.Warn().Msgf("Dns record %v pointing to %v was not created by this controller, leaving it untouched", dnsRecordName, record.Content)
+			continue
+		}
+
+		if !cl.adoptDNSRecords {
+			log.Warn().Msgf("Dns record %v pointing to node %v was not created by this controller, leaving it untouched; enable adopting dns records to take it over", dnsRecordName, record.Content)
+			existingIPs = append(existingIPs, record.Content)
+			records = append(records, record)
+			continue
+		}
+
+		log.Info().Msgf("Taking over dns record %v pointing to %v", dnsRecordName, record.Content)
+		err = cl.createDNSRecordMarker(apiClient, zoneID, dnsRecordName, record.Content, markers)
+		if err != nil {
+			return
+		}
+		existingIPs = append(existingIPs, record.Content)
+		records = append(records, record)
+	}
+
+	// create records for nodes that do not have one yet; the marker goes first, so a record is never left unmarked
+	for _, ip := range nodeIPs {
+		if contains(existingIPs, ip) {
+			continue
+		}
+
+		err = cl.createDNSRecordMarker(apiClient, zoneID, dnsRecordName, ip, markers)
+		if err != nil {
+			return
+		}
+
+		log.Info().Msgf("Creating dns record %v pointing to %v", dnsRecordName, ip)
+		var response *cloudflare.DNSRecordResponse
+		response, err = apiClient.CreateDNSRecord(zoneID, cloudflare.DNSRecord{
+			Type:    "A",
+			Name:    dnsRecordName,
+			Content: ip,
+			Proxied: true,
+		})
+		if err != nil {
+			log.Error().Err(err).Msgf("Error creating dns record %v pointing to %v", dnsRecordName, ip)
+			return
+		}
+		existingIPs = append(existingIPs, ip)
+		records = append(records, response.Result)
+	}
+
+	// remove the markers of records that are gone
+	for ip, marker := range markers {
+		if contains(existingIPs, ip) {
+			continue
+		}
+
+		err = cl.deleteDNSRecordMarker(apiClient, zoneID, dnsRecordName, ip, marker)
+		if err != nil {
+			return
+		}
+	}
+	log.Debug().Interface("dnsRecords", records).Msgf("Dns records for zone %v and name %v", zoneID, dnsRecordName)
+
+	return
+}
+
+func (cl *cloudflareAPIClientImpl) getZoneID(ctx context.Context, zoneName string) (zoneID string, err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	zones, err := apiClient.ListZones(zoneName)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error retrieving zone %v", zoneName)
+		return
+	}
+	if len(zones) == 0 {
+		err = &CloudflareAPIError{Kind: CloudflareErrorNotFound, Message: fmt.Sprintf("Zero zones returned when retrieving zone %v", zoneName)}
+		log.Error().Err(err).Msgf("Zero zones returned when retrieving zone %v", zoneName)
+		return
 	}
+	zoneID = zones[0].ID
+	log.Debug().Msgf("Zone ID for zone %v is %v", zoneName, zoneID)
 
 	return
 }
 
+func (cl *cloudflareAPIClientImpl) DeleteLoadBalancerMonitor(ctx context.Context, poolName, zoneName, path string) (err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	monitors, err := apiClient.ListLoadBalancerMonitors()
+	if err != nil {
+		log.Error().Err(err).Msg("Error retrieving load balancer monitors")
+		return
+	}
+
+	monitorDescription := fmt.Sprintf("%v.%v%v", cl.getPoolName(poolName), zoneName, path)
+	monitor, monitorExists := findLoadBalancerMonitor(monitors, monitorDescription)
+	if !monitorExists {
+		log.Info().Msgf("Monitor with description %v does not exist, nothing to delete", monitorDescription)
+		return
+	}
+	if !isOwned(monitor.Description) {
+		log.Warn().Msgf("Monitor with description %v was not created by this controller, leaving it untouched", monitorDescription)
+		return
+	}
+
+	log.Info().Msgf("Deleting monitor with description %v", monitorDescription)
+	err = apiClient.DeleteLoadBalancerMonitor(monitor.ID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed deleting monitor with description %v", monitorDescription)
+		return
+	}
+
+	return
+}
+
+func (cl *cloudflareAPIClientImpl) DeleteLoadBalancerPools(ctx context.Context, poolName string) (err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	loadBalancerPools, err := apiClient.ListLoadBalancerPools()
+	if err != nil {
+		log.Error().Err(err).Msg("Error retrieving load balancer pools")
+		return
+	}
+
+	for _, lbp := range loadBalancerPools {
+		if !isOwnPool(cl.getPoolName(poolName), lbp) {
+			continue
+		}
+		if !isOwned(lbp.Description) {
+			log.Warn().Msgf("Load balancer pool with name %v was not created by this controller, leaving it untouched", lbp.Name)
+			continue
+		}
+
+		log.Info().Msgf("Deleting load balancer pool with name %v", lbp.Name)
+		err = apiClient.DeleteLoadBalancerPool(lbp.ID)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error deleting load balancer pool with name %v", lbp.Name)
+			return
+		}
+	}
+
+	return
+}
+
+// DeleteLoadBalancer removes the pools for the pool name from the load balancer, and deletes the load balancer itself
+// once it has no pools of other clusters left; load balancers not created by this controller are never deleted, so it
+// fails if such a load balancer would be left without pools
+func (cl *cloudflareAPIClientImpl) DeleteLoadBalancer(ctx context.Context, loadbalancerName, zoneName, poolName string) (err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	// get zone id
+	zoneID, err := cl.getZoneID(ctx, zoneName)
+	if err != nil {
+		return
+	}
+
+	loadBalancers, err := apiClient.ListLoadBalancers(zoneID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error retrieving load balancers for zone id %v", zoneID)
+		return
+	}
+
+	loadBalancerPools, err := apiClient.ListLoadBalancerPools()
+	if err != nil {
+		log.Error().Err(err).Msg("Error retrieving load balancer pools")
+		return
+	}
+
+	ownPoolIDs := []string{}
+	for _, lbp := range loadBalancerPools {
+		if isOwnPool(cl.getPoolName(poolName), lbp) {
+			ownPoolIDs = append(ownPoolIDs, lbp.ID)
+		}
+	}
+
+	lbName := fmt.Sprintf("%v.%v", loadbalancerName, zoneName)
+	for _, lb := range loadBalancers {
+		if lb.Name != lbName {
+			continue
+		}
+
+		// leave the load balancer in place for the other clusters still using it
+		updatedLoadBalancer := withoutPools(lb, ownPoolIDs)
+		if len(updatedLoadBalancer.DefaultPools) > 0 {
+			if loadBalancersEqual(lb, updatedLoadBalancer) {
+				continue
+			}
+
+			log.Info().Msgf("Removing pools for %v from load balancer with name %v, which still has pools of other clusters", cl.getPoolName(poolName), lbName)
+			_, err = apiClient.ModifyLoadBalancer(zoneID, updatedLoadBalancer)
+			if err != nil {
+				log.Error().Err(err).Msgf("Error removing pools from load balancer with name %v", lbName)
+				return
+			}
+			continue
+		}
+
+		// a load balancer needs at least one default pool, so the pools can't be removed from a load balancer that isn't
+		// ours without leaving it empty; deleting the pools would fail anyway while it still refers to them
+		if !isOwned(lb.Description) {
+			err = fmt.Errorf("Load balancer with name %v was not created by this controller and has no pools left besides the ones for %v; add another pool to it or delete it before removing the pools", lbName, cl.getPoolName(poolName))
+			log.Error().Err(err).Msgf("Error removing pools from load balancer with name %v", lbName)
+			return
+		}
+
+		log.Info().Msgf("Deleting load balancer with name %v", lbName)
+		err = apiClient.DeleteLoadBalancer(zoneID, lb.ID)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error deleting load balancer with name %v", lbName)
+			return
+		}
+	}
+
+	return
+}
+
+// DeleteDNSRecords deletes all a records for <lbName>.<zoneName> that were created by this controller, whichever node
+// they point to, along with the txt records marking them as owned; other records are left untouched
+func (cl *cloudflareAPIClientImpl) DeleteDNSRecords(ctx context.Context, loadbalancerName, zoneName string) (err error) {
+
+	apiClient := cl.getAPIClient(ctx)
+
+	// get zone id
+	zoneID, err := cl.getZoneID(ctx, zoneName)
+	if err != nil {
+		return
+	}
+
+	dnsRecordName := fmt.Sprintf("%v.%v", loadbalancerName, zoneName)
+	records, _, markers, err := cl.getDNSRecords(apiClient, zoneID, dnsRecordName)
+	if err != nil {
+		return
+	}
+
+	for _, record := range records {
+		log.Info().Msgf("Deleting dns record %v pointing to %v", dnsRecordName, record.Content)
+		err = apiClient.DeleteDNSRecord(zoneID, record.ID)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error deleting dns record %v pointing to %v", dnsRecordName, record.Content)
+			return
+		}
+	}
+
+	// the markers go last, so records are never left unmarked when deleting fails halfway
+	for ip, marker := range markers {
+		err = cl.deleteDNSRecordMarker(apiClient, zoneID, dnsRecordName, ip, marker)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// getDNSRecords returns the a records with the name, split into the ones marked as created by this controller and the
+// others, and the txt records marking them by ip
+func (cl *cloudflareAPIClientImpl) getDNSRecords(apiClient cloudflareAPI, zoneID, dnsRecordName string) (ownRecords, otherRecords []cloudflare.DNSRecord, markers map[string]cloudflare.DNSRecord, err error) {
+
+	records, err := apiClient.DNSRecords(zoneID, cloudflare.DNSRecord{Type: "A", Name: dnsRecordName})
+	if err != nil {
+		log.Error().Err(err).Msgf("Error retrieving dns records with name %v", dnsRecordName)
+		return
+	}
+
+	txtRecords, err := apiClient.DNSRecords(zoneID, cloudflare.DNSRecord{Type: "TXT", Name: dnsRecordName})
+	if err != nil {
+		log.Error().Err(err).Msgf("Error retrieving txt records with name %v", dnsRecordName)
+		return
+	}
+
+	markers = map[string]cloudflare.DNSRecord{}
+	for _, record := range txtRecords {
+		if ip, ok := cl.getMarkedIP(record); ok {
+			markers[ip] = record
+		}
+	}
+
+	ownRecords = []cloudflare.DNSRecord{}
+	otherRecords = []cloudflare.DNSRecord{}
+	for _, record := range records {
+		if _, ok := markers[record.Content]; ok {
+			ownRecords = append(ownRecords, record)
+		} else {
+			otherRecords = append(otherRecords, record)
+		}
+	}
+
+	return
+}
+
+// createDNSRecordMarker creates the txt record marking the a record pointing to the ip as created by this controller,
+// unless it already exists, and adds it to the markers
+func (cl *cloudflareAPIClientImpl) createDNSRecordMarker(apiClient cloudflareAPI, zoneID, dnsRecordName, ip string, markers map[string]cloudflare.DNSRecord) (err error) {
+
+	if _, ok := markers[ip]; ok {
+		return
+	}
+
+	log.Info().Msgf("Creating txt record %v marking dns record pointing to %v as owned", dnsRecordName, ip)
+	response, err := apiClient.CreateDNSRecord(zoneID, cloudflare.DNSRecord{
+		Type:    "TXT",
+		Name:    dnsRecordName,
+		Content: cl.getDNSRecordMarker(ip),
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("Error creating txt record %v marking dns record pointing to %v as owned", dnsRecordName, ip)
+		return
+	}
+	markers[ip] = response.Result
+
+	return
+}
+
+// deleteDNSRecordMarker deletes the txt record marking the a record pointing to the ip as created by this controller
+func (cl *cloudflareAPIClientImpl) deleteDNSRecordMarker(apiClient cloudflareAPI, zoneID, dnsRecordName, ip string, marker cloudflare.DNSRecord) (err error) {
+
+	if marker.ID == "" {
+		return
+	}
+
+	log.Info().Msgf("Deleting txt record %v marking dns record pointing to %v as owned", dnsRecordName, ip)
+	err = apiClient.DeleteDNSRecord(zoneID, marker.ID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error deleting txt record %v marking dns record pointing to %v as owned", dnsRecordName, ip)
+		return
+	}
+
+	return
+}
+
+// findLoadBalancerMonitor looks up a monitor by its description, with or without the ownership marker
+func findLoadBalancerMonitor(monitors []cloudflare.LoadBalancerMonitor, description string) (monitor cloudflare.LoadBalancerMonitor, exists bool) {
+	for _, mon := range monitors {
+		if mon.Description == description || mon.Description == withOwnershipMarker(description) {
+			return mon, true
+		}
+	}
+	return
+}
+
+// loadBalancerPoolDiff describes the changes needed to get a pool into its desired state
+type loadBalancerPoolDiff struct {
+	AddedOrigins   []string `json:"addedOrigins,omitempty"`
+	RemovedOrigins []string `json:"removedOrigins,omitempty"`
+	ChangedOrigins []string `json:"changedOrigins,omitempty"`
+	MonitorFrom    string   `json:"monitorFrom,omitempty"`
+	MonitorTo      string   `json:"monitorTo,omitempty"`
+	EnabledFrom    *bool    `json:"enabledFrom,omitempty"`
+	EnabledTo      *bool    `json:"enabledTo,omitempty"`
+}
+
+// HasChanges returns true if the pool needs to be updated
+func (d loadBalancerPoolDiff) HasChanges() bool {
+	return len(d.AddedOrigins) > 0 || len(d.RemovedOrigins) > 0 || len(d.ChangedOrigins) > 0 || d.MonitorFrom != d.MonitorTo || d.EnabledFrom != nil
+}
+
+// diffLoadBalancerPool compares the origins, monitor and enabled state of a pool; the order of the origins is ignored
+func diffLoadBalancerPool(current, desired cloudflare.LoadBalancerPool) (diff loadBalancerPoolDiff) {
+
+	currentOrigins := map[string]cloudflare.LoadBalancerOrigin{}
+	for _, origin := range current.Origins {
+		currentOrigins[origin.Name] = origin
+	}
+	desiredOrigins := map[string]cloudflare.LoadBalancerOrigin{}
+	for _, origin := range desired.Origins {
+		desiredOrigins[origin.Name] = origin
+	}
+
+	for _, origin := range desired.Origins {
+		currentOrigin, ok := currentOrigins[origin.Name]
+		if !ok {
+			diff.AddedOrigins = append(diff.AddedOrigins, origin.Name)
+		} else if currentOrigin != origin {
+			diff.ChangedOrigins = append(diff.ChangedOrigins, origin.Name)
+		}
+	}
+	for _, origin := range current.Origins {
+		if _, ok := desiredOrigins[origin.Name]; !ok {
+			diff.RemovedOrigins = append(diff.RemovedOrigins, origin.Name)
+		}
+	}
+
+	if current.Monitor != desired.Monitor {
+		diff.MonitorFrom = current.Monitor
+		diff.MonitorTo = desired.Monitor
+	}
+
+	if current.Enabled != desired.Enabled {
+		diff.EnabledFrom = &current.Enabled
+		diff.EnabledTo = &desired.Enabled
+	}
+
+	return
+}
+
+// isActivePool returns true if the pool is enabled and has at least one enabled origin
+func isActivePool(pool cloudflare.LoadBalancerPool) bool {
+	if !pool.Enabled {
+		return false
+	}
+	for _, origin := range pool.Origins {
+		if origin.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// mergePools keeps the pools in their current position, removes the inactive pools and appends the new active pools
+func mergePools(currentPoolIDs, activePoolIDs, inactivePoolIDs []string) (poolIDs []string) {
+	poolIDs = withoutPoolIDs(currentPoolIDs, inactivePoolIDs)
+	for _, poolID := range activePoolIDs {
+		if !contains(poolIDs, poolID) {
+			poolIDs = append(poolIDs, poolID)
+		}
+	}
+	return
+}
+
+// getSteeredPools returns the pools per region or PoP, with the active pools merged into the steered ones and the pools
+// of this controller removed from the others; the pools of other clusters are left in place, so each cluster can add its
+// pools to the regions it serves
+func getSteeredPools(currentPools, steeredPools map[string][]string, activePoolIDs, inactivePoolIDs []string) (pools map[string][]string) {
+
+	ownPoolIDs := append(append([]string{}, activePoolIDs...), inactivePoolIDs...)
+
+	pools = map[string][]string{}
+	for key, poolIDs := range currentPools {
+		if _, isSteered := steeredPools[key]; !isSteered {
+			poolIDs = withoutPoolIDs(poolIDs, ownPoolIDs)
+		}
+		if len(poolIDs) > 0 {
+			pools[key] = poolIDs
+		}
+	}
+	for key := range steeredPools {
+		if poolIDs := mergePools(currentPools[key], activePoolIDs, inactivePoolIDs); len(poolIDs) > 0 {
+			pools[key] = poolIDs
+		} else {
+			// without active pools a steered region or PoP falls back to the default pools
+			delete(pools, key)
+		}
+	}
+
+	return
+}
+
+// withoutPools returns the load balancer with the pools removed from its default pools and from every region and PoP,
+// keeping the order of the remaining pools; a removed fallback pool is replaced by the first remaining default pool
+func withoutPools(loadBalancer cloudflare.LoadBalancer, poolIDs []string) cloudflare.LoadBalancer {
+
+	loadBalancer.DefaultPools = withoutPoolIDs(loadBalancer.DefaultPools, poolIDs)
+	loadBalancer.RegionPools = withoutPoolIDsPerKey(loadBalancer.RegionPools, poolIDs)
+	loadBalancer.PopPools = withoutPoolIDsPerKey(loadBalancer.PopPools, poolIDs)
+
+	if contains(poolIDs, loadBalancer.FallbackPool) && len(loadBalancer.DefaultPools) > 0 {
+		loadBalancer.FallbackPool = loadBalancer.DefaultPools[0]
+	}
+
+	return loadBalancer
+}
+
+func withoutPoolIDs(poolIDs, removedPoolIDs []string) (remainingPoolIDs []string) {
+	remainingPoolIDs = []string{}
+	for _, poolID := range poolIDs {
+		if !contains(removedPoolIDs, poolID) {
+			remainingPoolIDs = append(remainingPoolIDs, poolID)
+		}
+	}
+	return
+}
+
+// withoutPoolIDsPerKey removes the pools from each region or PoP, leaving out the ones without any pools left
+func withoutPoolIDsPerKey(pools map[string][]string, removedPoolIDs []string) (remainingPools map[string][]string) {
+	remainingPools = map[string][]string{}
+	for key, poolIDs := range pools {
+		if remainingPoolIDs := withoutPoolIDs(poolIDs, removedPoolIDs); len(remainingPoolIDs) > 0 {
+			remainingPools[key] = remainingPoolIDs
+		}
+	}
+	return
+}
+
+func loadBalancersEqual(a, b cloudflare.LoadBalancer) bool {
+	if a.Description != b.Description || a.Proxied != b.Proxied || a.TTL != b.TTL || a.FallbackPool != b.FallbackPool {
+		return false
+	}
+	return stringSlicesEqual(a.DefaultPools, b.DefaultPools) && stringSliceMapsEqual(a.RegionPools, b.RegionPools) && stringSliceMapsEqual(a.PopPools, b.PopPools)
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func loadBalancerMonitorsEqual(a, b cloudflare.LoadBalancerMonitor) bool {
+	return a.Type == b.Type &&
+		a.Description == b.Description &&
+		a.Method == b.Method &&
+		a.Path == b.Path &&
+		stringSliceMapsEqual(a.Header, b.Header) &&
+		a.Timeout == b.Timeout &&
+		a.Retries == b.Retries &&
+		a.Interval == b.Interval &&
+		a.ExpectedBody == b.ExpectedBody &&
+		a.ExpectedCodes == b.ExpectedCodes &&
+		a.FollowRedirects == b.FollowRedirects &&
+		a.AllowInsecure == b.AllowInsecure
+}
+
+func stringSliceMapsEqual(a, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, values := range a {
+		if otherValues, ok := b[key]; !ok || !stringSlicesEqual(values, otherValues) {
+			return false
+		}
+	}
+	return true
+}
+
+// getPoolName returns the name of the pool in Cloudflare, prefixed with the cluster id if there is one
+func (cl *cloudflareAPIClientImpl) getPoolName(poolName string) string {
+	if cl.clusterID == "" {
+		return poolName
+	}
+	return fmt.Sprintf("%v-%v", cl.clusterID, poolName)
+}
+
+// getOriginName returns the name of the origin for a node, prefixed with the cluster id if there is one, so nodes with
+// the same name in different clusters don't collide
+func (cl *cloudflareAPIClientImpl) getOriginName(nodeName string) string {
+	if cl.clusterID == "" {
+		return nodeName
+	}
+	return fmt.Sprintf("%v-%v", cl.clusterID, nodeName)
+}
+
+// withNodeNames returns the pool with the cluster id removed from its origin names, so they match the node names again
+func (cl *cloudflareAPIClientImpl) withNodeNames(pool cloudflare.LoadBalancerPool) cloudflare.LoadBalancerPool {
+
+	if cl.clusterID == "" {
+		return pool
+	}
+
+	origins := []cloudflare.LoadBalancerOrigin{}
+	for _, origin := range pool.Origins {
+		origin.Name = strings.TrimPrefix(origin.Name, cl.clusterID+"-")
+		origins = append(origins, origin)
+	}
+	pool.Origins = origins
+
+	return pool
+}
+
+// getDNSRecordMarker returns the content of the txt record marking the a record pointing to the ip as created by this
+// controller; it includes the cluster id if there is one, so clusters sharing a hostname leave each other's records alone
+func (cl *cloudflareAPIClientImpl) getDNSRecordMarker(ip string) string {
+	if cl.clusterID == "" {
+		return fmt.Sprintf("%v for %v", ownershipMarker, ip)
+	}
+	return fmt.Sprintf("%v in cluster %v for %v", ownershipMarker, cl.clusterID, ip)
+}
+
+// getMarkedIP returns the ip of the a record the txt record marks as created by this controller, if it's one of its
+// markers; Cloudflare may return the content of txt records within quotes
+func (cl *cloudflareAPIClientImpl) getMarkedIP(record cloudflare.DNSRecord) (ip string, ok bool) {
+	prefix := cl.getDNSRecordMarker("")
+	content := strings.Trim(record.Content, `"`)
+	if !strings.HasPrefix(content, prefix) {
+		return "", false
+	}
+	ip = strings.TrimPrefix(content, prefix)
+	return ip, net.ParseIP(ip) != nil
+}
+
+func withOwnershipMarker(description string) string {
+	return fmt.Sprintf("%v - %v", description, ownershipMarker)
+}
+
+// withOptionalOwnershipMarker adds the ownership marker to a description, or returns just the marker if the description
+// is empty
+func withOptionalOwnershipMarker(description string) string {
+	if description == "" || description == ownershipMarker {
+		return ownershipMarker
+	}
+	return withOwnershipMarker(description)
+}
+
+func isOwned(description string) bool {
+	return strings.Contains(description, ownershipMarker)
+}
+
+// getPoolShardName returns the name of the n-th pool for a pool name; the first pool keeps the pool name itself, the
+// following ones get a -2, -3, etc suffix
+func getPoolShardName(poolName string, index int) string {
+	if index == 0 {
+		return poolName
+	}
+	return fmt.Sprintf("%v-%v", poolName, index+1)
+}
+
+// isPoolShardName returns true if the name is the pool name itself or one of the extra pool names it's sharded into
+func isPoolShardName(poolName, name string) bool {
+	if name == poolName {
+		return true
+	}
+	if !strings.HasPrefix(name, poolName+"-") {
+		return false
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(name, poolName+"-"))
+	return err == nil && index >= 2
+}
+
+// poolNamesCollide returns true if the pools for the two pool names would be mistaken for each other, because the names
+// are the same or the extra pools of one are named like the other
+func poolNamesCollide(a, b string) bool {
+	return isPoolShardName(a, b) || isPoolShardName(b, a)
+}
+
+// isOwnPool returns true if the pool is one of the pools for the pool name; the extra pools also need the ownership
+// marker, so a pool that merely has a matching name, like one added by hand, is never claimed, disabled or deleted
+func isOwnPool(poolName string, pool cloudflare.LoadBalancerPool) bool {
+	if pool.Name == poolName {
+		return true
+	}
+	return isPoolShardName(poolName, pool.Name) && isOwned(pool.Description)
+}
+
+// assignNodesToPools distributes the nodes over the pools; nodes stay in the pool they're already an origin of as long
+// as it has room, the remaining nodes fill up the pools in order of their name, so pool membership stays stable
+// between reconciles
+func assignNodesToPools(nodes []Node, poolNames []string, existingPools map[string]cloudflare.LoadBalancerPool, maxOriginsPerPool int) map[string][]Node {
+
+	sortedNodes := make([]Node, len(nodes))
+	copy(sortedNodes, nodes)
+	sort.Slice(sortedNodes, func(i, j int) bool {
+		return sortedNodes[i].Name < sortedNodes[j].Name
+	})
+
+	assignedNodes := map[string][]Node{}
+	assigned := map[string]bool{}
+
+	// keep nodes in the pool they're already in
+	for _, poolName := range poolNames {
+		pool, ok := existingPools[poolName]
+		if !ok {
+			continue
+		}
+
+		originNames := []string{}
+		for _, origin := range pool.Origins {
+			originNames = append(originNames, origin.Name)
+		}
+
+		for _, node := range sortedNodes {
+			if assigned[node.Name] || len(assignedNodes[poolName]) >= maxOriginsPerPool {
+				continue
+			}
+			if contains(originNames, node.Name) {
+				assignedNodes[poolName] = append(assignedNodes[poolName], node)
+				assigned[node.Name] = true
+			}
+		}
+	}
+
+	// fill up the pools with the remaining nodes
+	for _, node := range sortedNodes {
+		if assigned[node.Name] {
+			continue
+		}
+		for _, poolName := range poolNames {
+			if len(assignedNodes[poolName]) < maxOriginsPerPool {
+				assignedNodes[poolName] = append(assignedNodes[poolName], node)
+				assigned[node.Name] = true
+				break
+			}
+		}
+	}
+
+	// order the nodes within each pool by name
+	for _, poolName := range poolNames {
+		poolNodes := assignedNodes[poolName]
+		sort.Slice(poolNodes, func(i, j int) bool {
+			return poolNodes[i].Name < poolNodes[j].Name
+		})
+	}
+
+	return assignedNodes
+}
+
 func contains(s []string, v string) bool {
 	for _, a := range s {
 		if a == v {
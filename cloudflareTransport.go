@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// cloudflareIDRegex matches the ids Cloudflare uses for zones, pools, monitors, load balancers and dns records
+var cloudflareIDRegex = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// CloudflareErrorKind classifies errors returned by the Cloudflare API
+type CloudflareErrorKind string
+
+const (
+	// CloudflareErrorRetryable is used for rate limiting, server errors and network failures that might succeed when retried
+	CloudflareErrorRetryable CloudflareErrorKind = "retryable"
+	// CloudflareErrorAuth is used when the credentials are invalid or lack permissions
+	CloudflareErrorAuth CloudflareErrorKind = "auth"
+	// CloudflareErrorNotFound is used when the requested object doesn't exist
+	CloudflareErrorNotFound CloudflareErrorKind = "not-found"
+	// CloudflareErrorValidation is used when the request is rejected because of its content
+	CloudflareErrorValidation CloudflareErrorKind = "validation"
+	// CloudflareErrorUnknown is used for all other errors
+	CloudflareErrorUnknown CloudflareErrorKind = "unknown"
+)
+
+// CloudflareAPIError is returned for failed calls to the Cloudflare API
+type CloudflareAPIError struct {
+	Kind       CloudflareErrorKind
+	StatusCode int
+	Message    string
+}
+
+func (e *CloudflareAPIError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("Cloudflare API error (%v): %v", e.Kind, e.Message)
+	}
+	return fmt.Sprintf("Cloudflare API error (%v) with HTTP status %v: %v", e.Kind, e.StatusCode, e.Message)
+}
+
+// getCloudflareErrorKind returns the kind of an error returned by the Cloudflare API, looking through the errors it got
+// wrapped in by the Cloudflare and http clients
+func getCloudflareErrorKind(err error) CloudflareErrorKind {
+
+	err = errors.Cause(err)
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if apiErr, ok := err.(*CloudflareAPIError); ok {
+		return apiErr.Kind
+	}
+
+	return CloudflareErrorUnknown
+}
+
+func getCloudflareErrorKindForStatus(statusCode int) CloudflareErrorKind {
+	switch {
+	case statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return CloudflareErrorRetryable
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return CloudflareErrorAuth
+	case statusCode == http.StatusNotFound:
+		return CloudflareErrorNotFound
+	case statusCode == http.StatusBadRequest || statusCode == http.StatusConflict || statusCode == http.StatusUnprocessableEntity:
+		return CloudflareErrorValidation
+	}
+	return CloudflareErrorUnknown
+}
+
+// cloudflareTransport sends requests to the Cloudflare API within the rate limit, times out each attempt and retries
+// retryable failures with exponential backoff; failed responses are turned into a CloudflareAPIError
+type cloudflareTransport struct {
+	ctx        context.Context
+	transport  http.RoundTripper
+	limiter    *tokenBucket
+	timeout    time.Duration
+	maxRetries int
+}
+
+func (t *cloudflareTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	for attempt := 0; ; attempt++ {
+
+		// the request body has been consumed by the previous attempt, so use a copy of the request with a fresh body
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.WithContext(t.ctx)
+			attemptReq.Body = body
+		}
+
+		err := t.limiter.Wait(t.ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.roundTripWithTimeout(attemptReq)
+		if err == nil {
+			return resp, nil
+		}
+		if t.ctx.Err() != nil {
+			return nil, t.ctx.Err()
+		}
+
+		apiErr, ok := err.(*CloudflareAPIError)
+		if !ok {
+			apiErr = &CloudflareAPIError{Kind: CloudflareErrorRetryable, Message: err.Error()}
+		}
+
+		// creating objects is only retried when rate limited, since a failed request might have created them anyway
+		retryable := apiErr.Kind == CloudflareErrorRetryable && (req.Method != http.MethodPost || apiErr.StatusCode == http.StatusTooManyRequests)
+		if !retryable || attempt >= t.maxRetries {
+			return nil, apiErr
+		}
+
+		delay := getBackoffDelay(attempt)
+		if resp != nil {
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(seconds)*time.Second > delay {
+				delay = time.Duration(seconds) * time.Second
+			}
+		}
+
+		log.Warn().Err(apiErr).Msgf("Request %v %v failed, retrying in %v (attempt %v of %v)", req.Method, req.URL.Path, delay, attempt+1, t.maxRetries)
+
+		select {
+		case <-t.ctx.Done():
+			return nil, t.ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// roundTripWithTimeout sends a single request; a failed response is returned along with the error, with its body
+// already consumed
+func (t *cloudflareTransport) roundTripWithTimeout(req *http.Request) (resp *http.Response, err error) {
+
+	ctx, cancel := context.WithTimeout(t.ctx, t.timeout)
+
+	start := time.Now()
+	resp, err = t.transport.RoundTrip(req.WithContext(ctx))
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	labels := prometheus.Labels{"operation": getCloudflareOperation(req), "code": code}
+	cloudflareAPIRequestTotals.With(labels).Inc()
+	cloudflareAPIRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		cancel()
+		return
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer cancel()
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		err = &CloudflareAPIError{
+			Kind:       getCloudflareErrorKindForStatus(resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Message:    string(body),
+		}
+		return
+	}
+
+	// the body is read after returning, so only release the context once it's closed
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return
+}
+
+// getCloudflareOperation returns the method and path of a request with the ids replaced, like
+// 'GET /zones/:id/load_balancers', to keep the number of metric labels small
+func getCloudflareOperation(req *http.Request) string {
+
+	segments := strings.Split(req.URL.Path, "/")
+	for i, segment := range segments {
+		if cloudflareIDRegex.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+
+	// strip the api version prefix
+	path := strings.TrimPrefix(strings.Join(segments, "/"), "/client/v4")
+
+	return req.Method + " " + path
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// getBackoffDelay returns an exponentially growing delay of about 1, 2, 4, ... seconds up to 30 seconds, with jitter
+func getBackoffDelay(attempt int) time.Duration {
+
+	delay := math.Min(math.Pow(2, float64(attempt)), 30)
+
+	// the random number generator isn't safe for concurrent use
+	randMutex.Lock()
+	defer randMutex.Unlock()
+
+	return time.Duration((0.75 + 0.5*r.Float64()) * delay * float64(time.Second))
+}
+
+// tokenBucket limits the rate of requests; it holds up to burst tokens, which are refilled at rate tokens per second
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes a token, blocking until one is available or the context is cancelled
+func (b *tokenBucket) Wait(ctx context.Context) error {
+
+	for {
+		b.mutex.Lock()
+		now := time.Now()
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mutex.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
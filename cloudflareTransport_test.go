@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		rate        float64
+		burst       int
+		requests    int
+		minDuration time.Duration
+		maxDuration time.Duration
+	}{
+		{"AllowsBurstWithoutWaiting", 10, 3, 3, 0, 50 * time.Millisecond},
+		{"WaitsForRefillBeyondBurst", 50, 2, 4, 35 * time.Millisecond, 200 * time.Millisecond},
+		{"LimitsToRateWithoutBurst", 100, 1, 6, 45 * time.Millisecond, 250 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			bucket := newTokenBucket(tt.rate, tt.burst)
+			start := time.Now()
+
+			// act
+			for i := 0; i < tt.requests; i++ {
+				err := bucket.Wait(context.Background())
+				assert.Nil(t, err)
+			}
+
+			duration := time.Since(start)
+			assert.True(t, duration >= tt.minDuration, "took %v, expected at least %v", duration, tt.minDuration)
+			assert.True(t, duration <= tt.maxDuration, "took %v, expected at most %v", duration, tt.maxDuration)
+		})
+	}
+
+	t.Run("ReturnsErrorWhenContextIsCancelledWhileWaiting", func(t *testing.T) {
+
+		bucket := newTokenBucket(0.1, 1)
+		bucket.Wait(context.Background())
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		// act
+		err := bucket.Wait(ctx)
+
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+}
+
+func TestCloudflareTransportRoundTrip(t *testing.T) {
+
+	// a status of 0 makes the server hang until the attempt times out
+	tests := []struct {
+		name             string
+		method           string
+		statuses         []int
+		retryAfter       string
+		timeout          time.Duration
+		maxRetries       int
+		expectedAttempts int
+		expectedKind     CloudflareErrorKind
+		minDuration      time.Duration
+	}{
+		{"ReturnsSuccessfulResponse", http.MethodGet, []int{200}, "", time.Second, 2, 1, "", 0},
+		{"RetriesServerError", http.MethodGet, []int{500, 200}, "", time.Second, 2, 2, "", 0},
+		{"RetriesRateLimit", http.MethodGet, []int{429, 200}, "", time.Second, 2, 2, "", 0},
+		{"DoesNotRetryPostOnServerError", http.MethodPost, []int{500, 200}, "", time.Second, 2, 1, CloudflareErrorRetryable, 0},
+		{"RetriesPostOnRateLimit", http.MethodPost, []int{429, 200}, "", time.Second, 2, 2, "", 0},
+		{"DoesNotRetryValidationError", http.MethodPut, []int{400, 200}, "", time.Second, 2, 1, CloudflareErrorValidation, 0},
+		{"DoesNotRetryAuthError", http.MethodGet, []int{403, 200}, "", time.Second, 2, 1, CloudflareErrorAuth, 0},
+		{"DoesNotRetryNotFound", http.MethodDelete, []int{404, 200}, "", time.Second, 2, 1, CloudflareErrorNotFound, 0},
+		{"WaitsForRetryAfterWhenLongerThanBackoff", http.MethodGet, []int{429, 200}, "2", time.Second, 2, 2, "", 2 * time.Second},
+		{"RetriesAttemptThatTimesOut", http.MethodGet, []int{0, 200}, "", 50 * time.Millisecond, 2, 2, "", 0},
+		{"ReturnsRetryableErrorWhenAttemptTimesOut", http.MethodGet, []int{0}, "", 50 * time.Millisecond, 0, 1, CloudflareErrorRetryable, 0},
+		{"GivesUpAfterMaxRetries", http.MethodGet, []int{503}, "", time.Second, 1, 2, CloudflareErrorRetryable, 0},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// the backoff between attempts takes about a second, so don't wait for each case in turn
+			t.Parallel()
+
+			var mutex sync.Mutex
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				mutex.Lock()
+				status := tt.statuses[len(tt.statuses)-1]
+				if attempts < len(tt.statuses) {
+					status = tt.statuses[attempts]
+				}
+				attempts++
+				mutex.Unlock()
+
+				if status == 0 {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(time.Second):
+					}
+					return
+				}
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+				w.Write([]byte(`{"success":true}`))
+			}))
+			defer server.Close()
+
+			transport := &cloudflareTransport{
+				ctx:        context.Background(),
+				transport:  http.DefaultTransport,
+				limiter:    newTokenBucket(1000, 1000),
+				timeout:    tt.timeout,
+				maxRetries: tt.maxRetries,
+			}
+			req, _ := http.NewRequest(tt.method, server.URL+"/client/v4/zones", strings.NewReader(`{"name":"example.com"}`))
+			start := time.Now()
+
+			// act
+			resp, err := transport.RoundTrip(req)
+
+			duration := time.Since(start)
+			if tt.expectedKind == "" {
+				if assert.Nil(t, err) {
+					body, _ := ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+					assert.Equal(t, `{"success":true}`, string(body))
+				}
+			} else {
+				assert.Nil(t, resp)
+				assert.Equal(t, tt.expectedKind, getCloudflareErrorKind(err))
+			}
+			mutex.Lock()
+			assert.Equal(t, tt.expectedAttempts, attempts)
+			mutex.Unlock()
+			assert.True(t, duration >= tt.minDuration, "took %v, expected at least %v", duration, tt.minDuration)
+		})
+	}
+}
+
+func TestGetCloudflareOperation(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		operation string
+	}{
+		{"ReturnsPathWithoutApiVersion", "GET", "https://api.cloudflare.com/client/v4/zones?name=example.com", "GET /zones"},
+		{"ReplacesIds", "PUT", "https://api.cloudflare.com/client/v4/zones/023e105f4ecef8ad9ca31a8372d0c353/load_balancers/699d98642c564d2e855e9661899b7252", "PUT /zones/:id/load_balancers/:id"},
+		{"KeepsSegmentsThatAreNoIds", "GET", "https://api.cloudflare.com/client/v4/user/load_balancers/pools", "GET /user/load_balancers/pools"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			req, _ := http.NewRequest(tt.method, tt.url, nil)
+
+			// act
+			operation := getCloudflareOperation(req)
+
+			assert.Equal(t, tt.operation, operation)
+		})
+	}
+}
@@ -0,0 +1,1145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPoolShardName(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		poolName  string
+		poolShard string
+		expected  bool
+	}{
+		{"ReturnsTrueForPoolName", "my-cluster", "my-cluster", true},
+		{"ReturnsTrueForSecondShard", "my-cluster", "my-cluster-2", true},
+		{"ReturnsTrueForTenthShard", "my-cluster", "my-cluster-10", true},
+		{"ReturnsFalseForFirstShardSuffix", "my-cluster", "my-cluster-1", false},
+		{"ReturnsFalseForZeroSuffix", "my-cluster", "my-cluster-0", false},
+		{"ReturnsFalseForNonNumericSuffix", "my-cluster", "my-cluster-eu", false},
+		{"ReturnsFalseForOtherPool", "my-cluster", "other-cluster", false},
+		{"ReturnsFalseForPoolNamePrefix", "my-cluster", "my-cluster2", false},
+		{"ReturnsFalseForNestedShard", "my-cluster", "my-cluster-2-2", false},
+		{"ReturnsTrueForShardWithClusterPrefix", "europe-my-cluster", "europe-my-cluster-2", true},
+		{"ReturnsFalseForPoolOfOtherCluster", "europe-my-cluster", "us-my-cluster-2", false},
+		{"ReturnsFalseForUnprefixedShard", "europe-my-cluster", "my-cluster-2", false},
+		{"ReturnsFalseForPoolWithLongerNameInSameCluster", "prod-web", "prod-eu-web-2", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			result := isPoolShardName(tt.poolName, tt.poolShard)
+
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestIsOwnPool(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		pool     cloudflare.LoadBalancerPool
+		expected bool
+	}{
+		{"ReturnsTrueForPoolNameWithoutMarker", cloudflare.LoadBalancerPool{Name: "my-cluster"}, true},
+		{"ReturnsTrueForPoolNameWithMarker", cloudflare.LoadBalancerPool{Name: "my-cluster", Description: ownershipMarker}, true},
+		{"ReturnsTrueForShardWithMarker", cloudflare.LoadBalancerPool{Name: "my-cluster-2", Description: ownershipMarker}, true},
+		{"ReturnsFalseForShardWithoutMarker", cloudflare.LoadBalancerPool{Name: "my-cluster-2", Description: "Added by hand"}, false},
+		{"ReturnsFalseForOtherPoolWithMarker", cloudflare.LoadBalancerPool{Name: "other-cluster", Description: ownershipMarker}, false},
+		{"ReturnsFalseForPoolOfOtherClusterWithMarker", cloudflare.LoadBalancerPool{Name: "us-my-cluster", Description: ownershipMarker}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			result := isOwnPool("my-cluster", tt.pool)
+
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestNewCloudflareAPIClient(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		clusterID string
+		valid     bool
+	}{
+		{"ReturnsClientWithoutClusterID", "", true},
+		{"ReturnsClientForClusterIDOfLettersAndDigits", "europe1", true},
+		{"ReturnsErrorForClusterIDWithDash", "prod-eu", false},
+		{"ReturnsErrorForClusterIDWithDot", "prod.eu", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			_, err := NewCloudflareAPIClient("key", "user@example.com", "", time.Second, 4, 0, false, tt.clusterID, false)
+
+			if tt.valid {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestClusterNames(t *testing.T) {
+
+	tests := []struct {
+		name               string
+		clusterID          string
+		expectedPoolName   string
+		expectedOriginName string
+	}{
+		{"LeavesNamesAloneWithoutClusterID", "", "my-cluster", "gke-node-1"},
+		{"PrefixesNamesWithClusterID", "europe", "europe-my-cluster", "europe-gke-node-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := &cloudflareAPIClientImpl{clusterID: tt.clusterID}
+
+			// act
+			poolName := cl.getPoolName("my-cluster")
+			originName := cl.getOriginName("gke-node-1")
+
+			assert.Equal(t, tt.expectedPoolName, poolName)
+			assert.Equal(t, tt.expectedOriginName, originName)
+			pool := cl.withNodeNames(cloudflare.LoadBalancerPool{Origins: []cloudflare.LoadBalancerOrigin{{Name: originName}}})
+			assert.Equal(t, "gke-node-1", pool.Origins[0].Name)
+		})
+	}
+}
+
+func TestWithoutPools(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		loadBalancer cloudflare.LoadBalancer
+		poolIDs      []string
+		expected     cloudflare.LoadBalancer
+	}{
+		{
+			name:         "RemovesPoolsKeepingOrderOfOthers",
+			loadBalancer: cloudflare.LoadBalancer{DefaultPools: []string{"a", "own", "b"}, FallbackPool: "a"},
+			poolIDs:      []string{"own"},
+			expected:     cloudflare.LoadBalancer{DefaultPools: []string{"a", "b"}, FallbackPool: "a", RegionPools: map[string][]string{}, PopPools: map[string][]string{}},
+		},
+		{
+			name:         "ReplacesRemovedFallbackPool",
+			loadBalancer: cloudflare.LoadBalancer{DefaultPools: []string{"own", "a"}, FallbackPool: "own"},
+			poolIDs:      []string{"own"},
+			expected:     cloudflare.LoadBalancer{DefaultPools: []string{"a"}, FallbackPool: "a", RegionPools: map[string][]string{}, PopPools: map[string][]string{}},
+		},
+		{
+			name:         "KeepsFallbackPoolWithoutRemainingPools",
+			loadBalancer: cloudflare.LoadBalancer{DefaultPools: []string{"own"}, FallbackPool: "own"},
+			poolIDs:      []string{"own"},
+			expected:     cloudflare.LoadBalancer{DefaultPools: []string{}, FallbackPool: "own", RegionPools: map[string][]string{}, PopPools: map[string][]string{}},
+		},
+		{
+			name: "RemovesPoolsFromRegionsAndPops",
+			loadBalancer: cloudflare.LoadBalancer{
+				DefaultPools: []string{"a", "own"},
+				FallbackPool: "a",
+				RegionPools:  map[string][]string{"WEU": {"own", "a"}, "ENAM": {"own"}},
+				PopPools:     map[string][]string{"AMS": {"own"}},
+			},
+			poolIDs:  []string{"own"},
+			expected: cloudflare.LoadBalancer{DefaultPools: []string{"a"}, FallbackPool: "a", RegionPools: map[string][]string{"WEU": {"a"}}, PopPools: map[string][]string{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			loadBalancer := withoutPools(tt.loadBalancer, tt.poolIDs)
+
+			assert.Equal(t, tt.expected, loadBalancer)
+		})
+	}
+}
+
+func TestAssignNodesToPools(t *testing.T) {
+
+	pool := func(name string, originNames ...string) cloudflare.LoadBalancerPool {
+		origins := []cloudflare.LoadBalancerOrigin{}
+		for _, originName := range originNames {
+			origins = append(origins, cloudflare.LoadBalancerOrigin{Name: originName})
+		}
+		return cloudflare.LoadBalancerPool{Name: name, Origins: origins}
+	}
+
+	tests := []struct {
+		name              string
+		nodeNames         []string
+		poolNames         []string
+		existingPools     map[string]cloudflare.LoadBalancerPool
+		maxOriginsPerPool int
+		expected          map[string][]string
+	}{
+		{
+			name:              "FillsPoolsInOrderOfNodeName",
+			nodeNames:         []string{"node-c", "node-a", "node-d", "node-b"},
+			poolNames:         []string{"pool", "pool-2"},
+			existingPools:     map[string]cloudflare.LoadBalancerPool{},
+			maxOriginsPerPool: 2,
+			expected:          map[string][]string{"pool": {"node-a", "node-b"}, "pool-2": {"node-c", "node-d"}},
+		},
+		{
+			name:              "KeepsNodesInTheirExistingPool",
+			nodeNames:         []string{"node-a", "node-b", "node-c"},
+			poolNames:         []string{"pool", "pool-2"},
+			existingPools:     map[string]cloudflare.LoadBalancerPool{"pool": pool("pool", "node-c"), "pool-2": pool("pool-2", "node-a")},
+			maxOriginsPerPool: 2,
+			expected:          map[string][]string{"pool": {"node-b", "node-c"}, "pool-2": {"node-a"}},
+		},
+		{
+			name:              "MovesNodesOutOfFullPools",
+			nodeNames:         []string{"node-a", "node-b", "node-c"},
+			poolNames:         []string{"pool", "pool-2"},
+			existingPools:     map[string]cloudflare.LoadBalancerPool{"pool": pool("pool", "node-a", "node-b", "node-c")},
+			maxOriginsPerPool: 2,
+			expected:          map[string][]string{"pool": {"node-a", "node-b"}, "pool-2": {"node-c"}},
+		},
+		{
+			name:              "MovesNodesOutOfSurplusPools",
+			nodeNames:         []string{"node-a", "node-b"},
+			poolNames:         []string{"pool"},
+			existingPools:     map[string]cloudflare.LoadBalancerPool{"pool": pool("pool", "node-a"), "pool-2": pool("pool-2", "node-b")},
+			maxOriginsPerPool: 2,
+			expected:          map[string][]string{"pool": {"node-a", "node-b"}},
+		},
+		{
+			name:              "LeavesOutDepartedNodes",
+			nodeNames:         []string{"node-b"},
+			poolNames:         []string{"pool"},
+			existingPools:     map[string]cloudflare.LoadBalancerPool{"pool": pool("pool", "node-a", "node-b")},
+			maxOriginsPerPool: 2,
+			expected:          map[string][]string{"pool": {"node-b"}},
+		},
+		{
+			name:              "ReturnsNoNodesWithoutNodes",
+			nodeNames:         []string{},
+			poolNames:         []string{"pool"},
+			existingPools:     map[string]cloudflare.LoadBalancerPool{},
+			maxOriginsPerPool: 2,
+			expected:          map[string][]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			nodes := []Node{}
+			for _, name := range tt.nodeNames {
+				nodes = append(nodes, Node{Name: name})
+			}
+
+			// act
+			assignedNodes := assignNodesToPools(nodes, tt.poolNames, tt.existingPools, tt.maxOriginsPerPool)
+
+			assignedNodeNames := map[string][]string{}
+			for poolName, poolNodes := range assignedNodes {
+				for _, node := range poolNodes {
+					assignedNodeNames[poolName] = append(assignedNodeNames[poolName], node.Name)
+				}
+			}
+			assert.Equal(t, tt.expected, assignedNodeNames)
+		})
+	}
+}
+
+func TestDiffLoadBalancerPool(t *testing.T) {
+
+	origin := func(name string, enabled bool) cloudflare.LoadBalancerOrigin {
+		return cloudflare.LoadBalancerOrigin{Name: name, Address: name + ".example.com", Enabled: enabled}
+	}
+	enabled := true
+	disabled := false
+
+	tests := []struct {
+		name       string
+		current    cloudflare.LoadBalancerPool
+		desired    cloudflare.LoadBalancerPool
+		expected   loadBalancerPoolDiff
+		hasChanges bool
+	}{
+		{
+			name:       "ReturnsNoChangesForEqualPools",
+			current:    cloudflare.LoadBalancerPool{Monitor: "m1", Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{origin("a", true), origin("b", true)}},
+			desired:    cloudflare.LoadBalancerPool{Monitor: "m1", Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{origin("a", true), origin("b", true)}},
+			expected:   loadBalancerPoolDiff{},
+			hasChanges: false,
+		},
+		{
+			name:       "IgnoresOrderOfOrigins",
+			current:    cloudflare.LoadBalancerPool{Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{origin("b", true), origin("a", true)}},
+			desired:    cloudflare.LoadBalancerPool{Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{origin("a", true), origin("b", true)}},
+			expected:   loadBalancerPoolDiff{},
+			hasChanges: false,
+		},
+		{
+			name:       "ReturnsAddedAndRemovedOrigins",
+			current:    cloudflare.LoadBalancerPool{Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{origin("a", true), origin("b", true)}},
+			desired:    cloudflare.LoadBalancerPool{Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{origin("b", true), origin("c", true)}},
+			expected:   loadBalancerPoolDiff{AddedOrigins: []string{"c"}, RemovedOrigins: []string{"a"}},
+			hasChanges: true,
+		},
+		{
+			name:       "ReturnsChangedOriginForDisabledOrigin",
+			current:    cloudflare.LoadBalancerPool{Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{origin("a", true)}},
+			desired:    cloudflare.LoadBalancerPool{Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{origin("a", false)}},
+			expected:   loadBalancerPoolDiff{ChangedOrigins: []string{"a"}},
+			hasChanges: true,
+		},
+		{
+			name:       "ReturnsChangedMonitor",
+			current:    cloudflare.LoadBalancerPool{Monitor: "m1", Enabled: true},
+			desired:    cloudflare.LoadBalancerPool{Monitor: "m2", Enabled: true},
+			expected:   loadBalancerPoolDiff{MonitorFrom: "m1", MonitorTo: "m2"},
+			hasChanges: true,
+		},
+		{
+			name:       "ReturnsChangedEnabledState",
+			current:    cloudflare.LoadBalancerPool{Enabled: true},
+			desired:    cloudflare.LoadBalancerPool{Enabled: false},
+			expected:   loadBalancerPoolDiff{EnabledFrom: &enabled, EnabledTo: &disabled},
+			hasChanges: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			diff := diffLoadBalancerPool(tt.current, tt.desired)
+
+			assert.Equal(t, tt.expected, diff)
+			assert.Equal(t, tt.hasChanges, diff.HasChanges())
+		})
+	}
+}
+
+func TestGetOrCreateDNSRecords(t *testing.T) {
+
+	aRecord := func(id, ip string) cloudflare.DNSRecord {
+		return cloudflare.DNSRecord{ID: id, Type: "A", Name: "www.example.com", Content: ip}
+	}
+	marker := func(id, ip string) cloudflare.DNSRecord {
+		return cloudflare.DNSRecord{ID: id, Type: "TXT", Name: "www.example.com", Content: ownershipMarker + " for " + ip}
+	}
+
+	tests := []struct {
+		name            string
+		records         []cloudflare.DNSRecord
+		nodes           []Node
+		adoptDNSRecords bool
+		expectedRecords []string
+	}{
+		{
+			name:            "CreatesMarkedRecordsForNodes",
+			records:         []cloudflare.DNSRecord{},
+			nodes:           []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}, {Name: "node-2", ExternalIP: "203.0.113.2"}},
+			expectedRecords: []string{"A 203.0.113.1", "A 203.0.113.2", "TXT " + ownershipMarker + " for 203.0.113.1", "TXT " + ownershipMarker + " for 203.0.113.2"},
+		},
+		{
+			name:            "DeletesMarkedRecordsOfDepartedNodes",
+			records:         []cloudflare.DNSRecord{aRecord("a1", "203.0.113.1"), marker("t1", "203.0.113.1"), aRecord("a2", "203.0.113.2"), marker("t2", "203.0.113.2")},
+			nodes:           []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}},
+			expectedRecords: []string{"A 203.0.113.1", "TXT " + ownershipMarker + " for 203.0.113.1"},
+		},
+		{
+			name:            "DeletesDuplicateMarkedRecords",
+			records:         []cloudflare.DNSRecord{aRecord("a1", "203.0.113.1"), aRecord("a2", "203.0.113.1"), marker("t1", "203.0.113.1")},
+			nodes:           []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}},
+			expectedRecords: []string{"A 203.0.113.1", "TXT " + ownershipMarker + " for 203.0.113.1"},
+		},
+		{
+			name:            "SkipsNodesWithoutExternalIP",
+			records:         []cloudflare.DNSRecord{},
+			nodes:           []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}, {Name: "node-2"}},
+			expectedRecords: []string{"A 203.0.113.1", "TXT " + ownershipMarker + " for 203.0.113.1"},
+		},
+		{
+			name:            "LeavesForeignRecordsUntouched",
+			records:         []cloudflare.DNSRecord{aRecord("a9", "198.51.100.9"), {ID: "t9", Type: "TXT", Name: "www.example.com", Content: "v=spf1 -all"}},
+			nodes:           []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}},
+			expectedRecords: []string{"A 198.51.100.9", "A 203.0.113.1", "TXT " + ownershipMarker + " for 203.0.113.1", "TXT v=spf1 -all"},
+		},
+		{
+			name:            "LeavesUnmarkedRecordsPointingToNodesUntouched",
+			records:         []cloudflare.DNSRecord{aRecord("a1", "203.0.113.1")},
+			nodes:           []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}},
+			expectedRecords: []string{"A 203.0.113.1"},
+		},
+		{
+			name:            "MarksUnmarkedRecordsPointingToNodesWhenAdopting",
+			records:         []cloudflare.DNSRecord{aRecord("a1", "203.0.113.1")},
+			nodes:           []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}},
+			adoptDNSRecords: true,
+			expectedRecords: []string{"A 203.0.113.1", "TXT " + ownershipMarker + " for 203.0.113.1"},
+		},
+		{
+			name:            "LeavesRecordsMarkedByOtherClusterUntouched",
+			records:         []cloudflare.DNSRecord{aRecord("a2", "203.0.113.2"), {ID: "t2", Type: "TXT", Name: "www.example.com", Content: ownershipMarker + " in cluster us for 203.0.113.2"}},
+			nodes:           []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}},
+			expectedRecords: []string{"A 203.0.113.1", "A 203.0.113.2", "TXT " + ownershipMarker + " for 203.0.113.1", "TXT " + ownershipMarker + " in cluster us for 203.0.113.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			api := &fakeCloudflareAPI{dnsRecords: tt.records}
+			cl, server := newTestCloudflareAPIClient(api, "")
+			defer server.Close()
+			cl.adoptDNSRecords = tt.adoptDNSRecords
+
+			// act
+			_, err := cl.GetOrCreateDNSRecords(context.Background(), "www", "example.com", tt.nodes)
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expectedRecords, api.getDNSRecords())
+		})
+	}
+}
+
+func TestGetOrCreateLoadBalancerMonitor(t *testing.T) {
+
+	monitorConfig := MonitorConfig{Path: "/liveness"}
+	monitorConfig.SetDefaults()
+	desiredMonitor := monitorConfig.ToLoadBalancerMonitor()
+	description := "my-cluster.example.com/liveness - " + ownershipMarker
+
+	driftedMonitor := monitorConfig.ToLoadBalancerMonitor()
+	driftedMonitor.ID = "m1"
+	driftedMonitor.Description = description
+	driftedMonitor.Interval = 15
+
+	upToDateMonitor := monitorConfig.ToLoadBalancerMonitor()
+	upToDateMonitor.ID = "m1"
+	upToDateMonitor.Description = description
+
+	tests := []struct {
+		name            string
+		monitors        []cloudflare.LoadBalancerMonitor
+		expectedChanges []string
+	}{
+		{"CreatesMissingMonitor", []cloudflare.LoadBalancerMonitor{}, []string{"POST user/load_balancers/monitors"}},
+		{"UpdatesDriftedMonitor", []cloudflare.LoadBalancerMonitor{driftedMonitor}, []string{"PUT user/load_balancers/monitors/m1"}},
+		{"LeavesUpToDateMonitorUntouched", []cloudflare.LoadBalancerMonitor{upToDateMonitor}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			api := &fakeCloudflareAPI{monitors: tt.monitors}
+			cl, server := newTestCloudflareAPIClient(api, "")
+			defer server.Close()
+
+			// act
+			monitor, err := cl.GetOrCreateLoadBalancerMonitor(context.Background(), "my-cluster", "example.com", desiredMonitor)
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expectedChanges, api.changes)
+			assert.Equal(t, description, monitor.Description)
+			assert.Equal(t, 60, monitor.Interval)
+			if assert.Equal(t, 1, len(api.monitors)) {
+				assert.Equal(t, 60, api.monitors[0].Interval)
+			}
+		})
+	}
+}
+
+func TestGetOrCreateLoadBalancer(t *testing.T) {
+
+	activePool := cloudflare.LoadBalancerPool{ID: "pool-1", Name: "my-cluster", Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{{Name: "node-1", Enabled: true}}}
+	inactivePool := cloudflare.LoadBalancerPool{ID: "pool-2", Name: "my-cluster-2", Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{{Name: "node-2", Enabled: false}}}
+	desiredLoadBalancer := cloudflare.LoadBalancer{Description: "Load balancer for www.example.com", TTL: 30}
+	ownDescription := "Load balancer for www.example.com - " + ownershipMarker
+
+	tests := []struct {
+		name          string
+		loadBalancers []cloudflare.LoadBalancer
+		pools         []cloudflare.LoadBalancerPool
+		expectedBody  string
+		expectedError bool
+	}{
+		{
+			name:         "CreatesLoadBalancerWithActivePools",
+			pools:        []cloudflare.LoadBalancerPool{activePool, inactivePool},
+			expectedBody: `{"description":"` + ownDescription + `","name":"www.example.com","ttl":30,"fallback_pool":"pool-1","default_pools":["pool-1"],"region_pools":{},"pop_pools":{},"proxied":false}`,
+		},
+		{
+			name:          "FailsCreatingLoadBalancerWithoutActivePools",
+			pools:         []cloudflare.LoadBalancerPool{inactivePool},
+			expectedError: true,
+		},
+		{
+			name:          "KeepsForeignPoolsAndDropsInactiveOwnPools",
+			loadBalancers: []cloudflare.LoadBalancer{{ID: "lb-1", Name: "www.example.com", Description: ownDescription, TTL: 30, FallbackPool: "pool-2", DefaultPools: []string{"foreign-1", "pool-2"}}},
+			pools:         []cloudflare.LoadBalancerPool{activePool, inactivePool},
+			expectedBody:  `{"id":"lb-1","description":"` + ownDescription + `","name":"www.example.com","ttl":30,"fallback_pool":"foreign-1","default_pools":["foreign-1","pool-1"],"region_pools":{},"pop_pools":{},"proxied":false}`,
+		},
+		{
+			name:          "CorrectsDriftedSettings",
+			loadBalancers: []cloudflare.LoadBalancer{{ID: "lb-1", Name: "www.example.com", Description: "Old description - " + ownershipMarker, Proxied: true, FallbackPool: "removed-pool", DefaultPools: []string{"pool-1"}}},
+			pools:         []cloudflare.LoadBalancerPool{activePool},
+			expectedBody:  `{"id":"lb-1","description":"` + ownDescription + `","name":"www.example.com","ttl":30,"fallback_pool":"pool-1","default_pools":["pool-1"],"region_pools":{},"pop_pools":{},"proxied":false}`,
+		},
+		{
+			name:          "LeavesDescriptionOfLoadBalancerAddedByHand",
+			loadBalancers: []cloudflare.LoadBalancer{{ID: "lb-1", Name: "www.example.com", Description: "Added by hand", TTL: 60, FallbackPool: "pool-1", DefaultPools: []string{"pool-1"}}},
+			pools:         []cloudflare.LoadBalancerPool{activePool},
+			expectedBody:  `{"id":"lb-1","description":"Added by hand","name":"www.example.com","ttl":30,"fallback_pool":"pool-1","default_pools":["pool-1"],"region_pools":{},"pop_pools":{},"proxied":false}`,
+		},
+		{
+			name:          "MovesFallbackToForeignPoolWhenNoOwnPoolIsActive",
+			loadBalancers: []cloudflare.LoadBalancer{{ID: "lb-1", Name: "www.example.com", Description: ownDescription, TTL: 30, FallbackPool: "pool-2", DefaultPools: []string{"pool-2", "foreign-1"}}},
+			pools:         []cloudflare.LoadBalancerPool{inactivePool},
+			expectedBody:  `{"id":"lb-1","description":"` + ownDescription + `","name":"www.example.com","ttl":30,"fallback_pool":"foreign-1","default_pools":["foreign-1"],"region_pools":null,"pop_pools":null,"proxied":false}`,
+		},
+		{
+			name:          "KeepsCurrentDefaultPoolsWhenNoPoolIsActive",
+			loadBalancers: []cloudflare.LoadBalancer{{ID: "lb-1", Name: "www.example.com", Description: ownDescription, TTL: 30, FallbackPool: "pool-2", DefaultPools: []string{"pool-2"}}},
+			pools:         []cloudflare.LoadBalancerPool{inactivePool},
+		},
+		{
+			name:          "LeavesUnchangedLoadBalancerAlone",
+			loadBalancers: []cloudflare.LoadBalancer{{ID: "lb-1", Name: "www.example.com", Description: ownDescription, TTL: 30, FallbackPool: "foreign-1", DefaultPools: []string{"foreign-1", "pool-1"}}},
+			pools:         []cloudflare.LoadBalancerPool{activePool},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			api := &fakeCloudflareAPI{loadBalancers: tt.loadBalancers}
+			cl, server := newTestCloudflareAPIClient(api, "")
+			defer server.Close()
+
+			// act
+			_, err := cl.GetOrCreateLoadBalancer(context.Background(), "www", "example.com", desiredLoadBalancer, tt.pools)
+
+			if tt.expectedError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+			if tt.expectedBody == "" {
+				assert.Empty(t, api.loadBalancerBodies)
+			} else if assert.Equal(t, 1, len(api.loadBalancerBodies)) {
+				assert.JSONEq(t, tt.expectedBody, api.loadBalancerBodies[0])
+			}
+		})
+	}
+
+	t.Run("SteersConfiguredRegionsAndPopsToActivePoolsKeepingOthers", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{loadBalancers: []cloudflare.LoadBalancer{{
+			ID:           "lb-1",
+			Name:         "www.example.com",
+			Description:  ownDescription,
+			TTL:          30,
+			FallbackPool: "pool-1",
+			DefaultPools: []string{"pool-1"},
+			RegionPools:  map[string][]string{"ENAM": {"foreign-1"}, "WEU": {"pool-2"}},
+		}}}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		steeredLoadBalancer := desiredLoadBalancer
+		steeredLoadBalancer.RegionPools = map[string][]string{"WEU": {}}
+		steeredLoadBalancer.PopPools = map[string][]string{"AMS": {}}
+
+		// act
+		_, err := cl.GetOrCreateLoadBalancer(context.Background(), "www", "example.com", steeredLoadBalancer, []cloudflare.LoadBalancerPool{activePool, inactivePool})
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(api.loadBalancerBodies)) {
+			assert.JSONEq(t, `{"id":"lb-1","description":"`+ownDescription+`","name":"www.example.com","ttl":30,"fallback_pool":"pool-1","default_pools":["pool-1"],"region_pools":{"ENAM":["foreign-1"],"WEU":["pool-1"]},"pop_pools":{"AMS":["pool-1"]},"proxied":false}`, api.loadBalancerBodies[0])
+		}
+	})
+}
+
+func TestMergePools(t *testing.T) {
+
+	tests := []struct {
+		name            string
+		currentPoolIDs  []string
+		activePoolIDs   []string
+		inactivePoolIDs []string
+		expected        []string
+	}{
+		{"AppendsNewActivePools", []string{"other"}, []string{"own"}, []string{}, []string{"other", "own"}},
+		{"KeepsPoolsInTheirCurrentPosition", []string{"own", "other"}, []string{"own"}, []string{}, []string{"own", "other"}},
+		{"RemovesInactivePools", []string{"own", "own-2", "other"}, []string{"own"}, []string{"own-2"}, []string{"own", "other"}},
+		{"ReturnsActivePoolsWithoutCurrentPools", nil, []string{"own", "own-2"}, []string{}, []string{"own", "own-2"}},
+		{"ReturnsNoPoolsWithoutActivePools", []string{"own"}, []string{}, []string{"own"}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			poolIDs := mergePools(tt.currentPoolIDs, tt.activePoolIDs, tt.inactivePoolIDs)
+
+			assert.Equal(t, tt.expected, poolIDs)
+		})
+	}
+}
+
+func TestGetSteeredPools(t *testing.T) {
+
+	tests := []struct {
+		name            string
+		currentPools    map[string][]string
+		steeredPools    map[string][]string
+		activePoolIDs   []string
+		inactivePoolIDs []string
+		expected        map[string][]string
+	}{
+		{
+			name:          "AddsActivePoolsToSteeredRegions",
+			currentPools:  map[string][]string{},
+			steeredPools:  map[string][]string{"WEU": nil, "EEU": nil},
+			activePoolIDs: []string{"own"},
+			expected:      map[string][]string{"WEU": {"own"}, "EEU": {"own"}},
+		},
+		{
+			name:          "KeepsPoolsOfOtherClustersInSteeredRegions",
+			currentPools:  map[string][]string{"WEU": {"other"}},
+			steeredPools:  map[string][]string{"WEU": nil},
+			activePoolIDs: []string{"own"},
+			expected:      map[string][]string{"WEU": {"other", "own"}},
+		},
+		{
+			name:          "RemovesOwnPoolsFromRegionsNoLongerSteered",
+			currentPools:  map[string][]string{"WEU": {"own"}, "ENAM": {"other", "own"}},
+			steeredPools:  map[string][]string{"WEU": nil},
+			activePoolIDs: []string{"own"},
+			expected:      map[string][]string{"WEU": {"own"}, "ENAM": {"other"}},
+		},
+		{
+			name:          "KeepsRegionsOfOtherClusters",
+			currentPools:  map[string][]string{"ENAM": {"other"}},
+			steeredPools:  map[string][]string{},
+			activePoolIDs: []string{"own"},
+			expected:      map[string][]string{"ENAM": {"other"}},
+		},
+		{
+			name:            "RemovesInactivePoolsFromSteeredRegions",
+			currentPools:    map[string][]string{"WEU": {"own", "own-2"}},
+			steeredPools:    map[string][]string{"WEU": nil},
+			activePoolIDs:   []string{"own"},
+			inactivePoolIDs: []string{"own-2"},
+			expected:        map[string][]string{"WEU": {"own"}},
+		},
+		{
+			name:            "LeavesOutSteeredRegionsWithoutPools",
+			currentPools:    map[string][]string{"WEU": {"own"}},
+			steeredPools:    map[string][]string{"WEU": nil},
+			activePoolIDs:   []string{},
+			inactivePoolIDs: []string{"own"},
+			expected:        map[string][]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			pools := getSteeredPools(tt.currentPools, tt.steeredPools, tt.activePoolIDs, tt.inactivePoolIDs)
+
+			assert.Equal(t, tt.expected, pools)
+		})
+	}
+}
+
+func TestGetOrCreateLoadBalancerPools(t *testing.T) {
+
+	t.Run("DisablesOwnPoolsNoLongerNeeded", func(t *testing.T) {
+
+		origins := []cloudflare.LoadBalancerOrigin{{Name: "node-1", Address: "203.0.113.1", Enabled: true}}
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{
+			{ID: "p1", Name: "my-cluster", Description: ownershipMarker, Monitor: "m1", Enabled: true, Origins: origins},
+			{ID: "p2", Name: "my-cluster-2", Description: ownershipMarker, Monitor: "m1", Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{{Name: "node-2", Address: "203.0.113.2", Enabled: true}}},
+		}}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+
+		// act
+		pools, err := cl.GetOrCreateLoadBalancerPools(context.Background(), "my-cluster", []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}}, cloudflare.LoadBalancerMonitor{ID: "m1"}, 5)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"PUT user/load_balancers/pools/p2"}, api.changes)
+		if assert.Equal(t, 2, len(pools)) {
+			assert.True(t, pools[0].Enabled)
+			assert.False(t, pools[1].Enabled)
+		}
+	})
+
+	t.Run("DeletesDisabledSurplusPoolsAndLeavesPoolsAddedByHandUntouched", func(t *testing.T) {
+
+		origins := []cloudflare.LoadBalancerOrigin{{Name: "node-1", Address: "203.0.113.1", Enabled: true}}
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{
+			{ID: "p1", Name: "my-cluster", Description: ownershipMarker, Monitor: "m1", Enabled: true, Origins: origins},
+			{ID: "p2", Name: "my-cluster-2", Description: ownershipMarker, Monitor: "m1", Enabled: false},
+			{ID: "p3", Name: "my-cluster-3", Description: "Added by hand", Monitor: "m1", Enabled: true},
+		}}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+
+		// act
+		pools, err := cl.GetOrCreateLoadBalancerPools(context.Background(), "my-cluster", []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}}, cloudflare.LoadBalancerMonitor{ID: "m1"}, 5)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"DELETE user/load_balancers/pools/p2"}, api.changes)
+		assert.Equal(t, 1, len(pools))
+		assert.Equal(t, []string{"my-cluster", "my-cluster-3"}, api.getPoolNames())
+	})
+
+	t.Run("PrefixesOriginsWithClusterIDAndReturnsNodeNames", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{
+			{ID: "p1", Name: "eu-my-cluster", Description: ownershipMarker, Monitor: "m1", Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{{Name: "eu-node-1", Address: "203.0.113.1", Enabled: true}}},
+			{ID: "p2", Name: "us-my-cluster", Description: ownershipMarker, Monitor: "m1", Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{{Name: "us-node-1", Address: "198.51.100.1", Enabled: true}}},
+		}}
+		cl, server := newTestCloudflareAPIClient(api, "eu")
+		defer server.Close()
+
+		// act
+		pools, err := cl.GetOrCreateLoadBalancerPools(context.Background(), "my-cluster", []Node{{Name: "node-1", ExternalIP: "203.0.113.1"}, {Name: "node-2", ExternalIP: "203.0.113.2"}}, cloudflare.LoadBalancerMonitor{ID: "m1"}, 5)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"PUT user/load_balancers/pools/p1"}, api.changes)
+		if assert.Equal(t, 1, len(pools)) {
+			assert.Equal(t, []string{"node-1", "node-2"}, []string{pools[0].Origins[0].Name, pools[0].Origins[1].Name})
+		}
+		assert.Equal(t, []string{"eu-node-1", "eu-node-2"}, []string{api.pools[0].Origins[0].Name, api.pools[0].Origins[1].Name})
+		assert.Equal(t, "us-node-1", api.pools[1].Origins[0].Name)
+	})
+}
+
+func TestDeleteLoadBalancerMonitor(t *testing.T) {
+
+	tests := []struct {
+		name             string
+		monitor          cloudflare.LoadBalancerMonitor
+		expectedMonitors int
+	}{
+		{"DeletesOwnedMonitor", cloudflare.LoadBalancerMonitor{ID: "m1", Description: "my-cluster.example.com/liveness - " + ownershipMarker}, 0},
+		{"LeavesMonitorAddedByHandUntouched", cloudflare.LoadBalancerMonitor{ID: "m1", Description: "my-cluster.example.com/liveness"}, 1},
+		{"LeavesMonitorForOtherPathUntouched", cloudflare.LoadBalancerMonitor{ID: "m1", Description: "my-cluster.example.com/readiness - " + ownershipMarker}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			api := &fakeCloudflareAPI{monitors: []cloudflare.LoadBalancerMonitor{tt.monitor}}
+			cl, server := newTestCloudflareAPIClient(api, "")
+			defer server.Close()
+
+			// act
+			err := cl.DeleteLoadBalancerMonitor(context.Background(), "my-cluster", "example.com", "/liveness")
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expectedMonitors, len(api.monitors))
+		})
+	}
+}
+
+func TestDeleteLoadBalancerPools(t *testing.T) {
+
+	t.Run("DeletesOwnedPoolsForPoolNameOnly", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{
+			{ID: "p1", Name: "my-cluster", Description: ownershipMarker},
+			{ID: "p2", Name: "my-cluster-2", Description: ownershipMarker},
+			{ID: "p3", Name: "my-cluster-3", Description: "Added by hand"},
+			{ID: "p4", Name: "other-cluster", Description: ownershipMarker},
+		}}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+
+		// act
+		err := cl.DeleteLoadBalancerPools(context.Background(), "my-cluster")
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"my-cluster-3", "other-cluster"}, api.getPoolNames())
+	})
+}
+
+func TestDeleteLoadBalancer(t *testing.T) {
+
+	ownDescription := "Load balancer for www.example.com - " + ownershipMarker
+	pools := []cloudflare.LoadBalancerPool{
+		{ID: "pool", Name: "my-cluster"},
+		{ID: "pool-eu", Name: "eu-my-cluster"},
+		{ID: "pool-eu-2", Name: "eu-my-cluster-2", Description: ownershipMarker},
+		{ID: "pool-us", Name: "us-my-cluster"},
+	}
+
+	tests := []struct {
+		name                  string
+		clusterID             string
+		loadBalancer          cloudflare.LoadBalancer
+		expectedBody          string
+		expectedLoadBalancers int
+		expectedError         bool
+	}{
+		{
+			name:                  "DeletesOwnedLoadBalancer",
+			loadBalancer:          cloudflare.LoadBalancer{ID: "lb-1", Name: "www.example.com", Description: ownershipMarker},
+			expectedLoadBalancers: 0,
+		},
+		{
+			name:                  "LeavesLoadBalancerAddedByHandUntouched",
+			loadBalancer:          cloudflare.LoadBalancer{ID: "lb-1", Name: "www.example.com", Description: "Added by hand", FallbackPool: "pool-us", DefaultPools: []string{"pool-us"}},
+			expectedLoadBalancers: 1,
+		},
+		{
+			name:                  "LeavesOtherLoadBalancerUntouched",
+			loadBalancer:          cloudflare.LoadBalancer{ID: "lb-1", Name: "api.example.com", Description: ownershipMarker},
+			expectedLoadBalancers: 1,
+		},
+		{
+			name:                  "RemovesOwnPoolsFromLoadBalancerSharedWithOtherCluster",
+			clusterID:             "eu",
+			loadBalancer:          cloudflare.LoadBalancer{ID: "lb-1", Name: "www.example.com", Description: ownDescription, TTL: 30, FallbackPool: "pool-eu", DefaultPools: []string{"pool-eu", "pool-us", "pool-eu-2"}, RegionPools: map[string][]string{"WEU": {"pool-eu"}, "ENAM": {"pool-us"}}},
+			expectedBody:          `{"id":"lb-1","description":"` + ownDescription + `","name":"www.example.com","ttl":30,"fallback_pool":"pool-us","default_pools":["pool-us"],"region_pools":{"ENAM":["pool-us"]},"pop_pools":{},"proxied":false}`,
+			expectedLoadBalancers: 1,
+		},
+		{
+			name:                  "DeletesLoadBalancerWithoutPoolsOfOtherClusters",
+			clusterID:             "eu",
+			loadBalancer:          cloudflare.LoadBalancer{ID: "lb-1", Name: "www.example.com", Description: ownDescription, FallbackPool: "pool-eu", DefaultPools: []string{"pool-eu", "pool-eu-2"}},
+			expectedLoadBalancers: 0,
+		},
+		{
+			name:                  "RemovesOnlyUnprefixedPoolsWithoutClusterID",
+			clusterID:             "",
+			loadBalancer:          cloudflare.LoadBalancer{ID: "lb-1", Name: "www.example.com", Description: ownDescription, TTL: 30, FallbackPool: "pool", DefaultPools: []string{"pool", "pool-eu", "pool-us"}},
+			expectedBody:          `{"id":"lb-1","description":"` + ownDescription + `","name":"www.example.com","ttl":30,"fallback_pool":"pool-eu","default_pools":["pool-eu","pool-us"],"region_pools":{},"pop_pools":{},"proxied":false}`,
+			expectedLoadBalancers: 1,
+		},
+		{
+			name:                  "LeavesUnprefixedPoolsAloneWithClusterID",
+			clusterID:             "eu",
+			loadBalancer:          cloudflare.LoadBalancer{ID: "lb-1", Name: "www.example.com", Description: ownDescription, TTL: 30, FallbackPool: "pool", DefaultPools: []string{"pool", "pool-eu"}},
+			expectedBody:          `{"id":"lb-1","description":"` + ownDescription + `","name":"www.example.com","ttl":30,"fallback_pool":"pool","default_pools":["pool"],"region_pools":{},"pop_pools":{},"proxied":false}`,
+			expectedLoadBalancers: 1,
+		},
+		{
+			name:                  "LeavesLoadBalancerWithoutOwnPoolsUntouched",
+			clusterID:             "eu",
+			loadBalancer:          cloudflare.LoadBalancer{ID: "lb-1", Name: "www.example.com", Description: ownDescription, FallbackPool: "pool-us", DefaultPools: []string{"pool-us"}},
+			expectedLoadBalancers: 1,
+		},
+		{
+			name:                  "FailsForLoadBalancerAddedByHandWithoutOtherPools",
+			clusterID:             "eu",
+			loadBalancer:          cloudflare.LoadBalancer{ID: "lb-1", Name: "www.example.com", Description: "Added by hand", FallbackPool: "pool-eu", DefaultPools: []string{"pool-eu"}},
+			expectedLoadBalancers: 1,
+			expectedError:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			api := &fakeCloudflareAPI{loadBalancers: []cloudflare.LoadBalancer{tt.loadBalancer}, pools: pools}
+			cl, server := newTestCloudflareAPIClient(api, tt.clusterID)
+			defer server.Close()
+
+			// act
+			err := cl.DeleteLoadBalancer(context.Background(), "www", "example.com", "my-cluster")
+
+			assert.Equal(t, tt.expectedError, err != nil)
+			if tt.expectedBody == "" {
+				assert.Empty(t, api.loadBalancerBodies)
+			} else if assert.Equal(t, 1, len(api.loadBalancerBodies)) {
+				assert.JSONEq(t, tt.expectedBody, api.loadBalancerBodies[0])
+			}
+			assert.Equal(t, tt.expectedLoadBalancers, len(api.loadBalancers))
+		})
+	}
+}
+
+func TestDeleteDNSRecords(t *testing.T) {
+
+	t.Run("DeletesAllMarkedRecordsAndLeavesOthersUntouched", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{dnsRecords: []cloudflare.DNSRecord{
+			{ID: "a1", Type: "A", Name: "www.example.com", Content: "203.0.113.1"},
+			{ID: "t1", Type: "TXT", Name: "www.example.com", Content: ownershipMarker + " for 203.0.113.1"},
+			{ID: "a2", Type: "A", Name: "www.example.com", Content: "203.0.113.2"},
+			{ID: "t2", Type: "TXT", Name: "www.example.com", Content: ownershipMarker + " for 203.0.113.2"},
+			{ID: "t3", Type: "TXT", Name: "www.example.com", Content: ownershipMarker + " for 203.0.113.3"},
+			{ID: "a9", Type: "A", Name: "www.example.com", Content: "198.51.100.9"},
+		}}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+
+		// act
+		err := cl.DeleteDNSRecords(context.Background(), "www", "example.com")
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"A 198.51.100.9"}, api.getDNSRecords())
+	})
+}
+
+func TestGetAPIClient(t *testing.T) {
+
+	t.Run("AbortsRequestsOnceContextIsCancelled", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// act
+		_, err := cl.GetDNSRecords(ctx, "www", "example.com")
+
+		assert.NotNil(t, err)
+	})
+}
+
+// newTestCloudflareAPIClient returns an api client sending its requests to the fake api
+func newTestCloudflareAPIClient(api *fakeCloudflareAPI, clusterID string) (*cloudflareAPIClientImpl, *httptest.Server) {
+
+	server := httptest.NewServer(api)
+
+	apiClient, _ := cloudflare.New("key", "user@example.com")
+	apiClient.BaseURL = server.URL
+
+	return &cloudflareAPIClientImpl{
+		apiClient: apiClient,
+		timeout:   5 * time.Second,
+		limiter:   newTokenBucket(1000, 1000),
+		clusterID: clusterID,
+	}, server
+}
+
+// fakeCloudflareAPI serves the zone, dns record, monitor, pool and load balancer calls of the Cloudflare API from memory
+// for zone example.com
+type fakeCloudflareAPI struct {
+	mutex         sync.Mutex
+	dnsRecords    []cloudflare.DNSRecord
+	monitors      []cloudflare.LoadBalancerMonitor
+	pools         []cloudflare.LoadBalancerPool
+	loadBalancers []cloudflare.LoadBalancer
+	lastID        int
+	// changes holds the method and path of all requests other than GET, in order
+	changes []string
+	// loadBalancerBodies holds the bodies of load balancer creations and updates, so tests can check what got sent
+	loadBalancerBodies []string
+}
+
+func (api *fakeCloudflareAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	collection := segments
+	if len(collection) > 3 {
+		collection = collection[:3]
+	}
+	route := r.Method + " " + strings.Join(collection, "/")
+	if len(segments) > 3 {
+		route += "/:id"
+	}
+	if r.Method != "GET" {
+		api.changes = append(api.changes, r.Method+" "+strings.Join(segments, "/"))
+	}
+
+	var result interface{}
+	switch route {
+	case "GET zones":
+		result = []cloudflare.Zone{{ID: "zone-id", Name: "example.com"}}
+
+	case "GET zones/zone-id/dns_records":
+		records := []cloudflare.DNSRecord{}
+		for _, record := range api.dnsRecords {
+			if record.Type == r.URL.Query().Get("type") && record.Name == r.URL.Query().Get("name") {
+				records = append(records, record)
+			}
+		}
+		result = records
+
+	case "GET zones/zone-id/dns_records/:id":
+		for _, record := range api.dnsRecords {
+			if record.ID == segments[3] {
+				result = record
+			}
+		}
+
+	case "POST zones/zone-id/dns_records":
+		var record cloudflare.DNSRecord
+		json.Unmarshal(body, &record)
+		api.lastID++
+		record.ID = fmt.Sprintf("id-%v", api.lastID)
+		api.dnsRecords = append(api.dnsRecords, record)
+		result = record
+
+	case "DELETE zones/zone-id/dns_records/:id":
+		records := []cloudflare.DNSRecord{}
+		for _, record := range api.dnsRecords {
+			if record.ID != segments[3] {
+				records = append(records, record)
+			}
+		}
+		api.dnsRecords = records
+		result = map[string]string{"id": segments[3]}
+
+	case "GET user/load_balancers/monitors":
+		result = api.monitors
+
+	case "POST user/load_balancers/monitors":
+		var monitor cloudflare.LoadBalancerMonitor
+		json.Unmarshal(body, &monitor)
+		api.lastID++
+		monitor.ID = fmt.Sprintf("id-%v", api.lastID)
+		api.monitors = append(api.monitors, monitor)
+		result = monitor
+
+	case "PUT user/load_balancers/monitors/:id":
+		var monitor cloudflare.LoadBalancerMonitor
+		json.Unmarshal(body, &monitor)
+		for i := range api.monitors {
+			if api.monitors[i].ID == segments[3] {
+				api.monitors[i] = monitor
+			}
+		}
+		result = monitor
+
+	case "DELETE user/load_balancers/monitors/:id":
+		monitors := []cloudflare.LoadBalancerMonitor{}
+		for _, monitor := range api.monitors {
+			if monitor.ID != segments[3] {
+				monitors = append(monitors, monitor)
+			}
+		}
+		api.monitors = monitors
+		result = map[string]string{"id": segments[3]}
+
+	case "GET user/load_balancers/pools":
+		result = api.pools
+
+	case "PUT user/load_balancers/pools/:id":
+		var pool cloudflare.LoadBalancerPool
+		json.Unmarshal(body, &pool)
+		for i := range api.pools {
+			if api.pools[i].ID == segments[3] {
+				api.pools[i] = pool
+			}
+		}
+		result = pool
+
+	case "DELETE user/load_balancers/pools/:id":
+		pools := []cloudflare.LoadBalancerPool{}
+		for _, pool := range api.pools {
+			if pool.ID != segments[3] {
+				pools = append(pools, pool)
+			}
+		}
+		api.pools = pools
+		result = map[string]string{"id": segments[3]}
+
+	case "GET zones/zone-id/load_balancers":
+		result = api.loadBalancers
+
+	case "POST zones/zone-id/load_balancers":
+		api.loadBalancerBodies = append(api.loadBalancerBodies, string(body))
+		var loadBalancer cloudflare.LoadBalancer
+		json.Unmarshal(body, &loadBalancer)
+		api.lastID++
+		loadBalancer.ID = fmt.Sprintf("id-%v", api.lastID)
+		api.loadBalancers = append(api.loadBalancers, loadBalancer)
+		result = loadBalancer
+
+	case "PUT zones/zone-id/load_balancers/:id":
+		api.loadBalancerBodies = append(api.loadBalancerBodies, string(body))
+		var loadBalancer cloudflare.LoadBalancer
+		json.Unmarshal(body, &loadBalancer)
+		for i := range api.loadBalancers {
+			if api.loadBalancers[i].ID == segments[3] {
+				api.loadBalancers[i] = loadBalancer
+			}
+		}
+		result = loadBalancer
+
+	case "DELETE zones/zone-id/load_balancers/:id":
+		loadBalancers := []cloudflare.LoadBalancer{}
+		for _, loadBalancer := range api.loadBalancers {
+			if loadBalancer.ID != segments[3] {
+				loadBalancers = append(loadBalancers, loadBalancer)
+			}
+		}
+		api.loadBalancers = loadBalancers
+		result = map[string]string{"id": segments[3]}
+
+	default:
+		http.Error(w, fmt.Sprintf("no fake for %v", route), http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": result})
+}
+
+// getDNSRecords returns the type and content of the dns records, in order
+func (api *fakeCloudflareAPI) getDNSRecords() []string {
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	records := []string{}
+	for _, record := range api.dnsRecords {
+		records = append(records, record.Type+" "+record.Content)
+	}
+	sort.Strings(records)
+
+	return records
+}
+
+// getPoolNames returns the names of the pools, in order
+func (api *fakeCloudflareAPI) getPoolNames() []string {
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	names := []string{}
+	for _, pool := range api.pools {
+		names = append(names, pool.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	// steeringRegionRegex matches Cloudflare region codes like WEU or ENAM
+	steeringRegionRegex = regexp.MustCompile(`^[A-Z]+$`)
+	// steeringPopRegex matches the three letter codes of Cloudflare data centers like AMS
+	steeringPopRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// Config holds the configuration for all load balancers reconciled by the controller
+type Config struct {
+	LoadBalancers []LoadBalancerConfig `yaml:"loadBalancers"`
+}
+
+// LoadBalancerConfig holds the configuration for a single Cloudflare load balancer
+type LoadBalancerConfig struct {
+	// Name is the subdomain of the load balancer, it's served at <name>.<zone>
+	Name string `yaml:"name"`
+	Zone string `yaml:"zone"`
+	// Type is either 'lb' for a Cloudflare load balancer or 'dns' for poor mans load balancing with a dns record per node
+	Type        string `yaml:"type"`
+	Description string `yaml:"description"`
+	// Proxied sends traffic through Cloudflare; defaults to true
+	Proxied *bool `yaml:"proxied"`
+	// TTL is the dns ttl in seconds, only used when the load balancer is not proxied
+	TTL        int              `yaml:"ttl"`
+	Pool       PoolConfig       `yaml:"pool"`
+	Monitor    MonitorConfig    `yaml:"monitor"`
+	Safeguards SafeguardsConfig `yaml:"safeguards"`
+	Steering   SteeringConfig   `yaml:"steering"`
+	// Service is set for load balancers configured with service annotations; only the nodes running the endpoints of the
+	// service are used as origins
+	Service *ObjectReference `yaml:"-"`
+}
+
+// PoolConfig holds the configuration for the pools of a load balancer
+type PoolConfig struct {
+	Name string `yaml:"name" json:"name,omitempty"`
+	// MaxOrigins is the maximum number of origins per pool; if there are more nodes they're spread across multiple pools
+	MaxOrigins int `yaml:"maxOrigins" json:"maxOrigins,omitempty"`
+	// DrainGracePeriodSeconds is how long origins of cordoned, terminating or removed nodes are kept disabled before
+	// they're removed from the pool
+	DrainGracePeriodSeconds *int `yaml:"drainGracePeriodSeconds" json:"drainGracePeriodSeconds,omitempty"`
+}
+
+// SafeguardsConfig holds the limits that protect against removing too many origins at once, for example when Kubernetes
+// returns an empty or truncated list of nodes; an empty set of origins is never applied
+type SafeguardsConfig struct {
+	// MinOrigins is the minimum number of enabled origins to keep
+	MinOrigins int `yaml:"minOrigins" json:"minOrigins,omitempty"`
+	// MaxRemovalPercentage is the maximum percentage of enabled origins to remove in a single reconcile
+	MaxRemovalPercentage int `yaml:"maxRemovalPercentage" json:"maxRemovalPercentage,omitempty"`
+}
+
+// SteeringConfig holds the Cloudflare regions and PoPs whose visitors are sent to the pools of this load balancer,
+// instead of to the default pools; with several clusters each of them adds its own pools to the regions it serves
+type SteeringConfig struct {
+	// Regions are region codes like WEU or ENAM
+	Regions []string `yaml:"regions" json:"regions,omitempty"`
+	// Pops are the three letter codes of Cloudflare data centers like AMS or LAX
+	Pops []string `yaml:"pops" json:"pops,omitempty"`
+}
+
+// MonitorConfig holds the configuration for the monitor checking the health of the pool origins
+type MonitorConfig struct {
+	// Type is the protocol to use for the health check, either http, https or tcp
+	Type   string `yaml:"type" json:"type,omitempty"`
+	Method string `yaml:"method" json:"method,omitempty"`
+	Path   string `yaml:"path" json:"path,omitempty"`
+	// Host is sent as Host header, so the health check can be routed by the ingress controller
+	Host            string              `yaml:"host" json:"host,omitempty"`
+	Header          map[string][]string `yaml:"header" json:"header,omitempty"`
+	Timeout         int                 `yaml:"timeout" json:"timeout,omitempty"`
+	Retries         *int                `yaml:"retries" json:"retries,omitempty"`
+	Interval        int                 `yaml:"interval" json:"interval,omitempty"`
+	ExpectedBody    string              `yaml:"expectedBody" json:"expectedBody,omitempty"`
+	ExpectedCodes   string              `yaml:"expectedCodes" json:"expectedCodes,omitempty"`
+	FollowRedirects bool                `yaml:"followRedirects" json:"followRedirects,omitempty"`
+	AllowInsecure   *bool               `yaml:"allowInsecure" json:"allowInsecure,omitempty"`
+}
+
+// ReadConfigFromFile reads the load balancer configuration from a yaml file
+func ReadConfigFromFile(configFilePath string) (config Config, err error) {
+
+	data, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return config, fmt.Errorf("Read config file %v error:\n%v", configFilePath, err)
+	}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("Unmarshal config file %v error:\n%v", configFilePath, err)
+	}
+
+	return
+}
+
+// SetDefaults fills in the default values for settings that are not configured
+func (c *Config) SetDefaults() {
+	for i := range c.LoadBalancers {
+		c.LoadBalancers[i].SetDefaults()
+	}
+}
+
+// Validate checks whether all load balancers are configured correctly
+func (c *Config) Validate() error {
+
+	if len(c.LoadBalancers) == 0 {
+		return fmt.Errorf("No load balancers are configured")
+	}
+
+	hostnames := []string{}
+	poolNames := []string{}
+	for _, lb := range c.LoadBalancers {
+		if err := lb.Validate(); err != nil {
+			return err
+		}
+		if contains(hostnames, lb.Hostname()) {
+			return fmt.Errorf("Load balancer %v is configured more than once", lb.Hostname())
+		}
+		hostnames = append(hostnames, lb.Hostname())
+
+		if lb.Type != "lb" {
+			continue
+		}
+		// load balancers sharing a pool would keep changing its monitor and origins, and since the extra pools are found
+		// by name, a pool named like an extra pool of another one would be taken over by it
+		for _, poolName := range poolNames {
+			if poolName == lb.Pool.Name {
+				return fmt.Errorf("Pool %v is used by more than one load balancer", poolName)
+			}
+			if poolNamesCollide(poolName, lb.Pool.Name) {
+				return fmt.Errorf("Pool names %v and %v can't be used together, since the extra pools of one are named like the other", poolName, lb.Pool.Name)
+			}
+		}
+		poolNames = append(poolNames, lb.Pool.Name)
+	}
+
+	return nil
+}
+
+// SetDefaults fills in the default values for settings that are not configured
+func (c *LoadBalancerConfig) SetDefaults() {
+	if c.Type == "" {
+		c.Type = "lb"
+	}
+	if c.Proxied == nil {
+		proxied := true
+		c.Proxied = &proxied
+	}
+	if c.Pool.MaxOrigins == 0 {
+		c.Pool.MaxOrigins = 5
+	}
+	if c.Pool.DrainGracePeriodSeconds == nil {
+		drainGracePeriodSeconds := 60
+		c.Pool.DrainGracePeriodSeconds = &drainGracePeriodSeconds
+	}
+	if c.Safeguards.MinOrigins == 0 {
+		c.Safeguards.MinOrigins = 1
+	}
+	if c.Safeguards.MaxRemovalPercentage == 0 {
+		c.Safeguards.MaxRemovalPercentage = 50
+	}
+	c.Monitor.SetDefaults()
+}
+
+// Validate checks whether the load balancer is configured correctly
+func (c *LoadBalancerConfig) Validate() error {
+
+	if c.Name == "" {
+		return fmt.Errorf("Load balancer name is required")
+	}
+	if c.Zone == "" {
+		return fmt.Errorf("Zone is required for load balancer %v", c.Name)
+	}
+
+	if c.Safeguards.MinOrigins < 1 {
+		return fmt.Errorf("Safeguards min origins should be at least 1 for load balancer %v", c.Hostname())
+	}
+	if c.Safeguards.MaxRemovalPercentage < 1 || c.Safeguards.MaxRemovalPercentage > 100 {
+		return fmt.Errorf("Safeguards max removal percentage should be between 1 and 100 for load balancer %v", c.Hostname())
+	}
+
+	switch c.Type {
+	case "dns":
+		if len(c.Steering.Regions) > 0 || len(c.Steering.Pops) > 0 {
+			return fmt.Errorf("Steering is only supported for load balancers of type 'lb', not for %v", c.Hostname())
+		}
+	case "lb":
+		if c.Pool.Name == "" {
+			return fmt.Errorf("Pool name is required for load balancer %v", c.Hostname())
+		}
+		if c.TTL < 0 {
+			return fmt.Errorf("TTL should not be negative for load balancer %v", c.Hostname())
+		}
+		if c.Pool.MaxOrigins < 1 {
+			return fmt.Errorf("Pool max origins should be at least 1 for load balancer %v", c.Hostname())
+		}
+		if c.Pool.DrainGracePeriodSeconds == nil || *c.Pool.DrainGracePeriodSeconds < 0 {
+			return fmt.Errorf("Pool drain grace period should not be negative for load balancer %v", c.Hostname())
+		}
+		if err := c.Monitor.Validate(); err != nil {
+			return fmt.Errorf("Monitor for load balancer %v is invalid: %v", c.Hostname(), err)
+		}
+		if err := c.Steering.Validate(); err != nil {
+			return fmt.Errorf("Steering for load balancer %v is invalid: %v", c.Hostname(), err)
+		}
+	default:
+		return fmt.Errorf("Type for load balancer %v should be either 'lb' or 'dns', not '%v'", c.Hostname(), c.Type)
+	}
+
+	return nil
+}
+
+// ToLoadBalancer returns the Cloudflare load balancer settings for this configuration; the name and pools are filled in
+// when reconciling, including the pools of the steered regions and PoPs
+func (c *LoadBalancerConfig) ToLoadBalancer() cloudflare.LoadBalancer {
+
+	loadBalancer := cloudflare.LoadBalancer{
+		Description: c.Description,
+		TTL:         c.TTL,
+		RegionPools: map[string][]string{},
+		PopPools:    map[string][]string{},
+	}
+	if c.Proxied != nil {
+		loadBalancer.Proxied = *c.Proxied
+	}
+	for _, region := range c.Steering.Regions {
+		loadBalancer.RegionPools[region] = []string{}
+	}
+	for _, pop := range c.Steering.Pops {
+		loadBalancer.PopPools[pop] = []string{}
+	}
+
+	return loadBalancer
+}
+
+// Hostname returns the hostname the load balancer is served at
+func (c *LoadBalancerConfig) Hostname() string {
+	return fmt.Sprintf("%v.%v", c.Name, c.Zone)
+}
+
+// Validate checks whether the regions and PoPs are valid codes
+func (c *SteeringConfig) Validate() error {
+
+	for _, region := range c.Regions {
+		if !steeringRegionRegex.MatchString(region) {
+			return fmt.Errorf("region should be an uppercase region code like WEU, not '%v'", region)
+		}
+	}
+	for _, pop := range c.Pops {
+		if !steeringPopRegex.MatchString(pop) {
+			return fmt.Errorf("pop should be an uppercase three letter data center code like AMS, not '%v'", pop)
+		}
+	}
+
+	return nil
+}
+
+// SetDefaults fills in the default values for settings that are not configured; the http settings only get defaults for
+// http and https monitors
+func (c *MonitorConfig) SetDefaults() {
+	if c.Type == "" {
+		c.Type = "https"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5
+	}
+	if c.Retries == nil {
+		retries := 2
+		c.Retries = &retries
+	}
+	if c.Interval == 0 {
+		c.Interval = 60
+	}
+	if !c.IsHTTP() {
+		return
+	}
+	if c.Method == "" {
+		c.Method = "GET"
+	}
+	if c.ExpectedCodes == "" {
+		c.ExpectedCodes = "200"
+	}
+	if c.AllowInsecure == nil {
+		allowInsecure := true
+		c.AllowInsecure = &allowInsecure
+	}
+}
+
+// IsHTTP returns true for http and https monitors, which are the only ones using the http settings
+func (c *MonitorConfig) IsHTTP() bool {
+	return c.Type == "http" || c.Type == "https"
+}
+
+// Validate checks whether the monitor is configured correctly
+func (c *MonitorConfig) Validate() error {
+
+	switch c.Type {
+	case "http", "https":
+		if c.Path == "" {
+			return fmt.Errorf("path is required")
+		}
+	case "tcp":
+		// the path is part of the description the monitor is found by, while Cloudflare doesn't keep it for tcp monitors
+		if c.Path != "" {
+			return fmt.Errorf("path is only used by http and https monitors")
+		}
+	default:
+		return fmt.Errorf("type should be http, https or tcp, not '%v'", c.Type)
+	}
+
+	if c.Timeout < 1 {
+		return fmt.Errorf("timeout should be at least 1 second")
+	}
+	if c.Interval <= c.Timeout {
+		return fmt.Errorf("interval should be larger than the timeout")
+	}
+	if c.Retries == nil || *c.Retries < 0 {
+		return fmt.Errorf("retries should not be negative")
+	}
+
+	return nil
+}
+
+// ToLoadBalancerMonitor returns the Cloudflare monitor for this configuration; tcp monitors leave out the http settings,
+// since Cloudflare doesn't keep them and the monitor would never match the desired state otherwise
+func (c *MonitorConfig) ToLoadBalancerMonitor() cloudflare.LoadBalancerMonitor {
+
+	if !c.IsHTTP() {
+		return cloudflare.LoadBalancerMonitor{
+			Type:     c.Type,
+			Timeout:  c.Timeout,
+			Retries:  c.getRetries(),
+			Interval: c.Interval,
+		}
+	}
+
+	header := map[string][]string{}
+	for name, values := range c.Header {
+		header[name] = values
+	}
+	if c.Host != "" {
+		header["Host"] = []string{c.Host}
+	}
+
+	monitor := cloudflare.LoadBalancerMonitor{
+		Type:            c.Type,
+		Method:          c.Method,
+		Path:            c.Path,
+		Header:          header,
+		Timeout:         c.Timeout,
+		Retries:         c.getRetries(),
+		Interval:        c.Interval,
+		ExpectedBody:    c.ExpectedBody,
+		ExpectedCodes:   c.ExpectedCodes,
+		FollowRedirects: c.FollowRedirects,
+	}
+	if c.AllowInsecure != nil {
+		monitor.AllowInsecure = *c.AllowInsecure
+	}
+
+	return monitor
+}
+
+func (c *MonitorConfig) getRetries() int {
+	if c.Retries == nil {
+		return 0
+	}
+	return *c.Retries
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+
+	lbConfig := func(name string, apply func(*LoadBalancerConfig)) LoadBalancerConfig {
+		config := LoadBalancerConfig{
+			Name: name,
+			Zone: "example.com",
+			Type: "lb",
+			Pool: PoolConfig{
+				Name: "my-cluster",
+			},
+			Monitor: MonitorConfig{
+				Path: "/liveness",
+			},
+		}
+		if apply != nil {
+			apply(&config)
+		}
+		config.SetDefaults()
+		return config
+	}
+
+	tests := []struct {
+		name          string
+		loadBalancers []LoadBalancerConfig
+		valid         bool
+	}{
+		{"ReturnsNoErrorForLoadBalancer", []LoadBalancerConfig{lbConfig("www", nil)}, true},
+		{"ReturnsNoErrorForDNSLoadBalancer", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Type = "dns"; c.Pool.Name = "" })}, true},
+		{"ReturnsNoErrorForMultipleLoadBalancers", []LoadBalancerConfig{lbConfig("www", nil), lbConfig("api", func(c *LoadBalancerConfig) { c.Pool.Name = "api" })}, true},
+		{"ReturnsErrorWithoutLoadBalancers", []LoadBalancerConfig{}, false},
+		{"ReturnsErrorForDuplicateHostname", []LoadBalancerConfig{lbConfig("www", nil), lbConfig("www", nil)}, false},
+		{"ReturnsErrorForDuplicatePoolName", []LoadBalancerConfig{lbConfig("www", nil), lbConfig("api", nil)}, false},
+		{"ReturnsNoErrorForDNSLoadBalancersWithoutPoolName", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Type = "dns"; c.Pool.Name = "" }), lbConfig("api", func(c *LoadBalancerConfig) { c.Type = "dns"; c.Pool.Name = "" })}, true},
+		{"ReturnsErrorForPoolNamedLikeExtraPoolOfOtherPool", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Pool.Name = "web" }), lbConfig("api", func(c *LoadBalancerConfig) { c.Pool.Name = "web-2" })}, false},
+		{"ReturnsErrorForPoolWithExtraPoolNamedLikeEarlierPool", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Pool.Name = "web-2" }), lbConfig("api", func(c *LoadBalancerConfig) { c.Pool.Name = "web" })}, false},
+		{"ReturnsNoErrorForPoolNamesWithNonNumericSuffix", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Pool.Name = "web" }), lbConfig("api", func(c *LoadBalancerConfig) { c.Pool.Name = "web-eu" })}, true},
+		{"ReturnsErrorWithoutName", []LoadBalancerConfig{lbConfig("", nil)}, false},
+		{"ReturnsErrorWithoutZone", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Zone = "" })}, false},
+		{"ReturnsErrorForUnknownType", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Type = "gclb" })}, false},
+		{"ReturnsErrorForNegativeMaxOrigins", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Pool.MaxOrigins = -1 })}, false},
+		{"ReturnsErrorForNegativeTTL", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.TTL = -1 })}, false},
+		{"ReturnsErrorForNegativeDrainGracePeriod", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { gracePeriod := -1; c.Pool.DrainGracePeriodSeconds = &gracePeriod })}, false},
+		{"ReturnsErrorWithoutPoolName", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Pool.Name = "" })}, false},
+		{"ReturnsNoErrorForTCPMonitorWithoutPath", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Monitor.Type = "tcp"; c.Monitor.Path = "" })}, true},
+		{"ReturnsErrorForTCPMonitorWithPath", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Monitor.Type = "tcp" })}, false},
+		{"ReturnsErrorForMaxRemovalPercentageAbove100", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Safeguards.MaxRemovalPercentage = 101 })}, false},
+		{"ReturnsErrorForNegativeMinOrigins", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Safeguards.MinOrigins = -1 })}, false},
+		{"ReturnsErrorForHTTPSMonitorWithoutPath", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Monitor.Path = "" })}, false},
+		{"ReturnsErrorForUnknownMonitorType", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Monitor.Type = "icmp" })}, false},
+		{"ReturnsErrorForMonitorIntervalNotAboveTimeout", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Monitor.Timeout = 60 })}, false},
+		{"ReturnsErrorForNegativeMonitorRetries", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { retries := -1; c.Monitor.Retries = &retries })}, false},
+		{"ReturnsNoErrorForSteeredLoadBalancer", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Steering.Regions = []string{"WEU"}; c.Steering.Pops = []string{"AMS"} })}, true},
+		{"ReturnsErrorForSteeredDNSLoadBalancer", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Type = "dns"; c.Steering.Regions = []string{"WEU"} })}, false},
+		{"ReturnsErrorForLowercaseSteeringRegion", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Steering.Regions = []string{"weu"} })}, false},
+		{"ReturnsErrorForSteeringPopThatIsNotThreeLetters", []LoadBalancerConfig{lbConfig("www", func(c *LoadBalancerConfig) { c.Steering.Pops = []string{"AMST"} })}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			config := Config{LoadBalancers: tt.loadBalancers}
+
+			// act
+			err := config.Validate()
+
+			if tt.valid {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestMonitorConfigToLoadBalancerMonitor(t *testing.T) {
+
+	t.Run("SendsHostAsHostHeader", func(t *testing.T) {
+
+		config := MonitorConfig{Path: "/liveness", Host: "www.example.com", Header: map[string][]string{"X-Probe": {"cloudflare"}}}
+		config.SetDefaults()
+
+		// act
+		monitor := config.ToLoadBalancerMonitor()
+
+		assert.Equal(t, map[string][]string{"Host": {"www.example.com"}, "X-Probe": {"cloudflare"}}, monitor.Header)
+		assert.Equal(t, "https", monitor.Type)
+		assert.Equal(t, 2, monitor.Retries)
+		assert.True(t, monitor.AllowInsecure)
+	})
+
+	t.Run("LeavesOutHTTPSettingsForTCPMonitor", func(t *testing.T) {
+
+		allowInsecure := true
+		config := MonitorConfig{Type: "tcp", Method: "GET", Host: "www.example.com", ExpectedCodes: "200", AllowInsecure: &allowInsecure}
+		config.SetDefaults()
+
+		// act
+		monitor := config.ToLoadBalancerMonitor()
+
+		assert.Equal(t, "tcp", monitor.Type)
+		assert.Equal(t, "", monitor.Method)
+		assert.Equal(t, "", monitor.ExpectedCodes)
+		assert.False(t, monitor.AllowInsecure)
+		assert.Equal(t, 0, len(monitor.Header))
+		assert.Equal(t, 5, monitor.Timeout)
+		assert.Equal(t, 2, monitor.Retries)
+		assert.Equal(t, 60, monitor.Interval)
+	})
+
+	t.Run("SetsNoHTTPDefaultsForTCPMonitor", func(t *testing.T) {
+
+		config := MonitorConfig{Type: "tcp"}
+
+		// act
+		config.SetDefaults()
+
+		assert.Equal(t, "", config.Method)
+		assert.Equal(t, "", config.ExpectedCodes)
+		assert.Nil(t, config.AllowInsecure)
+	})
+}
+
+func TestLoadBalancerConfigToLoadBalancer(t *testing.T) {
+
+	t.Run("ReturnsEmptyPoolsForSteeredRegionsAndPops", func(t *testing.T) {
+
+		config := LoadBalancerConfig{Name: "www", Zone: "example.com", Steering: SteeringConfig{Regions: []string{"WEU", "EEU"}, Pops: []string{"AMS"}}}
+		config.SetDefaults()
+
+		// act
+		loadBalancer := config.ToLoadBalancer()
+
+		assert.Equal(t, map[string][]string{"WEU": {}, "EEU": {}}, loadBalancer.RegionPools)
+		assert.Equal(t, map[string][]string{"AMS": {}}, loadBalancer.PopPools)
+	})
+}
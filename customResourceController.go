@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// conditions reported in the status of the load balancer custom resources
+const (
+	conditionReady  = "Ready"
+	conditionInSync = "InSync"
+)
+
+// CustomResourceController runs a load balancer controller for each CloudflareLoadBalancer custom resource in its
+// namespace, writes back their status and removes the Cloudflare objects once a resource gets deleted; a finalizer keeps
+// deleted resources around until their Cloudflare objects have been removed
+type CustomResourceController interface {
+	Run(context.Context)
+}
+
+type customResourceControllerImpl struct {
+	k8sAPIClient     KubernetesAPIClient
+	cfAPIClient      CloudflareAPIClient
+	healthChecker    HealthChecker
+	eventRecorder    EventRecorder
+	planStore        PlanStore
+	namespace        string
+	hostnames        HostnameRegistry
+	nodeChanges      NodeChangeNotifier
+	syncInterval     int
+	loadBalancers    map[string]*managedLoadBalancer
+	claimedHostnames map[string]string
+	waitGroup        *sync.WaitGroup
+}
+
+// NewCustomResourceController returns an instance of CustomResourceController; resources using a hostname or pool name
+// that's claimed in the hostname registry by the config or a service are skipped, and the resources are checked every
+// sync interval, since the vendored client can't watch them
+func NewCustomResourceController(k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, healthChecker HealthChecker, eventRecorder EventRecorder, planStore PlanStore, namespace string, hostnames HostnameRegistry, nodeChanges NodeChangeNotifier, syncInterval int, waitGroup *sync.WaitGroup) CustomResourceController {
+
+	// return instance of CustomResourceController
+	return &customResourceControllerImpl{
+		k8sAPIClient:     k8sAPIClient,
+		cfAPIClient:      cfAPIClient,
+		healthChecker:    healthChecker,
+		eventRecorder:    eventRecorder,
+		planStore:        planStore,
+		namespace:        namespace,
+		hostnames:        hostnames,
+		nodeChanges:      nodeChanges,
+		syncInterval:     syncInterval,
+		loadBalancers:    map[string]*managedLoadBalancer{},
+		claimedHostnames: map[string]string{},
+		waitGroup:        waitGroup,
+	}
+}
+
+// Run syncs the load balancers with the custom resources until the context is cancelled; the load balancer controllers
+// are stopped then, but their Cloudflare objects are left in place, since the resources still want them
+func (cc *customResourceControllerImpl) Run(ctx context.Context) {
+
+	cc.waitGroup.Add(1)
+
+	go func() {
+		defer cc.waitGroup.Done()
+
+		for {
+			cc.sync(ctx)
+
+			select {
+			case <-ctx.Done():
+				for _, lb := range cc.loadBalancers {
+					lb.stop(cc.healthChecker)
+				}
+				return
+			case <-time.After(time.Duration(cc.syncInterval) * time.Second):
+			}
+		}
+	}()
+}
+
+// sync starts a load balancer controller for each new custom resource, restarts them for resources with a changed spec,
+// removes the load balancers of resources that are gone and writes back the status of each resource
+func (cc *customResourceControllerImpl) sync(ctx context.Context) {
+
+	resources, err := cc.k8sAPIClient.GetCloudflareLoadBalancers(ctx, cc.namespace)
+	if err != nil {
+		// never remove load balancers because the custom resources couldn't be retrieved
+		log.Error().Err(err).Msg("Failed retrieving custom resources for load balancers")
+		return
+	}
+
+	unfinalized := cc.addFinalizers(ctx, resources)
+
+	currentConfigs := map[string]LoadBalancerConfig{}
+	for key, lb := range cc.loadBalancers {
+		if lb.isRunning() {
+			currentConfigs[key] = lb.config
+		}
+	}
+
+	desiredConfigs, failures := resolveCustomResourceConfigs(resources, currentConfigs, cc.hostnames)
+	for key, config := range desiredConfigs {
+		cc.claimedHostnames[config.Hostname()] = getCustomResourceHostnameOwner(key)
+	}
+	cc.addDeletedLoadBalancers(resources)
+	defer releaseHostnames(cc.hostnames, cc.claimedHostnames, desiredConfigs, cc.loadBalancers)
+
+	// stop the controllers of resources that are gone or changed, and remove their load balancer unless the new spec
+	// can take over its Cloudflare objects
+	previousConfigs := map[string]LoadBalancerConfig{}
+	for key, lb := range cc.loadBalancers {
+		config, isDesired := desiredConfigs[key]
+		if isDesired && reflect.DeepEqual(config, lb.config) && lb.isRunning() {
+			continue
+		}
+
+		lb.stop(cc.healthChecker)
+
+		if !isDesired || requiresTeardown(lb.config, config) {
+			log.Info().Msgf("Removing load balancer %v for custom resource %v...", lb.config.Hostname(), key)
+			err := lb.controller.Teardown(ctx)
+			if err != nil {
+				// try again on the next sync
+				log.Error().Err(err).Msgf("Failed removing load balancer %v for custom resource %v", lb.config.Hostname(), key)
+				if cc.planStore == nil {
+					cc.eventRecorder.ControllerEvent(ctx, eventTypeWarning, "TeardownFailed", fmt.Sprintf("Removing load balancer %v for custom resource %v failed: %v", lb.config.Hostname(), key, err))
+				}
+				if isDesired {
+					failures[key] = newCondition(conditionReady, "False", "TeardownFailed", fmt.Sprintf("Removing previous load balancer %v failed: %v", lb.config.Hostname(), err))
+				}
+				continue
+			}
+		} else {
+			previousConfigs[key] = lb.config
+		}
+
+		delete(cc.loadBalancers, key)
+	}
+
+	for key, config := range desiredConfigs {
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a stopped controller is waiting for its previous load balancer to be removed
+		if _, exists := cc.loadBalancers[key]; exists {
+			continue
+		}
+
+		// without the finalizer the load balancer would be left behind if the resource got deleted while the controller
+		// isn't running
+		if unfinalized[key] {
+			failures[key] = newCondition(conditionReady, "False", "FinalizerFailed", fmt.Sprintf("Adding finalizer %v failed", customResourceFinalizer))
+			continue
+		}
+
+		log.Info().Msgf("Starting load balancer %v for custom resource %v...", config.Hostname(), key)
+		lb, err := startLoadBalancer(ctx, cc.k8sAPIClient, cc.cfAPIClient, config, cc.healthChecker, cc.eventRecorder, cc.planStore, cc.nodeChanges)
+		if err != nil {
+			// try again on the next sync
+			log.Error().Err(err).Msgf("Failed starting load balancer %v for custom resource %v", config.Hostname(), key)
+			failures[key] = newCondition(conditionReady, "False", "InitFailed", err.Error())
+			continue
+		}
+		cc.loadBalancers[key] = lb
+
+		// the pools use the new monitor now, so the previous one can go
+		if previousConfig, ok := previousConfigs[key]; ok && hasReplacedMonitor(previousConfig, config) {
+			err = cc.cfAPIClient.DeleteLoadBalancerMonitor(ctx, previousConfig.Pool.Name, previousConfig.Zone, previousConfig.Monitor.Path)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Failed removing previous monitor of load balancer %v for custom resource %v", config.Hostname(), key)
+			}
+		}
+	}
+
+	// in dry-run mode the statuses are left alone, since nothing they'd report has actually been applied
+	if cc.planStore != nil {
+		return
+	}
+
+	for _, resource := range resources {
+		if ctx.Err() != nil {
+			return
+		}
+
+		key := getObjectKey(resource.Metadata.GetNamespace(), resource.Metadata.GetName())
+
+		// a deleted resource only waits for its load balancer to be removed
+		if isCustomResourceDeleted(resource) {
+			if _, exists := cc.loadBalancers[key]; !exists && hasCustomResourceFinalizer(resource) {
+				cc.removeFinalizer(ctx, resource)
+			}
+			continue
+		}
+
+		var failure *CloudflareLoadBalancerCondition
+		if condition, ok := failures[key]; ok {
+			failure = &condition
+		}
+
+		cc.updateStatus(ctx, resource, failure)
+	}
+}
+
+// updateStatus writes back the Cloudflare objects of the resource's load balancer and the result of its last reconcile,
+// unless nothing changed; a failure to start or remove the load balancer replaces the ready condition
+func (cc *customResourceControllerImpl) updateStatus(ctx context.Context, resource CloudflareLoadBalancer, failure *CloudflareLoadBalancerCondition) {
+
+	key := getObjectKey(resource.Metadata.GetNamespace(), resource.Metadata.GetName())
+
+	status := CloudflareLoadBalancerStatus{}
+	ready := newCondition(conditionReady, "Unknown", "NotRunning", "")
+	inSync := newCondition(conditionInSync, "Unknown", "NotRunning", "")
+
+	if lb, exists := cc.loadBalancers[key]; exists && lb.isRunning() {
+		lastSuccess, lastError := cc.healthChecker.LastReconcile(lb.config.Hostname())
+		if !lastSuccess.IsZero() {
+			lastSyncTime := lastSuccess.UTC().Truncate(time.Second)
+			status.LastSyncTime = &lastSyncTime
+		}
+
+		switch {
+		case lastError != nil:
+			ready = newCondition(conditionReady, "False", "ReconcileFailed", lastError.Error())
+		case lastSuccess.IsZero():
+			ready = newCondition(conditionReady, "Unknown", "Pending", "")
+		default:
+			ready = newCondition(conditionReady, "True", "Reconciled", "")
+		}
+
+		lbStatus, err := getLoadBalancerStatus(ctx, cc.k8sAPIClient, cc.cfAPIClient, lb.config)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed retrieving status of load balancer %v for custom resource %v", lb.config.Hostname(), key)
+			inSync = newCondition(conditionInSync, "Unknown", "StatusFailed", err.Error())
+		} else {
+			status.LoadBalancerID = lbStatus.LoadBalancerID
+			if lbStatus.Monitor != nil {
+				status.MonitorID = lbStatus.Monitor.ID
+			}
+			status.Pools = lbStatus.Pools
+			status.RegionPools = lbStatus.RegionPools
+			status.PopPools = lbStatus.PopPools
+			status.DNSRecords = lbStatus.DNSRecords
+
+			if lbStatus.HasMismatches() {
+				inSync = newCondition(conditionInSync, "False", "Drifted", strings.Join(lbStatus.Mismatches, "; "))
+			} else {
+				inSync = newCondition(conditionInSync, "True", "InSync", "")
+			}
+		}
+	}
+
+	if failure != nil {
+		ready = *failure
+	}
+	status.Conditions = []CloudflareLoadBalancerCondition{ready, inSync}
+
+	// conditions only get a new transition time when their status changes
+	if resource.Status != nil {
+		for i, condition := range status.Conditions {
+			for _, previousCondition := range resource.Status.Conditions {
+				if previousCondition.Type == condition.Type && previousCondition.Status == condition.Status {
+					status.Conditions[i].LastTransitionTime = previousCondition.LastTransitionTime
+				}
+			}
+		}
+	}
+
+	if resource.Status != nil && customResourceStatusesEqual(*resource.Status, status) {
+		return
+	}
+
+	resource.Status = &status
+	_, err := cc.k8sAPIClient.UpdateCloudflareLoadBalancer(ctx, resource)
+	if err != nil {
+		// a conflict means the resource changed in the meantime, it gets a new status on the next sync
+		log.Warn().Err(err).Msgf("Failed updating status of custom resource %v", key)
+	}
+}
+
+// addFinalizers adds the finalizer to the resources that don't have it yet and replaces them with the updated ones,
+// returning the resources it couldn't be added to; in dry-run mode the resources are left alone
+func (cc *customResourceControllerImpl) addFinalizers(ctx context.Context, resources []CloudflareLoadBalancer) (unfinalized map[string]bool) {
+
+	unfinalized = map[string]bool{}
+	if cc.planStore != nil {
+		return
+	}
+
+	for i, resource := range resources {
+		if isCustomResourceDeleted(resource) || hasCustomResourceFinalizer(resource) {
+			continue
+		}
+
+		key := getObjectKey(resource.Metadata.GetNamespace(), resource.Metadata.GetName())
+		metadata := *resource.Metadata
+		metadata.Finalizers = append(append([]string{}, metadata.Finalizers...), customResourceFinalizer)
+		resource.Metadata = &metadata
+
+		updatedResource, err := cc.k8sAPIClient.UpdateCloudflareLoadBalancer(ctx, resource)
+		if err != nil {
+			// try again on the next sync
+			log.Warn().Err(err).Msgf("Failed adding finalizer to custom resource %v", key)
+			unfinalized[key] = true
+			continue
+		}
+		resources[i] = updatedResource
+	}
+
+	return
+}
+
+// addDeletedLoadBalancers adds a stopped load balancer controller for the deleted resources that still have the
+// finalizer but no load balancer here, because they were deleted while the controller wasn't running, so their
+// Cloudflare objects get removed like those of the other resources that are gone; resources with an invalid spec or
+// a hostname or pool name in use by another owner have no Cloudflare objects of their own to remove
+func (cc *customResourceControllerImpl) addDeletedLoadBalancers(resources []CloudflareLoadBalancer) {
+
+	for _, resource := range resources {
+		key := getObjectKey(resource.Metadata.GetNamespace(), resource.Metadata.GetName())
+		if _, exists := cc.loadBalancers[key]; exists || !isCustomResourceDeleted(resource) || !hasCustomResourceFinalizer(resource) {
+			continue
+		}
+
+		config, err := getCustomResourceLoadBalancerConfig(resource)
+		if err != nil {
+			continue
+		}
+
+		owner := getCustomResourceHostnameOwner(key)
+		if err := cc.hostnames.Claim(config.Hostname(), getCustomResourcePoolName(config), owner); err != nil {
+			log.Warn().Err(err).Msgf("Skipping removal of load balancer for deleted custom resource %v", key)
+			continue
+		}
+		cc.claimedHostnames[config.Hostname()] = owner
+
+		cc.loadBalancers[key] = &managedLoadBalancer{
+			config:     config,
+			controller: NewLoadBalancerController(cc.k8sAPIClient, cc.cfAPIClient, config, cc.healthChecker, cc.eventRecorder, cc.planStore, &sync.WaitGroup{}),
+		}
+	}
+}
+
+// removeFinalizer removes the finalizer from a deleted resource whose load balancer is gone, so Kubernetes can delete it
+func (cc *customResourceControllerImpl) removeFinalizer(ctx context.Context, resource CloudflareLoadBalancer) {
+
+	key := getObjectKey(resource.Metadata.GetNamespace(), resource.Metadata.GetName())
+	metadata := *resource.Metadata
+	metadata.Finalizers = []string{}
+	for _, finalizer := range resource.Metadata.Finalizers {
+		if finalizer != customResourceFinalizer {
+			metadata.Finalizers = append(metadata.Finalizers, finalizer)
+		}
+	}
+	resource.Metadata = &metadata
+
+	_, err := cc.k8sAPIClient.UpdateCloudflareLoadBalancer(ctx, resource)
+	if err != nil {
+		// try again on the next sync
+		log.Warn().Err(err).Msgf("Failed removing finalizer from custom resource %v", key)
+		return
+	}
+
+	log.Info().Msgf("Removed finalizer from deleted custom resource %v", key)
+}
+
+// getCustomResourceLoadBalancerConfigs returns the load balancer configuration for each custom resource in the namespace
+// as they are right now; resources with an invalid spec or a hostname or pool name that's already in use are skipped
+func getCustomResourceLoadBalancerConfigs(ctx context.Context, k8sAPIClient KubernetesAPIClient, namespace string, hostnames HostnameRegistry) (configs []LoadBalancerConfig, err error) {
+
+	resources, err := k8sAPIClient.GetCloudflareLoadBalancers(ctx, namespace)
+	if err != nil {
+		return
+	}
+
+	desiredConfigs, _ := resolveCustomResourceConfigs(resources, nil, hostnames)
+
+	configs = []LoadBalancerConfig{}
+	for _, resource := range resources {
+		if config, ok := desiredConfigs[getObjectKey(resource.Metadata.GetNamespace(), resource.Metadata.GetName())]; ok {
+			configs = append(configs, config)
+		}
+	}
+
+	return
+}
+
+// resolveCustomResourceConfigs returns the load balancer configuration per custom resource and claims their hostnames
+// and pool names, and returns the ready condition for the resources that are skipped because their hostname or pool name
+// is claimed by another resource, a service or the config, or because their spec is invalid; deleted resources are
+// left out, and a resource with an invalid spec keeps its current configuration, rather than losing its load balancer
+// over a mistake in the new spec
+func resolveCustomResourceConfigs(resources []CloudflareLoadBalancer, currentConfigs map[string]LoadBalancerConfig, hostnames HostnameRegistry) (configs map[string]LoadBalancerConfig, failures map[string]CloudflareLoadBalancerCondition) {
+
+	configs = map[string]LoadBalancerConfig{}
+	failures = map[string]CloudflareLoadBalancerCondition{}
+
+	for _, resource := range resources {
+		key := getObjectKey(resource.Metadata.GetNamespace(), resource.Metadata.GetName())
+
+		// a deleted resource no longer wants a load balancer
+		if isCustomResourceDeleted(resource) {
+			continue
+		}
+
+		config, err := getCustomResourceLoadBalancerConfig(resource)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Invalid spec for load balancer custom resource %v", key)
+			failures[key] = newCondition(conditionReady, "False", "InvalidSpec", err.Error())
+
+			currentConfig, ok := currentConfigs[key]
+			if !ok {
+				continue
+			}
+			config = currentConfig
+		}
+
+		if err := hostnames.Claim(config.Hostname(), getCustomResourcePoolName(config), getCustomResourceHostnameOwner(key)); err != nil {
+			log.Warn().Err(err).Msgf("Skipping load balancer for custom resource %v", key)
+			reason := "HostnameInUse"
+			if conflict, ok := err.(*claimConflictError); ok {
+				reason = conflict.Kind + "InUse"
+			}
+			failures[key] = newCondition(conditionReady, "False", reason, err.Error())
+			continue
+		}
+
+		configs[key] = config
+	}
+
+	return
+}
+
+// getCustomResourcePoolName returns the pool name to claim for a custom resource; dns load balancers have no pools
+func getCustomResourcePoolName(config LoadBalancerConfig) string {
+	if config.Type != "lb" {
+		return ""
+	}
+	return config.Pool.Name
+}
+
+// getCustomResourceHostnameOwner returns the owner of the hostname claimed for a custom resource in the hostname registry
+func getCustomResourceHostnameOwner(key string) string {
+	return fmt.Sprintf("custom resource %v", key)
+}
+
+// getCustomResourceLoadBalancerConfig returns the configuration of the load balancer declared by a custom resource
+func getCustomResourceLoadBalancerConfig(resource CloudflareLoadBalancer) (config LoadBalancerConfig, err error) {
+
+	spec := resource.Spec
+	if spec.Hostname == "" || spec.Zone == "" {
+		return config, fmt.Errorf("Hostname and zone are required")
+	}
+	if !strings.HasSuffix(spec.Hostname, "."+spec.Zone) {
+		return config, fmt.Errorf("Hostname %v is not in zone %v", spec.Hostname, spec.Zone)
+	}
+
+	config = LoadBalancerConfig{
+		Name:        strings.TrimSuffix(spec.Hostname, "."+spec.Zone),
+		Zone:        spec.Zone,
+		Type:        spec.Type,
+		Description: spec.Description,
+		Proxied:     spec.Proxied,
+		TTL:         spec.TTL,
+		Pool:        spec.Pool,
+		Monitor:     spec.Monitor,
+		Safeguards:  spec.Safeguards,
+		Steering:    spec.Steering,
+	}
+	if config.Description == "" {
+		config.Description = fmt.Sprintf("Load balancer for custom resource %v", getObjectKey(resource.Metadata.GetNamespace(), resource.Metadata.GetName()))
+	}
+
+	config.SetDefaults()
+	err = config.Validate()
+
+	return
+}
+
+// isCustomResourceDeleted returns true once the resource has been deleted and only waits for its finalizers
+func isCustomResourceDeleted(resource CloudflareLoadBalancer) bool {
+	return resource.Metadata.GetDeletionTimestamp() != nil
+}
+
+// hasCustomResourceFinalizer returns true if the resource holds the finalizer of the controller
+func hasCustomResourceFinalizer(resource CloudflareLoadBalancer) bool {
+	return contains(resource.Metadata.GetFinalizers(), customResourceFinalizer)
+}
+
+// newCondition returns a condition that transitioned just now
+func newCondition(conditionType, status, reason, message string) CloudflareLoadBalancerCondition {
+	return CloudflareLoadBalancerCondition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// customResourceStatusesEqual compares the statuses the way they're stored, since times read back from the Kubernetes
+// API differ from the ones created here in location and monotonic clock reading
+func customResourceStatusesEqual(a, b CloudflareLoadBalancerStatus) bool {
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
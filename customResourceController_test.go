@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCustomResourceLoadBalancerConfig(t *testing.T) {
+
+	t.Run("ReturnsConfigFromSpecWithDefaults", func(t *testing.T) {
+
+		resource := newTestCustomResource("www", CloudflareLoadBalancerSpec{
+			Hostname: "www.example.com",
+			Zone:     "example.com",
+			Pool:     PoolConfig{Name: "my-cluster"},
+			Monitor:  MonitorConfig{Path: "/liveness"},
+			Steering: SteeringConfig{Regions: []string{"WEU"}},
+		})
+
+		// act
+		config, err := getCustomResourceLoadBalancerConfig(resource)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "www", config.Name)
+		assert.Equal(t, "example.com", config.Zone)
+		assert.Equal(t, "lb", config.Type)
+		assert.Equal(t, "Load balancer for custom resource estafette/www", config.Description)
+		assert.Equal(t, 5, config.Pool.MaxOrigins)
+		assert.Equal(t, []string{"WEU"}, config.Steering.Regions)
+	})
+
+	tests := []struct {
+		name string
+		spec CloudflareLoadBalancerSpec
+	}{
+		{"ReturnsErrorWithoutHostname", CloudflareLoadBalancerSpec{Zone: "example.com", Pool: PoolConfig{Name: "my-cluster"}, Monitor: MonitorConfig{Path: "/liveness"}}},
+		{"ReturnsErrorForHostnameOutsideZone", CloudflareLoadBalancerSpec{Hostname: "www.example.org", Zone: "example.com", Pool: PoolConfig{Name: "my-cluster"}, Monitor: MonitorConfig{Path: "/liveness"}}},
+		{"ReturnsErrorForInvalidConfig", CloudflareLoadBalancerSpec{Hostname: "www.example.com", Zone: "example.com", Monitor: MonitorConfig{Path: "/liveness"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			_, err := getCustomResourceLoadBalancerConfig(newTestCustomResource("www", tt.spec))
+
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestResolveCustomResourceConfigs(t *testing.T) {
+
+	specWithPool := func(hostname, poolName string) CloudflareLoadBalancerSpec {
+		return CloudflareLoadBalancerSpec{Hostname: hostname, Zone: "example.com", Pool: PoolConfig{Name: poolName}, Monitor: MonitorConfig{Path: "/liveness"}}
+	}
+	validSpec := func(hostname string) CloudflareLoadBalancerSpec {
+		return specWithPool(hostname, strings.Split(hostname, ".")[0])
+	}
+	invalidSpec := CloudflareLoadBalancerSpec{Hostname: "api.example.org", Zone: "example.com"}
+	currentConfig, _ := getCustomResourceLoadBalancerConfig(newTestCustomResource("api", validSpec("api.example.com")))
+
+	tests := []struct {
+		name              string
+		resources         []CloudflareLoadBalancer
+		currentConfigs    map[string]LoadBalancerConfig
+		claims            [][3]string
+		expectedHostnames map[string]string
+		expectedReasons   map[string]string
+	}{
+		{
+			"ReturnsConfigPerResource",
+			[]CloudflareLoadBalancer{newTestCustomResource("api", validSpec("api.example.com")), newTestCustomResource("shop", validSpec("shop.example.com"))},
+			nil,
+			nil,
+			map[string]string{"estafette/api": "api.example.com", "estafette/shop": "shop.example.com"},
+			map[string]string{},
+		},
+		{
+			"SkipsReservedAndDuplicateHostnames",
+			[]CloudflareLoadBalancer{newTestCustomResource("api", validSpec("api.example.com")), newTestCustomResource("other", validSpec("api.example.com")), newTestCustomResource("www", validSpec("www.example.com"))},
+			nil,
+			nil,
+			map[string]string{"estafette/api": "api.example.com"},
+			map[string]string{"estafette/other": "HostnameInUse", "estafette/www": "HostnameInUse"},
+		},
+		{
+			"SkipsNewResourceWithInvalidSpec",
+			[]CloudflareLoadBalancer{newTestCustomResource("api", invalidSpec)},
+			nil,
+			nil,
+			map[string]string{},
+			map[string]string{"estafette/api": "InvalidSpec"},
+		},
+		{
+			"KeepsCurrentConfigForResourceWithInvalidSpec",
+			[]CloudflareLoadBalancer{newTestCustomResource("api", invalidSpec)},
+			map[string]LoadBalancerConfig{"estafette/api": currentConfig},
+			nil,
+			map[string]string{"estafette/api": "api.example.com"},
+			map[string]string{"estafette/api": "InvalidSpec"},
+		},
+		{
+			"KeepsHostnameForResourceThatClaimedItFirst",
+			[]CloudflareLoadBalancer{newTestCustomResource("api-copy", validSpec("api.example.com")), newTestCustomResource("api", validSpec("api.example.com"))},
+			nil,
+			[][3]string{{"api.example.com", "api", "custom resource estafette/api"}},
+			map[string]string{"estafette/api": "api.example.com"},
+			map[string]string{"estafette/api-copy": "HostnameInUse"},
+		},
+		{
+			"SkipsResourceWithHostnameOfService",
+			[]CloudflareLoadBalancer{newTestCustomResource("api", validSpec("api.example.com"))},
+			nil,
+			[][3]string{{"api.example.com", "api-example-com", "service default/api"}},
+			map[string]string{},
+			map[string]string{"estafette/api": "HostnameInUse"},
+		},
+		{
+			"SkipsResourceWithPoolOfOtherResource",
+			[]CloudflareLoadBalancer{newTestCustomResource("api", validSpec("api.example.com")), newTestCustomResource("shop", specWithPool("shop.example.com", "api"))},
+			nil,
+			nil,
+			map[string]string{"estafette/api": "api.example.com"},
+			map[string]string{"estafette/shop": "PoolInUse"},
+		},
+		{
+			"SkipsResourceWithConfiguredPool",
+			[]CloudflareLoadBalancer{newTestCustomResource("shop", specWithPool("shop.example.com", "my-cluster-2"))},
+			nil,
+			nil,
+			map[string]string{},
+			map[string]string{"estafette/shop": "PoolInUse"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			registry := NewHostnameRegistry(Config{LoadBalancers: []LoadBalancerConfig{{Name: "www", Zone: "example.com", Type: "lb", Pool: PoolConfig{Name: "my-cluster"}}}})
+			for _, claim := range tt.claims {
+				registry.Claim(claim[0], claim[1], claim[2])
+			}
+
+			// act
+			configs, failures := resolveCustomResourceConfigs(tt.resources, tt.currentConfigs, registry)
+
+			hostnames := map[string]string{}
+			for key, config := range configs {
+				hostnames[key] = config.Hostname()
+			}
+			reasons := map[string]string{}
+			for key, condition := range failures {
+				reasons[key] = condition.Reason
+			}
+			assert.Equal(t, tt.expectedHostnames, hostnames)
+			assert.Equal(t, tt.expectedReasons, reasons)
+		})
+	}
+	t.Run("NamesOwnerOfHostnameInUse", func(t *testing.T) {
+
+		hostnames := NewHostnameRegistry(Config{})
+		hostnames.Claim("api.example.com", "api-example-com", "service default/api")
+
+		// act
+		_, failures := resolveCustomResourceConfigs([]CloudflareLoadBalancer{newTestCustomResource("api", validSpec("api.example.com"))}, nil, hostnames)
+
+		assert.Equal(t, "Hostname api.example.com is already in use by service default/api", failures["estafette/api"].Message)
+	})
+}
+
+func TestCustomResourceControllerSync(t *testing.T) {
+
+	newTestCustomResourceController := func(k8sAPIClient KubernetesAPIClient) *customResourceControllerImpl {
+		return NewCustomResourceController(k8sAPIClient, nil, NewHealthChecker(0, 0), &fakeEventRecorder{events: []string{}}, nil, "estafette", NewHostnameRegistry(Config{}), nil, 0, &sync.WaitGroup{}).(*customResourceControllerImpl)
+	}
+	config, _ := getCustomResourceLoadBalancerConfig(newTestCustomResource("api", CloudflareLoadBalancerSpec{Hostname: "api.example.com", Zone: "example.com", Pool: PoolConfig{Name: "my-cluster"}, Monitor: MonitorConfig{Path: "/liveness"}}))
+
+	t.Run("RemovesLoadBalancerOfDeletedResource", func(t *testing.T) {
+
+		cc := newTestCustomResourceController(&fakeCustomResourcesAPIClient{resources: []CloudflareLoadBalancer{}})
+		controller := &fakeLoadBalancerController{}
+		cc.loadBalancers["estafette/api"] = &managedLoadBalancer{config: config, controller: controller}
+
+		// act
+		cc.sync(context.Background())
+
+		assert.Equal(t, 1, controller.teardowns)
+		assert.Equal(t, 0, len(cc.loadBalancers))
+	})
+
+	t.Run("KeepsLoadBalancersWhenResourcesCanNotBeRetrieved", func(t *testing.T) {
+
+		cc := newTestCustomResourceController(&fakeCustomResourcesAPIClient{resourcesErr: fmt.Errorf("connection refused")})
+		controller := &fakeLoadBalancerController{}
+		cc.loadBalancers["estafette/api"] = &managedLoadBalancer{config: config, controller: controller}
+
+		// act
+		cc.sync(context.Background())
+
+		assert.Equal(t, 0, controller.teardowns)
+		assert.Equal(t, 1, len(cc.loadBalancers))
+	})
+
+	t.Run("ReportsInvalidSpecInStatus", func(t *testing.T) {
+
+		k8sAPIClient := &fakeCustomResourcesAPIClient{resources: []CloudflareLoadBalancer{newTestCustomResource("api", CloudflareLoadBalancerSpec{Hostname: "api.example.org", Zone: "example.com"})}}
+		cc := newTestCustomResourceController(k8sAPIClient)
+
+		// act
+		cc.sync(context.Background())
+
+		if assert.Equal(t, 2, len(k8sAPIClient.updates)) {
+			conditions := k8sAPIClient.updates[1].Status.Conditions
+			if assert.Equal(t, 2, len(conditions)) {
+				assert.Equal(t, "Ready", conditions[0].Type)
+				assert.Equal(t, "False", conditions[0].Status)
+				assert.Equal(t, "InvalidSpec", conditions[0].Reason)
+				assert.Equal(t, "Hostname api.example.org is not in zone example.com", conditions[0].Message)
+				assert.Equal(t, "InSync", conditions[1].Type)
+				assert.Equal(t, "Unknown", conditions[1].Status)
+			}
+		}
+	})
+
+	t.Run("AddsFinalizerToNewResource", func(t *testing.T) {
+
+		k8sAPIClient := &fakeCustomResourcesAPIClient{resources: []CloudflareLoadBalancer{newTestCustomResource("api", CloudflareLoadBalancerSpec{Hostname: "api.example.org", Zone: "example.com"})}}
+		cc := newTestCustomResourceController(k8sAPIClient)
+
+		// act
+		cc.sync(context.Background())
+
+		if assert.Equal(t, 2, len(k8sAPIClient.updates)) {
+			assert.Equal(t, []string{"estafette.io/cloudflare-loadbalancer"}, k8sAPIClient.updates[0].Metadata.Finalizers)
+			assert.Nil(t, k8sAPIClient.updates[0].Status)
+			assert.Equal(t, []string{"estafette.io/cloudflare-loadbalancer"}, k8sAPIClient.updates[1].Metadata.Finalizers)
+		}
+	})
+
+	t.Run("SkipsStartingLoadBalancerWhenFinalizerCanNotBeAdded", func(t *testing.T) {
+
+		k8sAPIClient := &fakeCustomResourcesAPIClient{
+			resources: []CloudflareLoadBalancer{newTestCustomResource("api", CloudflareLoadBalancerSpec{Hostname: "api.example.com", Zone: "example.com", Pool: PoolConfig{Name: "my-cluster"}, Monitor: MonitorConfig{Path: "/liveness"}})},
+			updateErr: fmt.Errorf("conflict"),
+		}
+		cc := newTestCustomResourceController(k8sAPIClient)
+
+		// act
+		cc.sync(context.Background())
+
+		assert.Equal(t, 0, len(cc.loadBalancers))
+		if assert.Equal(t, 2, len(k8sAPIClient.updates)) {
+			assert.Equal(t, "FinalizerFailed", k8sAPIClient.updates[1].Status.Conditions[0].Reason)
+		}
+	})
+
+	t.Run("RemovesFinalizerOnceLoadBalancerOfDeletedResourceIsRemoved", func(t *testing.T) {
+
+		k8sAPIClient := &fakeCustomResourcesAPIClient{resources: []CloudflareLoadBalancer{newTestDeletedCustomResource("api", CloudflareLoadBalancerSpec{Hostname: "api.example.com", Zone: "example.com", Pool: PoolConfig{Name: "my-cluster"}, Monitor: MonitorConfig{Path: "/liveness"}})}}
+		cc := newTestCustomResourceController(k8sAPIClient)
+		controller := &fakeLoadBalancerController{}
+		cc.loadBalancers["estafette/api"] = &managedLoadBalancer{config: config, controller: controller}
+
+		// act
+		cc.sync(context.Background())
+
+		assert.Equal(t, 1, controller.teardowns)
+		assert.Equal(t, 0, len(cc.loadBalancers))
+		if assert.Equal(t, 1, len(k8sAPIClient.updates)) {
+			assert.Equal(t, []string{"other/finalizer"}, k8sAPIClient.updates[0].Metadata.Finalizers)
+			assert.Nil(t, k8sAPIClient.updates[0].Status)
+		}
+	})
+
+	t.Run("KeepsFinalizerWhenTeardownOfDeletedResourceFails", func(t *testing.T) {
+
+		k8sAPIClient := &fakeCustomResourcesAPIClient{resources: []CloudflareLoadBalancer{newTestDeletedCustomResource("api", CloudflareLoadBalancerSpec{Hostname: "api.example.com", Zone: "example.com", Pool: PoolConfig{Name: "my-cluster"}, Monitor: MonitorConfig{Path: "/liveness"}})}}
+		cc := newTestCustomResourceController(k8sAPIClient)
+		controller := &fakeLoadBalancerController{teardownErr: fmt.Errorf("Cloudflare API error")}
+		cc.loadBalancers["estafette/api"] = &managedLoadBalancer{config: config, controller: controller}
+
+		// act
+		cc.sync(context.Background())
+
+		assert.Equal(t, 1, controller.teardowns)
+		assert.Equal(t, 1, len(cc.loadBalancers))
+		assert.Equal(t, 0, len(k8sAPIClient.updates))
+	})
+
+	t.Run("RemovesLoadBalancerOfResourceDeletedWhileControllerWasNotRunning", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{{ID: "pool-1", Name: "api", Description: ownershipMarker}}}
+		cfAPIClient, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		k8sAPIClient := &fakeCustomResourcesAPIClient{resources: []CloudflareLoadBalancer{newTestDeletedCustomResource("api", CloudflareLoadBalancerSpec{Hostname: "api.example.com", Zone: "example.com", Pool: PoolConfig{Name: "api"}, Monitor: MonitorConfig{Path: "/liveness"}})}}
+		cc := newTestCustomResourceController(k8sAPIClient)
+		cc.cfAPIClient = cfAPIClient
+
+		// act
+		cc.sync(context.Background())
+
+		assert.Equal(t, []string{}, api.getPoolNames())
+		assert.Equal(t, 0, len(cc.loadBalancers))
+		if assert.Equal(t, 1, len(k8sAPIClient.updates)) {
+			assert.Equal(t, []string{"other/finalizer"}, k8sAPIClient.updates[0].Metadata.Finalizers)
+		}
+	})
+
+	t.Run("RemovesFinalizerOfDeletedResourceWithHostnameOfOtherOwnerWithoutTeardown", func(t *testing.T) {
+
+		k8sAPIClient := &fakeCustomResourcesAPIClient{resources: []CloudflareLoadBalancer{newTestDeletedCustomResource("api", CloudflareLoadBalancerSpec{Hostname: "api.example.com", Zone: "example.com", Pool: PoolConfig{Name: "api"}, Monitor: MonitorConfig{Path: "/liveness"}})}}
+		cc := newTestCustomResourceController(k8sAPIClient)
+		cc.hostnames.Claim("api.example.com", "api-example-com", "service default/api")
+
+		// act
+		cc.sync(context.Background())
+
+		assert.Equal(t, 0, len(cc.loadBalancers))
+		assert.Equal(t, 1, len(k8sAPIClient.updates))
+		assert.NotNil(t, cc.hostnames.Claim("api.example.com", "api", "custom resource estafette/other"))
+	})
+}
+
+func TestCustomResourceControllerUpdateStatus(t *testing.T) {
+
+	transitionTime := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	failure := newCondition(conditionReady, "False", "InvalidSpec", "Hostname and zone are required")
+
+	t.Run("KeepsTransitionTimeOfUnchangedConditionsAndSkipsUnchangedStatus", func(t *testing.T) {
+
+		resource := newTestCustomResource("api", CloudflareLoadBalancerSpec{})
+		resource.Status = &CloudflareLoadBalancerStatus{Conditions: []CloudflareLoadBalancerCondition{
+			{Type: conditionReady, Status: "False", Reason: "InvalidSpec", Message: "Hostname and zone are required", LastTransitionTime: transitionTime},
+			{Type: conditionInSync, Status: "Unknown", Reason: "NotRunning", LastTransitionTime: transitionTime},
+		}}
+		k8sAPIClient := &fakeCustomResourcesAPIClient{}
+		cc := NewCustomResourceController(k8sAPIClient, nil, NewHealthChecker(0, 0), &fakeEventRecorder{events: []string{}}, nil, "estafette", NewHostnameRegistry(Config{}), nil, 0, &sync.WaitGroup{}).(*customResourceControllerImpl)
+
+		// act
+		cc.updateStatus(context.Background(), resource, &failure)
+
+		assert.Equal(t, 0, len(k8sAPIClient.updates))
+	})
+
+	t.Run("ResetsTransitionTimeOfChangedCondition", func(t *testing.T) {
+
+		resource := newTestCustomResource("api", CloudflareLoadBalancerSpec{})
+		resource.Status = &CloudflareLoadBalancerStatus{Conditions: []CloudflareLoadBalancerCondition{
+			{Type: conditionReady, Status: "True", Reason: "Reconciled", LastTransitionTime: transitionTime},
+			{Type: conditionInSync, Status: "Unknown", Reason: "NotRunning", LastTransitionTime: transitionTime},
+		}}
+		k8sAPIClient := &fakeCustomResourcesAPIClient{}
+		cc := NewCustomResourceController(k8sAPIClient, nil, NewHealthChecker(0, 0), &fakeEventRecorder{events: []string{}}, nil, "estafette", NewHostnameRegistry(Config{}), nil, 0, &sync.WaitGroup{}).(*customResourceControllerImpl)
+
+		// act
+		cc.updateStatus(context.Background(), resource, &failure)
+
+		if assert.Equal(t, 1, len(k8sAPIClient.updates)) {
+			conditions := k8sAPIClient.updates[0].Status.Conditions
+			assert.True(t, conditions[0].LastTransitionTime.After(transitionTime))
+			assert.Equal(t, transitionTime, conditions[1].LastTransitionTime)
+		}
+	})
+}
+
+// newTestCustomResource returns a load balancer custom resource in namespace estafette
+func newTestCustomResource(name string, spec CloudflareLoadBalancerSpec) CloudflareLoadBalancer {
+	return CloudflareLoadBalancer{
+		Metadata: &metav1.ObjectMeta{Namespace: k8s.String("estafette"), Name: k8s.String(name)},
+		Spec:     spec,
+	}
+}
+
+// newTestDeletedCustomResource returns a load balancer custom resource in namespace estafette that's been deleted, but
+// is still held by the finalizer of the controller and one of another controller
+func newTestDeletedCustomResource(name string, spec CloudflareLoadBalancerSpec) CloudflareLoadBalancer {
+	deletionTime := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC).Unix()
+	resource := newTestCustomResource(name, spec)
+	resource.Metadata.DeletionTimestamp = &metav1.Time{Seconds: &deletionTime}
+	resource.Metadata.Finalizers = []string{"other/finalizer", customResourceFinalizer}
+	return resource
+}
+
+// fakeCustomResourcesAPIClient returns a fixed list of load balancer custom resources and records the updates; calls
+// unrelated to custom resources aren't supported
+type fakeCustomResourcesAPIClient struct {
+	KubernetesAPIClient
+
+	resources    []CloudflareLoadBalancer
+	resourcesErr error
+	updates      []CloudflareLoadBalancer
+	updateErr    error
+}
+
+func (cl *fakeCustomResourcesAPIClient) GetCloudflareLoadBalancers(ctx context.Context, namespace string) ([]CloudflareLoadBalancer, error) {
+	return cl.resources, cl.resourcesErr
+}
+
+func (cl *fakeCustomResourcesAPIClient) UpdateCloudflareLoadBalancer(ctx context.Context, resource CloudflareLoadBalancer) (CloudflareLoadBalancer, error) {
+	cl.updates = append(cl.updates, resource)
+	return resource, cl.updateErr
+}
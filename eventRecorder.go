@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	eventTypeNormal  = "Normal"
+	eventTypeWarning = "Warning"
+)
+
+// EventRecorder publishes Kubernetes events about load balancer changes and failures, against the nodes involved and
+// against the pod of the controller itself
+type EventRecorder interface {
+	NodeEvent(context.Context, Node, string, string, string)
+	ControllerEvent(context.Context, string, string, string)
+}
+
+type eventRecorderImpl struct {
+	k8sAPIClient  KubernetesAPIClient
+	controllerPod ObjectReference
+}
+
+// NewEventRecorder returns an instance of EventRecorder; controller events are only published if the pod name,
+// namespace and uid are known
+func NewEventRecorder(k8sAPIClient KubernetesAPIClient, podName, podNamespace, podUID string) EventRecorder {
+
+	// return instance of EventRecorder
+	return &eventRecorderImpl{
+		k8sAPIClient: k8sAPIClient,
+		controllerPod: ObjectReference{
+			Kind:      "Pod",
+			Namespace: podNamespace,
+			Name:      podName,
+			UID:       podUID,
+		},
+	}
+}
+
+// NodeEvent publishes an event for a node; nodes that no longer exist are skipped, since their events wouldn't show up
+// anywhere
+func (er *eventRecorderImpl) NodeEvent(ctx context.Context, node Node, eventType, reason, message string) {
+
+	if node.UID == "" {
+		return
+	}
+
+	er.createEvent(ctx, ObjectReference{Kind: "Node", Name: node.Name, UID: node.UID}, eventType, reason, message)
+}
+
+func (er *eventRecorderImpl) ControllerEvent(ctx context.Context, eventType, reason, message string) {
+
+	if er.controllerPod.Name == "" || er.controllerPod.Namespace == "" || er.controllerPod.UID == "" {
+		return
+	}
+
+	er.createEvent(ctx, er.controllerPod, eventType, reason, message)
+}
+
+// createEvent publishes the event; failing to do so doesn't affect reconciling, so the error is only logged
+func (er *eventRecorderImpl) createEvent(ctx context.Context, object ObjectReference, eventType, reason, message string) {
+
+	err := er.k8sAPIClient.CreateEvent(ctx, object, eventType, reason, message)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Creating %v event for %v %v failed", reason, object.Kind, object.Name)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventRecorder(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		podUID         string
+		record         func(EventRecorder)
+		expectedEvents []string
+	}{
+		{"PublishesNodeEvent", "pod-uid", func(er EventRecorder) {
+			er.NodeEvent(context.Background(), Node{Name: "node-1", UID: "node-uid"}, eventTypeNormal, "OriginAdded", "Added as origin")
+		}, []string{"Node node-1 Normal OriginAdded: Added as origin"}},
+		{"SkipsEventForDepartedNode", "pod-uid", func(er EventRecorder) {
+			er.NodeEvent(context.Background(), Node{Name: "node-1"}, eventTypeNormal, "OriginRemoved", "Removed as origin")
+		}, []string{}},
+		{"PublishesControllerEvent", "pod-uid", func(er EventRecorder) {
+			er.ControllerEvent(context.Background(), eventTypeWarning, "ReconcileFailed", "Reconciling failed")
+		}, []string{"Pod estafette/estafette-cloudflare-loadbalancer-0 Warning ReconcileFailed: Reconciling failed"}},
+		{"SkipsControllerEventWithoutPodUID", "", func(er EventRecorder) {
+			er.ControllerEvent(context.Background(), eventTypeWarning, "ReconcileFailed", "Reconciling failed")
+		}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			k8sAPIClient := &fakeEventsAPIClient{events: []string{}}
+			er := NewEventRecorder(k8sAPIClient, "estafette-cloudflare-loadbalancer-0", "estafette", tt.podUID)
+
+			// act
+			tt.record(er)
+
+			assert.Equal(t, tt.expectedEvents, k8sAPIClient.events)
+		})
+	}
+}
+
+// fakeEventsAPIClient keeps the events as "<kind> <namespace>/<name> <type> <reason>: <message>" strings; calls
+// unrelated to events aren't supported
+type fakeEventsAPIClient struct {
+	KubernetesAPIClient
+
+	events []string
+}
+
+func (cl *fakeEventsAPIClient) CreateEvent(ctx context.Context, object ObjectReference, eventType, reason, message string) error {
+
+	name := object.Name
+	if object.Namespace != "" {
+		name = object.Namespace + "/" + object.Name
+	}
+	cl.events = append(cl.events, fmt.Sprintf("%v %v %v %v: %v", object.Kind, name, eventType, reason, message))
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthChecker tracks the reconcile status of the load balancer controllers for the health endpoints
+type HealthChecker interface {
+	Register(string)
+	Unregister(string)
+	InitFinished(string, error)
+	ReconcileEnqueued(string)
+	ReconcileStarted(string)
+	ReconcileFinished(string, error)
+	LastReconcile(string) (time.Time, error)
+	CheckReadiness() error
+	CheckLiveness() error
+}
+
+type reconcileStatus struct {
+	initialized      bool
+	lastSuccess      time.Time
+	lastError        error
+	reconcilingSince time.Time
+	pendingSince     time.Time
+}
+
+type healthCheckerImpl struct {
+	mutex                sync.Mutex
+	statuses             map[string]*reconcileStatus
+	maxReconcileAge      time.Duration
+	maxReconcileDuration time.Duration
+}
+
+// NewHealthChecker returns an instance of HealthChecker; controllers are ready once initialized and as long as their
+// last successful reconcile isn't older than maxReconcileAge, and live as long as no reconcile runs or waits to run for
+// longer than maxReconcileDuration
+func NewHealthChecker(maxReconcileAge, maxReconcileDuration time.Duration) HealthChecker {
+
+	// return instance of HealthChecker
+	return &healthCheckerImpl{
+		statuses:             make(map[string]*reconcileStatus),
+		maxReconcileAge:      maxReconcileAge,
+		maxReconcileDuration: maxReconcileDuration,
+	}
+}
+
+// Register starts tracking a controller; its status is reset if it was tracked before
+func (hc *healthCheckerImpl) Register(name string) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	hc.statuses[name] = &reconcileStatus{}
+}
+
+// Unregister stops tracking a controller, for example when it stops because leadership is lost
+func (hc *healthCheckerImpl) Unregister(name string) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	delete(hc.statuses, name)
+}
+
+func (hc *healthCheckerImpl) InitFinished(name string, err error) {
+	hc.update(name, func(status *reconcileStatus) {
+		status.lastError = err
+		if err == nil {
+			status.initialized = true
+			status.lastSuccess = time.Now()
+		}
+	})
+}
+
+func (hc *healthCheckerImpl) ReconcileEnqueued(name string) {
+	hc.update(name, func(status *reconcileStatus) {
+		if status.pendingSince.IsZero() {
+			status.pendingSince = time.Now()
+		}
+	})
+}
+
+func (hc *healthCheckerImpl) ReconcileStarted(name string) {
+	hc.update(name, func(status *reconcileStatus) {
+		status.pendingSince = time.Time{}
+		status.reconcilingSince = time.Now()
+	})
+}
+
+// ReconcileFinished records the result of a reconcile; a successful reconcile also completes an initialization that
+// failed before, since it sets up everything that's missing
+func (hc *healthCheckerImpl) ReconcileFinished(name string, err error) {
+	hc.update(name, func(status *reconcileStatus) {
+		status.reconcilingSince = time.Time{}
+		status.lastError = err
+		if err == nil {
+			status.initialized = true
+			status.lastSuccess = time.Now()
+		}
+	})
+}
+
+// LastReconcile returns the time of the last successful reconcile of a controller, which is zero if it didn't succeed
+// yet, and the error if the last reconcile failed
+func (hc *healthCheckerImpl) LastReconcile(name string) (lastSuccess time.Time, lastError error) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	if status, ok := hc.statuses[name]; ok {
+		return status.lastSuccess, status.lastError
+	}
+	return
+}
+
+// CheckReadiness returns an error if any controller hasn't been initialized or hasn't reconciled successfully within
+// the maximum reconcile age
+func (hc *healthCheckerImpl) CheckReadiness() error {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	for _, name := range hc.getNames() {
+		status := hc.statuses[name]
+		if !status.initialized {
+			return fmt.Errorf("Load balancer %v has not been initialized: %v", name, status.lastError)
+		}
+		if time.Since(status.lastSuccess) > hc.maxReconcileAge {
+			return fmt.Errorf("Load balancer %v has not been reconciled successfully since %v: %v", name, status.lastSuccess.Format(time.RFC3339), status.lastError)
+		}
+	}
+
+	return nil
+}
+
+// CheckLiveness returns an error if a reconcile has been running or waiting to run for longer than the maximum
+// reconcile duration, which means the reconcile loop is stuck
+func (hc *healthCheckerImpl) CheckLiveness() error {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	for _, name := range hc.getNames() {
+		status := hc.statuses[name]
+		if !status.reconcilingSince.IsZero() && time.Since(status.reconcilingSince) > hc.maxReconcileDuration {
+			return fmt.Errorf("Reconcile for load balancer %v has been running since %v", name, status.reconcilingSince.Format(time.RFC3339))
+		}
+		if status.reconcilingSince.IsZero() && !status.pendingSince.IsZero() && time.Since(status.pendingSince) > hc.maxReconcileDuration {
+			return fmt.Errorf("Reconcile for load balancer %v has been waiting to run since %v", name, status.pendingSince.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+func (hc *healthCheckerImpl) update(name string, apply func(*reconcileStatus)) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	if status, ok := hc.statuses[name]; ok {
+		apply(status)
+	}
+}
+
+// getNames returns the tracked controllers in a fixed order, so the reported error doesn't jump between them
+func (hc *healthCheckerImpl) getNames() (names []string) {
+	for name := range hc.statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
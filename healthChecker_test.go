@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckReadiness(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		status reconcileStatus
+		ready  bool
+	}{
+		{"ReturnsNoErrorForRecentSuccessfulReconcile", reconcileStatus{initialized: true, lastSuccess: time.Now().Add(-time.Minute)}, true},
+		{"ReturnsErrorBeforeInitialization", reconcileStatus{lastError: fmt.Errorf("Cloudflare API error")}, false},
+		{"ReturnsErrorForOutdatedSuccessfulReconcile", reconcileStatus{initialized: true, lastSuccess: time.Now().Add(-time.Hour), lastError: fmt.Errorf("Cloudflare API error")}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			hc := newTestHealthChecker()
+			hc.Register("www.example.com")
+			*hc.statuses["www.example.com"] = tt.status
+
+			// act
+			err := hc.CheckReadiness()
+
+			if tt.ready {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+
+	t.Run("ReturnsNoErrorOnceInitialized", func(t *testing.T) {
+
+		hc := newTestHealthChecker()
+		hc.Register("www.example.com")
+
+		// act
+		hc.InitFinished("www.example.com", nil)
+
+		assert.Nil(t, hc.CheckReadiness())
+	})
+
+	t.Run("ReturnsNoErrorOnceReconcileSucceedsAfterFailedInitialization", func(t *testing.T) {
+
+		hc := newTestHealthChecker()
+		hc.Register("www.example.com")
+		hc.InitFinished("www.example.com", fmt.Errorf("Cloudflare API error"))
+
+		// act
+		hc.ReconcileFinished("www.example.com", nil)
+
+		assert.Nil(t, hc.CheckReadiness())
+	})
+
+	t.Run("ReturnsNoErrorForReplicaThatLostLeadership", func(t *testing.T) {
+
+		hc := newTestHealthChecker()
+		hc.Register("www.example.com")
+
+		// act
+		hc.Unregister("www.example.com")
+
+		assert.Nil(t, hc.CheckReadiness())
+	})
+}
+
+func TestCheckLiveness(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		status reconcileStatus
+		live   bool
+	}{
+		{"ReturnsNoErrorWithoutReconcile", reconcileStatus{}, true},
+		{"ReturnsNoErrorForShortRunningReconcile", reconcileStatus{reconcilingSince: time.Now().Add(-time.Minute)}, true},
+		{"ReturnsErrorForLongRunningReconcile", reconcileStatus{reconcilingSince: time.Now().Add(-time.Hour)}, false},
+		{"ReturnsNoErrorForRecentlyPendingReconcile", reconcileStatus{pendingSince: time.Now().Add(-time.Minute)}, true},
+		{"ReturnsErrorForReconcilePendingTooLong", reconcileStatus{pendingSince: time.Now().Add(-time.Hour)}, false},
+		{"ReturnsNoErrorForReconcilePendingBehindRunningReconcile", reconcileStatus{reconcilingSince: time.Now().Add(-time.Minute), pendingSince: time.Now().Add(-time.Hour)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			hc := newTestHealthChecker()
+			hc.Register("www.example.com")
+			*hc.statuses["www.example.com"] = tt.status
+
+			// act
+			err := hc.CheckLiveness()
+
+			if tt.live {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+
+	t.Run("KeepsFirstPendingTimeForMergedRequests", func(t *testing.T) {
+
+		hc := newTestHealthChecker()
+		hc.Register("www.example.com")
+		pendingSince := time.Now().Add(-time.Hour)
+		hc.statuses["www.example.com"].pendingSince = pendingSince
+
+		// act
+		hc.ReconcileEnqueued("www.example.com")
+
+		assert.Equal(t, pendingSince, hc.statuses["www.example.com"].pendingSince)
+		assert.NotNil(t, hc.CheckLiveness())
+	})
+}
+
+func TestLastReconcile(t *testing.T) {
+
+	t.Run("ReturnsTimeOfLastSuccessAndLastError", func(t *testing.T) {
+
+		hc := newTestHealthChecker()
+		hc.Register("www.example.com")
+		lastSuccess := time.Now().Add(-time.Minute)
+		*hc.statuses["www.example.com"] = reconcileStatus{lastSuccess: lastSuccess, lastError: fmt.Errorf("Cloudflare API error")}
+
+		// act
+		success, err := hc.LastReconcile("www.example.com")
+
+		assert.Equal(t, lastSuccess, success)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsZeroTimeForUnregisteredController", func(t *testing.T) {
+
+		hc := newTestHealthChecker()
+
+		// act
+		success, err := hc.LastReconcile("www.example.com")
+
+		assert.True(t, success.IsZero())
+		assert.Nil(t, err)
+	})
+}
+
+// newTestHealthChecker returns a health checker that requires a successful reconcile every 30 minutes and reconciles
+// that take at most 10 minutes
+func newTestHealthChecker() *healthCheckerImpl {
+	return NewHealthChecker(30*time.Minute, 10*time.Minute).(*healthCheckerImpl)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// HostnameRegistry keeps track of who manages the load balancer for each hostname and the pools for each pool name, so
+// the controllers for the config, services and custom resources never manage the same load balancer or pools; the first
+// to claim a hostname keeps it, along with the pool name claimed with it, until it releases it again
+type HostnameRegistry interface {
+	Claim(string, string, string) error
+	Release(string, string)
+}
+
+type hostnameRegistryImpl struct {
+	mutex  sync.Mutex
+	claims map[string]hostnameClaim
+}
+
+type hostnameClaim struct {
+	owner    string
+	poolName string
+}
+
+// claimConflictError is returned when a hostname or pool name is already claimed by another owner; the kind is either
+// Hostname or Pool
+type claimConflictError struct {
+	Kind  string
+	Name  string
+	Owner string
+}
+
+func (e *claimConflictError) Error() string {
+	return fmt.Sprintf("%v %v is already in use by %v", e.Kind, e.Name, e.Owner)
+}
+
+// NewHostnameRegistry returns an instance of HostnameRegistry; the hostnames and pool names of the configured load
+// balancers are claimed up front and never released
+func NewHostnameRegistry(config Config) HostnameRegistry {
+
+	claims := map[string]hostnameClaim{}
+	for _, lbConfig := range config.LoadBalancers {
+		claim := hostnameClaim{owner: "config"}
+		if lbConfig.Type == "lb" {
+			claim.poolName = lbConfig.Pool.Name
+		}
+		claims[lbConfig.Hostname()] = claim
+	}
+
+	// return instance of HostnameRegistry
+	return &hostnameRegistryImpl{
+		claims: claims,
+	}
+}
+
+// Claim reserves the hostname and the pool name for the owner, replacing the pool name it claimed before with the
+// hostname; if another owner already holds the hostname, or a pool name that collides with it, nothing is claimed and
+// the error names that owner. Load balancers without pools of their own claim an empty pool name
+func (hr *hostnameRegistryImpl) Claim(hostname, poolName, owner string) error {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+
+	if claim, exists := hr.claims[hostname]; exists && claim.owner != owner {
+		return &claimConflictError{Kind: "Hostname", Name: hostname, Owner: claim.owner}
+	}
+
+	if poolName != "" {
+		for _, claim := range hr.claims {
+			if claim.owner != owner && claim.poolName != "" && poolNamesCollide(claim.poolName, poolName) {
+				return &claimConflictError{Kind: "Pool", Name: poolName, Owner: claim.owner}
+			}
+		}
+	}
+
+	hr.claims[hostname] = hostnameClaim{owner: owner, poolName: poolName}
+	return nil
+}
+
+// Release frees the hostname and its pool name, unless it's held by another owner
+func (hr *hostnameRegistryImpl) Release(hostname, owner string) {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+
+	if hr.claims[hostname].owner == owner {
+		delete(hr.claims, hostname)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostnameRegistry(t *testing.T) {
+
+	tests := []struct {
+		name          string
+		claims        [][3]string
+		releases      [][2]string
+		hostname      string
+		poolName      string
+		owner         string
+		expectedError string
+	}{
+		{"AllowsClaimingFreeHostname", nil, nil, "api.example.com", "api", "service default/api", ""},
+		{"AllowsClaimingOwnHostnameAgain", [][3]string{{"api.example.com", "api", "service default/api"}}, nil, "api.example.com", "api", "service default/api", ""},
+		{"BlocksClaimingHostnameOfOtherOwner", [][3]string{{"api.example.com", "api", "service default/api"}}, nil, "api.example.com", "web", "service default/web", "Hostname api.example.com is already in use by service default/api"},
+		{"BlocksClaimingConfiguredHostname", nil, nil, "www.example.com", "web", "service default/web", "Hostname www.example.com is already in use by config"},
+		{"AllowsClaimingReleasedHostname", [][3]string{{"api.example.com", "api", "service default/api"}}, [][2]string{{"api.example.com", "service default/api"}}, "api.example.com", "web", "service default/web", ""},
+		{"IgnoresReleaseByOtherOwner", [][3]string{{"api.example.com", "api", "service default/api"}}, [][2]string{{"api.example.com", "service default/web"}}, "api.example.com", "web", "service default/web", "Hostname api.example.com is already in use by service default/api"},
+		{"IgnoresReleaseOfConfiguredHostname", nil, [][2]string{{"www.example.com", "service default/web"}}, "www.example.com", "web", "service default/web", "Hostname www.example.com is already in use by config"},
+		{"BlocksClaimingPoolNameOfOtherOwner", [][3]string{{"api.example.com", "api", "custom resource default/api"}}, nil, "web.example.com", "api", "custom resource default/web", "Pool api is already in use by custom resource default/api"},
+		{"BlocksClaimingConfiguredPoolName", nil, nil, "web.example.com", "my-cluster", "custom resource default/web", "Pool my-cluster is already in use by config"},
+		{"BlocksClaimingPoolNamedLikeExtraPoolOfOtherOwner", [][3]string{{"api.example.com", "web", "custom resource default/api"}}, nil, "web.example.com", "web-2", "custom resource default/web", "Pool web-2 is already in use by custom resource default/api"},
+		{"AllowsClaimingPoolNameOfReleasedHostname", [][3]string{{"api.example.com", "api", "custom resource default/api"}}, [][2]string{{"api.example.com", "custom resource default/api"}}, "web.example.com", "api", "custom resource default/web", ""},
+		{"AllowsClaimingHostnamesWithoutPoolName", [][3]string{{"api.example.com", "", "ingress"}}, nil, "web.example.com", "", "custom resource default/web", ""},
+		{"DoesNotClaimHostnameWithPoolNameInUse", [][3]string{{"api.example.com", "api", "custom resource default/api"}, {"web.example.com", "api", "custom resource default/web"}}, nil, "web.example.com", "web", "service default/web", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			registry := NewHostnameRegistry(Config{LoadBalancers: []LoadBalancerConfig{{Name: "www", Zone: "example.com", Type: "lb", Pool: PoolConfig{Name: "my-cluster"}}}})
+			for _, claim := range tt.claims {
+				registry.Claim(claim[0], claim[1], claim[2])
+			}
+			for _, release := range tt.releases {
+				registry.Release(release[0], release[1])
+			}
+
+			// act
+			err := registry.Claim(tt.hostname, tt.poolName, tt.owner)
+
+			if tt.expectedError == "" {
+				assert.Nil(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.Equal(t, tt.expectedError, err.Error())
+			}
+		})
+	}
+}
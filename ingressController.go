@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/rs/zerolog/log"
+)
+
+// IngressController creates a load balancer for each host of the ingresses that opted in with the load balancer
+// annotation, all using the shared pools of the cluster, and removes them once the host is gone from every ingress
+type IngressController interface {
+	Run(context.Context)
+	Teardown(context.Context) error
+}
+
+// ingressHostnameOwner is the owner of the hostnames claimed for ingress hosts in the hostname registry
+const ingressHostnameOwner = "ingress"
+
+type ingressControllerImpl struct {
+	k8sAPIClient  KubernetesAPIClient
+	cfAPIClient   CloudflareAPIClient
+	poolConfig    LoadBalancerConfig
+	eventRecorder EventRecorder
+	planStore     PlanStore
+	hostnames     HostnameRegistry
+	syncInterval  int
+
+	// the hosts with a load balancer created by this controller and their zone; they're looked up in Cloudflare on the
+	// first sync, so hosts that disappeared while not running are removed as well
+	hosts       map[string]string
+	initialized bool
+
+	// the hosts claimed in the hostname registry, and the ones skipped because another owner claimed them
+	claimedHosts map[string]bool
+	skippedHosts map[string]bool
+
+	waitGroup *sync.WaitGroup
+}
+
+// NewIngressController returns an instance of IngressController; the load balancers use the pools and settings of the
+// configured load balancer poolConfig, hosts that are claimed in the hostname registry by the config, a service or a
+// custom resource are skipped, and the ingresses are checked every sync interval besides whenever they change
+func NewIngressController(k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, poolConfig LoadBalancerConfig, eventRecorder EventRecorder, planStore PlanStore, hostnames HostnameRegistry, syncInterval int, waitGroup *sync.WaitGroup) IngressController {
+
+	// return instance of IngressController
+	return &ingressControllerImpl{
+		k8sAPIClient:  k8sAPIClient,
+		cfAPIClient:   cfAPIClient,
+		poolConfig:    poolConfig,
+		eventRecorder: eventRecorder,
+		planStore:     planStore,
+		hostnames:     hostnames,
+		syncInterval:  syncInterval,
+		hosts:         map[string]string{},
+		claimedHosts:  map[string]bool{},
+		skippedHosts:  map[string]bool{},
+		waitGroup:     waitGroup,
+	}
+}
+
+// Run syncs the load balancers with the ingress hosts until the context is cancelled
+func (ic *ingressControllerImpl) Run(ctx context.Context) {
+
+	ic.waitGroup.Add(1)
+
+	go func() {
+		defer ic.waitGroup.Done()
+
+		ingressChanges := make(chan struct{}, 1)
+		go ic.k8sAPIClient.WatchIngresses(ctx, ingressChanges)
+
+		for {
+			ic.sync(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ingressChanges:
+				log.Info().Msg("Ingresses changed, syncing their load balancers...")
+			case <-time.After(time.Duration(ic.syncInterval) * time.Second):
+			}
+		}
+	}()
+}
+
+// Teardown removes the load balancers of all ingress hosts, regardless of whether the hosts are still in use; it has to
+// run before the shared pools are removed, since the load balancers refer to them
+func (ic *ingressControllerImpl) Teardown(ctx context.Context) (err error) {
+
+	ctx, plan := ic.startPlan(ctx)
+	defer func() {
+		ic.finishPlan(plan, err)
+	}()
+
+	zoneNames, err := ic.cfAPIClient.GetZoneNames(ctx)
+	if err != nil {
+		return
+	}
+
+	err = ic.findLoadBalancers(ctx, zoneNames)
+	if err != nil {
+		return
+	}
+
+	for host, zone := range ic.hosts {
+		err = ic.cfAPIClient.DeleteLoadBalancer(ctx, strings.TrimSuffix(host, "."+zone), zone, ic.poolConfig.Pool.Name)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed deleting load balancer for ingress host %v", host)
+			return
+		}
+		delete(ic.hosts, host)
+		ic.releaseHost(host)
+	}
+
+	return
+}
+
+// sync creates or updates the load balancer of each ingress host and removes the ones of hosts that are gone; failures
+// for single hosts are logged and retried on the next sync
+func (ic *ingressControllerImpl) sync(ctx context.Context) (err error) {
+
+	ctx, plan := ic.startPlan(ctx)
+	defer func() {
+		ic.finishPlan(plan, err)
+	}()
+
+	hosts, err := ic.k8sAPIClient.GetIngressHosts(ctx)
+	if err != nil {
+		// never remove load balancers because the ingresses couldn't be retrieved
+		log.Error().Err(err).Msg("Failed retrieving ingress hosts for load balancers")
+		return
+	}
+
+	zoneNames, err := ic.cfAPIClient.GetZoneNames(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed retrieving Cloudflare zones for ingress hosts")
+		return
+	}
+
+	if !ic.initialized {
+		err = ic.findLoadBalancers(ctx, zoneNames)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed retrieving existing load balancers for ingress hosts")
+			return
+		}
+		ic.initialized = true
+	}
+
+	// remove the load balancers of hosts that are gone from every ingress
+	for host, zone := range ic.hosts {
+		if contains(hosts, host) {
+			continue
+		}
+
+		log.Info().Msgf("Removing load balancer for ingress host %v...", host)
+		if err := ic.cfAPIClient.DeleteLoadBalancer(ctx, strings.TrimSuffix(host, "."+zone), zone, ic.poolConfig.Pool.Name); err != nil {
+			log.Error().Err(err).Msgf("Failed deleting load balancer for ingress host %v", host)
+			continue
+		}
+		delete(ic.hosts, host)
+	}
+
+	// hosts gone from every ingress without a load balancer left can be claimed by others again
+	for host := range ic.claimedHosts {
+		if _, exists := ic.hosts[host]; !exists && !contains(hosts, host) {
+			ic.releaseHost(host)
+		}
+	}
+	for host := range ic.skippedHosts {
+		if !contains(hosts, host) {
+			delete(ic.skippedHosts, host)
+		}
+	}
+
+	pools, err := ic.cfAPIClient.GetLoadBalancerPools(ctx, ic.poolConfig.Pool.Name)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed retrieving pools %v for ingress hosts", ic.poolConfig.Pool.Name)
+		return
+	}
+
+	desiredLoadBalancer := ic.poolConfig.ToLoadBalancer()
+	desiredLoadBalancer.Description = ic.getDescription()
+
+	for _, host := range hosts {
+		zone := getZoneForHostname(host, zoneNames)
+		if zone == "" || zone == host || strings.HasPrefix(host, "*.") {
+			log.Warn().Msgf("Skipping load balancer for ingress host %v, it's not a subdomain of any Cloudflare zone or a wildcard", host)
+			continue
+		}
+
+		if !ic.claimHost(ctx, host) {
+			continue
+		}
+
+		if _, err := ic.cfAPIClient.GetOrCreateLoadBalancer(ctx, strings.TrimSuffix(host, "."+zone), zone, desiredLoadBalancer, pools); err != nil {
+			log.Error().Err(err).Msgf("Failed creating load balancer for ingress host %v", host)
+			continue
+		}
+		ic.hosts[host] = zone
+	}
+
+	return
+}
+
+// claimHost claims the host in the hostname registry and returns whether it succeeded; a host that's claimed by another
+// owner is skipped, with a warning event the first time
+func (ic *ingressControllerImpl) claimHost(ctx context.Context, host string) bool {
+
+	err := ic.hostnames.Claim(host, "", ingressHostnameOwner)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Skipping load balancer for ingress host %v", host)
+		if !ic.skippedHosts[host] && ic.planStore == nil {
+			ic.eventRecorder.ControllerEvent(ctx, eventTypeWarning, "HostnameInUse", fmt.Sprintf("Skipping load balancer for ingress host %v: %v", host, err))
+		}
+		ic.skippedHosts[host] = true
+		return false
+	}
+
+	ic.claimedHosts[host] = true
+	delete(ic.skippedHosts, host)
+	return true
+}
+
+// releaseHost releases the host in the hostname registry, if it was claimed
+func (ic *ingressControllerImpl) releaseHost(host string) {
+	if ic.claimedHosts[host] {
+		ic.hostnames.Release(host, ingressHostnameOwner)
+		delete(ic.claimedHosts, host)
+	}
+}
+
+// findLoadBalancers looks up the load balancers created for ingress hosts sharing the same pools
+func (ic *ingressControllerImpl) findLoadBalancers(ctx context.Context, zoneNames []string) (err error) {
+
+	description := withOwnershipMarker(ic.getDescription())
+
+	for _, zoneName := range zoneNames {
+		var loadBalancers []cloudflare.LoadBalancer
+		loadBalancers, err = ic.cfAPIClient.GetLoadBalancers(ctx, zoneName)
+		if err != nil {
+			return
+		}
+
+		for _, lb := range loadBalancers {
+			if lb.Description == description {
+				ic.hosts[lb.Name] = zoneName
+			}
+		}
+	}
+
+	return
+}
+
+// getDescription returns the description that marks the load balancers of ingress hosts using the shared pools
+func (ic *ingressControllerImpl) getDescription() string {
+	return fmt.Sprintf("Load balancer for ingress host using pool %v", ic.poolConfig.Pool.Name)
+}
+
+// startPlan attaches a new plan to the context in dry-run mode, to collect the changes a sync would have made
+func (ic *ingressControllerImpl) startPlan(ctx context.Context) (context.Context, *Plan) {
+
+	if ic.planStore == nil {
+		return ctx, nil
+	}
+
+	plan := &Plan{
+		LoadBalancer: "ingress hosts",
+		Time:         time.Now(),
+		Entries:      []PlanEntry{},
+	}
+
+	return withPlan(ctx, plan), plan
+}
+
+// finishPlan keeps the plan, replacing the one of the previous sync
+func (ic *ingressControllerImpl) finishPlan(plan *Plan, err error) {
+
+	if plan == nil {
+		return
+	}
+
+	if err != nil {
+		plan.Error = err.Error()
+	}
+
+	log.Info().Msgf("Dry-run: syncing load balancers for ingress hosts would have made %v changes", len(plan.Entries))
+	ic.planStore.Set(plan)
+}
+
+// getZoneForHostname returns the longest zone the hostname is part of, or an empty string if there's none
+func getZoneForHostname(hostname string, zoneNames []string) (zoneName string) {
+	for _, name := range zoneNames {
+		if (hostname == name || strings.HasSuffix(hostname, "."+name)) && len(name) > len(zoneName) {
+			zoneName = name
+		}
+	}
+	return
+}
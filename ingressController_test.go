@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetZoneForHostname(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		hostname     string
+		expectedZone string
+	}{
+		{"ReturnsZoneOfSubdomain", "www.example.com", "example.com"},
+		{"ReturnsLongestZone", "www.shop.example.com", "shop.example.com"},
+		{"ReturnsZoneForApex", "example.com", "example.com"},
+		{"ReturnsEmptyStringForHostOutsideZones", "www.example.org", ""},
+		{"ReturnsEmptyStringForZoneNameSuffix", "www.otherexample.com", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			zone := getZoneForHostname(tt.hostname, []string{"example.com", "shop.example.com"})
+
+			assert.Equal(t, tt.expectedZone, zone)
+		})
+	}
+}
+
+func TestIngressControllerSync(t *testing.T) {
+
+	poolConfig := LoadBalancerConfig{Name: "www", Zone: "example.com", Pool: PoolConfig{Name: "my-cluster"}}
+	poolConfig.SetDefaults()
+	pool := cloudflare.LoadBalancerPool{ID: "pool-1", Name: "my-cluster", Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{{Name: "node-a", Address: "10.0.0.1", Enabled: true}}}
+	ingressDescription := "Load balancer for ingress host using pool my-cluster - " + ownershipMarker
+
+	t.Run("CreatesLoadBalancerForEachHostUsingSharedPools", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{pool}}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		k8sAPIClient := &fakeIngressesAPIClient{hosts: []string{"api.example.com", "www.example.com", "example.com", "*.example.com", "www.example.org"}}
+		ic := NewIngressController(k8sAPIClient, cl, poolConfig, &fakeEventRecorder{events: []string{}}, nil, NewHostnameRegistry(Config{LoadBalancers: []LoadBalancerConfig{poolConfig}}), 0, &sync.WaitGroup{}).(*ingressControllerImpl)
+
+		// act
+		err := ic.sync(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"POST zones/zone-id/load_balancers"}, api.changes)
+		if assert.Equal(t, 1, len(api.loadBalancers)) {
+			assert.Equal(t, "api.example.com", api.loadBalancers[0].Name)
+			assert.Equal(t, ingressDescription, api.loadBalancers[0].Description)
+			assert.Equal(t, []string{"pool-1"}, api.loadBalancers[0].DefaultPools)
+		}
+		assert.Equal(t, map[string]string{"api.example.com": "example.com"}, ic.hosts)
+	})
+
+	t.Run("RemovesLoadBalancerOfHostGoneWhileNotRunning", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{
+			pools: []cloudflare.LoadBalancerPool{pool},
+			loadBalancers: []cloudflare.LoadBalancer{
+				{ID: "lb-1", Name: "old.example.com", Description: ingressDescription, DefaultPools: []string{"pool-1"}, FallbackPool: "pool-1"},
+				{ID: "lb-2", Name: "other.example.com", Description: "Load balancer for other.example.com", DefaultPools: []string{"pool-1"}, FallbackPool: "pool-1"},
+			},
+		}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		k8sAPIClient := &fakeIngressesAPIClient{hosts: []string{}}
+		ic := NewIngressController(k8sAPIClient, cl, poolConfig, &fakeEventRecorder{events: []string{}}, nil, NewHostnameRegistry(Config{}), 0, &sync.WaitGroup{}).(*ingressControllerImpl)
+
+		// act
+		err := ic.sync(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"DELETE zones/zone-id/load_balancers/lb-1"}, api.changes)
+		assert.Equal(t, map[string]string{}, ic.hosts)
+	})
+
+	t.Run("RemovesAllLoadBalancersOnTeardown", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{pool}}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		k8sAPIClient := &fakeIngressesAPIClient{hosts: []string{"api.example.com"}}
+		ic := NewIngressController(k8sAPIClient, cl, poolConfig, &fakeEventRecorder{events: []string{}}, nil, NewHostnameRegistry(Config{}), 0, &sync.WaitGroup{}).(*ingressControllerImpl)
+		ic.sync(context.Background())
+
+		// act
+		err := ic.Teardown(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(api.loadBalancers))
+		assert.Equal(t, map[string]string{}, ic.hosts)
+	})
+}
+
+func TestIngressControllerClaimHost(t *testing.T) {
+
+	newTestIngressController := func(hostnames HostnameRegistry, eventRecorder EventRecorder) *ingressControllerImpl {
+		return NewIngressController(nil, nil, LoadBalancerConfig{}, eventRecorder, nil, hostnames, 0, &sync.WaitGroup{}).(*ingressControllerImpl)
+	}
+
+	t.Run("SkipsHostClaimedByServiceWithWarningEventOnce", func(t *testing.T) {
+
+		hostnames := NewHostnameRegistry(Config{})
+		hostnames.Claim("api.example.com", "api-example-com", "service default/api")
+		eventRecorder := &fakeEventRecorder{events: []string{}}
+		ic := newTestIngressController(hostnames, eventRecorder)
+
+		// act
+		claimed := ic.claimHost(context.Background(), "api.example.com")
+		claimedAgain := ic.claimHost(context.Background(), "api.example.com")
+
+		assert.False(t, claimed)
+		assert.False(t, claimedAgain)
+		assert.Equal(t, []string{"controller HostnameInUse: Skipping load balancer for ingress host api.example.com: Hostname api.example.com is already in use by service default/api"}, eventRecorder.events)
+	})
+
+	t.Run("SkipsConfiguredHost", func(t *testing.T) {
+
+		hostnames := NewHostnameRegistry(Config{LoadBalancers: []LoadBalancerConfig{{Name: "www", Zone: "example.com"}}})
+		ic := newTestIngressController(hostnames, &fakeEventRecorder{events: []string{}})
+
+		// act
+		claimed := ic.claimHost(context.Background(), "www.example.com")
+
+		assert.False(t, claimed)
+	})
+
+	t.Run("BlocksServiceFromClaimingHostOfIngress", func(t *testing.T) {
+
+		hostnames := NewHostnameRegistry(Config{})
+		ic := newTestIngressController(hostnames, &fakeEventRecorder{events: []string{}})
+
+		// act
+		claimed := ic.claimHost(context.Background(), "api.example.com")
+
+		assert.True(t, claimed)
+		err := hostnames.Claim("api.example.com", "api-example-com", "service default/api")
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Hostname api.example.com is already in use by ingress", err.Error())
+		}
+	})
+
+	t.Run("LetsServiceClaimHostOnceReleased", func(t *testing.T) {
+
+		hostnames := NewHostnameRegistry(Config{})
+		ic := newTestIngressController(hostnames, &fakeEventRecorder{events: []string{}})
+		ic.claimHost(context.Background(), "api.example.com")
+
+		// act
+		ic.releaseHost("api.example.com")
+
+		assert.Nil(t, hostnames.Claim("api.example.com", "api-example-com", "service default/api"))
+	})
+}
+
+// fakeIngressesAPIClient returns a fixed list of ingress hosts; calls unrelated to ingresses aren't supported
+type fakeIngressesAPIClient struct {
+	KubernetesAPIClient
+
+	hosts []string
+}
+
+func (cl *fakeIngressesAPIClient) GetIngressHosts(ctx context.Context) ([]string, error) {
+	return cl.hosts, nil
+}
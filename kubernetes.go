@@ -2,40 +2,223 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/ericchiang/k8s"
+	apiv1 "github.com/ericchiang/k8s/api/v1"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type Node struct {
-	Name       string
-	ExternalIP string
+	Name          string
+	UID           string
+	ExternalIP    string
+	Ready         bool
+	Unschedulable bool
+	Terminating   bool
+	// Draining is set for nodes that are on their way out; their origins are kept disabled until the drain grace period ends
+	Draining bool
+}
+
+// IsHealthy returns true if the node can receive traffic
+func (n Node) IsHealthy() bool {
+	return n.Ready && !n.Unschedulable && !n.Terminating
+}
+
+// nodeState holds the node properties that affect the load balancer origins
+type nodeState struct {
+	Ready         bool
+	Unschedulable bool
+	Terminating   bool
+	Excluded      bool
+	ExternalIP    string
+}
+
+// excludeNodeAnnotation opts a node out of the load balancer when set to "true"
+const excludeNodeAnnotation = "estafette.io/cloudflare-loadbalancer-exclude"
+
+// annotations on a service to get a Cloudflare load balancer for it at the hostname, with the nodes running its
+// endpoints as origins
+const (
+	loadBalancerServiceAnnotation            = "estafette.io/cloudflare-loadbalancer"
+	loadBalancerHostnameServiceAnnotation    = "estafette.io/cloudflare-loadbalancer-hostname"
+	loadBalancerZoneServiceAnnotation        = "estafette.io/cloudflare-loadbalancer-zone"
+	loadBalancerMonitorPathServiceAnnotation = "estafette.io/cloudflare-loadbalancer-monitor-path"
+)
+
+// loadBalancerIngressAnnotation opts an ingress in to get a Cloudflare load balancer for each of its hosts
+const loadBalancerIngressAnnotation = "estafette.io/cloudflare-loadbalancer"
+
+// Service is a Kubernetes service that opted in to get a Cloudflare load balancer with its annotations
+type Service struct {
+	Namespace   string
+	Name        string
+	Hostname    string
+	Zone        string
+	MonitorPath string
+}
+
+// labelRequirement is a single requirement of an equality based label selector
+type labelRequirement struct {
+	Key      string
+	Operator string
+	Value    string
+}
+
+// taintMatcher matches taints by key and optionally value and effect
+type taintMatcher struct {
+	Key    string
+	Value  string
+	Effect string
+}
+
+// leaseAnnotation is the annotation on the leader election config map holding the lease
+const leaseAnnotation = "estafette.io/leader"
+
+// Lease records which replica holds the leadership and until when
+type Lease struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+}
+
+// the custom resource declaring a load balancer, registered with a CustomResourceDefinition
+const (
+	customResourceAPIGroup   = "estafette.io"
+	customResourceAPIVersion = "v1"
+	customResourceKind       = "CloudflareLoadBalancer"
+	customResourcePlural     = "cloudflareloadbalancers"
+	customResourceFinalizer  = "estafette.io/cloudflare-loadbalancer"
+)
+
+// CloudflareLoadBalancer is the custom resource declaring a load balancer, with the status written back by the controller
+type CloudflareLoadBalancer struct {
+	Kind       string                        `json:"kind"`
+	APIVersion string                        `json:"apiVersion"`
+	Metadata   *metav1.ObjectMeta            `json:"metadata"`
+	Spec       CloudflareLoadBalancerSpec    `json:"spec"`
+	Status     *CloudflareLoadBalancerStatus `json:"status,omitempty"`
+}
+
+// CloudflareLoadBalancerSpec holds the configuration of the load balancer; unset settings get the same defaults as in
+// the config file
+type CloudflareLoadBalancerSpec struct {
+	Hostname string `json:"hostname"`
+	Zone     string `json:"zone"`
+	// Type is either 'lb' for a Cloudflare load balancer or 'dns' for a dns record per node
+	Type        string           `json:"type,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Proxied     *bool            `json:"proxied,omitempty"`
+	TTL         int              `json:"ttl,omitempty"`
+	Pool        PoolConfig       `json:"pool"`
+	Monitor     MonitorConfig    `json:"monitor"`
+	Safeguards  SafeguardsConfig `json:"safeguards"`
+	Steering    SteeringConfig   `json:"steering"`
+}
+
+// CloudflareLoadBalancerStatus reports the Cloudflare objects of the load balancer and the result of reconciling it
+type CloudflareLoadBalancerStatus struct {
+	LoadBalancerID string                            `json:"loadBalancerID,omitempty"`
+	MonitorID      string                            `json:"monitorID,omitempty"`
+	Pools          []PoolStatus                      `json:"pools,omitempty"`
+	RegionPools    map[string][]string               `json:"regionPools,omitempty"`
+	PopPools       map[string][]string               `json:"popPools,omitempty"`
+	DNSRecords     []string                          `json:"dnsRecords,omitempty"`
+	LastSyncTime   *time.Time                        `json:"lastSyncTime,omitempty"`
+	Conditions     []CloudflareLoadBalancerCondition `json:"conditions,omitempty"`
+}
+
+// CloudflareLoadBalancerCondition is either the Ready condition, telling whether the last reconcile succeeded, or the
+// InSync condition, telling whether Cloudflare still matches the spec and the healthy nodes
+type CloudflareLoadBalancerCondition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+type cloudflareLoadBalancerList struct {
+	Kind       string                   `json:"kind"`
+	APIVersion string                   `json:"apiVersion"`
+	Metadata   *metav1.ListMeta         `json:"metadata"`
+	Items      []CloudflareLoadBalancer `json:"items"`
+}
+
+// ObjectReference identifies the Kubernetes object an event is about
+type ObjectReference struct {
+	Kind      string
+	Namespace string
+	Name      string
+	UID       string
 }
 
 // KubernetesAPIClient handles communications with the Kubernetes API
 type KubernetesAPIClient interface {
-	GetHealthyNodes() ([]Node, error)
+	GetNodes(context.Context) ([]Node, error)
+	GetHealthyNodes(context.Context) ([]Node, error)
+	WatchNodes(context.Context, chan<- struct{})
+	GetLease(context.Context, string, string) (Lease, string, error)
+	UpdateLease(context.Context, string, string, Lease, string) error
+	CreateEvent(context.Context, ObjectReference, string, string, string) error
+	GetServices(context.Context) ([]Service, error)
+	WatchServices(context.Context, chan<- struct{})
+	GetServiceNodeNames(context.Context, string, string) ([]string, error)
+	GetIngressHosts(context.Context) ([]string, error)
+	WatchIngresses(context.Context, chan<- struct{})
+	GetCloudflareLoadBalancers(context.Context, string) ([]CloudflareLoadBalancer, error)
+	UpdateCloudflareLoadBalancer(context.Context, CloudflareLoadBalancer) (CloudflareLoadBalancer, error)
 }
 
 type kubernetesAPIClientImpl struct {
-	kubeClient *k8s.Client
+	kubeClient     *k8s.Client
+	labelSelector  []labelRequirement
+	excludedTaints []taintMatcher
+	timeout        time.Duration
 }
 
-// NewKubernetesAPIClient returns an instance of KubernetesAPIClient
-func NewKubernetesAPIClient() (KubernetesAPIClient, error) {
+// NewKubernetesAPIClient returns an instance of KubernetesAPIClient; only nodes matching the label selector and without
+// any of the excluded taints are used, like 'cloud.google.com/gke-nodepool=ingress' and 'dedicated=batch:NoSchedule';
+// each call to the Kubernetes API times out after the timeout
+func NewKubernetesAPIClient(labelSelector string, excludedTaints []string, timeout time.Duration) (KubernetesAPIClient, error) {
 
 	kubeClient, err := getKubeClient()
 	if err != nil {
 		return nil, err
 	}
 
+	requirements, err := parseLabelSelector(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	taintMatchers := []taintMatcher{}
+	for _, taint := range excludedTaints {
+		matcher, err := parseTaintMatcher(taint)
+		if err != nil {
+			return nil, err
+		}
+		taintMatchers = append(taintMatchers, matcher)
+	}
+
 	// return instance of KubernetesAPIClient
 	return &kubernetesAPIClientImpl{
-		kubeClient: kubeClient,
+		kubeClient:     kubeClient,
+		labelSelector:  requirements,
+		excludedTaints: taintMatchers,
+		timeout:        timeout,
 	}, nil
 }
 
@@ -63,11 +246,11 @@ func getKubeClient() (*k8s.Client, error) {
 	return k8s.NewInClusterClient()
 }
 
-func (cl *kubernetesAPIClientImpl) GetHealthyNodes() (nodes []Node, err error) {
+func (cl *kubernetesAPIClientImpl) GetNodes(ctx context.Context) (nodes []Node, err error) {
 
 	nodes = []Node{}
 
-	kubeNodes, err := cl.kubeClient.CoreV1().ListNodes(context.Background())
+	kubeNodes, err := cl.listNodes(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("Retrieving Kubernetes nodes failed")
 		return
@@ -79,24 +262,820 @@ func (cl *kubernetesAPIClientImpl) GetHealthyNodes() (nodes []Node, err error) {
 
 	for _, node := range kubeNodes.Items {
 
-		externalIP := ""
-		for _, address := range node.Status.Addresses {
-			if *address.Type == "ExternalIP" {
-				externalIP = *address.Address
+		state := cl.getNodeState(node)
+
+		// leave out nodes that don't match the selectors or opted out
+		if state.Excluded {
+			continue
+		}
+
+		nodes = append(nodes, Node{
+			Name:          node.GetMetadata().GetName(),
+			UID:           node.GetMetadata().GetUid(),
+			ExternalIP:    state.ExternalIP,
+			Ready:         state.Ready,
+			Unschedulable: state.Unschedulable,
+			Terminating:   state.Terminating,
+		})
+	}
+
+	return
+}
+
+func (cl *kubernetesAPIClientImpl) GetHealthyNodes(ctx context.Context) (nodes []Node, err error) {
+
+	allNodes, err := cl.GetNodes(ctx)
+	if err != nil {
+		return
+	}
+
+	nodes = []Node{}
+	for _, node := range allNodes {
+		if node.IsHealthy() {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return
+}
+
+// WatchNodes watches nodes and signals on the changes channel whenever a node is added or removed or changes its ready
+// state, schedulability, termination, exclusion or external ip; it resumes the watch from the last seen resource version when it gets
+// disconnected and relists the nodes when that resource version has expired; it returns once the context is cancelled
+func (cl *kubernetesAPIClientImpl) WatchNodes(ctx context.Context, changes chan<- struct{}) {
+
+	listThenWatch(ctx, watchedResource{
+		kind:   "nodes",
+		object: "Node",
+		list: func(ctx context.Context) (states map[string]interface{}, resourceVersion string, err error) {
+			kubeNodes, err := cl.listNodes(ctx)
+			if err != nil {
+				return
+			}
+
+			states = map[string]interface{}{}
+			for _, node := range kubeNodes.Items {
+				states[node.GetMetadata().GetName()] = cl.getNodeState(node)
+			}
+
+			return states, kubeNodes.GetMetadata().GetResourceVersion(), nil
+		},
+		watch: func(ctx context.Context, resourceVersion string) (resourceWatcher, error) {
+			watcher, err := cl.kubeClient.CoreV1().WatchNodes(ctx, k8s.ResourceVersion(resourceVersion))
+			if err != nil {
+				return nil, err
+			}
+			return &nodeWatcher{cl: cl, watcher: watcher}, nil
+		},
+	}, changes)
+}
+
+// nodeWatcher reduces the events of a node watch to the node states
+type nodeWatcher struct {
+	cl      *kubernetesAPIClientImpl
+	watcher *k8s.CoreV1NodeWatcher
+}
+
+func (w *nodeWatcher) Next() (event watchEvent, err error) {
+
+	kubeEvent, node, err := w.watcher.Next()
+	if err != nil {
+		return
+	}
+
+	event = watchEvent{
+		Type:            kubeEvent.GetType(),
+		Key:             node.GetMetadata().GetName(),
+		ResourceVersion: node.GetMetadata().GetResourceVersion(),
+	}
+	if event.Type != k8s.EventError {
+		event.State = w.cl.getNodeState(node)
+	}
+
+	return
+}
+
+func (w *nodeWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (cl *kubernetesAPIClientImpl) listNodes(ctx context.Context) (*apiv1.NodeList, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, cl.timeout)
+	defer cancel()
+
+	nodes, err := cl.kubeClient.CoreV1().ListNodes(ctx)
+	if err != nil {
+		kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": "list_nodes"}).Inc()
+	}
+
+	return nodes, err
+}
+
+func (cl *kubernetesAPIClientImpl) getNodeState(node *apiv1.Node) (state nodeState) {
+
+	for _, address := range node.GetStatus().GetAddresses() {
+		if address.GetType() == "ExternalIP" {
+			state.ExternalIP = address.GetAddress()
+		}
+	}
+
+	for _, condition := range node.GetStatus().GetConditions() {
+		if condition.GetType() == "Ready" && condition.GetStatus() == "True" {
+			state.Ready = true
+		}
+	}
+
+	state.Unschedulable = node.GetSpec().GetUnschedulable()
+
+	// nodes being deleted or scaled down by the cluster autoscaler are terminating
+	if node.GetMetadata().GetDeletionTimestamp() != nil {
+		state.Terminating = true
+	}
+	for _, taint := range node.GetSpec().GetTaints() {
+		if taint.GetKey() == "ToBeDeletedByClusterAutoscaler" {
+			state.Terminating = true
+		}
+	}
+
+	state.Excluded = cl.isExcluded(node)
+
+	return
+}
+
+// isExcluded returns true if the node doesn't match the label selector, has one of the excluded taints or opted out with
+// the exclude annotation
+func (cl *kubernetesAPIClientImpl) isExcluded(node *apiv1.Node) bool {
+
+	if node.GetMetadata().GetAnnotations()[excludeNodeAnnotation] == "true" {
+		return true
+	}
+
+	labels := node.GetMetadata().GetLabels()
+	for _, requirement := range cl.labelSelector {
+		value, hasLabel := labels[requirement.Key]
+		switch requirement.Operator {
+		case "=":
+			if !hasLabel || value != requirement.Value {
+				return true
+			}
+		case "!=":
+			if hasLabel && value == requirement.Value {
+				return true
+			}
+		case "exists":
+			if !hasLabel {
+				return true
+			}
+		case "!exists":
+			if hasLabel {
+				return true
+			}
+		}
+	}
+
+	for _, taint := range node.GetSpec().GetTaints() {
+		for _, matcher := range cl.excludedTaints {
+			if taint.GetKey() == matcher.Key &&
+				(matcher.Value == "" || taint.GetValue() == matcher.Value) &&
+				(matcher.Effect == "" || taint.GetEffect() == matcher.Effect) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// parseLabelSelector parses a comma separated equality based label selector like 'key=value,key!=value,key,!key'
+func parseLabelSelector(selector string) (requirements []labelRequirement, err error) {
+
+	requirements = []labelRequirement{}
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var requirement labelRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			keyValue := strings.SplitN(part, "!=", 2)
+			requirement = labelRequirement{Key: keyValue[0], Operator: "!=", Value: keyValue[1]}
+		case strings.Contains(part, "=="):
+			keyValue := strings.SplitN(part, "==", 2)
+			requirement = labelRequirement{Key: keyValue[0], Operator: "=", Value: keyValue[1]}
+		case strings.Contains(part, "="):
+			keyValue := strings.SplitN(part, "=", 2)
+			requirement = labelRequirement{Key: keyValue[0], Operator: "=", Value: keyValue[1]}
+		case strings.HasPrefix(part, "!"):
+			requirement = labelRequirement{Key: strings.TrimPrefix(part, "!"), Operator: "!exists"}
+		default:
+			requirement = labelRequirement{Key: part, Operator: "exists"}
+		}
+
+		requirement.Key = strings.TrimSpace(requirement.Key)
+		requirement.Value = strings.TrimSpace(requirement.Value)
+		if requirement.Key == "" {
+			return nil, fmt.Errorf("Label selector %v has a requirement without key", selector)
+		}
+
+		requirements = append(requirements, requirement)
+	}
+
+	return
+}
+
+// parseTaintMatcher parses a taint in the form of 'key', 'key=value', 'key:effect' or 'key=value:effect'
+func parseTaintMatcher(excludedTaint string) (matcher taintMatcher, err error) {
+
+	taint := strings.TrimSpace(excludedTaint)
+	if i := strings.LastIndex(taint, ":"); i >= 0 {
+		matcher.Effect = taint[i+1:]
+		taint = taint[:i]
+	}
+	if i := strings.Index(taint, "="); i >= 0 {
+		matcher.Value = taint[i+1:]
+		taint = taint[:i]
+	}
+	matcher.Key = taint
+
+	if matcher.Key == "" {
+		err = fmt.Errorf("Excluded taint %v has no key", excludedTaint)
+	}
+
+	return
+}
+
+// watchedResource describes how listThenWatch lists and watches a kind of resource; only the state the controllers
+// care about is kept per object, so other changes to the objects aren't signalled
+type watchedResource struct {
+	// kind is the plural name of the resource, used in the logs and the error metric
+	kind string
+	// object is the name of a single object, used in the logs
+	object string
+	list   func(context.Context) (map[string]interface{}, string, error)
+	watch  func(context.Context, string) (resourceWatcher, error)
+}
+
+// resourceWatcher returns the events of a watch reduced to the state of the objects
+type resourceWatcher interface {
+	Next() (watchEvent, error)
+	Close() error
+}
+
+// watchEvent is a watch event for an object; its state is nil if the object no longer matters to the controllers, for
+// example because it opted out
+type watchEvent struct {
+	Type            string
+	Key             string
+	ResourceVersion string
+	State           interface{}
+}
+
+// listThenWatch lists the objects of a resource and watches them from there, signalling on the changes channel whenever
+// an object is added or removed or its state changes; it resumes the watch from the last seen resource version when it
+// gets disconnected, relists the objects when that resource version has expired, signalling if they changed while not
+// watching, and returns once the context is cancelled
+func listThenWatch(ctx context.Context, resource watchedResource, changes chan<- struct{}) {
+
+	operation := fmt.Sprintf("watch_%v", resource.kind)
+	states := map[string]interface{}{}
+	initialized := false
+	resourceVersion := ""
+
+	for ctx.Err() == nil {
+		// (re)list objects if there's no resource version to resume watching from
+		if resourceVersion == "" {
+			currentStates, listResourceVersion, err := resource.list(ctx)
+			if err != nil {
+				log.Error().Err(err).Msgf("Listing Kubernetes %v before watching failed", resource.kind)
+				sleepWithJitter(ctx, 5)
+				continue
+			}
+
+			if initialized && !statesEqual(states, currentStates) {
+				log.Info().Msgf("Kubernetes %v changed while not watching", resource.kind)
+				notifyChange(changes)
+			}
+
+			states = currentStates
+			initialized = true
+			resourceVersion = listResourceVersion
+		}
+
+		// the watch runs until it's closed by the server or the context is cancelled, so it has no timeout
+		watcher, err := resource.watch(ctx, resourceVersion)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error().Err(err).Msgf("Watching Kubernetes %v from resource version %v failed", resource.kind, resourceVersion)
+			kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": operation}).Inc()
+			if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == 410 {
+				// resource version has expired, relist
+				resourceVersion = ""
+			}
+			sleepWithJitter(ctx, 5)
+			continue
+		}
+
+		for {
+			event, err := watcher.Next()
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Debug().Msgf("Stopped watching Kubernetes %v", resource.kind)
+				} else if err == io.EOF {
+					log.Debug().Msgf("Watch for Kubernetes %v closed at resource version %v, resuming", resource.kind, resourceVersion)
+				} else {
+					log.Warn().Err(err).Msgf("Reading event from Kubernetes %v watch failed, relisting %v", resource.kind, resource.kind)
+					kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": operation}).Inc()
+					resourceVersion = ""
+				}
+				break
+			}
+
+			if event.Type == k8s.EventError {
+				log.Warn().Msgf("Watch for Kubernetes %v returned an error event at resource version %v, relisting %v", resource.kind, resourceVersion, resource.kind)
+				kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": operation}).Inc()
+				resourceVersion = ""
+				break
+			}
+
+			resourceVersion = event.ResourceVersion
+			previousState, exists := states[event.Key]
+
+			if event.Type == k8s.EventDeleted || event.State == nil {
+				if exists {
+					delete(states, event.Key)
+					log.Info().Msgf("%v %v has been removed or no longer applies", resource.object, event.Key)
+					notifyChange(changes)
+				}
+				continue
+			}
+
+			if !exists || event.State != previousState {
+				states[event.Key] = event.State
+				log.Info().Interface("previousState", previousState).Interface("state", event.State).Msgf("%v %v has been added or changed", resource.object, event.Key)
+				notifyChange(changes)
+			}
+		}
+
+		watcher.Close()
+	}
+}
+
+// statesEqual returns true if both maps hold the same objects in the same state
+func statesEqual(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, state := range a {
+		if other, ok := b[key]; !ok || other != state {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyChange signals a change without blocking if a change is already pending
+func notifyChange(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// sleepWithJitter sleeps around the number of seconds, or until the context is cancelled
+func sleepWithJitter(ctx context.Context, seconds int) {
+	select {
+	case <-time.After(time.Duration(applyJitter(seconds)) * time.Second):
+	case <-ctx.Done():
+	}
+}
+
+// GetLease returns the lease stored on the config map along with the config map's resource version, which is empty if
+// the config map doesn't exist yet
+func (cl *kubernetesAPIClientImpl) GetLease(ctx context.Context, namespace, name string) (lease Lease, resourceVersion string, err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, cl.timeout)
+	defer cancel()
+
+	configMap, err := cl.kubeClient.CoreV1().GetConfigMap(ctx, name, namespace)
+	if err != nil {
+		if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == 404 {
+			err = nil
+			return
+		}
+		kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": "get_lease"}).Inc()
+		return
+	}
+
+	resourceVersion = configMap.GetMetadata().GetResourceVersion()
+
+	if value, ok := configMap.GetMetadata().GetAnnotations()[leaseAnnotation]; ok {
+		err = json.Unmarshal([]byte(value), &lease)
+		if err != nil {
+			err = fmt.Errorf("Unmarshal lease on config map %v in namespace %v error:\n%v", name, namespace, err)
+			return
+		}
+	}
+
+	return
+}
+
+// UpdateLease stores the lease on the config map; the update fails with a conflict if the config map changed since the
+// resource version was retrieved, and the config map is created if the resource version is empty
+func (cl *kubernetesAPIClientImpl) UpdateLease(ctx context.Context, namespace, name string, lease Lease, resourceVersion string) (err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, cl.timeout)
+	defer cancel()
+
+	value, err := json.Marshal(lease)
+	if err != nil {
+		return
+	}
+
+	configMap := &apiv1.ConfigMap{
+		Metadata: &metav1.ObjectMeta{
+			Name:      k8s.String(name),
+			Namespace: k8s.String(namespace),
+			Annotations: map[string]string{
+				leaseAnnotation: string(value),
+			},
+		},
+	}
+
+	if resourceVersion == "" {
+		_, err = cl.kubeClient.CoreV1().CreateConfigMap(ctx, configMap)
+	} else {
+		configMap.Metadata.ResourceVersion = k8s.String(resourceVersion)
+		_, err = cl.kubeClient.CoreV1().UpdateConfigMap(ctx, configMap)
+	}
+	if err != nil {
+		kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": "update_lease"}).Inc()
+	}
+
+	return
+}
+
+// CreateEvent publishes an event about the object; the event type is either Normal or Warning and the reason a short
+// CamelCase description like OriginAdded
+func (cl *kubernetesAPIClientImpl) CreateEvent(ctx context.Context, object ObjectReference, eventType, reason, message string) (err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, cl.timeout)
+	defer cancel()
+
+	// events for cluster scoped objects like nodes go into the default namespace
+	namespace := object.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	now := time.Now()
+	seconds := now.Unix()
+	nanos := int32(now.Nanosecond())
+	timestamp := &metav1.Time{
+		Seconds: &seconds,
+		Nanos:   &nanos,
+	}
+	count := int32(1)
+
+	event := &apiv1.Event{
+		Metadata: &metav1.ObjectMeta{
+			Name:      k8s.String(fmt.Sprintf("%v.%x", object.Name, now.UnixNano())),
+			Namespace: k8s.String(namespace),
+		},
+		InvolvedObject: &apiv1.ObjectReference{
+			Kind:       k8s.String(object.Kind),
+			Namespace:  k8s.String(object.Namespace),
+			Name:       k8s.String(object.Name),
+			Uid:        k8s.String(object.UID),
+			ApiVersion: k8s.String("v1"),
+		},
+		Reason:  k8s.String(reason),
+		Message: k8s.String(message),
+		Source: &apiv1.EventSource{
+			Component: k8s.String("estafette-cloudflare-loadbalancer"),
+		},
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          &count,
+		Type:           k8s.String(eventType),
+	}
+
+	_, err = cl.kubeClient.CoreV1().CreateEvent(ctx, event)
+	if err != nil {
+		kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": "create_event"}).Inc()
+	}
+
+	return
+}
+
+// GetServices returns the services in all namespaces that opted in to get a load balancer
+func (cl *kubernetesAPIClientImpl) GetServices(ctx context.Context) (services []Service, err error) {
+
+	kubeServices, err := cl.listServices(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Retrieving Kubernetes services failed")
+		return
+	}
+
+	services = []Service{}
+	for _, service := range kubeServices.Items {
+		if isLoadBalancerService(service) {
+			services = append(services, getService(service))
+		}
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		return getObjectKey(services[i].Namespace, services[i].Name) < getObjectKey(services[j].Namespace, services[j].Name)
+	})
+
+	return
+}
+
+// WatchServices watches services and signals on the changes channel whenever a service opts in or out of getting a load
+// balancer, changes its load balancer annotations or gets removed; like WatchNodes it resumes or relists when the watch
+// gets disconnected, and returns once the context is cancelled
+func (cl *kubernetesAPIClientImpl) WatchServices(ctx context.Context, changes chan<- struct{}) {
+
+	listThenWatch(ctx, watchedResource{
+		kind:   "services",
+		object: "Service",
+		list: func(ctx context.Context) (states map[string]interface{}, resourceVersion string, err error) {
+			kubeServices, err := cl.listServices(ctx)
+			if err != nil {
+				return
+			}
+
+			states = map[string]interface{}{}
+			for _, service := range kubeServices.Items {
+				if isLoadBalancerService(service) {
+					states[getObjectKey(service.GetMetadata().GetNamespace(), service.GetMetadata().GetName())] = getService(service)
+				}
+			}
+
+			return states, kubeServices.GetMetadata().GetResourceVersion(), nil
+		},
+		watch: func(ctx context.Context, resourceVersion string) (resourceWatcher, error) {
+			watcher, err := cl.kubeClient.CoreV1().WatchServices(ctx, k8s.AllNamespaces, k8s.ResourceVersion(resourceVersion))
+			if err != nil {
+				return nil, err
+			}
+			return &serviceWatcher{watcher: watcher}, nil
+		},
+	}, changes)
+}
+
+// serviceWatcher reduces the events of a service watch to the load balancer settings of the services that opted in
+type serviceWatcher struct {
+	watcher *k8s.CoreV1ServiceWatcher
+}
+
+func (w *serviceWatcher) Next() (event watchEvent, err error) {
+
+	kubeEvent, service, err := w.watcher.Next()
+	if err != nil {
+		return
+	}
+
+	event = watchEvent{
+		Type:            kubeEvent.GetType(),
+		Key:             getObjectKey(service.GetMetadata().GetNamespace(), service.GetMetadata().GetName()),
+		ResourceVersion: service.GetMetadata().GetResourceVersion(),
+	}
+	if event.Type != k8s.EventError && isLoadBalancerService(service) {
+		event.State = getService(service)
+	}
+
+	return
+}
+
+func (w *serviceWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// GetServiceNodeNames returns the names of the nodes running the ready endpoints of a service
+func (cl *kubernetesAPIClientImpl) GetServiceNodeNames(ctx context.Context, namespace, name string) (nodeNames []string, err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, cl.timeout)
+	defer cancel()
+
+	nodeNames = []string{}
+
+	endpoints, err := cl.kubeClient.CoreV1().GetEndpoints(ctx, name, namespace)
+	if err != nil {
+		if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == 404 {
+			// the endpoints don't exist until the service has been set up
+			err = nil
+			return
+		}
+		log.Error().Err(err).Msgf("Retrieving endpoints for service %v failed", getObjectKey(namespace, name))
+		kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": "get_endpoints"}).Inc()
+		return
+	}
+
+	for _, subset := range endpoints.GetSubsets() {
+		for _, address := range subset.GetAddresses() {
+			if address.GetNodeName() != "" && !contains(nodeNames, address.GetNodeName()) {
+				nodeNames = append(nodeNames, address.GetNodeName())
 			}
 		}
+	}
+	sort.Strings(nodeNames)
+
+	return
+}
+
+func (cl *kubernetesAPIClientImpl) listServices(ctx context.Context) (*apiv1.ServiceList, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, cl.timeout)
+	defer cancel()
+
+	services, err := cl.kubeClient.CoreV1().ListServices(ctx, k8s.AllNamespaces)
+	if err != nil {
+		kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": "list_services"}).Inc()
+	}
+
+	return services, err
+}
+
+func isLoadBalancerService(service *apiv1.Service) bool {
+	return service.GetMetadata().GetAnnotations()[loadBalancerServiceAnnotation] == "true"
+}
+
+func getService(service *apiv1.Service) Service {
 
-		nodeReady := false
-		for _, condition := range node.Status.Conditions {
-			if *condition.Type == "Ready" && *condition.Status == "True" {
-				nodeReady = true
+	annotations := service.GetMetadata().GetAnnotations()
+
+	return Service{
+		Namespace:   service.GetMetadata().GetNamespace(),
+		Name:        service.GetMetadata().GetName(),
+		Hostname:    strings.TrimSpace(annotations[loadBalancerHostnameServiceAnnotation]),
+		Zone:        strings.TrimSpace(annotations[loadBalancerZoneServiceAnnotation]),
+		MonitorPath: strings.TrimSpace(annotations[loadBalancerMonitorPathServiceAnnotation]),
+	}
+}
+
+func getObjectKey(namespace, name string) string {
+	return fmt.Sprintf("%v/%v", namespace, name)
+}
+
+// GetIngressHosts returns the hosts of the ingresses in all namespaces that opted in to get load balancers
+func (cl *kubernetesAPIClientImpl) GetIngressHosts(ctx context.Context) (hosts []string, err error) {
+
+	ingresses, err := cl.listIngresses(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Retrieving Kubernetes ingresses failed")
+		return
+	}
+
+	hosts = []string{}
+	for _, ingress := range ingresses.Items {
+		if !isLoadBalancerIngress(ingress) {
+			continue
+		}
+		for _, host := range getIngressHosts(ingress) {
+			if !contains(hosts, host) {
+				hosts = append(hosts, host)
 			}
 		}
+	}
+	sort.Strings(hosts)
+
+	return
+}
+
+// WatchIngresses watches ingresses and signals on the changes channel whenever an ingress opts in or out of getting
+// load balancers, changes its hosts or gets removed; like WatchNodes it resumes or relists when the watch gets
+// disconnected, and returns once the context is cancelled
+func (cl *kubernetesAPIClientImpl) WatchIngresses(ctx context.Context, changes chan<- struct{}) {
+
+	listThenWatch(ctx, watchedResource{
+		kind:   "ingresses",
+		object: "Ingress",
+		list: func(ctx context.Context) (states map[string]interface{}, resourceVersion string, err error) {
+			ingresses, err := cl.listIngresses(ctx)
+			if err != nil {
+				return
+			}
+
+			// the hosts of each opted in ingress, joined so they can be compared
+			states = map[string]interface{}{}
+			for _, ingress := range ingresses.Items {
+				if isLoadBalancerIngress(ingress) {
+					states[getObjectKey(ingress.GetMetadata().GetNamespace(), ingress.GetMetadata().GetName())] = strings.Join(getIngressHosts(ingress), ",")
+				}
+			}
+
+			return states, ingresses.GetMetadata().GetResourceVersion(), nil
+		},
+		watch: func(ctx context.Context, resourceVersion string) (resourceWatcher, error) {
+			watcher, err := cl.kubeClient.ExtensionsV1Beta1().WatchIngresses(ctx, k8s.AllNamespaces, k8s.ResourceVersion(resourceVersion))
+			if err != nil {
+				return nil, err
+			}
+			return &ingressWatcher{watcher: watcher}, nil
+		},
+	}, changes)
+}
+
+// ingressWatcher reduces the events of an ingress watch to the joined hosts of the ingresses that opted in
+type ingressWatcher struct {
+	watcher *k8s.ExtensionsV1Beta1IngressWatcher
+}
+
+func (w *ingressWatcher) Next() (event watchEvent, err error) {
+
+	kubeEvent, ingress, err := w.watcher.Next()
+	if err != nil {
+		return
+	}
+
+	event = watchEvent{
+		Type:            kubeEvent.GetType(),
+		Key:             getObjectKey(ingress.GetMetadata().GetNamespace(), ingress.GetMetadata().GetName()),
+		ResourceVersion: ingress.GetMetadata().GetResourceVersion(),
+	}
+	if event.Type != k8s.EventError && isLoadBalancerIngress(ingress) {
+		event.State = strings.Join(getIngressHosts(ingress), ",")
+	}
+
+	return
+}
+
+func (w *ingressWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (cl *kubernetesAPIClientImpl) listIngresses(ctx context.Context) (*extensionsv1beta1.IngressList, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, cl.timeout)
+	defer cancel()
+
+	ingresses, err := cl.kubeClient.ExtensionsV1Beta1().ListIngresses(ctx, k8s.AllNamespaces)
+	if err != nil {
+		kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": "list_ingresses"}).Inc()
+	}
 
-		if !*node.Spec.Unschedulable && nodeReady {
-			nodes = append(nodes, Node{Name: *node.Metadata.Name, ExternalIP: externalIP})
+	return ingresses, err
+}
+
+func isLoadBalancerIngress(ingress *extensionsv1beta1.Ingress) bool {
+	return ingress.GetMetadata().GetAnnotations()[loadBalancerIngressAnnotation] == "true"
+}
+
+// getIngressHosts returns the sorted hosts of the ingress rules
+func getIngressHosts(ingress *extensionsv1beta1.Ingress) (hosts []string) {
+	hosts = []string{}
+	for _, rule := range ingress.GetSpec().GetRules() {
+		host := strings.ToLower(strings.TrimSpace(rule.GetHost()))
+		if host != "" && !contains(hosts, host) {
+			hosts = append(hosts, host)
 		}
 	}
+	sort.Strings(hosts)
+	return
+}
+
+// GetCloudflareLoadBalancers returns the load balancer custom resources in the namespace; the vendored client only
+// supports custom resources per namespace
+func (cl *kubernetesAPIClientImpl) GetCloudflareLoadBalancers(ctx context.Context, namespace string) (resources []CloudflareLoadBalancer, err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, cl.timeout)
+	defer cancel()
+
+	var list cloudflareLoadBalancerList
+	err = cl.kubeClient.ThirdPartyResources(customResourceAPIGroup, customResourceAPIVersion).List(ctx, customResourcePlural, namespace, &list)
+	if err != nil {
+		log.Error().Err(err).Msgf("Retrieving load balancer custom resources in namespace %v failed", namespace)
+		kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": "list_custom_resources"}).Inc()
+		return
+	}
+
+	resources = list.Items
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Metadata.GetName() < resources[j].Metadata.GetName()
+	})
+
+	return
+}
+
+// UpdateCloudflareLoadBalancer replaces the custom resource, to write back its status and finalizers, and returns it as
+// stored; the update fails with a conflict if the resource changed since it was retrieved
+func (cl *kubernetesAPIClientImpl) UpdateCloudflareLoadBalancer(ctx context.Context, resource CloudflareLoadBalancer) (updatedResource CloudflareLoadBalancer, err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, cl.timeout)
+	defer cancel()
+
+	resource.Kind = customResourceKind
+	resource.APIVersion = fmt.Sprintf("%v/%v", customResourceAPIGroup, customResourceAPIVersion)
+
+	err = cl.kubeClient.ThirdPartyResources(customResourceAPIGroup, customResourceAPIVersion).Update(ctx, customResourcePlural, resource.Metadata.GetNamespace(), resource.Metadata.GetName(), &resource, &updatedResource)
+	if err != nil {
+		kubernetesAPIErrorTotals.With(prometheus.Labels{"operation": "update_custom_resource"}).Inc()
+	}
 
 	return
 }
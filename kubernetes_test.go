@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	apiv1 "github.com/ericchiang/k8s/api/v1"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNodeState(t *testing.T) {
+
+	node := func(ready string, unschedulable bool, addresses ...*apiv1.NodeAddress) *apiv1.Node {
+		return &apiv1.Node{
+			Spec: &apiv1.NodeSpec{Unschedulable: k8s.Bool(unschedulable)},
+			Status: &apiv1.NodeStatus{
+				Addresses:  addresses,
+				Conditions: []*apiv1.NodeCondition{{Type: k8s.String("Ready"), Status: k8s.String(ready)}},
+			},
+		}
+	}
+	address := func(addressType, ip string) *apiv1.NodeAddress {
+		return &apiv1.NodeAddress{Type: k8s.String(addressType), Address: k8s.String(ip)}
+	}
+	deletedNode := node("True", false, address("ExternalIP", "203.0.113.1"))
+	deletionSeconds := int64(1)
+	deletedNode.Metadata = &metav1.ObjectMeta{DeletionTimestamp: &metav1.Time{Seconds: &deletionSeconds}}
+	scaledDownNode := node("True", false, address("ExternalIP", "203.0.113.1"))
+	scaledDownNode.Spec.Taints = []*apiv1.Taint{{Key: k8s.String("ToBeDeletedByClusterAutoscaler"), Effect: k8s.String("NoSchedule")}}
+
+	tests := []struct {
+		name          string
+		node          *apiv1.Node
+		expectedState nodeState
+	}{
+		{"ReturnsReadyNodeWithExternalIP", node("True", false, address("InternalIP", "10.0.0.1"), address("ExternalIP", "203.0.113.1")), nodeState{Ready: true, ExternalIP: "203.0.113.1"}},
+		{"ReturnsNotReadyNode", node("False", false, address("ExternalIP", "203.0.113.1")), nodeState{ExternalIP: "203.0.113.1"}},
+		{"ReturnsCordonedNode", node("True", true, address("ExternalIP", "203.0.113.1")), nodeState{Ready: true, Unschedulable: true, ExternalIP: "203.0.113.1"}},
+		{"ReturnsTerminatingNodeForDeletedNode", deletedNode, nodeState{Ready: true, Terminating: true, ExternalIP: "203.0.113.1"}},
+		{"ReturnsTerminatingNodeForNodeScaledDownByClusterAutoscaler", scaledDownNode, nodeState{Ready: true, Terminating: true, ExternalIP: "203.0.113.1"}},
+		{"ReturnsNodeWithoutExternalIP", node("True", false, address("InternalIP", "10.0.0.1")), nodeState{Ready: true}},
+		{"ReturnsEmptyStateForNodeWithoutSpecOrStatus", &apiv1.Node{}, nodeState{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := &kubernetesAPIClientImpl{}
+
+			// act
+			state := cl.getNodeState(tt.node)
+
+			assert.Equal(t, tt.expectedState, state)
+		})
+	}
+}
+
+func TestStatesEqual(t *testing.T) {
+
+	ready := nodeState{Ready: true, ExternalIP: "203.0.113.1"}
+
+	tests := []struct {
+		name     string
+		a        map[string]interface{}
+		b        map[string]interface{}
+		expected bool
+	}{
+		{"ReturnsTrueForSameStates", map[string]interface{}{"a": ready}, map[string]interface{}{"a": ready}, true},
+		{"ReturnsFalseForAddedNode", map[string]interface{}{"a": ready}, map[string]interface{}{"a": ready, "b": ready}, false},
+		{"ReturnsFalseForRenamedNode", map[string]interface{}{"a": ready}, map[string]interface{}{"b": ready}, false},
+		{"ReturnsFalseForChangedState", map[string]interface{}{"a": ready}, map[string]interface{}{"a": nodeState{ExternalIP: "203.0.113.1"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			equal := statesEqual(tt.a, tt.b)
+
+			assert.Equal(t, tt.expected, equal)
+		})
+	}
+}
+
+func TestNotifyChange(t *testing.T) {
+
+	t.Run("KeepsSingleChangePendingWithoutBlocking", func(t *testing.T) {
+
+		changes := make(chan struct{}, 1)
+
+		// act
+		notifyChange(changes)
+		notifyChange(changes)
+
+		assert.Equal(t, 1, len(changes))
+	})
+}
+
+func TestListThenWatch(t *testing.T) {
+
+	tests := []struct {
+		name            string
+		events          []watchEvent
+		expectedChanges int
+	}{
+		{"SignalsAddedObject", []watchEvent{{Type: k8s.EventAdded, Key: "b", ResourceVersion: "2", State: "b1"}}, 1},
+		{"SignalsChangedState", []watchEvent{{Type: k8s.EventModified, Key: "a", ResourceVersion: "2", State: "a2"}}, 1},
+		{"IgnoresUnchangedState", []watchEvent{{Type: k8s.EventModified, Key: "a", ResourceVersion: "2", State: "a1"}}, 0},
+		{"SignalsRemovedObject", []watchEvent{{Type: k8s.EventDeleted, Key: "a", ResourceVersion: "2", State: "a1"}}, 1},
+		{"SignalsObjectThatNoLongerApplies", []watchEvent{{Type: k8s.EventModified, Key: "a", ResourceVersion: "2"}}, 1},
+		{"IgnoresObjectThatNeverApplied", []watchEvent{{Type: k8s.EventModified, Key: "b", ResourceVersion: "2"}}, 0},
+		{"SignalsEachChange", []watchEvent{
+			{Type: k8s.EventModified, Key: "a", ResourceVersion: "2", State: "a2"},
+			{Type: k8s.EventModified, Key: "a", ResourceVersion: "3", State: "a2"},
+			{Type: k8s.EventDeleted, Key: "a", ResourceVersion: "4", State: "a2"},
+		}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			ctx, cancel := context.WithCancel(context.Background())
+			watcher := &fakeResourceWatcher{ctx: ctx, events: tt.events, drained: make(chan struct{})}
+			resource := watchedResource{
+				kind:   "things",
+				object: "Thing",
+				list: func(ctx context.Context) (map[string]interface{}, string, error) {
+					return map[string]interface{}{"a": "a1"}, "1", nil
+				},
+				watch: func(ctx context.Context, resourceVersion string) (resourceWatcher, error) {
+					return watcher, nil
+				},
+			}
+			changes := make(chan struct{}, 10)
+			done := make(chan struct{})
+
+			// act
+			go func() {
+				listThenWatch(ctx, resource, changes)
+				close(done)
+			}()
+			<-watcher.drained
+			cancel()
+			<-done
+
+			assert.Equal(t, tt.expectedChanges, len(changes))
+		})
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+
+	node := func(labels, annotations map[string]string, taints ...*apiv1.Taint) *apiv1.Node {
+		return &apiv1.Node{
+			Metadata: &metav1.ObjectMeta{Labels: labels, Annotations: annotations},
+			Spec:     &apiv1.NodeSpec{Taints: taints},
+		}
+	}
+	taint := func(key, value, effect string) *apiv1.Taint {
+		return &apiv1.Taint{Key: k8s.String(key), Value: k8s.String(value), Effect: k8s.String(effect)}
+	}
+	ingressPool := map[string]string{"pool": "ingress"}
+
+	tests := []struct {
+		name           string
+		labelSelector  string
+		excludedTaints []string
+		node           *apiv1.Node
+		excluded       bool
+	}{
+		{"IncludesNodeWithoutSelectorOrTaints", "", nil, node(nil, nil), false},
+		{"IncludesNodeMatchingSelector", "pool=ingress", nil, node(ingressPool, nil), false},
+		{"ExcludesNodeNotMatchingSelector", "pool=ingress", nil, node(map[string]string{"pool": "batch"}, nil), true},
+		{"ExcludesNodeWithoutSelectedLabel", "pool", nil, node(nil, nil), true},
+		{"ExcludesNodeWithNegatedLabel", "!batch", nil, node(map[string]string{"batch": "true"}, nil), true},
+		{"ExcludesNodeWithExcludedTaint", "", []string{"dedicated=batch:NoSchedule"}, node(nil, nil, taint("dedicated", "batch", "NoSchedule")), true},
+		{"IncludesNodeWithTaintOfOtherValue", "", []string{"dedicated=batch:NoSchedule"}, node(nil, nil, taint("dedicated", "ingress", "NoSchedule")), false},
+		{"ExcludesNodeWithExcludedTaintKey", "", []string{"dedicated"}, node(nil, nil, taint("dedicated", "ingress", "NoExecute")), true},
+		{"ExcludesNodeWithExcludeAnnotation", "pool=ingress", nil, node(ingressPool, map[string]string{excludeNodeAnnotation: "true"}), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			labelSelector, err := parseLabelSelector(tt.labelSelector)
+			assert.Nil(t, err)
+			excludedTaints := []taintMatcher{}
+			for _, excludedTaint := range tt.excludedTaints {
+				matcher, err := parseTaintMatcher(excludedTaint)
+				assert.Nil(t, err)
+				excludedTaints = append(excludedTaints, matcher)
+			}
+			cl := &kubernetesAPIClientImpl{labelSelector: labelSelector, excludedTaints: excludedTaints}
+
+			// act
+			excluded := cl.isExcluded(tt.node)
+
+			assert.Equal(t, tt.excluded, excluded)
+		})
+	}
+}
+
+func TestParseLabelSelector(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		selector     string
+		requirements []labelRequirement
+		valid        bool
+	}{
+		{"ReturnsNoRequirementsForEmptySelector", "", []labelRequirement{}, true},
+		{"ReturnsEqualityRequirement", "cloud.google.com/gke-nodepool=ingress", []labelRequirement{{Key: "cloud.google.com/gke-nodepool", Operator: "=", Value: "ingress"}}, true},
+		{"ReturnsEqualityRequirementForDoubleEquals", "pool==ingress", []labelRequirement{{Key: "pool", Operator: "=", Value: "ingress"}}, true},
+		{"ReturnsInequalityRequirement", "pool!=batch", []labelRequirement{{Key: "pool", Operator: "!=", Value: "batch"}}, true},
+		{"ReturnsExistsRequirement", "ingress", []labelRequirement{{Key: "ingress", Operator: "exists"}}, true},
+		{"ReturnsNotExistsRequirement", "!batch", []labelRequirement{{Key: "batch", Operator: "!exists"}}, true},
+		{"ReturnsEmptyValueRequirement", "pool=", []labelRequirement{{Key: "pool", Operator: "=", Value: ""}}, true},
+		{"ReturnsAllRequirementsTrimmed", " pool = ingress , !batch ,", []labelRequirement{{Key: "pool", Operator: "=", Value: "ingress"}, {Key: "batch", Operator: "!exists"}}, true},
+		{"ReturnsErrorForRequirementWithoutKey", "=ingress", nil, false},
+		{"ReturnsErrorForNegationWithoutKey", "pool=ingress,!", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			requirements, err := parseLabelSelector(tt.selector)
+
+			if tt.valid {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.requirements, requirements)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestParseTaintMatcher(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		taint   string
+		matcher taintMatcher
+		valid   bool
+	}{
+		{"ReturnsKey", "dedicated", taintMatcher{Key: "dedicated"}, true},
+		{"ReturnsKeyAndValue", "dedicated=batch", taintMatcher{Key: "dedicated", Value: "batch"}, true},
+		{"ReturnsKeyAndEffect", "dedicated:NoSchedule", taintMatcher{Key: "dedicated", Effect: "NoSchedule"}, true},
+		{"ReturnsKeyValueAndEffect", "dedicated=batch:NoSchedule", taintMatcher{Key: "dedicated", Value: "batch", Effect: "NoSchedule"}, true},
+		{"ReturnsKeyWithPrefix", " node.kubernetes.io/unschedulable:NoSchedule ", taintMatcher{Key: "node.kubernetes.io/unschedulable", Effect: "NoSchedule"}, true},
+		{"ReturnsErrorWithoutKey", "=batch:NoSchedule", taintMatcher{}, false},
+		{"ReturnsErrorForEmptyTaint", "", taintMatcher{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			matcher, err := parseTaintMatcher(tt.taint)
+
+			if tt.valid {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.matcher, matcher)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestGetIngressHosts(t *testing.T) {
+
+	t.Run("ReturnsDistinctLowercaseHostsInOrder", func(t *testing.T) {
+
+		ingress := &extensionsv1beta1.Ingress{
+			Spec: &extensionsv1beta1.IngressSpec{
+				Rules: []*extensionsv1beta1.IngressRule{
+					{Host: k8s.String("www.example.com")},
+					{Host: k8s.String(" API.example.com ")},
+					{Host: k8s.String("www.example.com")},
+					{},
+				},
+			},
+		}
+
+		// act
+		hosts := getIngressHosts(ingress)
+
+		assert.Equal(t, []string{"api.example.com", "www.example.com"}, hosts)
+	})
+}
+
+// fakeResourceWatcher returns its events and then blocks until the context is cancelled
+type fakeResourceWatcher struct {
+	ctx     context.Context
+	events  []watchEvent
+	drained chan struct{}
+}
+
+func (w *fakeResourceWatcher) Next() (watchEvent, error) {
+	if len(w.events) > 0 {
+		event := w.events[0]
+		w.events = w.events[1:]
+		return event, nil
+	}
+	close(w.drained)
+	<-w.ctx.Done()
+	return watchEvent{}, w.ctx.Err()
+}
+
+func (w *fakeResourceWatcher) Close() error {
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/rs/zerolog/log"
+)
+
+// LeaderElector makes sure only one replica reconciles the load balancers at a time, by holding a lease stored on a
+// config map
+type LeaderElector interface {
+	Run(context.Context, func(context.Context))
+}
+
+type leaderElectorImpl struct {
+	k8sAPIClient  KubernetesAPIClient
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	// the lease as last seen and the local time it was seen at; expiry is based on the local time rather than the
+	// renew time written by the holder, so clock skew between replicas doesn't matter
+	observedLease Lease
+	observedTime  time.Time
+
+	waitGroup *sync.WaitGroup
+}
+
+// NewLeaderElector returns an instance of LeaderElector; the leader renews its lease every retry period and stops
+// leading if it couldn't renew it within the renew deadline, well before other replicas consider it expired after the
+// lease duration
+func NewLeaderElector(k8sAPIClient KubernetesAPIClient, namespace, name, identity string, leaseDuration, renewDeadline, retryPeriod time.Duration, waitGroup *sync.WaitGroup) LeaderElector {
+
+	// return instance of LeaderElector
+	return &leaderElectorImpl{
+		k8sAPIClient:  k8sAPIClient,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewDeadline: renewDeadline,
+		retryPeriod:   retryPeriod,
+		waitGroup:     waitGroup,
+	}
+}
+
+// Run campaigns for leadership until the context is cancelled; while leading it runs onStartedLeading with a context
+// that is cancelled once leadership is lost, and only gives up the lease after onStartedLeading has returned
+func (le *leaderElectorImpl) Run(ctx context.Context, onStartedLeading func(context.Context)) {
+
+	le.waitGroup.Add(1)
+
+	go func() {
+		defer le.waitGroup.Done()
+
+		for ctx.Err() == nil {
+			if !le.acquire(ctx) {
+				return
+			}
+
+			log.Info().Msgf("Acquired leader lease %v/%v as %v", le.namespace, le.name, le.identity)
+			leaderGauge.Set(1)
+
+			leaderCtx, cancelLeading := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				onStartedLeading(leaderCtx)
+			}()
+
+			le.renew(leaderCtx)
+			cancelLeading()
+			<-done
+
+			leaderGauge.Set(0)
+			log.Info().Msgf("Stopped leading as %v", le.identity)
+
+			le.release()
+		}
+	}()
+}
+
+// acquire blocks until the lease is acquired, or returns false when the context is cancelled
+func (le *leaderElectorImpl) acquire(ctx context.Context) bool {
+
+	log.Info().Msgf("Waiting to acquire leader lease %v/%v as %v...", le.namespace, le.name, le.identity)
+
+	for {
+		if le.tryAcquireOrRenew(ctx) {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(le.retryPeriod):
+		}
+	}
+}
+
+// renew blocks while the lease gets renewed, and returns once it couldn't be renewed within the renew deadline, another
+// replica took it over or the context is cancelled
+func (le *leaderElectorImpl) renew(ctx context.Context) {
+
+	lastRenewed := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(le.retryPeriod):
+		}
+
+		if le.tryAcquireOrRenew(ctx) {
+			lastRenewed = time.Now()
+			continue
+		}
+
+		if le.observedLease.HolderIdentity != le.identity {
+			log.Warn().Msgf("Leader lease %v/%v has been taken over by %v", le.namespace, le.name, le.observedLease.HolderIdentity)
+			return
+		}
+		if time.Since(lastRenewed) > le.renewDeadline {
+			log.Warn().Msgf("Failed renewing leader lease %v/%v within %v", le.namespace, le.name, le.renewDeadline)
+			return
+		}
+	}
+}
+
+// release gives up the lease if it's still held, so another replica can take over right away instead of waiting for
+// it to expire
+func (le *leaderElectorImpl) release() {
+
+	// the context is probably cancelled already because of shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), le.renewDeadline)
+	defer cancel()
+
+	lease, resourceVersion, err := le.k8sAPIClient.GetLease(ctx, le.namespace, le.name)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Retrieving leader lease %v/%v for releasing it failed", le.namespace, le.name)
+		return
+	}
+	if lease.HolderIdentity != le.identity {
+		return
+	}
+
+	err = le.k8sAPIClient.UpdateLease(ctx, le.namespace, le.name, Lease{
+		LeaseDurationSeconds: 1,
+		RenewTime:            time.Now().UTC(),
+	}, resourceVersion)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Releasing leader lease %v/%v failed", le.namespace, le.name)
+		return
+	}
+
+	log.Info().Msgf("Released leader lease %v/%v", le.namespace, le.name)
+}
+
+// tryAcquireOrRenew takes the lease if it's free or expired, or renews it if it's already held
+func (le *leaderElectorImpl) tryAcquireOrRenew(ctx context.Context) bool {
+
+	now := time.Now()
+
+	lease, resourceVersion, err := le.k8sAPIClient.GetLease(ctx, le.namespace, le.name)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Retrieving leader lease %v/%v failed", le.namespace, le.name)
+		return false
+	}
+
+	if lease.HolderIdentity != le.observedLease.HolderIdentity || !lease.RenewTime.Equal(le.observedLease.RenewTime) {
+		le.observedLease = lease
+		le.observedTime = now
+	}
+
+	if lease.HolderIdentity != "" && lease.HolderIdentity != le.identity && now.Before(le.observedTime.Add(time.Duration(lease.LeaseDurationSeconds)*time.Second)) {
+		return false
+	}
+
+	desiredLease := Lease{
+		HolderIdentity:       le.identity,
+		LeaseDurationSeconds: int(le.leaseDuration.Seconds()),
+		AcquireTime:          now.UTC(),
+		RenewTime:            now.UTC(),
+	}
+	if lease.HolderIdentity == le.identity {
+		desiredLease.AcquireTime = lease.AcquireTime
+	}
+
+	err = le.k8sAPIClient.UpdateLease(ctx, le.namespace, le.name, desiredLease, resourceVersion)
+	if err != nil {
+		if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == 409 {
+			log.Debug().Msgf("Leader lease %v/%v got updated by another replica", le.namespace, le.name)
+		} else {
+			log.Warn().Err(err).Msgf("Updating leader lease %v/%v failed", le.namespace, le.name)
+		}
+		return false
+	}
+
+	le.observedLease = desiredLease
+	le.observedTime = now
+
+	return true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTryAcquireOrRenew(t *testing.T) {
+
+	renewTime := time.Now().UTC().Add(-5 * time.Second)
+	acquireTime := time.Now().UTC().Add(-time.Hour)
+
+	tests := []struct {
+		name           string
+		lease          Lease
+		observedSince  time.Duration
+		updateErr      error
+		acquired       bool
+		expectedHolder string
+	}{
+		{"AcquiresFreeLease", Lease{}, 0, nil, true, "pod-a"},
+		{"AcquiresExpiredLeaseOfOtherPod", Lease{HolderIdentity: "pod-b", LeaseDurationSeconds: 15, RenewTime: renewTime}, time.Minute, nil, true, "pod-a"},
+		{"DoesNotAcquireLeaseHeldByOtherPod", Lease{HolderIdentity: "pod-b", LeaseDurationSeconds: 15, RenewTime: renewTime}, 0, nil, false, "pod-b"},
+		{"RenewsOwnLease", Lease{HolderIdentity: "pod-a", LeaseDurationSeconds: 15, AcquireTime: acquireTime, RenewTime: renewTime}, 0, nil, true, "pod-a"},
+		{"FailsWhenLeaseGotUpdatedByOtherPod", Lease{}, 0, &k8s.APIError{Code: 409}, false, ""},
+		{"FailsWhenUpdatingLeaseFails", Lease{HolderIdentity: "pod-a", LeaseDurationSeconds: 15, RenewTime: renewTime}, 0, fmt.Errorf("connection refused"), false, "pod-a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			k8sAPIClient := &fakeLeaseAPIClient{lease: tt.lease, updateErr: tt.updateErr}
+			le := newTestLeaderElector(k8sAPIClient)
+			if tt.observedSince > 0 {
+				le.observedLease = tt.lease
+				le.observedTime = time.Now().Add(-tt.observedSince)
+			}
+
+			// act
+			acquired := le.tryAcquireOrRenew(context.Background())
+
+			assert.Equal(t, tt.acquired, acquired)
+			assert.Equal(t, tt.expectedHolder, k8sAPIClient.lease.HolderIdentity)
+		})
+	}
+
+	t.Run("KeepsAcquireTimeWhenRenewing", func(t *testing.T) {
+
+		k8sAPIClient := &fakeLeaseAPIClient{lease: Lease{HolderIdentity: "pod-a", LeaseDurationSeconds: 15, AcquireTime: acquireTime, RenewTime: renewTime}}
+		le := newTestLeaderElector(k8sAPIClient)
+
+		// act
+		le.tryAcquireOrRenew(context.Background())
+
+		assert.True(t, acquireTime.Equal(k8sAPIClient.lease.AcquireTime))
+		assert.True(t, k8sAPIClient.lease.RenewTime.After(renewTime))
+	})
+}
+
+func TestRenew(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		takeOver  bool
+		updateErr error
+	}{
+		{"StopsLeadingWhenRenewingFailsPastDeadline", false, fmt.Errorf("connection refused")},
+		{"StopsLeadingWhenLeaseIsTakenOver", true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			k8sAPIClient := &fakeLeaseAPIClient{}
+			le := newTestLeaderElector(k8sAPIClient)
+			assert.True(t, le.tryAcquireOrRenew(context.Background()))
+			k8sAPIClient.setUpdateErr(tt.updateErr)
+			if tt.takeOver {
+				k8sAPIClient.setLease(Lease{HolderIdentity: "pod-b", LeaseDurationSeconds: 15, RenewTime: time.Now().UTC()})
+			}
+
+			stopped := make(chan struct{})
+
+			// act
+			go func() {
+				le.renew(context.Background())
+				close(stopped)
+			}()
+
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				assert.Fail(t, "Still leading after losing the lease")
+			}
+		})
+	}
+}
+
+func TestLeaderElectorRun(t *testing.T) {
+
+	t.Run("ReleasesLeaseOnceDoneLeading", func(t *testing.T) {
+
+		k8sAPIClient := &fakeLeaseAPIClient{}
+		le := newTestLeaderElector(k8sAPIClient)
+		ctx, cancel := context.WithCancel(context.Background())
+		led := false
+
+		// act
+		le.Run(ctx, func(leaderCtx context.Context) {
+			led = true
+			cancel()
+		})
+
+		le.waitGroup.Wait()
+		assert.True(t, led)
+		assert.Equal(t, "", k8sAPIClient.lease.HolderIdentity)
+		assert.Equal(t, 1, k8sAPIClient.lease.LeaseDurationSeconds)
+	})
+}
+
+// newTestLeaderElector returns a leader elector for pod-a that retries every 10 milliseconds
+func newTestLeaderElector(k8sAPIClient KubernetesAPIClient) *leaderElectorImpl {
+	return NewLeaderElector(k8sAPIClient, "estafette", "estafette-cloudflare-loadbalancer", "pod-a", 15*time.Second, 50*time.Millisecond, 10*time.Millisecond, &sync.WaitGroup{}).(*leaderElectorImpl)
+}
+
+// fakeLeaseAPIClient stores the lease in memory and rejects updates for an outdated resource version like the
+// Kubernetes API does; calls unrelated to the lease aren't supported
+type fakeLeaseAPIClient struct {
+	KubernetesAPIClient
+
+	mutex           sync.Mutex
+	lease           Lease
+	resourceVersion int
+	updateErr       error
+}
+
+func (cl *fakeLeaseAPIClient) GetLease(ctx context.Context, namespace, name string) (Lease, string, error) {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	return cl.lease, strconv.Itoa(cl.resourceVersion), nil
+}
+
+func (cl *fakeLeaseAPIClient) UpdateLease(ctx context.Context, namespace, name string, lease Lease, resourceVersion string) error {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if cl.updateErr != nil {
+		return cl.updateErr
+	}
+	if resourceVersion != strconv.Itoa(cl.resourceVersion) {
+		return &k8s.APIError{Code: 409}
+	}
+
+	cl.lease = lease
+	cl.resourceVersion++
+
+	return nil
+}
+
+func (cl *fakeLeaseAPIClient) setLease(lease Lease) {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.lease = lease
+	cl.resourceVersion++
+}
+
+func (cl *fakeLeaseAPIClient) setUpdateErr(err error) {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.updateErr = err
+}
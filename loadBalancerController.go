@@ -1,104 +1,200 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/rs/zerolog/log"
 )
 
+// reconcileRetryDelaySeconds is how long to wait before reconciling again after a retryable Cloudflare API failure
+const reconcileRetryDelaySeconds = 60
+
 // LoadBalancerController orchestrates the load balancer update process
 type LoadBalancerController interface {
-	Init(string, string, string, string) error
-	InitDns(string, string) error
-	InitMonitor(string, string, string) error
-	InitPool(string) error
-	InitLoadBalancer(string, string) error
-	RefreshLoadBalancerOnChanges(string) error
-	RefreshLoadBalancerOnInterval(string, string, string, int) error
+	Init(context.Context) error
+	InitDns(context.Context) error
+	InitMonitor(context.Context) error
+	InitPool(context.Context) error
+	InitLoadBalancer(context.Context) error
+	RefreshLoadBalancerOnChanges(context.Context, NodeChangeNotifier) error
+	RefreshLoadBalancerOnInterval(context.Context, int) error
+	Run(context.Context)
+	EnqueueReconcile(string)
+	Teardown(context.Context) error
 }
 
 type loadBalancerControllerImpl struct {
 	k8sAPIClient KubernetesAPIClient
 	cfAPIClient  CloudflareAPIClient
 	nodes        map[string]Node
-	lbType       string
+	config       LoadBalancerConfig
+	queue        chan string
+
+	drainingSince map[string]time.Time
+
+	// initialized is set once all Cloudflare objects have been set up; until then each reconcile sets up all of them
+	initialized bool
+
+	// labels of the origin enabled gauges set by the previous reconcile, to remove the ones for departed origins
+	originGaugeLabels []prometheus.Labels
 
 	monitor      cloudflare.LoadBalancerMonitor
-	pool         cloudflare.LoadBalancerPool
+	pools        []cloudflare.LoadBalancerPool
 	loadbalancer cloudflare.LoadBalancer
+	dnsRecords   []cloudflare.DNSRecord
 
-	waitGroup *sync.WaitGroup
+	healthChecker HealthChecker
+	eventRecorder EventRecorder
+	planStore     PlanStore
+	waitGroup     *sync.WaitGroup
 }
 
-// NewLoadBalancerController returns an instance of LoadBalancerController
-func NewLoadBalancerController(key, email, organizationID, lbType string, waitGroup *sync.WaitGroup) (LoadBalancerController, error) {
+// NewLoadBalancerController returns an instance of LoadBalancerController; the plan store is only set in dry-run mode,
+// to keep the changes each reconcile would have made
+func NewLoadBalancerController(k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, config LoadBalancerConfig, healthChecker HealthChecker, eventRecorder EventRecorder, planStore PlanStore, waitGroup *sync.WaitGroup) LoadBalancerController {
 
-	k8sAPIClient, err := NewKubernetesAPIClient()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed creating Kubernetes api client")
-		return nil, err
+	// return instance of LoadBalancerController
+	return &loadBalancerControllerImpl{
+		k8sAPIClient:  k8sAPIClient,
+		cfAPIClient:   cfAPIClient,
+		nodes:         make(map[string]Node),
+		config:        config,
+		queue:         make(chan string, 1),
+		drainingSince: make(map[string]time.Time),
+		healthChecker: healthChecker,
+		eventRecorder: eventRecorder,
+		planStore:     planStore,
+		waitGroup:     waitGroup,
 	}
+}
 
-	cfAPIClient, err := NewCloudflareAPIClient(key, email, organizationID)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed creating Cloudflare api client")
-		return nil, err
-	}
+func (ctl *loadBalancerControllerImpl) Init(ctx context.Context) (err error) {
 
-	// return instance of CloudflareAPIClient
-	return &loadBalancerControllerImpl{
-		k8sAPIClient: k8sAPIClient,
-		cfAPIClient:  cfAPIClient,
-		nodes:        make(map[string]Node),
-		lbType:       lbType,
-		waitGroup:    waitGroup,
-	}, nil
+	ctx, plan := ctl.startPlan(ctx)
+
+	start := time.Now()
+	defer func() {
+		ctl.finishPlan(plan, err)
+		ctl.healthChecker.InitFinished(ctl.config.Hostname(), err)
+		ctl.observeReconcile(start, err)
+		// a dry-run instance doesn't publish events, so it can run next to the replicas applying changes
+		if err != nil && ctx.Err() == nil && ctl.planStore == nil {
+			ctl.eventRecorder.ControllerEvent(ctx, eventTypeWarning, "InitFailed", fmt.Sprintf("Initializing load balancer %v failed: %v", ctl.config.Hostname(), err))
+		}
+		ctl.retryOnFailure(ctx, err, "failed initialization")
+	}()
+
+	err = ctl.initialize(ctx)
+
+	return
 }
 
-func (ctl *loadBalancerControllerImpl) Init(poolName, lbName, zoneName, monitorPath string) (err error) {
+// initialize sets up all Cloudflare objects of the load balancer
+func (ctl *loadBalancerControllerImpl) initialize(ctx context.Context) (err error) {
 
-	if ctl.lbType == "dns" {
+	if ctl.config.Type == "dns" {
 
-		err = ctl.InitDns(lbName, zoneName)
+		err = ctl.InitDns(ctx)
 		if err != nil {
 			return
 		}
 
-	} else if ctl.lbType == "lb" {
+	} else if ctl.config.Type == "lb" {
 
-		err = ctl.InitMonitor(poolName, zoneName, monitorPath)
+		err = ctl.InitMonitor(ctx)
 		if err != nil {
 			return
 		}
 
-		err = ctl.InitPool(poolName)
+		err = ctl.InitPool(ctx)
 		if err != nil {
 			return
 		}
 
-		err = ctl.InitLoadBalancer(lbName, zoneName)
+		err = ctl.InitLoadBalancer(ctx)
 		if err != nil {
 			return
 		}
 
 	}
 
+	ctl.initialized = true
+
 	return
 }
 
-func (ctl *loadBalancerControllerImpl) InitDns(lbName, zoneName string) (err error) {
+func (ctl *loadBalancerControllerImpl) InitDns(ctx context.Context) (err error) {
+
+	allNodes, _, err := ctl.getNodes(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed retrieving Kubernetes nodes")
+		return
+	}
+
+	nodes := []Node{}
+	for _, node := range allNodes {
+		if node.IsHealthy() {
+			nodes = append(nodes, node)
+		}
+	}
+
+	// copy nodes into map, dropping departed nodes
+	ctl.nodes = make(map[string]Node)
+	for _, node := range nodes {
+		ctl.nodes[node.Name] = node
+	}
+
+	currentRecords, err := ctl.cfAPIClient.GetDNSRecords(ctx, ctl.config.Name, ctl.config.Zone)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed retrieving Cloudflare dns records")
+		return
+	}
+
+	currentIPs := []string{}
+	for _, record := range currentRecords {
+		currentIPs = append(currentIPs, record.Content)
+	}
+	desiredIPs := []string{}
+	for _, node := range nodes {
+		if node.ExternalIP != "" {
+			desiredIPs = append(desiredIPs, node.ExternalIP)
+		}
+	}
+
+	desiredOriginsGauge.With(prometheus.Labels{"pool": ctl.config.Hostname()}).Set(float64(len(desiredIPs)))
+	actualOriginsGauge.With(prometheus.Labels{"pool": ctl.config.Hostname()}).Set(float64(len(currentIPs)))
+
+	err = ctl.checkOriginChanges(currentIPs, desiredIPs)
+	if err != nil {
+		return
+	}
+
+	// set dns records <lbName>.<zoneName> for each node; remove ones that no longer point to an existing node
+	ctl.dnsRecords, err = ctl.cfAPIClient.GetOrCreateDNSRecords(ctx, ctl.config.Name, ctl.config.Zone, nodes)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed updating Cloudflare dns records")
+		return
+	}
+
+	actualOriginsGauge.With(prometheus.Labels{"pool": ctl.config.Hostname()}).Set(float64(len(ctl.dnsRecords)))
 
-	// todo set dns records <lbName>.<zoneName> for each node; remove ones that no longer point to an existing node
+	// in dry-run mode nothing changed, so there's nothing to publish
+	if ctl.planStore == nil {
+		ctl.recordDNSRecordEvents(ctx, currentIPs, ctl.dnsRecords, allNodes)
+	}
 
 	return
 }
 
-func (ctl *loadBalancerControllerImpl) InitMonitor(poolName, zoneName, monitorPath string) (err error) {
+func (ctl *loadBalancerControllerImpl) InitMonitor(ctx context.Context) (err error) {
 
-	ctl.monitor, err = ctl.cfAPIClient.GetOrCreateLoadBalancerMonitor(poolName, zoneName, monitorPath)
+	ctl.monitor, err = ctl.cfAPIClient.GetOrCreateLoadBalancerMonitor(ctx, ctl.config.Pool.Name, ctl.config.Zone, ctl.config.Monitor.ToLoadBalancerMonitor())
 	if err != nil {
 		log.Error().Err(err).Msg("Failed creating Cloudflare load balancer monitor")
 		return
@@ -107,31 +203,324 @@ func (ctl *loadBalancerControllerImpl) InitMonitor(poolName, zoneName, monitorPa
 	return
 }
 
-func (ctl *loadBalancerControllerImpl) InitPool(poolName string) (err error) {
+func (ctl *loadBalancerControllerImpl) InitPool(ctx context.Context) (err error) {
 
-	nodes, err := ctl.k8sAPIClient.GetHealthyNodes()
+	nodes, clusterNodes, err := ctl.getNodes(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed retrieving Kubernetes nodes")
 		return
 	}
 
-	// copy nodes into map
+	// copy healthy nodes into map, dropping departed nodes
+	ctl.nodes = make(map[string]Node)
 	for _, node := range nodes {
-		ctl.nodes[node.Name] = node
+		if node.IsHealthy() {
+			ctl.nodes[node.Name] = node
+		}
+	}
+
+	currentPools, err := ctl.cfAPIClient.GetLoadBalancerPools(ctx, ctl.config.Pool.Name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed retrieving Cloudflare load balancer pools")
+		return
+	}
+
+	poolNodes := ctl.getPoolNodes(nodes, currentPools)
+
+	currentOrigins := []string{}
+	for _, pool := range currentPools {
+		if !pool.Enabled {
+			continue
+		}
+		for _, origin := range pool.Origins {
+			if origin.Enabled {
+				currentOrigins = append(currentOrigins, origin.Name)
+			}
+		}
+	}
+	desiredOrigins := []string{}
+	for _, node := range poolNodes {
+		if !node.Draining {
+			desiredOrigins = append(desiredOrigins, node.Name)
+		}
+	}
+
+	desiredOriginsGauge.With(prometheus.Labels{"pool": ctl.config.Pool.Name}).Set(float64(len(desiredOrigins)))
+	ctl.updateOriginMetrics(currentPools)
+
+	// the safeguards protect against losing nodes, so origins removed because the endpoints of a service moved or
+	// scaled down don't count as long as their nodes are still healthy
+	safeguardedOrigins := append([]string{}, desiredOrigins...)
+	for _, node := range clusterNodes {
+		if node.IsHealthy() && contains(currentOrigins, node.Name) && !contains(safeguardedOrigins, node.Name) {
+			safeguardedOrigins = append(safeguardedOrigins, node.Name)
+		}
+	}
+
+	err = ctl.checkOriginChanges(currentOrigins, safeguardedOrigins)
+	if err != nil {
+		return
+	}
+
+	// a pool needs at least one origin, so once a service has no endpoints left its last origins stay, disabled
+	if len(poolNodes) == 0 && ctl.config.Service != nil {
+		poolNodes = getDisabledOriginNodes(currentPools)
 	}
 
-	ctl.pool, err = ctl.cfAPIClient.GetOrCreateLoadBalancerPool(poolName, nodes, ctl.monitor)
+	ctl.pools, err = ctl.cfAPIClient.GetOrCreateLoadBalancerPools(ctx, ctl.config.Pool.Name, poolNodes, ctl.monitor, ctl.config.Pool.MaxOrigins)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed creating Cloudflare load balancer pool")
+		log.Error().Err(err).Msg("Failed creating Cloudflare load balancer pools")
 		return
 	}
 
+	ctl.updateOriginMetrics(ctl.pools)
+	// in dry-run mode nothing changed, so there's nothing to publish
+	if ctl.planStore == nil {
+		ctl.recordPoolEvents(ctx, currentPools, ctl.pools, nodes)
+	}
+
+	return
+}
+
+// getNodes returns the nodes that can be origins, along with all nodes of the cluster that could be; for load balancers
+// of a service only the nodes running its endpoints can be origins, so the origins of nodes the service moved away from
+// are drained like those of removed nodes
+func (ctl *loadBalancerControllerImpl) getNodes(ctx context.Context) (nodes, clusterNodes []Node, err error) {
+
+	clusterNodes, err = ctl.k8sAPIClient.GetNodes(ctx)
+	if err != nil || ctl.config.Service == nil {
+		return clusterNodes, clusterNodes, err
+	}
+
+	nodeNames, err := ctl.k8sAPIClient.GetServiceNodeNames(ctx, ctl.config.Service.Namespace, ctl.config.Service.Name)
+	if err != nil {
+		return
+	}
+
+	return filterNodes(clusterNodes, nodeNames), clusterNodes, nil
+}
+
+// getDisabledOriginNodes returns a draining node for each origin in the enabled pools, so the origins stay in the pools
+// disabled
+func getDisabledOriginNodes(pools []cloudflare.LoadBalancerPool) (nodes []Node) {
+	nodes = []Node{}
+	for _, pool := range pools {
+		if !pool.Enabled {
+			continue
+		}
+		for _, origin := range pool.Origins {
+			nodes = append(nodes, Node{Name: origin.Name, ExternalIP: origin.Address, Draining: true})
+		}
+	}
+	return
+}
+
+// updateOriginMetrics sets the number of enabled origins and whether the origin of each node is enabled from the pools
+// in Cloudflare
+func (ctl *loadBalancerControllerImpl) updateOriginMetrics(pools []cloudflare.LoadBalancerPool) {
+
+	enabledOrigins := 0
+	originGaugeLabels := []prometheus.Labels{}
+	for _, pool := range pools {
+		for _, origin := range pool.Origins {
+			labels := prometheus.Labels{"pool": pool.Name, "node": origin.Name}
+			if pool.Enabled && origin.Enabled {
+				enabledOrigins++
+				originEnabledGauge.With(labels).Set(1)
+			} else {
+				originEnabledGauge.With(labels).Set(0)
+			}
+			originGaugeLabels = append(originGaugeLabels, labels)
+		}
+	}
+
+	// remove the gauges of origins that are no longer in any pool
+	for _, previousLabels := range ctl.originGaugeLabels {
+		stale := true
+		for _, labels := range originGaugeLabels {
+			if labels["pool"] == previousLabels["pool"] && labels["node"] == previousLabels["node"] {
+				stale = false
+				break
+			}
+		}
+		if stale {
+			originEnabledGauge.Delete(previousLabels)
+		}
+	}
+	ctl.originGaugeLabels = originGaugeLabels
+
+	actualOriginsGauge.With(prometheus.Labels{"pool": ctl.config.Pool.Name}).Set(float64(enabledOrigins))
+}
+
+// recordPoolEvents publishes events for pools that got created and for nodes whose origins got added, disabled for
+// draining or removed
+func (ctl *loadBalancerControllerImpl) recordPoolEvents(ctx context.Context, currentPools, updatedPools []cloudflare.LoadBalancerPool, nodes []Node) {
+
+	nodesByName := map[string]Node{}
+	for _, node := range nodes {
+		nodesByName[node.Name] = node
+	}
+
+	currentPoolNames := []string{}
+	currentOrigins := map[string]bool{}
+	currentOriginPools := map[string]string{}
+	for _, pool := range currentPools {
+		currentPoolNames = append(currentPoolNames, pool.Name)
+		for _, origin := range pool.Origins {
+			currentOrigins[origin.Name] = pool.Enabled && origin.Enabled
+			currentOriginPools[origin.Name] = pool.Name
+		}
+	}
+
+	updatedOrigins := map[string]bool{}
+	for _, pool := range updatedPools {
+		if !contains(currentPoolNames, pool.Name) {
+			ctl.eventRecorder.ControllerEvent(ctx, eventTypeNormal, "PoolCreated", fmt.Sprintf("Created Cloudflare load balancer pool %v for %v", pool.Name, ctl.config.Hostname()))
+		}
+
+		for _, origin := range pool.Origins {
+			enabled := pool.Enabled && origin.Enabled
+			updatedOrigins[origin.Name] = enabled
+
+			wasEnabled, existed := currentOrigins[origin.Name]
+			if enabled && (!existed || !wasEnabled) {
+				ctl.eventRecorder.NodeEvent(ctx, nodesByName[origin.Name], eventTypeNormal, "OriginAdded", fmt.Sprintf("Added as origin to Cloudflare load balancer pool %v for %v", pool.Name, ctl.config.Hostname()))
+			} else if !enabled && existed && wasEnabled {
+				ctl.eventRecorder.NodeEvent(ctx, nodesByName[origin.Name], eventTypeNormal, "OriginDraining", fmt.Sprintf("Disabled as origin in Cloudflare load balancer pool %v for %v because the node is cordoned or terminating; it's removed after %v seconds", pool.Name, ctl.config.Hostname(), *ctl.config.Pool.DrainGracePeriodSeconds))
+			}
+		}
+	}
+
+	for name := range currentOrigins {
+		if _, exists := updatedOrigins[name]; !exists {
+			ctl.eventRecorder.NodeEvent(ctx, nodesByName[name], eventTypeNormal, "OriginRemoved", fmt.Sprintf("Removed as origin from Cloudflare load balancer pool %v for %v", currentOriginPools[name], ctl.config.Hostname()))
+		}
+	}
+}
+
+// recordDNSRecordEvents publishes events for nodes whose dns record got added or removed
+func (ctl *loadBalancerControllerImpl) recordDNSRecordEvents(ctx context.Context, currentIPs []string, updatedRecords []cloudflare.DNSRecord, nodes []Node) {
+
+	nodesByIP := map[string]Node{}
+	for _, node := range nodes {
+		if node.ExternalIP != "" {
+			nodesByIP[node.ExternalIP] = node
+		}
+	}
+
+	updatedIPs := []string{}
+	for _, record := range updatedRecords {
+		updatedIPs = append(updatedIPs, record.Content)
+		if !contains(currentIPs, record.Content) {
+			ctl.eventRecorder.NodeEvent(ctx, nodesByIP[record.Content], eventTypeNormal, "DNSRecordAdded", fmt.Sprintf("Added dns record %v pointing to %v", ctl.config.Hostname(), record.Content))
+		}
+	}
+
+	for _, ip := range currentIPs {
+		if !contains(updatedIPs, ip) {
+			ctl.eventRecorder.NodeEvent(ctx, nodesByIP[ip], eventTypeNormal, "DNSRecordRemoved", fmt.Sprintf("Removed dns record %v pointing to %v", ctl.config.Hostname(), ip))
+		}
+	}
+}
+
+// checkOriginChanges refuses changes that leave no origins, fewer than the minimum number of origins or shrink the
+// number of origins by more than the maximum percentage at once, since they're more likely caused by Kubernetes
+// returning an empty or truncated list of nodes than by the cluster actually shrinking that much; origins replaced by
+// others, like a preempted node by its successor, don't shrink the number of origins
+func (ctl *loadBalancerControllerImpl) checkOriginChanges(currentOrigins, desiredOrigins []string) (err error) {
+
+	removedOrigins := []string{}
+	for _, origin := range currentOrigins {
+		if !contains(desiredOrigins, origin) {
+			removedOrigins = append(removedOrigins, origin)
+		}
+	}
+	droppedOrigins := len(currentOrigins) - len(desiredOrigins)
+
+	reason := ""
+	if len(desiredOrigins) == 0 {
+		reason = "empty"
+		err = fmt.Errorf("Refusing to apply an empty set of origins to load balancer %v", ctl.config.Hostname())
+	} else if len(desiredOrigins) < ctl.config.Safeguards.MinOrigins {
+		reason = "min-origins"
+		err = fmt.Errorf("Refusing to apply %v origins to load balancer %v, the minimum is %v", len(desiredOrigins), ctl.config.Hostname(), ctl.config.Safeguards.MinOrigins)
+	} else if droppedOrigins > 0 && droppedOrigins*100 > len(currentOrigins)*ctl.config.Safeguards.MaxRemovalPercentage {
+		reason = "max-removal-percentage"
+		err = fmt.Errorf("Refusing to shrink load balancer %v from %v to %v origins, the maximum removal is %v%%", ctl.config.Hostname(), len(currentOrigins), len(desiredOrigins), ctl.config.Safeguards.MaxRemovalPercentage)
+	}
+
+	if err != nil {
+		log.Warn().Err(err).
+			Strs("currentOrigins", currentOrigins).
+			Strs("desiredOrigins", desiredOrigins).
+			Strs("removedOrigins", removedOrigins).
+			Msgf("Blocked origin changes for load balancer %v", ctl.config.Hostname())
+		blockedChangesTotals.With(prometheus.Labels{"loadbalancer": ctl.config.Hostname(), "reason": reason}).Inc()
+	}
+
+	return
+}
+
+// getPoolNodes returns the healthy nodes plus the nodes that are draining; origins of nodes that are cordoned,
+// terminating or removed are kept disabled for the drain grace period before they're removed from the pool
+func (ctl *loadBalancerControllerImpl) getPoolNodes(nodes []Node, currentPools []cloudflare.LoadBalancerPool) (poolNodes []Node) {
+
+	now := time.Now()
+	gracePeriod := time.Duration(*ctl.config.Pool.DrainGracePeriodSeconds) * time.Second
+
+	poolNodes = []Node{}
+	nodesByName := map[string]Node{}
+	for _, node := range nodes {
+		nodesByName[node.Name] = node
+		if node.IsHealthy() {
+			poolNodes = append(poolNodes, node)
+		}
+	}
+
+	drainingSince := map[string]time.Time{}
+	for _, pool := range currentPools {
+		if !pool.Enabled {
+			continue
+		}
+		for _, origin := range pool.Origins {
+			node, nodeExists := nodesByName[origin.Name]
+			if nodeExists && (node.IsHealthy() || (!node.Unschedulable && !node.Terminating)) {
+				// healthy nodes stay, nodes that are merely not ready are removed right away
+				continue
+			}
+
+			since, isDraining := ctl.drainingSince[origin.Name]
+			if !isDraining {
+				since = now
+				log.Info().Msgf("Draining origin %v for node that is cordoned, terminating or removed", origin.Name)
+
+				// reconcile once the grace period ends, so the origin doesn't linger until the next interval reconcile;
+				// scheduled only when draining starts, so frequent reconciles don't pile up timers
+				time.AfterFunc(gracePeriod, func() {
+					ctl.EnqueueReconcile("drain grace period ended")
+				})
+			}
+			if now.Sub(since) >= gracePeriod {
+				log.Info().Msgf("Drain grace period for origin %v has ended, removing it", origin.Name)
+				continue
+			}
+
+			drainingSince[origin.Name] = since
+			poolNodes = append(poolNodes, Node{
+				Name:       origin.Name,
+				ExternalIP: origin.Address,
+				Draining:   true,
+			})
+		}
+	}
+	ctl.drainingSince = drainingSince
+
 	return
 }
 
-func (ctl *loadBalancerControllerImpl) InitLoadBalancer(lbName, zoneName string) (err error) {
+func (ctl *loadBalancerControllerImpl) InitLoadBalancer(ctx context.Context) (err error) {
 
-	ctl.loadbalancer, err = ctl.cfAPIClient.GetOrCreateLoadBalancer(lbName, zoneName, ctl.pool)
+	ctl.loadbalancer, err = ctl.cfAPIClient.GetOrCreateLoadBalancer(ctx, ctl.config.Name, ctl.config.Zone, ctl.config.ToLoadBalancer(), ctl.pools)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed creating load balancer")
 		return
@@ -142,57 +531,323 @@ func (ctl *loadBalancerControllerImpl) InitLoadBalancer(lbName, zoneName string)
 	return nil
 }
 
-func (ctl *loadBalancerControllerImpl) RefreshLoadBalancerOnChanges(poolName string) (err error) {
+// Teardown removes the Cloudflare objects created by this controller; objects without the ownership marker are left
+// untouched
+func (ctl *loadBalancerControllerImpl) Teardown(ctx context.Context) (err error) {
+
+	ctx, plan := ctl.startPlan(ctx)
+	defer func() {
+		ctl.finishPlan(plan, err)
+	}()
+
+	if ctl.config.Type == "dns" {
+
+		// the records of cordoned, not ready or removed nodes go as well
+		err = ctl.cfAPIClient.DeleteDNSRecords(ctx, ctl.config.Name, ctl.config.Zone)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed deleting Cloudflare dns records")
+			return
+		}
+
+	} else if ctl.config.Type == "lb" {
+
+		// delete in reverse order of creation, since the load balancer refers to the pools and the pools to the monitor
+		err = ctl.cfAPIClient.DeleteLoadBalancer(ctx, ctl.config.Name, ctl.config.Zone, ctl.config.Pool.Name)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed deleting Cloudflare load balancer")
+			return
+		}
+
+		err = ctl.cfAPIClient.DeleteLoadBalancerPools(ctx, ctl.config.Pool.Name)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed deleting Cloudflare load balancer pools")
+			return
+		}
+
+		err = ctl.cfAPIClient.DeleteLoadBalancerMonitor(ctx, ctl.config.Pool.Name, ctl.config.Zone, ctl.config.Monitor.Path)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed deleting Cloudflare load balancer monitor")
+			return
+		}
+
+	}
+
+	return
+}
+
+// RefreshLoadBalancerOnChanges subscribes to the shared node watch, so a reconcile is enqueued once node changes have
+// settled, until the context is cancelled
+func (ctl *loadBalancerControllerImpl) RefreshLoadBalancerOnChanges(ctx context.Context, nodeChanges NodeChangeNotifier) (err error) {
+
+	nodeChanges.Subscribe(ctx, ctl)
+
+	return nil
+}
+
+// RefreshLoadBalancerOnInterval enqueues a reconcile around every interval seconds, until the context is cancelled
+func (ctl *loadBalancerControllerImpl) RefreshLoadBalancerOnInterval(ctx context.Context, interval int) (err error) {
 
-	// watch services for all namespaces
-	go func(waitGroup *sync.WaitGroup) {
-		// loop indefinitely
+	go func() {
+		// loop until cancelled
 		for {
-			// sleep random time between 22 and 37 seconds
-			sleepTime := applyJitter(30)
+			// sleep random time around 900 seconds
+			sleepTime := applyJitter(interval)
 			log.Info().Msgf("Sleeping for %v seconds...", sleepTime)
-			time.Sleep(time.Duration(sleepTime) * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(sleepTime) * time.Second):
+			}
+
+			ctl.EnqueueReconcile("interval")
 		}
-	}(ctl.waitGroup)
+	}()
 
 	return nil
 }
 
-func (ctl *loadBalancerControllerImpl) RefreshLoadBalancerOnInterval(poolName, lbName, zoneName string, interval int) (err error) {
+// Run processes the reconcile queue one request at a time until the context is cancelled; cancelling also aborts the
+// api calls of an in-flight reconcile, and the wait group tracks the queue processing so waiting for it lets that
+// reconcile return
+func (ctl *loadBalancerControllerImpl) Run(ctx context.Context) {
 
-	go func(waitGroup *sync.WaitGroup) {
-		// loop indefinitely
-		for {
+	ctl.waitGroup.Add(1)
 
-			if ctl.lbType == "dns" {
+	go func() {
+		defer ctl.waitGroup.Done()
 
-				err = ctl.InitDns(lbName, zoneName)
-				if err != nil {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case reason := <-ctl.queue:
+				// don't start a new reconcile when stopping
+				select {
+				case <-ctx.Done():
 					return
+				default:
 				}
 
-			} else if ctl.lbType == "lb" {
+				log.Info().Msgf("Reconciling load balancer %v because of %v...", ctl.config.Hostname(), reason)
+				ctl.healthChecker.ReconcileStarted(ctl.config.Hostname())
+				start := time.Now()
+				reconcileCtx, cancelReconcile := getReconcileContext(ctx)
+				reconcileCtx, plan := ctl.startPlan(reconcileCtx)
+				err := ctl.reconcile(reconcileCtx)
+				cancelReconcile()
+				ctl.finishPlan(plan, err)
+				ctl.healthChecker.ReconcileFinished(ctl.config.Hostname(), err)
+				ctl.observeReconcile(start, err)
+				ctl.retryOnFailure(ctx, err, "failed reconcile")
+			}
+		}
+	}()
+}
+
+// EnqueueReconcile requests a reconcile; if one is already pending the request is merged into it
+func (ctl *loadBalancerControllerImpl) EnqueueReconcile(reason string) {
+	select {
+	case ctl.queue <- reason:
+		ctl.healthChecker.ReconcileEnqueued(ctl.config.Hostname())
+	default:
+		log.Debug().Msgf("Reconcile for load balancer %v already pending, skipping request because of %v", ctl.config.Hostname(), reason)
+	}
+}
 
-				err = ctl.InitPool(poolName)
-				if err != nil {
-					log.Warn().Err(err).Msgf("Updating pool with name %v failed", poolName)
-				}
+func (ctl *loadBalancerControllerImpl) reconcile(ctx context.Context) (err error) {
+
+	if !ctl.initialized {
+
+		// initialization failed at startup, so set up all Cloudflare objects, including the monitor
+		err = ctl.initialize(ctx)
+		if err != nil {
+			log.Warn().Err(err).Str("kind", string(getCloudflareErrorKind(err))).Msgf("Initializing load balancer %v failed", ctl.config.Hostname())
+		}
 
+	} else if ctl.config.Type == "dns" {
+
+		err = ctl.InitDns(ctx)
+		if err != nil {
+			log.Warn().Err(err).Str("kind", string(getCloudflareErrorKind(err))).Msgf("Updating dns records with name %v failed", ctl.config.Hostname())
+		}
+
+	} else if ctl.config.Type == "lb" {
+
+		// restore the monitor first if it was changed or deleted by hand, so the pools keep referring to a valid one
+		err = ctl.InitMonitor(ctx)
+		if err != nil {
+			log.Warn().Err(err).Str("kind", string(getCloudflareErrorKind(err))).Msgf("Updating monitor for pool with name %v failed", ctl.config.Pool.Name)
+		} else if err = ctl.InitPool(ctx); err != nil {
+			log.Warn().Err(err).Str("kind", string(getCloudflareErrorKind(err))).Msgf("Updating pool with name %v failed", ctl.config.Pool.Name)
+		} else {
+			// attach pools that got added because the number of nodes grew
+			err = ctl.InitLoadBalancer(ctx)
+			if err != nil {
+				log.Warn().Err(err).Str("kind", string(getCloudflareErrorKind(err))).Msgf("Updating load balancer with name %v failed", ctl.config.Hostname())
 			}
+		}
 
-			// sleep random time around 900 seconds
-			sleepTime := applyJitter(interval)
-			log.Info().Msgf("Sleeping for %v seconds...", sleepTime)
-			time.Sleep(time.Duration(sleepTime) * time.Second)
+	}
+
+	if err != nil && ctx.Err() == nil && ctl.planStore == nil {
+		ctl.eventRecorder.ControllerEvent(ctx, eventTypeWarning, "ReconcileFailed", fmt.Sprintf("Reconciling load balancer %v failed: %v", ctl.config.Hostname(), err))
+	}
+
+	return
+}
+
+// retryOnFailure enqueues another reconcile after a delay if the failure may be resolved by trying again; the api client
+// already retried with backoff, so this tries again a bit later rather than waiting for the next interval. A load
+// balancer that isn't initialized yet is retried whatever the kind of failure, since nothing may have been set up yet
+func (ctl *loadBalancerControllerImpl) retryOnFailure(ctx context.Context, err error, reason string) {
+
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+
+	kind := getCloudflareErrorKind(err)
+	if ctl.initialized && kind != CloudflareErrorRetryable {
+		return
+	}
+
+	log.Info().Str("kind", string(kind)).Msgf("Retrying load balancer %v in %v seconds because of %v", ctl.config.Hostname(), reconcileRetryDelaySeconds, reason)
+	time.AfterFunc(time.Duration(reconcileRetryDelaySeconds)*time.Second, func() {
+		if ctx.Err() == nil {
+			ctl.EnqueueReconcile(reason)
+		}
+	})
+}
+
+type shutdownContextKey struct{}
+
+type shutdownContexts struct {
+	stopping context.Context
+	aborting context.Context
+}
+
+// withShutdownContext returns a context that lets reconciles in flight when it's cancelled finish until abortCtx is
+// cancelled as well; this only applies to shutting down, controllers stopped for another reason, like losing
+// leadership, still abort their reconcile right away
+func withShutdownContext(ctx, abortCtx context.Context) context.Context {
+	return context.WithValue(ctx, shutdownContextKey{}, shutdownContexts{stopping: ctx, aborting: abortCtx})
+}
+
+// getReconcileContext returns the context for a reconcile, which is cancelled along with the controller's context
+// unless the controller stops because of shutting down; then it's only cancelled once the api calls get aborted
+func getReconcileContext(ctx context.Context) (context.Context, context.CancelFunc) {
+
+	shutdown, ok := ctx.Value(shutdownContextKey{}).(shutdownContexts)
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	reconcileCtx, cancel := context.WithCancel(detachedContext{ctx})
+
+	go func() {
+		select {
+		case <-reconcileCtx.Done():
+			return
+		case <-ctx.Done():
 		}
-	}(ctl.waitGroup)
 
+		if shutdown.stopping.Err() != nil {
+			select {
+			case <-reconcileCtx.Done():
+				return
+			case <-shutdown.aborting.Done():
+			}
+		}
+
+		cancel()
+	}()
+
+	return reconcileCtx, cancel
+}
+
+// detachedContext keeps the values of its parent, but isn't cancelled along with it
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
 	return nil
 }
 
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// startPlan attaches a new plan to the context in dry-run mode, to collect the changes a reconcile would have made
+func (ctl *loadBalancerControllerImpl) startPlan(ctx context.Context) (context.Context, *Plan) {
+
+	if ctl.planStore == nil {
+		return ctx, nil
+	}
+
+	plan := &Plan{
+		LoadBalancer: ctl.config.Hostname(),
+		Time:         time.Now(),
+		Entries:      []PlanEntry{},
+	}
+
+	return withPlan(ctx, plan), plan
+}
+
+// finishPlan keeps the plan, replacing the one of the previous reconcile; a failed reconcile keeps the changes up to
+// the failure together with the error
+func (ctl *loadBalancerControllerImpl) finishPlan(plan *Plan, err error) {
+
+	if plan == nil {
+		return
+	}
+
+	if err != nil {
+		plan.Error = err.Error()
+	}
+
+	log.Info().Msgf("Dry-run: reconciling load balancer %v would have made %v changes", plan.LoadBalancer, len(plan.Entries))
+	ctl.planStore.Set(plan)
+}
+
+// observeReconcile records the duration and result of a reconcile
+func (ctl *loadBalancerControllerImpl) observeReconcile(start time.Time, err error) {
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	} else {
+		lastSuccessfulReconcile.With(prometheus.Labels{"loadbalancer": ctl.config.Hostname()}).Set(float64(time.Now().Unix()))
+	}
+
+	reconcileDuration.With(prometheus.Labels{"loadbalancer": ctl.config.Hostname(), "result": result}).Observe(time.Since(start).Seconds())
+}
+
+// filterNodes returns the nodes with one of the names
+func filterNodes(nodes []Node, names []string) (filteredNodes []Node) {
+	filteredNodes = []Node{}
+	for _, node := range nodes {
+		if contains(names, node.Name) {
+			filteredNodes = append(filteredNodes, node)
+		}
+	}
+	return
+}
+
 func applyJitter(input int) (output int) {
 
 	deviation := int(0.25 * float64(input))
 
+	// the random number generator isn't safe for concurrent use
+	randMutex.Lock()
+	defer randMutex.Unlock()
+
 	return input - deviation + r.Intn(2*deviation)
 }
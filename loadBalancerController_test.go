@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckOriginChanges(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		minOrigins     int
+		currentOrigins []string
+		desiredOrigins []string
+		allowed        bool
+	}{
+		{"AllowsUnchangedOrigins", 1, []string{"a", "b"}, []string{"a", "b"}, true},
+		{"AllowsAddedOrigins", 1, []string{"a"}, []string{"a", "b", "c"}, true},
+		{"AllowsFirstOrigins", 1, []string{}, []string{"a"}, true},
+		{"AllowsReplacingSingleOrigin", 1, []string{"a"}, []string{"b"}, true},
+		{"AllowsReplacingAllOrigins", 1, []string{"a", "b", "c"}, []string{"d", "e", "f"}, true},
+		{"AllowsShrinkingByMaxRemovalPercentage", 1, []string{"a", "b", "c", "d"}, []string{"a", "b"}, true},
+		{"BlocksShrinkingByMoreThanMaxRemovalPercentage", 1, []string{"a", "b", "c", "d"}, []string{"a"}, false},
+		{"BlocksShrinkingWhileReplacingOrigins", 1, []string{"a", "b", "c", "d"}, []string{"e"}, false},
+		{"BlocksEmptyOrigins", 1, []string{"a"}, []string{}, false},
+		{"BlocksEmptyOriginsWithoutCurrentOrigins", 1, []string{}, []string{}, false},
+		{"BlocksFewerThanMinOrigins", 3, []string{"a", "b", "c"}, []string{"a", "b"}, false},
+		{"AllowsMinOrigins", 2, []string{"a", "b", "c"}, []string{"a", "b"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			ctl := &loadBalancerControllerImpl{
+				config: LoadBalancerConfig{
+					Name: "www",
+					Zone: "example.com",
+					Safeguards: SafeguardsConfig{
+						MinOrigins:           tt.minOrigins,
+						MaxRemovalPercentage: 50,
+					},
+				},
+			}
+
+			// act
+			err := ctl.checkOriginChanges(tt.currentOrigins, tt.desiredOrigins)
+
+			if tt.allowed {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestGetPoolNodes(t *testing.T) {
+
+	node := func(name string, ready, unschedulable bool) Node {
+		return Node{Name: name, ExternalIP: name + ".example.com", Ready: ready, Unschedulable: unschedulable}
+	}
+	pool := func(originNames ...string) []cloudflare.LoadBalancerPool {
+		origins := []cloudflare.LoadBalancerOrigin{}
+		for _, originName := range originNames {
+			origins = append(origins, cloudflare.LoadBalancerOrigin{Name: originName, Address: originName + ".example.com", Enabled: true})
+		}
+		return []cloudflare.LoadBalancerPool{{Name: "my-cluster", Enabled: true, Origins: origins}}
+	}
+
+	tests := []struct {
+		name             string
+		nodes            []Node
+		currentPools     []cloudflare.LoadBalancerPool
+		expectedNodes    []string
+		expectedDraining []string
+	}{
+		{"ReturnsHealthyNodes", []Node{node("a", true, false), node("b", true, false)}, pool("a"), []string{"a", "b"}, []string{}},
+		{"DrainsOriginOfRemovedNode", []Node{node("b", true, false)}, pool("a", "b"), []string{"b", "a"}, []string{"a"}},
+		{"DrainsOriginOfCordonedNode", []Node{node("a", true, true), node("b", true, false)}, pool("a", "b"), []string{"b", "a"}, []string{"a"}},
+		{"DrainsOriginOfTerminatingNode", []Node{{Name: "a", Ready: true, Terminating: true}, node("b", true, false)}, pool("a", "b"), []string{"b", "a"}, []string{"a"}},
+		{"RemovesOriginOfNotReadyNodeRightAway", []Node{node("a", false, false), node("b", true, false)}, pool("a", "b"), []string{"b"}, []string{}},
+		{"IgnoresOriginsOfDisabledPool", []Node{node("b", true, false)}, []cloudflare.LoadBalancerPool{{Name: "my-cluster", Origins: pool("a")[0].Origins}}, []string{"b"}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			ctl := newTestLoadBalancerController()
+
+			// act
+			poolNodes := ctl.getPoolNodes(tt.nodes, tt.currentPools)
+
+			nodeNames := []string{}
+			drainingNodeNames := []string{}
+			for _, node := range poolNodes {
+				nodeNames = append(nodeNames, node.Name)
+				if node.Draining {
+					drainingNodeNames = append(drainingNodeNames, node.Name)
+				}
+			}
+			assert.Equal(t, tt.expectedNodes, nodeNames)
+			assert.Equal(t, tt.expectedDraining, drainingNodeNames)
+		})
+	}
+
+	t.Run("RemovesOriginOnceDrainGracePeriodHasEnded", func(t *testing.T) {
+
+		ctl := newTestLoadBalancerController()
+		ctl.drainingSince["a"] = time.Now().Add(-time.Hour)
+
+		// act
+		poolNodes := ctl.getPoolNodes([]Node{node("b", true, false)}, pool("a", "b"))
+
+		if assert.Equal(t, 1, len(poolNodes)) {
+			assert.Equal(t, "b", poolNodes[0].Name)
+		}
+		assert.Empty(t, ctl.drainingSince)
+	})
+
+	t.Run("AllowsServiceEndpointMovingToAnotherNode", func(t *testing.T) {
+
+		ctl := newTestLoadBalancerController()
+		nodes := filterNodes([]Node{node("a", true, false), node("b", true, false)}, []string{"b"})
+
+		// act
+		poolNodes := ctl.getPoolNodes(nodes, pool("a"))
+
+		desiredOrigins := []string{}
+		for _, node := range poolNodes {
+			if !node.Draining {
+				desiredOrigins = append(desiredOrigins, node.Name)
+			}
+		}
+		assert.Equal(t, []string{"b"}, desiredOrigins)
+		assert.Nil(t, ctl.checkOriginChanges([]string{"a"}, desiredOrigins))
+	})
+
+	t.Run("SchedulesReconcileOnlyWhenOriginStartsDraining", func(t *testing.T) {
+
+		gracePeriodSeconds := 1
+		startingCtl := newTestLoadBalancerController()
+		startingCtl.config.Pool.DrainGracePeriodSeconds = &gracePeriodSeconds
+		drainingCtl := newTestLoadBalancerController()
+		drainingCtl.config.Pool.DrainGracePeriodSeconds = &gracePeriodSeconds
+		drainingCtl.drainingSince["a"] = time.Now().Add(-500 * time.Millisecond)
+
+		// act
+		startingCtl.getPoolNodes([]Node{node("b", true, false)}, pool("a", "b"))
+		drainingCtl.getPoolNodes([]Node{node("b", true, false)}, pool("a", "b"))
+
+		time.Sleep(1500 * time.Millisecond)
+		assert.Equal(t, 1, len(startingCtl.queue))
+		assert.Equal(t, 0, len(drainingCtl.queue))
+	})
+}
+
+func TestEnqueueReconcile(t *testing.T) {
+
+	t.Run("MergesRequestsIntoPendingReconcile", func(t *testing.T) {
+
+		ctl := newTestLoadBalancerController()
+
+		// act
+		ctl.EnqueueReconcile("nodes changed")
+		ctl.EnqueueReconcile("interval")
+
+		assert.Equal(t, 1, len(ctl.queue))
+		assert.Equal(t, "nodes changed", <-ctl.queue)
+	})
+}
+
+func TestRun(t *testing.T) {
+
+	t.Run("DoesNotStartReconcileOnceStopped", func(t *testing.T) {
+
+		ctl := newTestLoadBalancerController()
+		ctl.EnqueueReconcile("interval")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// act
+		ctl.Run(ctx)
+
+		ctl.waitGroup.Wait()
+	})
+}
+
+func TestReconcile(t *testing.T) {
+
+	t.Run("UpdatesDriftedMonitorAfterInitialization", func(t *testing.T) {
+
+		monitorConfig := MonitorConfig{Path: "/liveness"}
+		monitorConfig.SetDefaults()
+		driftedMonitor := monitorConfig.ToLoadBalancerMonitor()
+		driftedMonitor.ID = "m1"
+		driftedMonitor.Description = "my-cluster.example.com/liveness - " + ownershipMarker
+		driftedMonitor.Interval = 15
+
+		api := &fakeCloudflareAPI{
+			monitors: []cloudflare.LoadBalancerMonitor{driftedMonitor},
+			pools:    []cloudflare.LoadBalancerPool{{ID: "p1", Name: "my-cluster", Enabled: true, Monitor: "m1", Origins: []cloudflare.LoadBalancerOrigin{{Name: "a", Address: "10.0.0.1", Enabled: true}}}},
+		}
+		cfAPIClient, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		ctl := newTestLoadBalancerController()
+		ctl.config.Monitor = monitorConfig
+		ctl.k8sAPIClient = &fakeNodesAPIClient{nodes: []Node{{Name: "a", ExternalIP: "10.0.0.1", Ready: true}}}
+		ctl.cfAPIClient = cfAPIClient
+		ctl.initialized = true
+
+		// act
+		err := ctl.reconcile(context.Background())
+
+		assert.Nil(t, err)
+		assert.Contains(t, api.changes, "PUT user/load_balancers/monitors/m1")
+		if assert.Equal(t, 1, len(api.monitors)) {
+			assert.Equal(t, 60, api.monitors[0].Interval)
+		}
+	})
+}
+
+func TestInitPool(t *testing.T) {
+
+	origins := func(names ...string) []cloudflare.LoadBalancerOrigin {
+		origins := []cloudflare.LoadBalancerOrigin{}
+		for _, name := range names {
+			origins = append(origins, cloudflare.LoadBalancerOrigin{Name: name, Address: name + ".example.com", Enabled: true})
+		}
+		return origins
+	}
+	nodes := func(names ...string) []Node {
+		nodes := []Node{}
+		for _, name := range names {
+			nodes = append(nodes, Node{Name: name, ExternalIP: name + ".example.com", Ready: true})
+		}
+		return nodes
+	}
+
+	t.Run("SetsOriginGaugesAfterReconcile", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{{ID: "p1", Name: "gauges-cluster", Description: ownershipMarker, Enabled: true, Origins: origins("a")}}}
+		cfAPIClient, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		ctl := newTestLoadBalancerController()
+		ctl.config.Pool.Name = "gauges-cluster"
+		ctl.k8sAPIClient = &fakeNodesAPIClient{nodes: nodes("a", "b")}
+		ctl.cfAPIClient = cfAPIClient
+
+		// act
+		err := ctl.InitPool(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, float64(2), getMetricValue(desiredOriginsGauge.With(prometheus.Labels{"pool": "gauges-cluster"})))
+		assert.Equal(t, float64(2), getMetricValue(actualOriginsGauge.With(prometheus.Labels{"pool": "gauges-cluster"})))
+		assert.Equal(t, float64(1), getMetricValue(originEnabledGauge.With(prometheus.Labels{"pool": "gauges-cluster", "node": "b"})))
+	})
+
+	enabledOrigins := func(pool cloudflare.LoadBalancerPool) map[string]bool {
+		enabled := map[string]bool{}
+		for _, origin := range pool.Origins {
+			enabled[origin.Name] = origin.Enabled
+		}
+		return enabled
+	}
+	newTestServiceLoadBalancerController := func(api *fakeCloudflareAPI, k8sAPIClient KubernetesAPIClient) (*loadBalancerControllerImpl, *httptest.Server) {
+		cfAPIClient, server := newTestCloudflareAPIClient(api, "")
+		ctl := newTestLoadBalancerController()
+		ctl.config.Name = "api"
+		ctl.config.Pool.Name = "api-example-com"
+		ctl.config.Service = &ObjectReference{Kind: "Service", Namespace: "default", Name: "api"}
+		ctl.k8sAPIClient = k8sAPIClient
+		ctl.cfAPIClient = cfAPIClient
+		return ctl, server
+	}
+
+	t.Run("DrainsOriginsOfServiceScalingDown", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{{ID: "p1", Name: "api-example-com", Description: ownershipMarker, Enabled: true, Origins: origins("a", "b", "c")}}}
+		ctl, server := newTestServiceLoadBalancerController(api, &fakeServicesAPIClient{nodes: nodes("a", "b", "c"), nodeNames: []string{"a"}})
+		defer server.Close()
+
+		// act
+		err := ctl.InitPool(context.Background())
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(api.pools)) {
+			assert.Equal(t, map[string]bool{"a": true, "b": false, "c": false}, enabledOrigins(api.pools[0]))
+		}
+	})
+
+	t.Run("KeepsOriginsOfServiceScaledToZeroDisabled", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{{ID: "p1", Name: "api-example-com", Description: ownershipMarker, Enabled: true, Origins: origins("a", "b", "c")}}}
+		ctl, server := newTestServiceLoadBalancerController(api, &fakeServicesAPIClient{nodes: nodes("a", "b", "c"), nodeNames: []string{}})
+		defer server.Close()
+		gracePeriod := 0
+		ctl.config.Pool.DrainGracePeriodSeconds = &gracePeriod
+
+		// act
+		err := ctl.InitPool(context.Background())
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(api.pools)) {
+			assert.Equal(t, map[string]bool{"a": false, "b": false, "c": false}, enabledOrigins(api.pools[0]))
+		}
+	})
+
+	t.Run("BlocksServiceLosingNodes", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{{ID: "p1", Name: "api-example-com", Description: ownershipMarker, Enabled: true, Origins: origins("a", "b", "c")}}}
+		ctl, server := newTestServiceLoadBalancerController(api, &fakeServicesAPIClient{nodes: nodes("a"), nodeNames: []string{"a"}})
+		defer server.Close()
+
+		// act
+		err := ctl.InitPool(context.Background())
+
+		assert.NotNil(t, err)
+		assert.Empty(t, api.changes)
+	})
+
+	t.Run("CountsBlockedChanges", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{pools: []cloudflare.LoadBalancerPool{{ID: "p1", Name: "blocked-cluster", Description: ownershipMarker, Enabled: true, Origins: origins("a", "b", "c", "d")}}}
+		cfAPIClient, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		ctl := newTestLoadBalancerController()
+		ctl.config.Name = "blocked"
+		ctl.config.Pool.Name = "blocked-cluster"
+		ctl.k8sAPIClient = &fakeNodesAPIClient{nodes: nodes("a")}
+		ctl.cfAPIClient = cfAPIClient
+
+		// act
+		err := ctl.InitPool(context.Background())
+
+		assert.NotNil(t, err)
+		assert.Empty(t, api.changes)
+		assert.Equal(t, float64(1), getMetricValue(blockedChangesTotals.With(prometheus.Labels{"loadbalancer": "blocked.example.com", "reason": "max-removal-percentage"})))
+		assert.Equal(t, float64(1), getMetricValue(desiredOriginsGauge.With(prometheus.Labels{"pool": "blocked-cluster"})))
+		assert.Equal(t, float64(4), getMetricValue(actualOriginsGauge.With(prometheus.Labels{"pool": "blocked-cluster"})))
+	})
+}
+
+func TestUpdateOriginMetrics(t *testing.T) {
+
+	t.Run("RemovesGaugesOfDepartedOrigins", func(t *testing.T) {
+
+		ctl := newTestLoadBalancerController()
+		ctl.config.Pool.Name = "departed-cluster"
+		ctl.updateOriginMetrics([]cloudflare.LoadBalancerPool{{Name: "departed-cluster", Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{{Name: "a", Enabled: true}, {Name: "b", Enabled: false}}}})
+
+		// act
+		ctl.updateOriginMetrics([]cloudflare.LoadBalancerPool{{Name: "departed-cluster", Enabled: true, Origins: []cloudflare.LoadBalancerOrigin{{Name: "a", Enabled: true}}}})
+
+		assert.Equal(t, float64(1), getMetricValue(actualOriginsGauge.With(prometheus.Labels{"pool": "departed-cluster"})))
+		assert.True(t, originEnabledGauge.Delete(prometheus.Labels{"pool": "departed-cluster", "node": "a"}))
+		assert.False(t, originEnabledGauge.Delete(prometheus.Labels{"pool": "departed-cluster", "node": "b"}))
+	})
+}
+
+func TestObserveReconcile(t *testing.T) {
+
+	t.Run("CountsReconcilesByResult", func(t *testing.T) {
+
+		ctl := newTestLoadBalancerController()
+		ctl.config.Name = "observed"
+
+		// act
+		ctl.observeReconcile(time.Now(), nil)
+		ctl.observeReconcile(time.Now(), fmt.Errorf("Cloudflare API error"))
+		ctl.observeReconcile(time.Now(), fmt.Errorf("Cloudflare API error"))
+
+		assert.Equal(t, float64(1), getMetricValue(reconcileDuration.With(prometheus.Labels{"loadbalancer": "observed.example.com", "result": "success"})))
+		assert.Equal(t, float64(2), getMetricValue(reconcileDuration.With(prometheus.Labels{"loadbalancer": "observed.example.com", "result": "failure"})))
+		assert.InDelta(t, float64(time.Now().Unix()), getMetricValue(lastSuccessfulReconcile.With(prometheus.Labels{"loadbalancer": "observed.example.com"})), 5)
+	})
+}
+
+// getMetricValue returns the value of a gauge or counter, or the number of observations of a histogram
+func getMetricValue(metric prometheus.Metric) float64 {
+
+	var m dto.Metric
+	metric.Write(&m)
+
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Histogram != nil:
+		return float64(m.Histogram.GetSampleCount())
+	}
+
+	return 0
+}
+
+// fakeNodesAPIClient returns a fixed list of nodes; calls unrelated to nodes aren't supported
+type fakeNodesAPIClient struct {
+	KubernetesAPIClient
+
+	nodes []Node
+}
+
+func (cl *fakeNodesAPIClient) GetNodes(ctx context.Context) ([]Node, error) {
+	return cl.nodes, nil
+}
+
+func (cl *fakeNodesAPIClient) GetHealthyNodes(ctx context.Context) ([]Node, error) {
+	nodes := []Node{}
+	for _, node := range cl.nodes {
+		if node.IsHealthy() {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+func TestGetReconcileContext(t *testing.T) {
+
+	isCancelled := func(ctx context.Context) bool {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	t.Run("CancelsReconcileAlongWithControllerWithoutShutdownContext", func(t *testing.T) {
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// act
+		reconcileCtx, cancelReconcile := getReconcileContext(ctx)
+		defer cancelReconcile()
+		cancel()
+
+		assert.True(t, isCancelled(reconcileCtx))
+	})
+
+	t.Run("KeepsReconcileRunningOnShutdownUntilAborted", func(t *testing.T) {
+
+		abortCtx, abort := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(abortCtx)
+		ctx = withShutdownContext(ctx, abortCtx)
+		controllerCtx, cancelController := context.WithCancel(ctx)
+		defer cancelController()
+
+		// act
+		reconcileCtx, cancelReconcile := getReconcileContext(controllerCtx)
+		defer cancelReconcile()
+		cancel()
+
+		assert.False(t, isCancelled(reconcileCtx))
+		abort()
+		assert.True(t, isCancelled(reconcileCtx))
+	})
+
+	t.Run("CancelsReconcileWhenControllerStopsWithoutShutdown", func(t *testing.T) {
+
+		abortCtx, abort := context.WithCancel(context.Background())
+		defer abort()
+		ctx, cancel := context.WithCancel(abortCtx)
+		defer cancel()
+		ctx = withShutdownContext(ctx, abortCtx)
+		controllerCtx, cancelController := context.WithCancel(ctx)
+
+		// act
+		reconcileCtx, cancelReconcile := getReconcileContext(controllerCtx)
+		defer cancelReconcile()
+		cancelController()
+
+		assert.True(t, isCancelled(reconcileCtx))
+	})
+}
+
+// newTestLoadBalancerController returns a controller for a load balancer with the default settings and a drain grace
+// period that doesn't end during the test
+func newTestLoadBalancerController() *loadBalancerControllerImpl {
+
+	config := LoadBalancerConfig{
+		Name: "www",
+		Zone: "example.com",
+		Type: "lb",
+		Pool: PoolConfig{
+			Name: "my-cluster",
+		},
+	}
+	config.SetDefaults()
+
+	return NewLoadBalancerController(nil, nil, config, NewHealthChecker(0, 0), &fakeEventRecorder{events: []string{}}, nil, &sync.WaitGroup{}).(*loadBalancerControllerImpl)
+}
+
+func TestRecordPoolEvents(t *testing.T) {
+
+	pool := func(name string, origins ...string) cloudflare.LoadBalancerPool {
+		pool := cloudflare.LoadBalancerPool{Name: name, Enabled: true}
+		for _, origin := range origins {
+			pool.Origins = append(pool.Origins, cloudflare.LoadBalancerOrigin{Name: origin, Enabled: true})
+		}
+		return pool
+	}
+	drainingPool := pool("my-cluster", "a", "b")
+	drainingPool.Origins[1].Enabled = false
+
+	tests := []struct {
+		name           string
+		currentPools   []cloudflare.LoadBalancerPool
+		updatedPools   []cloudflare.LoadBalancerPool
+		expectedEvents []string
+	}{
+		{"RecordsCreatedPoolAndAddedOrigin", nil, []cloudflare.LoadBalancerPool{pool("my-cluster", "a")}, []string{
+			"controller PoolCreated: Created Cloudflare load balancer pool my-cluster for www.example.com",
+			"node a OriginAdded: Added as origin to Cloudflare load balancer pool my-cluster for www.example.com",
+		}},
+		{"RecordsDrainingOrigin", []cloudflare.LoadBalancerPool{pool("my-cluster", "a", "b")}, []cloudflare.LoadBalancerPool{drainingPool}, []string{
+			"node b OriginDraining: Disabled as origin in Cloudflare load balancer pool my-cluster for www.example.com because the node is cordoned or terminating; it's removed after 60 seconds",
+		}},
+		{"RecordsRemovedOrigin", []cloudflare.LoadBalancerPool{pool("my-cluster", "a", "b")}, []cloudflare.LoadBalancerPool{pool("my-cluster", "a")}, []string{
+			"node b OriginRemoved: Removed as origin from Cloudflare load balancer pool my-cluster for www.example.com",
+		}},
+		{"RecordsRemovedOriginWithPoolItWasRemovedFrom", []cloudflare.LoadBalancerPool{pool("my-cluster", "a"), pool("my-cluster-2", "b")}, []cloudflare.LoadBalancerPool{pool("my-cluster", "a"), pool("my-cluster-2")}, []string{
+			"node b OriginRemoved: Removed as origin from Cloudflare load balancer pool my-cluster-2 for www.example.com",
+		}},
+		{"RecordsNothingForUnchangedOrigins", []cloudflare.LoadBalancerPool{pool("my-cluster", "a")}, []cloudflare.LoadBalancerPool{pool("my-cluster", "a")}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			eventRecorder := &fakeEventRecorder{events: []string{}}
+			ctl := newTestLoadBalancerController()
+			ctl.eventRecorder = eventRecorder
+
+			// act
+			ctl.recordPoolEvents(context.Background(), tt.currentPools, tt.updatedPools, []Node{{Name: "a"}, {Name: "b"}})
+
+			assert.Equal(t, tt.expectedEvents, eventRecorder.events)
+		})
+	}
+}
+
+func TestRecordDNSRecordEvents(t *testing.T) {
+
+	t.Run("RecordsAddedAndRemovedRecords", func(t *testing.T) {
+
+		eventRecorder := &fakeEventRecorder{events: []string{}}
+		ctl := newTestLoadBalancerController()
+		ctl.eventRecorder = eventRecorder
+		nodes := []Node{{Name: "a", ExternalIP: "203.0.113.1"}, {Name: "b", ExternalIP: "203.0.113.2"}}
+
+		// act
+		ctl.recordDNSRecordEvents(context.Background(), []string{"203.0.113.1"}, []cloudflare.DNSRecord{{Content: "203.0.113.2"}}, nodes)
+
+		assert.Equal(t, []string{
+			"node b DNSRecordAdded: Added dns record www.example.com pointing to 203.0.113.2",
+			"node a DNSRecordRemoved: Removed dns record www.example.com pointing to 203.0.113.1",
+		}, eventRecorder.events)
+	})
+}
+
+// fakeEventRecorder keeps the events as "<object> <reason>: <message>" strings instead of publishing them
+type fakeEventRecorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (er *fakeEventRecorder) NodeEvent(ctx context.Context, node Node, eventType, reason, message string) {
+	er.record(fmt.Sprintf("node %v %v: %v", node.Name, reason, message))
+}
+
+func (er *fakeEventRecorder) ControllerEvent(ctx context.Context, eventType, reason, message string) {
+	er.record(fmt.Sprintf("controller %v: %v", reason, message))
+}
+
+func (er *fakeEventRecorder) record(event string) {
+	er.mutex.Lock()
+	defer er.mutex.Unlock()
+	er.events = append(er.events, event)
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	stdlog "log"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -28,14 +34,69 @@ var (
 	goVersion = runtime.Version()
 
 	// flags
-	cloudflareAPIEmail                = kingpin.Flag("cloudflare-api-email", "The email address used to authenticate to the Cloudflare API.").Envar("CF_API_EMAIL").Required().String()
-	cloudflareAPIKey                  = kingpin.Flag("cloudflare-api-key", "The api key used to authenticate to the Cloudflare API.").Envar("CF_API_KEY").Required().String()
-	cloudflareOrganizationID          = kingpin.Flag("cloudflare-organization-id", "The organization id used to get organization level items from the Cloudflare API.").Envar("CF_ORG_ID").Required().String()
-	cloudflareLoadbalancerName        = kingpin.Flag("cloudflare-lb-name", "The name of the Cloudflare load balancer.").Envar("CF_LB_NAME").Required().String()
-	cloudflareLoadbalancerPoolName    = kingpin.Flag("cloudflare-lb-pool-name", "The name of the Cloudflare load balancer pool.").Envar("CF_LB_POOL_NAME").Required().String()
-	cloudflareLoadbalancerZone        = kingpin.Flag("cloudflare-lb-zone", "The zone for the Cloudflare load balancer.").Envar("CF_LB_ZONE").Required().String()
-	cloudflareLoadbalancerMonitorPath = kingpin.Flag("cloudflare-lb-monitor-path", "The path for the monitor the check the health of the Cloudflare load balancer pool.").Envar("CF_LB_MONITOR_PATH").Required().String()
-	cloudflareLoadbalancerType        = kingpin.Flag("cloudflare-lb-type", "Either use the Cloudflare Load Balancer by specifying 'lb' or poor mans load balancing with value 'dns'.").Envar("CF_LB_TYPE").Default("lb").String()
+	cloudflareAPIEmail                           = kingpin.Flag("cloudflare-api-email", "The email address used to authenticate to the Cloudflare API.").Envar("CF_API_EMAIL").Required().String()
+	cloudflareAPIKey                             = kingpin.Flag("cloudflare-api-key", "The api key used to authenticate to the Cloudflare API.").Envar("CF_API_KEY").Required().String()
+	cloudflareOrganizationID                     = kingpin.Flag("cloudflare-organization-id", "The organization id used to get organization level items from the Cloudflare API.").Envar("CF_ORG_ID").Required().String()
+	cloudflareLoadbalancerName                   = kingpin.Flag("cloudflare-lb-name", "The name of the Cloudflare load balancer.").Envar("CF_LB_NAME").String()
+	cloudflareLoadbalancerPoolName               = kingpin.Flag("cloudflare-lb-pool-name", "The name of the Cloudflare load balancer pool.").Envar("CF_LB_POOL_NAME").String()
+	cloudflareLoadbalancerZone                   = kingpin.Flag("cloudflare-lb-zone", "The zone for the Cloudflare load balancer.").Envar("CF_LB_ZONE").String()
+	cloudflareLoadbalancerMonitorPath            = kingpin.Flag("cloudflare-lb-monitor-path", "The path for the monitor the check the health of the Cloudflare load balancer pool.").Envar("CF_LB_MONITOR_PATH").String()
+	cloudflareLoadbalancerPoolMaxOrigins         = kingpin.Flag("cloudflare-lb-pool-max-origins", "The maximum number of origins per Cloudflare load balancer pool; if there are more nodes they're spread across multiple pools.").Envar("CF_LB_POOL_MAX_ORIGINS").Default("5").Int()
+	cloudflareLoadbalancerPoolDrainGracePeriod   = kingpin.Flag("cloudflare-lb-pool-drain-grace-period", "The number of seconds origins of cordoned, terminating or removed nodes stay disabled in the pool before they're removed.").Envar("CF_LB_POOL_DRAIN_GRACE_PERIOD").Default("60").Int()
+	cloudflareLoadbalancerType                   = kingpin.Flag("cloudflare-lb-type", "Either use the Cloudflare Load Balancer by specifying 'lb' or poor mans load balancing with value 'dns'.").Envar("CF_LB_TYPE").Default("lb").String()
+	cloudflareLoadbalancerMonitorType            = kingpin.Flag("cloudflare-lb-monitor-type", "The protocol used by the monitor, either http, https or tcp.").Envar("CF_LB_MONITOR_TYPE").Default("https").String()
+	cloudflareLoadbalancerMonitorMethod          = kingpin.Flag("cloudflare-lb-monitor-method", "The http method used by the monitor.").Envar("CF_LB_MONITOR_METHOD").Default("GET").String()
+	cloudflareLoadbalancerMonitorHost            = kingpin.Flag("cloudflare-lb-monitor-host", "The Host header sent by the monitor.").Envar("CF_LB_MONITOR_HOST").String()
+	cloudflareLoadbalancerMonitorTimeout         = kingpin.Flag("cloudflare-lb-monitor-timeout", "The timeout in seconds for a single health check.").Envar("CF_LB_MONITOR_TIMEOUT").Default("5").Int()
+	cloudflareLoadbalancerMonitorRetries         = kingpin.Flag("cloudflare-lb-monitor-retries", "The number of retries before an origin is marked unhealthy.").Envar("CF_LB_MONITOR_RETRIES").Default("2").Int()
+	cloudflareLoadbalancerMonitorInterval        = kingpin.Flag("cloudflare-lb-monitor-interval", "The interval in seconds between health checks.").Envar("CF_LB_MONITOR_INTERVAL").Default("60").Int()
+	cloudflareLoadbalancerMonitorExpectedBody    = kingpin.Flag("cloudflare-lb-monitor-expected-body", "A case-insensitive substring expected in the response body of the health check.").Envar("CF_LB_MONITOR_EXPECTED_BODY").String()
+	cloudflareLoadbalancerMonitorExpectedCodes   = kingpin.Flag("cloudflare-lb-monitor-expected-codes", "The expected http response codes of the health check, like 200 or 2xx.").Envar("CF_LB_MONITOR_EXPECTED_CODES").Default("200").String()
+	cloudflareLoadbalancerMonitorFollowRedirects = kingpin.Flag("cloudflare-lb-monitor-follow-redirects", "Whether the monitor follows redirects.").Envar("CF_LB_MONITOR_FOLLOW_REDIRECTS").Default("false").Bool()
+	cloudflareLoadbalancerMonitorAllowInsecure   = kingpin.Flag("cloudflare-lb-monitor-allow-insecure", "Whether the monitor skips validating the certificate of the origins.").Envar("CF_LB_MONITOR_ALLOW_INSECURE").Default("true").Bool()
+	cloudflareLoadbalancerProxied                = kingpin.Flag("cloudflare-lb-proxied", "Whether traffic to the Cloudflare load balancer is proxied through Cloudflare.").Envar("CF_LB_PROXIED").Default("true").Bool()
+	cloudflareLoadbalancerTTL                    = kingpin.Flag("cloudflare-lb-ttl", "The dns ttl in seconds of the Cloudflare load balancer when it's not proxied.").Envar("CF_LB_TTL").Default("0").Int()
+	clusterID                                    = kingpin.Flag("cluster-id", "An identifier for the cluster, prefixed to the names of its pools and origins, so the pools of several clusters can be added to the same load balancer; only letters and digits are allowed.").Envar("CLUSTER_ID").String()
+	adoptDNSRecords                              = kingpin.Flag("adopt-dns-records", "Whether dns load balancers take over A records without ownership marker that point to one of the nodes, like the ones created by earlier versions; otherwise they're left untouched.").Envar("ADOPT_DNS_RECORDS").Default("false").Bool()
+	cloudflareLoadbalancerSteeringRegions        = kingpin.Flag("cloudflare-lb-steering-regions", "Comma separated list of Cloudflare region codes, like WEU,EEU, whose visitors are sent to the pools of this cluster.").Envar("CF_LB_STEERING_REGIONS").String()
+	cloudflareLoadbalancerSteeringPops           = kingpin.Flag("cloudflare-lb-steering-pops", "Comma separated list of Cloudflare data center codes, like AMS,FRA, whose visitors are sent to the pools of this cluster.").Envar("CF_LB_STEERING_POPS").String()
+	nodeLabelSelector                            = kingpin.Flag("node-label-selector", "Only use nodes matching this label selector as origins, like 'cloud.google.com/gke-nodepool=ingress'.").Envar("NODE_LABEL_SELECTOR").String()
+	nodeExcludedTaints                           = kingpin.Flag("node-excluded-taints", "Comma separated list of taints, as key, key=value, key:effect or key=value:effect, for which nodes are not used as origins.").Envar("NODE_EXCLUDED_TAINTS").String()
+	safeguardsMinOrigins                         = kingpin.Flag("safeguards-min-origins", "The minimum number of enabled origins; changes leaving fewer origins are not applied.").Envar("SAFEGUARDS_MIN_ORIGINS").Default("1").Int()
+	safeguardsMaxRemovalPercentage               = kingpin.Flag("safeguards-max-removal-percentage", "The maximum percentage of enabled origins removed in a single reconcile; larger changes are not applied.").Envar("SAFEGUARDS_MAX_REMOVAL_PERCENTAGE").Default("50").Int()
+	cloudflareAPITimeout                         = kingpin.Flag("cloudflare-api-timeout", "The timeout in seconds for a single call to the Cloudflare API.").Envar("CF_API_TIMEOUT").Default("30").Int()
+	cloudflareAPIRateLimit                       = kingpin.Flag("cloudflare-api-rate-limit", "The maximum number of requests per second to the Cloudflare API, for all load balancers together.").Envar("CF_API_RATE_LIMIT").Default("4").Float64()
+	cloudflareAPIMaxRetries                      = kingpin.Flag("cloudflare-api-max-retries", "The number of times a Cloudflare API call is retried when it's rate limited or fails with a server or network error.").Envar("CF_API_MAX_RETRIES").Default("5").Int()
+	kubernetesAPITimeout                         = kingpin.Flag("kubernetes-api-timeout", "The timeout in seconds for a single call to the Kubernetes API; watches are not limited by it.").Envar("KUBERNETES_API_TIMEOUT").Default("30").Int()
+	dryRun                                       = kingpin.Flag("dry-run", "Compute the changes to Cloudflare without applying them; the plan is logged and served at /plan.").Envar("DRY_RUN").Default("false").Bool()
+	leaderElection                               = kingpin.Flag("leader-election", "Whether to elect a leader, so only one of multiple replicas reconciles the load balancers.").Envar("LEADER_ELECTION").Default("true").Bool()
+	leaderElectionConfigMap                      = kingpin.Flag("leader-election-configmap", "The name of the config map holding the leader lease.").Envar("LEADER_ELECTION_CONFIGMAP").Default("estafette-cloudflare-loadbalancer-leader").String()
+	leaderElectionLeaseDuration                  = kingpin.Flag("leader-election-lease-duration", "The number of seconds after which other replicas take over the lease if the leader stopped renewing it.").Envar("LEADER_ELECTION_LEASE_DURATION").Default("15").Int()
+	leaderElectionRenewDeadline                  = kingpin.Flag("leader-election-renew-deadline", "The number of seconds within which the leader has to renew its lease, otherwise it stops reconciling.").Envar("LEADER_ELECTION_RENEW_DEADLINE").Default("10").Int()
+	leaderElectionRetryPeriod                    = kingpin.Flag("leader-election-retry-period", "The number of seconds between attempts to acquire or renew the lease.").Envar("LEADER_ELECTION_RETRY_PERIOD").Default("2").Int()
+	podName                                      = kingpin.Flag("pod-name", "The name of the pod, used as identity for leader election.").Envar("POD_NAME").String()
+	podUID                                       = kingpin.Flag("pod-uid", "The uid of the pod, used to publish events about the controller.").Envar("POD_UID").String()
+	podNamespace                                 = kingpin.Flag("pod-namespace", "The namespace of the pod, in which the leader lease is stored.").Envar("POD_NAMESPACE").String()
+	readinessMaxReconcileAge                     = kingpin.Flag("readiness-max-reconcile-age", "The number of seconds after the last successful reconcile after which the controller is no longer ready.").Envar("READINESS_MAX_RECONCILE_AGE").Default("1800").Int()
+	livenessMaxReconcileDuration                 = kingpin.Flag("liveness-max-reconcile-duration", "The number of seconds a reconcile can run or wait to run before the controller is considered stuck.").Envar("LIVENESS_MAX_RECONCILE_DURATION").Default("900").Int()
+	shutdownTimeout                              = kingpin.Flag("shutdown-timeout", "The number of seconds running reconciles get to finish on shutdown before their Cloudflare api calls are aborted; keep it below the leader election lease duration.").Envar("SHUTDOWN_TIMEOUT").Default("10").Int()
+	serviceLoadBalancers                         = kingpin.Flag("service-load-balancers", "Whether to create a load balancer for each service annotated with estafette.io/cloudflare-loadbalancer: \"true\".").Envar("SERVICE_LOAD_BALANCERS").Default("false").Bool()
+	serviceSyncInterval                          = kingpin.Flag("service-sync-interval", "The number of seconds between checks of the annotated services and the nodes running their endpoints.").Envar("SERVICE_SYNC_INTERVAL").Default("60").Int()
+	ingressLoadBalancers                         = kingpin.Flag("ingress-load-balancers", "Whether to create a load balancer for each host of the ingresses annotated with estafette.io/cloudflare-loadbalancer: \"true\", using the pools of the first configured load balancer.").Envar("INGRESS_LOAD_BALANCERS").Default("false").Bool()
+	ingressSyncInterval                          = kingpin.Flag("ingress-sync-interval", "The number of seconds between checks of the annotated ingresses.").Envar("INGRESS_SYNC_INTERVAL").Default("60").Int()
+	customResources                              = kingpin.Flag("custom-resources", "Whether to create a load balancer for each CloudflareLoadBalancer custom resource and write back its status.").Envar("CUSTOM_RESOURCES").Default("false").Bool()
+	customResourceNamespace                      = kingpin.Flag("custom-resource-namespace", "The namespace of the CloudflareLoadBalancer custom resources; defaults to the namespace of the pod.").Envar("CUSTOM_RESOURCE_NAMESPACE").String()
+	customResourceSyncInterval                   = kingpin.Flag("custom-resource-sync-interval", "The number of seconds between checks of the CloudflareLoadBalancer custom resources.").Envar("CUSTOM_RESOURCE_SYNC_INTERVAL").Default("60").Int()
+	configFilePath                               = kingpin.Flag("config-file", "The path to a yaml file configuring one or more load balancers, instead of the single load balancer flags.").Envar("CF_LB_CONFIG_FILE").String()
+
+	// commands
+	controllerCommand = kingpin.Command("controller", "Run the controller that keeps the Cloudflare load balancer up to date with the Kubernetes nodes.").Default()
+	teardownCommand   = kingpin.Command("teardown", "Remove the Cloudflare load balancer, pools and monitor created by the controller.")
+	statusCommand     = kingpin.Command("status", "Print the Cloudflare monitor, pools and load balancer next to the healthy Kubernetes nodes, marking any mismatch.")
+	statusOutput      = statusCommand.Flag("output", "The output format, either text or json.").Short('o').Default("text").Enum("text", "json")
+	planCommand       = kingpin.Command("plan", "Print the changes a reconcile would make to Cloudflare, without applying them.")
+	planOutput        = planCommand.Flag("output", "The output format, either text or json.").Short('o').Default("text").Enum("text", "json")
+	applyCommand      = kingpin.Command("apply", "Reconcile the load balancers once and exit.")
 
 	// prometheus metrics listener
 	addr = flag.String("listen-address", ":9101", "The address to listen on for HTTP requests.")
@@ -44,30 +105,128 @@ var (
 	loadBalancerTotals = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "estafette_cloudflare_loadbalancer_pools_totals",
-			Help: "Number of created/updated Cloudflare load balancer pools.",
+			Help: "Number of created/updated/unchanged/deleted Cloudflare load balancer pools.",
 		},
 		[]string{"status"},
 	)
 
+	blockedChangesTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_cloudflare_loadbalancer_blocked_changes_totals",
+			Help: "Number of origin changes that were not applied because they would remove too many origins.",
+		},
+		[]string{"loadbalancer", "reason"},
+	)
+
+	reconcileDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "estafette_cloudflare_loadbalancer_reconcile_duration_seconds",
+			Help:    "Duration of reconciling a load balancer.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+		},
+		[]string{"loadbalancer", "result"},
+	)
+
+	lastSuccessfulReconcile = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "estafette_cloudflare_loadbalancer_last_successful_reconcile_timestamp_seconds",
+			Help: "Unix time of the last successful reconcile of a load balancer.",
+		},
+		[]string{"loadbalancer"},
+	)
+
+	desiredOriginsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "estafette_cloudflare_loadbalancer_desired_origins",
+			Help: "Number of enabled origins the controller wants in a pool, or dns records for dns load balancers.",
+		},
+		[]string{"pool"},
+	)
+
+	actualOriginsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "estafette_cloudflare_loadbalancer_actual_origins",
+			Help: "Number of enabled origins in Cloudflare for a pool, or dns records for dns load balancers.",
+		},
+		[]string{"pool"},
+	)
+
+	originEnabledGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "estafette_cloudflare_loadbalancer_origin_enabled",
+			Help: "Whether the origin for a node is enabled in a Cloudflare load balancer pool.",
+		},
+		[]string{"pool", "node"},
+	)
+
+	cloudflareAPIRequestTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_cloudflare_loadbalancer_cloudflare_api_requests_totals",
+			Help: "Number of requests to the Cloudflare API by operation and http status code, including retries.",
+		},
+		[]string{"operation", "code"},
+	)
+
+	cloudflareAPIRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "estafette_cloudflare_loadbalancer_cloudflare_api_request_duration_seconds",
+			Help:    "Duration of requests to the Cloudflare API by operation and http status code.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"operation", "code"},
+	)
+
+	kubernetesAPIErrorTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_cloudflare_loadbalancer_kubernetes_api_errors_totals",
+			Help: "Number of failed calls to the Kubernetes API by operation.",
+		},
+		[]string{"operation"},
+	)
+
+	leaderGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "estafette_cloudflare_loadbalancer_leader",
+			Help: "Whether this replica is the leader reconciling the load balancers.",
+		},
+	)
+
 	// seed random number
-	r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	r         = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randMutex = &sync.Mutex{}
 )
 
 func init() {
 	// Metrics have to be registered to be exposed:
 	prometheus.MustRegister(loadBalancerTotals)
+	prometheus.MustRegister(blockedChangesTotals)
+	prometheus.MustRegister(leaderGauge)
+	prometheus.MustRegister(reconcileDuration)
+	prometheus.MustRegister(lastSuccessfulReconcile)
+	prometheus.MustRegister(desiredOriginsGauge)
+	prometheus.MustRegister(actualOriginsGauge)
+	prometheus.MustRegister(originEnabledGauge)
+	prometheus.MustRegister(cloudflareAPIRequestTotals)
+	prometheus.MustRegister(cloudflareAPIRequestDuration)
+	prometheus.MustRegister(kubernetesAPIErrorTotals)
 }
 
 func main() {
 
 	// parse command line parameters
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	// log as severity for stackdriver logging to recognize the level
 	zerolog.LevelFieldName = "severity"
 
+	// the status and plan commands print their output to stdout, so their logs go to stderr
+	logOutput := os.Stdout
+	if command == statusCommand.FullCommand() || command == planCommand.FullCommand() {
+		logOutput = os.Stderr
+	}
+
 	// set some default fields added to all logs
-	log.Logger = zerolog.New(os.Stdout).With().
+	log.Logger = zerolog.New(logOutput).With().
 		Timestamp().
 		Str("app", "estafette-cloudflare-loadbalancer").
 		Str("version", version).
@@ -85,11 +244,77 @@ func main() {
 		Str("goVersion", goVersion).
 		Msg("Starting estafette-cloudflare-loadbalancer...")
 
+	config, err := getConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed getting load balancer configuration")
+	}
+
+	k8sAPIClient, err := NewKubernetesAPIClient(*nodeLabelSelector, splitList(*nodeExcludedTaints), time.Duration(*kubernetesAPITimeout)*time.Second)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed creating Kubernetes api client")
+	}
+
+	// the plan command always runs in dry-run mode
+	dryRunEnabled := *dryRun || command == planCommand.FullCommand()
+
+	cfAPIClient, err := NewCloudflareAPIClient(*cloudflareAPIKey, *cloudflareAPIEmail, *cloudflareOrganizationID, time.Duration(*cloudflareAPITimeout)*time.Second, *cloudflareAPIRateLimit, *cloudflareAPIMaxRetries, dryRunEnabled, *clusterID, *adoptDNSRecords)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed creating Cloudflare api client")
+	}
+
+	// the one-off commands include the load balancers of the annotated services as they are right now
+	hostnames := NewHostnameRegistry(config)
+	if command != controllerCommand.FullCommand() && *serviceLoadBalancers {
+		serviceConfigs, err := getServiceLoadBalancerConfigs(context.Background(), k8sAPIClient, hostnames)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed retrieving services for load balancers")
+		}
+		config.LoadBalancers = append(config.LoadBalancers, serviceConfigs...)
+	}
+	if command != controllerCommand.FullCommand() && *customResources {
+		namespace, err := getCustomResourceNamespace()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed determining namespace of the custom resources")
+		}
+		customResourceConfigs, err := getCustomResourceLoadBalancerConfigs(context.Background(), k8sAPIClient, namespace, hostnames)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed retrieving custom resources for load balancers")
+		}
+		config.LoadBalancers = append(config.LoadBalancers, customResourceConfigs...)
+	}
+
+	switch command {
+	case teardownCommand.FullCommand():
+		teardown(k8sAPIClient, cfAPIClient, config, getPlanStore(dryRunEnabled))
+		return
+	case statusCommand.FullCommand():
+		printStatus(k8sAPIClient, cfAPIClient, config, *statusOutput)
+		return
+	case planCommand.FullCommand():
+		printPlan(k8sAPIClient, cfAPIClient, config, getPlanStore(dryRunEnabled), *planOutput)
+		return
+	case applyCommand.FullCommand():
+		apply(k8sAPIClient, cfAPIClient, config, getPlanStore(dryRunEnabled))
+		return
+	}
+
 	// define channel and wait group to gracefully shutdown the application
-	gracefulShutdown := make(chan os.Signal)
+	gracefulShutdown := make(chan os.Signal, 1)
 	signal.Notify(gracefulShutdown, syscall.SIGTERM, syscall.SIGINT)
 	waitGroup := &sync.WaitGroup{}
 
+	// the root context is cancelled on sigterm or sigint, which stops the controllers; the api calls of reconciles in
+	// flight at that moment are only aborted through the abort context once they had the shutdown timeout to finish
+	abortCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	ctx, cancel := context.WithCancel(abortCtx)
+	defer cancel()
+	ctx = withShutdownContext(ctx, abortCtx)
+
+	eventRecorder := NewEventRecorder(k8sAPIClient, *podName, *podNamespace, *podUID)
+	healthChecker := NewHealthChecker(time.Duration(*readinessMaxReconcileAge)*time.Second, time.Duration(*livenessMaxReconcileDuration)*time.Second)
+	planStore := getPlanStore(dryRunEnabled)
+
 	// start prometheus
 	go func() {
 		log.Debug().
@@ -97,38 +322,404 @@ func main() {
 			Msg("Serving Prometheus metrics...")
 
 		http.Handle("/metrics", promhttp.Handler())
+		http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			writeHealth(w, healthChecker.CheckLiveness())
+		})
+		http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+			writeHealth(w, healthChecker.CheckReadiness())
+		})
+		if planStore != nil {
+			http.Handle("/plan", planStore)
+		}
 
 		if err := http.ListenAndServe(*addr, nil); err != nil {
 			log.Fatal().Err(err).Msg("Starting Prometheus listener failed")
 		}
 	}()
 
-	lbController, err := NewLoadBalancerController(*cloudflareAPIKey, *cloudflareAPIEmail, *cloudflareOrganizationID, *cloudflareLoadbalancerType, waitGroup)
+	// a dry-run instance doesn't take part in leader election, so it never takes over from the replicas applying changes
+	if *leaderElection && !dryRunEnabled {
+		identity, namespace, err := getLeaderElectionIdentity()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed determining identity for leader election")
+		}
+
+		// only the leader runs the controllers; they're stopped when leadership is lost
+		leaderElector := NewLeaderElector(k8sAPIClient, namespace, *leaderElectionConfigMap, identity,
+			time.Duration(*leaderElectionLeaseDuration)*time.Second,
+			time.Duration(*leaderElectionRenewDeadline)*time.Second,
+			time.Duration(*leaderElectionRetryPeriod)*time.Second,
+			waitGroup)
+
+		leaderElector.Run(ctx, func(leaderCtx context.Context) {
+			runControllers(leaderCtx, k8sAPIClient, cfAPIClient, config, healthChecker, eventRecorder, planStore)
+		})
+	} else {
+		leaderGauge.Set(1)
+
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			runControllers(ctx, k8sAPIClient, cfAPIClient, config, healthChecker, eventRecorder, planStore)
+		}()
+	}
+
+	// wait for sigterm
+	signalReceived := <-gracefulShutdown
+	log.Info().
+		Msgf("Received signal %v. Waiting on running tasks to finish...", signalReceived)
+
+	cancel()
+	if !waitWithTimeout(waitGroup, time.Duration(*shutdownTimeout)*time.Second) {
+		log.Warn().Msgf("Running tasks didn't finish within %v seconds, aborting them...", *shutdownTimeout)
+		abort()
+		waitGroup.Wait()
+	}
+
+	log.Info().Msg("Shutting down...")
+}
+
+// runControllers starts a controller for each load balancer and blocks until the context is cancelled and the
+// controllers have stopped; the health checker only tracks the controllers while they run
+func runControllers(ctx context.Context, k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, config Config, healthChecker HealthChecker, eventRecorder EventRecorder, planStore PlanStore) {
+
+	waitGroup := &sync.WaitGroup{}
+
+	for _, lbConfig := range config.LoadBalancers {
+		healthChecker.Register(lbConfig.Hostname())
+		defer healthChecker.Unregister(lbConfig.Hostname())
+	}
+
+	// all load balancers share a single node watch
+	nodeChanges := NewNodeChangeNotifier(k8sAPIClient, 10)
+	nodeChanges.Run(ctx)
+
+	for _, lbConfig := range config.LoadBalancers {
+
+		lbController := NewLoadBalancerController(k8sAPIClient, cfAPIClient, lbConfig, healthChecker, eventRecorder, planStore, waitGroup)
+
+		// a load balancer that fails to initialize doesn't stop the others; its controller keeps retrying and it's reported
+		// as not ready until it succeeds
+		err := lbController.Init(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Error().Err(err).Str("kind", string(getCloudflareErrorKind(err))).Msgf("Failed initializing load balancer %v", lbConfig.Hostname())
+		}
+
+		err = lbController.RefreshLoadBalancerOnChanges(ctx, nodeChanges)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed setting up refresh on changes for load balancer %v", lbConfig.Hostname())
+		}
+
+		err = lbController.RefreshLoadBalancerOnInterval(ctx, 900)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed setting up refresh on interval for load balancer %v", lbConfig.Hostname())
+		}
+
+		lbController.Run(ctx)
+	}
+
+	// services, custom resources and ingresses share the hostnames, so they never manage the same load balancer; the
+	// hostnames of the configured load balancers are claimed up front
+	hostnames := NewHostnameRegistry(config)
+
+	if *serviceLoadBalancers && ctx.Err() == nil {
+		serviceController := NewServiceController(k8sAPIClient, cfAPIClient, healthChecker, eventRecorder, planStore, hostnames, nodeChanges, *serviceSyncInterval, waitGroup)
+		serviceController.Run(ctx)
+	}
+
+	if *customResources && ctx.Err() == nil {
+		namespace, err := getCustomResourceNamespace()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed determining namespace of the custom resources")
+		}
+		customResourceController := NewCustomResourceController(k8sAPIClient, cfAPIClient, healthChecker, eventRecorder, planStore, namespace, hostnames, nodeChanges, *customResourceSyncInterval, waitGroup)
+		customResourceController.Run(ctx)
+	}
+
+	if poolConfig, ok := getIngressPoolConfig(config); *ingressLoadBalancers && ok && ctx.Err() == nil {
+		ingressController := NewIngressController(k8sAPIClient, cfAPIClient, poolConfig, eventRecorder, planStore, hostnames, *ingressSyncInterval, waitGroup)
+		ingressController.Run(ctx)
+	}
+
+	<-ctx.Done()
+	waitGroup.Wait()
+}
+
+// waitWithTimeout waits for the wait group and returns false if it didn't finish within the timeout
+func waitWithTimeout(waitGroup *sync.WaitGroup, timeout time.Duration) bool {
+
+	done := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// getPlanStore returns a plan store to keep the changes that would have been made in dry-run mode, and nil otherwise
+func getPlanStore(dryRunEnabled bool) PlanStore {
+	if !dryRunEnabled {
+		return nil
+	}
+	return NewPlanStore()
+}
+
+// writeHealth responds with 200 if the check passed, or with 503 and the reason if it failed
+func writeHealth(w http.ResponseWriter, err error) {
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed creating load balancer controller")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// getLeaderElectionIdentity returns the pod name as identity and the pod namespace to store the lease in, falling back
+// to the hostname and the namespace of the service account
+func getLeaderElectionIdentity() (identity, namespace string, err error) {
+
+	identity = *podName
+	if identity == "" {
+		identity, err = os.Hostname()
+		if err != nil {
+			return
+		}
 	}
 
-	err = lbController.Init(*cloudflareLoadbalancerPoolName, *cloudflareLoadbalancerName, *cloudflareLoadbalancerZone, *cloudflareLoadbalancerMonitorPath)
+	namespace, err = getPodNamespace()
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed initializing load balancer")
+		err = fmt.Errorf("Namespace for the leader lease is unknown, set POD_NAMESPACE:\n%v", err)
+	}
+
+	return
+}
+
+// getCustomResourceNamespace returns the namespace to look for the load balancer custom resources in, falling back to
+// the namespace of the pod
+func getCustomResourceNamespace() (namespace string, err error) {
+
+	if *customResourceNamespace != "" {
+		return *customResourceNamespace, nil
 	}
 
-	err = lbController.RefreshLoadBalancerOnChanges(*cloudflareLoadbalancerPoolName)
+	namespace, err = getPodNamespace()
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed setting up refresh on changes")
+		err = fmt.Errorf("Namespace for the custom resources is unknown, set CUSTOM_RESOURCE_NAMESPACE or POD_NAMESPACE:\n%v", err)
+	}
+
+	return
+}
+
+// getPodNamespace returns the namespace of the pod, falling back to the namespace of the service account
+func getPodNamespace() (namespace string, err error) {
+
+	namespace = *podNamespace
+	if namespace == "" {
+		var data []byte
+		data, err = ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+		if err != nil {
+			return
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	return
+}
+
+// getConfig reads the load balancers from the config file if set, otherwise it configures a single load balancer from
+// the flags
+func getConfig() (config Config, err error) {
+
+	if *configFilePath != "" {
+		config, err = ReadConfigFromFile(*configFilePath)
+		if err != nil {
+			return
+		}
+	} else if *cloudflareLoadbalancerName == "" && (*serviceLoadBalancers || *customResources) {
+		// only load balancers for annotated services or custom resources
+		return
+	} else {
+		config = Config{
+			LoadBalancers: []LoadBalancerConfig{
+				{
+					Name:    *cloudflareLoadbalancerName,
+					Zone:    *cloudflareLoadbalancerZone,
+					Type:    *cloudflareLoadbalancerType,
+					Proxied: cloudflareLoadbalancerProxied,
+					TTL:     *cloudflareLoadbalancerTTL,
+					Pool: PoolConfig{
+						Name:                    *cloudflareLoadbalancerPoolName,
+						MaxOrigins:              *cloudflareLoadbalancerPoolMaxOrigins,
+						DrainGracePeriodSeconds: cloudflareLoadbalancerPoolDrainGracePeriod,
+					},
+					Safeguards: SafeguardsConfig{
+						MinOrigins:           *safeguardsMinOrigins,
+						MaxRemovalPercentage: *safeguardsMaxRemovalPercentage,
+					},
+					Steering: SteeringConfig{
+						Regions: splitList(*cloudflareLoadbalancerSteeringRegions),
+						Pops:    splitList(*cloudflareLoadbalancerSteeringPops),
+					},
+					Monitor: MonitorConfig{
+						Type:            *cloudflareLoadbalancerMonitorType,
+						Method:          *cloudflareLoadbalancerMonitorMethod,
+						Path:            *cloudflareLoadbalancerMonitorPath,
+						Host:            *cloudflareLoadbalancerMonitorHost,
+						Timeout:         *cloudflareLoadbalancerMonitorTimeout,
+						Retries:         cloudflareLoadbalancerMonitorRetries,
+						Interval:        *cloudflareLoadbalancerMonitorInterval,
+						ExpectedBody:    *cloudflareLoadbalancerMonitorExpectedBody,
+						ExpectedCodes:   *cloudflareLoadbalancerMonitorExpectedCodes,
+						FollowRedirects: *cloudflareLoadbalancerMonitorFollowRedirects,
+						AllowInsecure:   cloudflareLoadbalancerMonitorAllowInsecure,
+					},
+				},
+			},
+		}
 	}
 
-	err = lbController.RefreshLoadBalancerOnInterval(*cloudflareLoadbalancerPoolName, *cloudflareLoadbalancerName, *cloudflareLoadbalancerZone, 900)
+	config.SetDefaults()
+	err = config.Validate()
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed setting up refresh on interval")
+		return
 	}
 
-	// wait for sigterm
-	signalReceived := <-gracefulShutdown
-	log.Info().
-		Msgf("Received signal %v. Waiting on running tasks to finish...", signalReceived)
+	if _, ok := getIngressPoolConfig(config); *ingressLoadBalancers && !ok {
+		err = fmt.Errorf("Load balancers for ingress hosts need a configured load balancer of type 'lb' to share its pools")
+	}
 
-	waitGroup.Wait()
+	return
+}
 
-	log.Info().Msg("Shutting down...")
+// getIngressPoolConfig returns the first load balancer of type lb, whose pools and settings are shared by the load
+// balancers of the ingress hosts
+func getIngressPoolConfig(config Config) (poolConfig LoadBalancerConfig, ok bool) {
+	for _, lbConfig := range config.LoadBalancers {
+		if lbConfig.Type == "lb" && lbConfig.Service == nil {
+			return lbConfig, true
+		}
+	}
+	return
+}
+
+func teardown(k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, config Config, planStore PlanStore) {
+
+	// the load balancers of ingress hosts refer to the shared pools, so they go first
+	if poolConfig, ok := getIngressPoolConfig(config); *ingressLoadBalancers && ok {
+		ingressController := NewIngressController(k8sAPIClient, cfAPIClient, poolConfig, NewEventRecorder(k8sAPIClient, "", "", ""), planStore, NewHostnameRegistry(config), *ingressSyncInterval, &sync.WaitGroup{})
+
+		err := ingressController.Teardown(context.Background())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed tearing down load balancers for ingress hosts")
+		}
+	}
+
+	for _, lbConfig := range config.LoadBalancers {
+
+		lbController := NewLoadBalancerController(k8sAPIClient, cfAPIClient, lbConfig, NewHealthChecker(0, 0), NewEventRecorder(k8sAPIClient, "", "", ""), planStore, &sync.WaitGroup{})
+
+		err := lbController.Teardown(context.Background())
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed tearing down load balancer %v", lbConfig.Hostname())
+		}
+	}
+
+	log.Info().Msg("Teardown finished")
+}
+
+// printStatus prints the state of each load balancer in Cloudflare next to the healthy nodes, and exits with 1 if any of
+// them differ from what the controller wants
+func printStatus(k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, config Config, output string) {
+
+	statuses := []LoadBalancerStatus{}
+	hasMismatches := false
+	for _, lbConfig := range config.LoadBalancers {
+		status, err := getLoadBalancerStatus(context.Background(), k8sAPIClient, cfAPIClient, lbConfig)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed retrieving status of load balancer %v", lbConfig.Hostname())
+		}
+		statuses = append(statuses, status)
+		hasMismatches = hasMismatches || status.HasMismatches()
+	}
+
+	if output == "json" {
+		writeJSON(os.Stdout, statuses)
+	} else {
+		writeStatusText(os.Stdout, statuses)
+	}
+
+	if hasMismatches {
+		os.Exit(1)
+	}
+}
+
+// printPlan runs a single reconcile of each load balancer in dry-run mode and prints the changes it would make; it exits
+// with 1 if any of the reconciles fail, for example because a safeguard blocks the changes
+func printPlan(k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, config Config, planStore PlanStore, output string) {
+
+	failed := false
+	for _, lbConfig := range config.LoadBalancers {
+
+		lbController := NewLoadBalancerController(k8sAPIClient, cfAPIClient, lbConfig, NewHealthChecker(0, 0), NewEventRecorder(k8sAPIClient, "", "", ""), planStore, &sync.WaitGroup{})
+
+		err := lbController.Init(context.Background())
+		if err != nil {
+			failed = true
+		}
+	}
+
+	if output == "json" {
+		writeJSON(os.Stdout, planStore.Get())
+	} else {
+		writePlansText(os.Stdout, planStore.Get())
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// apply runs a single reconcile of each load balancer
+func apply(k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, config Config, planStore PlanStore) {
+
+	for _, lbConfig := range config.LoadBalancers {
+
+		lbController := NewLoadBalancerController(k8sAPIClient, cfAPIClient, lbConfig, NewHealthChecker(0, 0), NewEventRecorder(k8sAPIClient, "", "", ""), planStore, &sync.WaitGroup{})
+
+		err := lbController.Init(context.Background())
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed reconciling load balancer %v", lbConfig.Hostname())
+		}
+	}
+
+	log.Info().Msg("Apply finished")
+}
+
+// writeJSON writes the value as indented json
+func writeJSON(w io.Writer, v interface{}) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Fatal().Err(err).Msg("Failed writing json output")
+	}
+}
+
+// splitList splits a comma separated list, leaving out empty items
+func splitList(list string) (items []string) {
+	items = []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return
 }
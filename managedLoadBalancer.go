@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// managedLoadBalancer is a load balancer controller started for a service or custom resource; it's stopped but kept
+// around while its Cloudflare objects couldn't be removed yet
+type managedLoadBalancer struct {
+	config     LoadBalancerConfig
+	controller LoadBalancerController
+	nodeNames  []string
+	cancel     context.CancelFunc
+	waitGroup  *sync.WaitGroup
+}
+
+// startLoadBalancer initializes a load balancer controller and runs it until it's stopped; a load balancer that can't be
+// initialized doesn't affect readiness, the caller retries it on its next sync instead
+func startLoadBalancer(ctx context.Context, k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, config LoadBalancerConfig, healthChecker HealthChecker, eventRecorder EventRecorder, planStore PlanStore, nodeChanges NodeChangeNotifier) (lb *managedLoadBalancer, err error) {
+
+	lbCtx, cancel := context.WithCancel(ctx)
+	waitGroup := &sync.WaitGroup{}
+	controller := NewLoadBalancerController(k8sAPIClient, cfAPIClient, config, healthChecker, eventRecorder, planStore, waitGroup)
+
+	healthChecker.Register(config.Hostname())
+	err = controller.Init(lbCtx)
+	if err != nil {
+		cancel()
+		healthChecker.Unregister(config.Hostname())
+		return
+	}
+
+	err = controller.RefreshLoadBalancerOnChanges(lbCtx, nodeChanges)
+	if err != nil {
+		cancel()
+		healthChecker.Unregister(config.Hostname())
+		return
+	}
+
+	err = controller.RefreshLoadBalancerOnInterval(lbCtx, 900)
+	if err != nil {
+		cancel()
+		healthChecker.Unregister(config.Hostname())
+		return
+	}
+
+	controller.Run(lbCtx)
+
+	lb = &managedLoadBalancer{
+		config:     config,
+		controller: controller,
+		cancel:     cancel,
+		waitGroup:  waitGroup,
+	}
+
+	return
+}
+
+// isRunning returns false once the controller has been stopped
+func (lb *managedLoadBalancer) isRunning() bool {
+	return lb.cancel != nil
+}
+
+// stop cancels the load balancer controller and waits for an in-flight reconcile to return
+func (lb *managedLoadBalancer) stop(healthChecker HealthChecker) {
+
+	if lb.cancel == nil {
+		return
+	}
+
+	lb.cancel()
+	lb.waitGroup.Wait()
+	lb.cancel = nil
+
+	healthChecker.Unregister(lb.config.Hostname())
+}
+
+// requiresTeardown returns true if the Cloudflare objects of the previous configuration can't be taken over by a
+// controller for the new one, because they're found by hostname, type and pool name
+func requiresTeardown(previousConfig, config LoadBalancerConfig) bool {
+	return previousConfig.Hostname() != config.Hostname() || previousConfig.Type != config.Type || previousConfig.Pool.Name != config.Pool.Name
+}
+
+// hasReplacedMonitor returns true if the controller for the new configuration created a monitor of its own, leaving the
+// monitor of the previous configuration unused
+func hasReplacedMonitor(previousConfig, config LoadBalancerConfig) bool {
+	return previousConfig.Type == "lb" && previousConfig.Monitor.Path != config.Monitor.Path
+}
+
+// releaseHostnames releases the claimed hostnames that are no longer wanted, once their load balancer has been removed;
+// claimedHostnames holds the owner of each hostname claimed by a controller and is updated accordingly
+func releaseHostnames(hostnames HostnameRegistry, claimedHostnames map[string]string, desiredConfigs map[string]LoadBalancerConfig, loadBalancers map[string]*managedLoadBalancer) {
+
+	heldHostnames := map[string]bool{}
+	for _, config := range desiredConfigs {
+		heldHostnames[config.Hostname()] = true
+	}
+	for _, lb := range loadBalancers {
+		heldHostnames[lb.config.Hostname()] = true
+	}
+
+	for hostname, owner := range claimedHostnames {
+		if !heldHostnames[hostname] {
+			hostnames.Release(hostname, owner)
+			delete(claimedHostnames, hostname)
+		}
+	}
+}
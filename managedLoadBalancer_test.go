@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequiresTeardown(t *testing.T) {
+
+	config := LoadBalancerConfig{Name: "www", Zone: "example.com", Type: "lb", Pool: PoolConfig{Name: "my-cluster"}, Monitor: MonitorConfig{Path: "/liveness"}}
+
+	tests := []struct {
+		name               string
+		apply              func(*LoadBalancerConfig)
+		requiresTeardown   bool
+		hasReplacedMonitor bool
+	}{
+		{"TakesOverUnchangedConfig", func(c *LoadBalancerConfig) {}, false, false},
+		{"TakesOverChangedSettings", func(c *LoadBalancerConfig) { c.TTL = 60; c.Steering.Regions = []string{"WEU"} }, false, false},
+		{"ReplacesMonitorForChangedPath", func(c *LoadBalancerConfig) { c.Monitor.Path = "/readiness" }, false, true},
+		{"TearsDownForChangedHostname", func(c *LoadBalancerConfig) { c.Name = "api" }, true, false},
+		{"TearsDownForChangedType", func(c *LoadBalancerConfig) { c.Type = "dns" }, true, false},
+		{"TearsDownForChangedPoolName", func(c *LoadBalancerConfig) { c.Pool.Name = "other-cluster" }, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			newConfig := config
+			tt.apply(&newConfig)
+
+			// act
+			teardown := requiresTeardown(config, newConfig)
+
+			assert.Equal(t, tt.requiresTeardown, teardown)
+			assert.Equal(t, tt.hasReplacedMonitor, hasReplacedMonitor(config, newConfig))
+		})
+	}
+}
+
+func TestReleaseHostnames(t *testing.T) {
+
+	config := func(name string) LoadBalancerConfig {
+		return LoadBalancerConfig{Name: name, Zone: "example.com"}
+	}
+
+	t.Run("ReleasesHostnamesNoLongerDesiredOrManaged", func(t *testing.T) {
+
+		hostnames := NewHostnameRegistry(Config{})
+		claimedHostnames := map[string]string{}
+		for _, name := range []string{"api", "shop", "web"} {
+			hostnames.Claim(name+".example.com", name+"-example-com", "service default/"+name)
+			claimedHostnames[name+".example.com"] = "service default/" + name
+		}
+
+		// act
+		releaseHostnames(hostnames, claimedHostnames, map[string]LoadBalancerConfig{"default/api": config("api")}, map[string]*managedLoadBalancer{"default/shop": {config: config("shop")}})
+
+		assert.Equal(t, map[string]string{"api.example.com": "service default/api", "shop.example.com": "service default/shop"}, claimedHostnames)
+		assert.Nil(t, hostnames.Claim("web.example.com", "web", "custom resource estafette/web"))
+		assert.NotNil(t, hostnames.Claim("shop.example.com", "shop", "custom resource estafette/shop"))
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NodeChangeNotifier watches the nodes once for all load balancer controllers and enqueues a reconcile for each
+// subscribed controller once node changes have settled, so the number of node watches doesn't grow with the number of
+// load balancers
+type NodeChangeNotifier interface {
+	Run(context.Context)
+	Subscribe(context.Context, LoadBalancerController)
+}
+
+type nodeChangeNotifierImpl struct {
+	k8sAPIClient KubernetesAPIClient
+	debounce     int
+	mutex        sync.Mutex
+	subscribers  map[LoadBalancerController]bool
+}
+
+// NewNodeChangeNotifier returns an instance of NodeChangeNotifier; a burst of node changes within the debounce period
+// in seconds leads to a single reconcile per controller
+func NewNodeChangeNotifier(k8sAPIClient KubernetesAPIClient, debounce int) NodeChangeNotifier {
+
+	// return instance of NodeChangeNotifier
+	return &nodeChangeNotifierImpl{
+		k8sAPIClient: k8sAPIClient,
+		debounce:     debounce,
+		subscribers:  map[LoadBalancerController]bool{},
+	}
+}
+
+// Run watches the nodes and notifies the subscribed controllers of changes until the context is cancelled
+func (n *nodeChangeNotifierImpl) Run(ctx context.Context) {
+
+	// watch nodes for changes
+	nodeChanges := make(chan struct{}, 1)
+	go n.k8sAPIClient.WatchNodes(ctx, nodeChanges)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-nodeChanges:
+			}
+
+			// wait for the debounce period so a burst of node changes leads to a single reconcile
+			debounceTimer := time.NewTimer(time.Duration(n.debounce) * time.Second)
+			settled := false
+			for !settled {
+				select {
+				case <-ctx.Done():
+					debounceTimer.Stop()
+					return
+				case <-nodeChanges:
+				case <-debounceTimer.C:
+					settled = true
+				}
+			}
+
+			for _, controller := range n.getSubscribers() {
+				controller.EnqueueReconcile("nodes changed")
+			}
+		}
+	}()
+}
+
+// Subscribe enqueues a reconcile for the controller whenever the nodes change, until the context is cancelled
+func (n *nodeChangeNotifierImpl) Subscribe(ctx context.Context, controller LoadBalancerController) {
+
+	n.mutex.Lock()
+	n.subscribers[controller] = true
+	n.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		n.mutex.Lock()
+		delete(n.subscribers, controller)
+		n.mutex.Unlock()
+	}()
+}
+
+// getSubscribers returns the currently subscribed controllers
+func (n *nodeChangeNotifierImpl) getSubscribers() (controllers []LoadBalancerController) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	controllers = []LoadBalancerController{}
+	for controller := range n.subscribers {
+		controllers = append(controllers, controller)
+	}
+	return
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeChangeNotifier(t *testing.T) {
+
+	receiveReconcile := func(ctl *loadBalancerControllerImpl) (reason string, ok bool) {
+		select {
+		case reason = <-ctl.queue:
+			return reason, true
+		case <-time.After(time.Second):
+			return "", false
+		}
+	}
+
+	t.Run("EnqueuesReconcileForEverySubscribedController", func(t *testing.T) {
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		k8sAPIClient := &fakeNodeWatchAPIClient{signals: make(chan struct{})}
+		notifier := NewNodeChangeNotifier(k8sAPIClient, 0)
+		ctl1 := newTestLoadBalancerController()
+		ctl2 := newTestLoadBalancerController()
+		notifier.Subscribe(ctx, ctl1)
+		notifier.Subscribe(ctx, ctl2)
+		notifier.Run(ctx)
+
+		// act
+		k8sAPIClient.signals <- struct{}{}
+
+		reason, ok := receiveReconcile(ctl1)
+		assert.True(t, ok)
+		assert.Equal(t, "nodes changed", reason)
+		reason, ok = receiveReconcile(ctl2)
+		assert.True(t, ok)
+		assert.Equal(t, "nodes changed", reason)
+		assert.Equal(t, 1, k8sAPIClient.watches())
+	})
+
+	t.Run("StopsEnqueuingOnceSubscriptionIsCancelled", func(t *testing.T) {
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		k8sAPIClient := &fakeNodeWatchAPIClient{signals: make(chan struct{})}
+		notifier := NewNodeChangeNotifier(k8sAPIClient, 0).(*nodeChangeNotifierImpl)
+		subscriptionCtx, cancelSubscription := context.WithCancel(ctx)
+		cancelled := newTestLoadBalancerController()
+		subscribed := newTestLoadBalancerController()
+		notifier.Subscribe(subscriptionCtx, cancelled)
+		notifier.Subscribe(ctx, subscribed)
+		notifier.Run(ctx)
+		cancelSubscription()
+		for deadline := time.Now().Add(time.Second); len(notifier.getSubscribers()) > 1 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// act
+		k8sAPIClient.signals <- struct{}{}
+
+		_, ok := receiveReconcile(subscribed)
+		assert.True(t, ok)
+		assert.Equal(t, 0, len(cancelled.queue))
+	})
+}
+
+// fakeNodeWatchAPIClient forwards the signals sent by a test to the node watch and counts the watches started
+type fakeNodeWatchAPIClient struct {
+	KubernetesAPIClient
+
+	signals      chan struct{}
+	mutex        sync.Mutex
+	watchesCount int
+}
+
+func (cl *fakeNodeWatchAPIClient) WatchNodes(ctx context.Context, changes chan<- struct{}) {
+	cl.mutex.Lock()
+	cl.watchesCount++
+	cl.mutex.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-cl.signals:
+			changes <- struct{}{}
+		}
+	}
+}
+
+func (cl *fakeNodeWatchAPIClient) watches() int {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.watchesCount
+}
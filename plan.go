@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/rs/zerolog/log"
+)
+
+// PlanEntry describes a change to a Cloudflare object that was left out because of running in dry-run mode
+type PlanEntry struct {
+	Action string      `json:"action"`
+	Kind   string      `json:"kind"`
+	Name   string      `json:"name"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// Plan holds the changes a single reconcile of a load balancer would have made
+type Plan struct {
+	LoadBalancer string      `json:"loadBalancer"`
+	Time         time.Time   `json:"time"`
+	Entries      []PlanEntry `json:"entries"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// Add appends a change to the plan and logs it
+func (p *Plan) Add(entry PlanEntry) {
+	log.Info().Interface("before", entry.Before).Interface("after", entry.After).Msgf("Dry-run: would %v %v %v for load balancer %v", entry.Action, entry.Kind, entry.Name, p.LoadBalancer)
+	p.Entries = append(p.Entries, entry)
+}
+
+type planContextKey struct{}
+
+// withPlan returns a context that collects the changes of the Cloudflare api calls made with it into the plan
+func withPlan(ctx context.Context, plan *Plan) context.Context {
+	return context.WithValue(ctx, planContextKey{}, plan)
+}
+
+// getPlan returns the plan attached to the context, or an unnamed one if there's none so changes are at least logged
+func getPlan(ctx context.Context) *Plan {
+	if plan, ok := ctx.Value(planContextKey{}).(*Plan); ok {
+		return plan
+	}
+	return &Plan{Time: time.Now()}
+}
+
+// PlanStore keeps the latest plan for each load balancer and serves them as json
+type PlanStore interface {
+	Set(*Plan)
+	Get() []*Plan
+	ServeHTTP(http.ResponseWriter, *http.Request)
+}
+
+type planStoreImpl struct {
+	mutex sync.Mutex
+	plans map[string]*Plan
+}
+
+// NewPlanStore returns an instance of PlanStore
+func NewPlanStore() PlanStore {
+
+	// return instance of PlanStore
+	return &planStoreImpl{
+		plans: make(map[string]*Plan),
+	}
+}
+
+func (ps *planStoreImpl) Set(plan *Plan) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.plans[plan.LoadBalancer] = plan
+}
+
+// Get returns the latest plans ordered by load balancer
+func (ps *planStoreImpl) Get() (plans []*Plan) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	plans = []*Plan{}
+	for _, plan := range ps.plans {
+		plans = append(plans, plan)
+	}
+
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].LoadBalancer < plans[j].LoadBalancer
+	})
+
+	return
+}
+
+func (ps *planStoreImpl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ps.Get()); err != nil {
+		log.Warn().Err(err).Msg("Writing plans failed")
+	}
+}
+
+// writePlansText writes the plans in a human readable form
+func writePlansText(w io.Writer, plans []*Plan) {
+	for _, plan := range plans {
+		if plan.Error != "" {
+			fmt.Fprintf(w, "Load balancer %v: failed: %v\n", plan.LoadBalancer, plan.Error)
+		} else if len(plan.Entries) == 0 {
+			fmt.Fprintf(w, "Load balancer %v: no changes\n", plan.LoadBalancer)
+		} else {
+			fmt.Fprintf(w, "Load balancer %v: %v changes\n", plan.LoadBalancer, len(plan.Entries))
+		}
+		for _, entry := range plan.Entries {
+			fmt.Fprintf(w, "  %v %v %v\n", entry.Action, entry.Kind, entry.Name)
+
+			// origin changes are the most common ones, so spell them out
+			before, beforeIsPool := entry.Before.(cloudflare.LoadBalancerPool)
+			after, afterIsPool := entry.After.(cloudflare.LoadBalancerPool)
+			if beforeIsPool && afterIsPool {
+				diff := diffLoadBalancerPool(before, after)
+				for _, origin := range diff.AddedOrigins {
+					fmt.Fprintf(w, "    + origin %v\n", origin)
+				}
+				for _, origin := range diff.ChangedOrigins {
+					fmt.Fprintf(w, "    ~ origin %v\n", origin)
+				}
+				for _, origin := range diff.RemovedOrigins {
+					fmt.Fprintf(w, "    - origin %v\n", origin)
+				}
+			}
+		}
+	}
+}
+
+// dryRunCloudflareAPI reads from the Cloudflare API, but adds a plan entry for each create, modify and delete call
+// instead of making it; created objects get a placeholder id so later steps of the reconcile can refer to them
+type dryRunCloudflareAPI struct {
+	*cloudflare.API
+	plan *Plan
+}
+
+func getDryRunID(name string) string {
+	return fmt.Sprintf("dry-run-%v", name)
+}
+
+func (api *dryRunCloudflareAPI) CreateLoadBalancerPool(pool cloudflare.LoadBalancerPool) (cloudflare.LoadBalancerPool, error) {
+	pool.ID = getDryRunID(pool.Name)
+	api.plan.Add(PlanEntry{Action: "create", Kind: "pool", Name: pool.Name, After: pool})
+	return pool, nil
+}
+
+func (api *dryRunCloudflareAPI) ModifyLoadBalancerPool(pool cloudflare.LoadBalancerPool) (cloudflare.LoadBalancerPool, error) {
+	before, err := api.LoadBalancerPoolDetails(pool.ID)
+	if err != nil {
+		return pool, err
+	}
+	api.plan.Add(PlanEntry{Action: "modify", Kind: "pool", Name: pool.Name, Before: before, After: pool})
+	return pool, nil
+}
+
+func (api *dryRunCloudflareAPI) DeleteLoadBalancerPool(poolID string) error {
+	before, err := api.LoadBalancerPoolDetails(poolID)
+	if err != nil {
+		return err
+	}
+	api.plan.Add(PlanEntry{Action: "delete", Kind: "pool", Name: before.Name, Before: before})
+	return nil
+}
+
+func (api *dryRunCloudflareAPI) CreateLoadBalancerMonitor(monitor cloudflare.LoadBalancerMonitor) (cloudflare.LoadBalancerMonitor, error) {
+	monitor.ID = getDryRunID(monitor.Description)
+	api.plan.Add(PlanEntry{Action: "create", Kind: "monitor", Name: monitor.Description, After: monitor})
+	return monitor, nil
+}
+
+func (api *dryRunCloudflareAPI) ModifyLoadBalancerMonitor(monitor cloudflare.LoadBalancerMonitor) (cloudflare.LoadBalancerMonitor, error) {
+	before, err := api.LoadBalancerMonitorDetails(monitor.ID)
+	if err != nil {
+		return monitor, err
+	}
+	api.plan.Add(PlanEntry{Action: "modify", Kind: "monitor", Name: monitor.Description, Before: before, After: monitor})
+	return monitor, nil
+}
+
+func (api *dryRunCloudflareAPI) DeleteLoadBalancerMonitor(monitorID string) error {
+	before, err := api.LoadBalancerMonitorDetails(monitorID)
+	if err != nil {
+		return err
+	}
+	api.plan.Add(PlanEntry{Action: "delete", Kind: "monitor", Name: before.Description, Before: before})
+	return nil
+}
+
+func (api *dryRunCloudflareAPI) CreateLoadBalancer(zoneID string, lb cloudflare.LoadBalancer) (cloudflare.LoadBalancer, error) {
+	lb.ID = getDryRunID(lb.Name)
+	api.plan.Add(PlanEntry{Action: "create", Kind: "loadbalancer", Name: lb.Name, After: lb})
+	return lb, nil
+}
+
+func (api *dryRunCloudflareAPI) ModifyLoadBalancer(zoneID string, lb cloudflare.LoadBalancer) (cloudflare.LoadBalancer, error) {
+	before, err := api.LoadBalancerDetails(zoneID, lb.ID)
+	if err != nil {
+		return lb, err
+	}
+	api.plan.Add(PlanEntry{Action: "modify", Kind: "loadbalancer", Name: lb.Name, Before: before, After: lb})
+	return lb, nil
+}
+
+func (api *dryRunCloudflareAPI) DeleteLoadBalancer(zoneID, lbID string) error {
+	before, err := api.LoadBalancerDetails(zoneID, lbID)
+	if err != nil {
+		return err
+	}
+	api.plan.Add(PlanEntry{Action: "delete", Kind: "loadbalancer", Name: before.Name, Before: before})
+	return nil
+}
+
+func (api *dryRunCloudflareAPI) CreateDNSRecord(zoneID string, rr cloudflare.DNSRecord) (*cloudflare.DNSRecordResponse, error) {
+	rr.ID = getDryRunID(rr.Content)
+	api.plan.Add(PlanEntry{Action: "create", Kind: "dns record", Name: rr.Name, After: rr})
+	return &cloudflare.DNSRecordResponse{Result: rr}, nil
+}
+
+func (api *dryRunCloudflareAPI) DeleteDNSRecord(zoneID, recordID string) error {
+	before, err := api.DNSRecord(zoneID, recordID)
+	if err != nil {
+		return err
+	}
+	api.plan.Add(PlanEntry{Action: "delete", Kind: "dns record", Name: before.Name, Before: before})
+	return nil
+}
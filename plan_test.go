@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunCloudflareAPI(t *testing.T) {
+
+	t.Run("PlansMonitorCreationWithoutCreatingIt", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		cl.dryRun = true
+		plan := &Plan{LoadBalancer: "www.example.com", Entries: []PlanEntry{}}
+
+		// act
+		monitor, err := cl.GetOrCreateLoadBalancerMonitor(withPlan(context.Background(), plan), "my-cluster", "example.com", cloudflare.LoadBalancerMonitor{Path: "/liveness"})
+
+		assert.Nil(t, err)
+		assert.Empty(t, api.changes)
+		assert.Equal(t, getDryRunID(monitor.Description), monitor.ID)
+		if assert.Equal(t, 1, len(plan.Entries)) {
+			assert.Equal(t, "create", plan.Entries[0].Action)
+			assert.Equal(t, "monitor", plan.Entries[0].Kind)
+			assert.Equal(t, "my-cluster.example.com/liveness - "+ownershipMarker, plan.Entries[0].Name)
+		}
+	})
+
+	t.Run("PlansDNSRecordDeletionsWithRecordBeforeDeletion", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{dnsRecords: []cloudflare.DNSRecord{
+			{ID: "a1", Type: "A", Name: "www.example.com", Content: "203.0.113.1"},
+			{ID: "t1", Type: "TXT", Name: "www.example.com", Content: ownershipMarker + " for 203.0.113.1"},
+			{ID: "a9", Type: "A", Name: "www.example.com", Content: "198.51.100.9"},
+		}}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		cl.dryRun = true
+		plan := &Plan{LoadBalancer: "www.example.com", Entries: []PlanEntry{}}
+
+		// act
+		err := cl.DeleteDNSRecords(withPlan(context.Background(), plan), "www", "example.com")
+
+		assert.Nil(t, err)
+		assert.Empty(t, api.changes)
+		assert.Equal(t, 3, len(api.dnsRecords))
+		if assert.Equal(t, 2, len(plan.Entries)) {
+			assert.Equal(t, "delete", plan.Entries[0].Action)
+			assert.Equal(t, "dns record", plan.Entries[0].Kind)
+			assert.Equal(t, "www.example.com", plan.Entries[0].Name)
+			assert.Equal(t, "203.0.113.1", plan.Entries[0].Before.(cloudflare.DNSRecord).Content)
+			assert.Equal(t, "delete", plan.Entries[1].Action)
+			assert.Equal(t, ownershipMarker+" for 203.0.113.1", plan.Entries[1].Before.(cloudflare.DNSRecord).Content)
+		}
+	})
+}
+
+func TestPlanStoreServeHTTP(t *testing.T) {
+
+	t.Run("ServesLatestPlanPerLoadBalancerSortedByName", func(t *testing.T) {
+
+		planTime := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+		ps := NewPlanStore()
+		ps.Set(&Plan{LoadBalancer: "www.example.com", Time: planTime, Entries: []PlanEntry{{Action: "create", Kind: "pool", Name: "my-cluster"}}})
+		ps.Set(&Plan{LoadBalancer: "www.example.com", Time: planTime, Entries: []PlanEntry{}})
+		ps.Set(&Plan{LoadBalancer: "api.example.com", Time: planTime, Entries: []PlanEntry{{Action: "delete", Kind: "dns record", Name: "api.example.com"}}})
+		recorder := httptest.NewRecorder()
+
+		// act
+		ps.ServeHTTP(recorder, httptest.NewRequest("GET", "/plan", nil))
+
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		assert.JSONEq(t, `[
+			{"loadBalancer":"api.example.com","time":"2018-05-01T12:00:00Z","entries":[{"action":"delete","kind":"dns record","name":"api.example.com"}]},
+			{"loadBalancer":"www.example.com","time":"2018-05-01T12:00:00Z","entries":[]}
+		]`, recorder.Body.String())
+	})
+}
+
+func TestWritePlansText(t *testing.T) {
+
+	t.Run("SpellsOutOriginChangesOfPools", func(t *testing.T) {
+
+		before := cloudflare.LoadBalancerPool{Name: "my-cluster", Origins: []cloudflare.LoadBalancerOrigin{{Name: "node-a", Address: "10.0.0.1", Enabled: true}, {Name: "node-b", Address: "10.0.0.2", Enabled: true}}}
+		after := cloudflare.LoadBalancerPool{Name: "my-cluster", Origins: []cloudflare.LoadBalancerOrigin{{Name: "node-a", Address: "10.0.0.1", Enabled: true}, {Name: "node-c", Address: "10.0.0.3", Enabled: true}}}
+		plans := []*Plan{
+			{LoadBalancer: "api.example.com", Error: "Cloudflare API error"},
+			{LoadBalancer: "test.example.com", Entries: []PlanEntry{}},
+			{LoadBalancer: "www.example.com", Entries: []PlanEntry{{Action: "modify", Kind: "pool", Name: "my-cluster", Before: before, After: after}}},
+		}
+		var buffer bytes.Buffer
+
+		// act
+		writePlansText(&buffer, plans)
+
+		assert.Equal(t, `Load balancer api.example.com: failed: Cloudflare API error
+Load balancer test.example.com: no changes
+Load balancer www.example.com: 1 changes
+  modify pool my-cluster
+    + origin node-c
+    - origin node-b
+`, buffer.String())
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ServiceController runs a load balancer controller for each service that opted in with the load balancer annotations,
+// and removes the Cloudflare load balancer, pools and monitor again once the service opts out or gets deleted
+type ServiceController interface {
+	Run(context.Context)
+}
+
+type serviceControllerImpl struct {
+	k8sAPIClient     KubernetesAPIClient
+	cfAPIClient      CloudflareAPIClient
+	healthChecker    HealthChecker
+	eventRecorder    EventRecorder
+	planStore        PlanStore
+	hostnames        HostnameRegistry
+	nodeChanges      NodeChangeNotifier
+	syncInterval     int
+	loadBalancers    map[string]*managedLoadBalancer
+	claimedHostnames map[string]string
+	waitGroup        *sync.WaitGroup
+}
+
+// NewServiceController returns an instance of ServiceController; services using a hostname or pool name that's claimed
+// in the hostname registry by the config or a custom resource are skipped, and the services and the nodes running their
+// endpoints are checked every sync interval besides whenever the services change
+func NewServiceController(k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, healthChecker HealthChecker, eventRecorder EventRecorder, planStore PlanStore, hostnames HostnameRegistry, nodeChanges NodeChangeNotifier, syncInterval int, waitGroup *sync.WaitGroup) ServiceController {
+
+	// return instance of ServiceController
+	return &serviceControllerImpl{
+		k8sAPIClient:     k8sAPIClient,
+		cfAPIClient:      cfAPIClient,
+		healthChecker:    healthChecker,
+		eventRecorder:    eventRecorder,
+		planStore:        planStore,
+		hostnames:        hostnames,
+		nodeChanges:      nodeChanges,
+		syncInterval:     syncInterval,
+		loadBalancers:    map[string]*managedLoadBalancer{},
+		claimedHostnames: map[string]string{},
+		waitGroup:        waitGroup,
+	}
+}
+
+// Run syncs the load balancers with the services until the context is cancelled; the load balancer controllers are
+// stopped then, but their Cloudflare objects are left in place, since the services still want them
+func (sc *serviceControllerImpl) Run(ctx context.Context) {
+
+	sc.waitGroup.Add(1)
+
+	go func() {
+		defer sc.waitGroup.Done()
+
+		serviceChanges := make(chan struct{}, 1)
+		go sc.k8sAPIClient.WatchServices(ctx, serviceChanges)
+
+		for {
+			sc.sync(ctx)
+
+			select {
+			case <-ctx.Done():
+				for _, lb := range sc.loadBalancers {
+					lb.stop(sc.healthChecker)
+				}
+				return
+			case <-serviceChanges:
+				log.Info().Msg("Services changed, syncing their load balancers...")
+			case <-time.After(time.Duration(sc.syncInterval) * time.Second):
+			}
+		}
+	}()
+}
+
+// sync starts a load balancer controller for each new service, restarts them for services with changed annotations,
+// reconciles them when the nodes running the endpoints change and removes the load balancers of services that are gone
+func (sc *serviceControllerImpl) sync(ctx context.Context) {
+
+	configs, err := getServiceLoadBalancerConfigs(ctx, sc.k8sAPIClient, sc.hostnames)
+	if err != nil {
+		// never remove load balancers because the services couldn't be retrieved
+		log.Error().Err(err).Msg("Failed retrieving services for load balancers")
+		return
+	}
+
+	desiredConfigs := map[string]LoadBalancerConfig{}
+	for _, config := range configs {
+		desiredConfigs[getObjectKey(config.Service.Namespace, config.Service.Name)] = config
+		sc.claimedHostnames[config.Hostname()] = getServiceHostnameOwner(config.Service.Namespace, config.Service.Name)
+	}
+	defer releaseHostnames(sc.hostnames, sc.claimedHostnames, desiredConfigs, sc.loadBalancers)
+
+	// stop the controllers of services that are gone or changed, and remove their load balancer unless the service
+	// still wants it at the same hostname
+	previousConfigs := map[string]LoadBalancerConfig{}
+	for key, lb := range sc.loadBalancers {
+		config, isDesired := desiredConfigs[key]
+		if isDesired && reflect.DeepEqual(config, lb.config) && lb.isRunning() {
+			continue
+		}
+
+		lb.stop(sc.healthChecker)
+
+		if !isDesired || requiresTeardown(lb.config, config) {
+			log.Info().Msgf("Removing load balancer %v for service %v...", lb.config.Hostname(), key)
+			err := lb.controller.Teardown(ctx)
+			if err != nil {
+				// try again on the next sync
+				log.Error().Err(err).Msgf("Failed removing load balancer %v for service %v", lb.config.Hostname(), key)
+				if sc.planStore == nil {
+					sc.eventRecorder.ControllerEvent(ctx, eventTypeWarning, "TeardownFailed", fmt.Sprintf("Removing load balancer %v for service %v failed: %v", lb.config.Hostname(), key, err))
+				}
+				continue
+			}
+		} else {
+			previousConfigs[key] = lb.config
+		}
+
+		delete(sc.loadBalancers, key)
+	}
+
+	for key, config := range desiredConfigs {
+		if ctx.Err() != nil {
+			return
+		}
+
+		nodeNames, err := sc.k8sAPIClient.GetServiceNodeNames(ctx, config.Service.Namespace, config.Service.Name)
+		if err != nil {
+			continue
+		}
+
+		lb, exists := sc.loadBalancers[key]
+		if exists {
+			// a stopped controller is waiting for its previous load balancer to be removed
+			if lb.isRunning() && !reflect.DeepEqual(nodeNames, lb.nodeNames) {
+				lb.nodeNames = nodeNames
+				lb.controller.EnqueueReconcile("service endpoints moved")
+			}
+			continue
+		}
+
+		log.Info().Msgf("Starting load balancer %v for service %v...", config.Hostname(), key)
+		lb, err = startLoadBalancer(ctx, sc.k8sAPIClient, sc.cfAPIClient, config, sc.healthChecker, sc.eventRecorder, sc.planStore, sc.nodeChanges)
+		if err != nil {
+			// try again on the next sync
+			log.Error().Err(err).Msgf("Failed starting load balancer %v for service %v", config.Hostname(), key)
+			continue
+		}
+		lb.nodeNames = nodeNames
+		sc.loadBalancers[key] = lb
+
+		// the pools use the new monitor now, so the one for the previous health check path can go
+		if previousConfig, ok := previousConfigs[key]; ok && hasReplacedMonitor(previousConfig, config) {
+			err = sc.cfAPIClient.DeleteLoadBalancerMonitor(ctx, previousConfig.Pool.Name, previousConfig.Zone, previousConfig.Monitor.Path)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Failed removing previous monitor of load balancer %v for service %v", config.Hostname(), key)
+			}
+		}
+	}
+}
+
+// getServiceLoadBalancerConfigs returns the load balancer configuration for each service that opted in and claims their
+// hostnames and pool names; services with invalid annotations or a hostname or pool name that's claimed by another
+// service, a custom resource or the config are skipped
+func getServiceLoadBalancerConfigs(ctx context.Context, k8sAPIClient KubernetesAPIClient, hostnames HostnameRegistry) (configs []LoadBalancerConfig, err error) {
+
+	services, err := k8sAPIClient.GetServices(ctx)
+	if err != nil {
+		return
+	}
+
+	configs = []LoadBalancerConfig{}
+	for _, service := range services {
+		config, err := getServiceLoadBalancerConfig(service)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Skipping load balancer for service %v", getObjectKey(service.Namespace, service.Name))
+			continue
+		}
+		if err := hostnames.Claim(config.Hostname(), config.Pool.Name, getServiceHostnameOwner(service.Namespace, service.Name)); err != nil {
+			log.Warn().Err(err).Msgf("Skipping load balancer for service %v", getObjectKey(service.Namespace, service.Name))
+			continue
+		}
+
+		configs = append(configs, config)
+	}
+
+	return
+}
+
+// getServiceHostnameOwner returns the owner of the hostname claimed for a service in the hostname registry
+func getServiceHostnameOwner(namespace, name string) string {
+	return fmt.Sprintf("service %v", getObjectKey(namespace, name))
+}
+
+// getServiceLoadBalancerConfig returns the configuration of the load balancer for a service from its annotations
+func getServiceLoadBalancerConfig(service Service) (config LoadBalancerConfig, err error) {
+
+	if service.Hostname == "" || service.Zone == "" {
+		return config, fmt.Errorf("Annotations %v and %v are required", loadBalancerHostnameServiceAnnotation, loadBalancerZoneServiceAnnotation)
+	}
+	if !strings.HasSuffix(service.Hostname, "."+service.Zone) {
+		return config, fmt.Errorf("Hostname %v is not in zone %v", service.Hostname, service.Zone)
+	}
+
+	config = LoadBalancerConfig{
+		Name:        strings.TrimSuffix(service.Hostname, "."+service.Zone),
+		Zone:        service.Zone,
+		Type:        "lb",
+		Description: fmt.Sprintf("Load balancer for service %v", getObjectKey(service.Namespace, service.Name)),
+		Pool: PoolConfig{
+			// pool names can't contain dots
+			Name: strings.Replace(service.Hostname, ".", "-", -1),
+		},
+		Monitor: MonitorConfig{
+			Path: service.MonitorPath,
+		},
+		Service: &ObjectReference{
+			Kind:      "Service",
+			Namespace: service.Namespace,
+			Name:      service.Name,
+		},
+	}
+
+	config.SetDefaults()
+	err = config.Validate()
+
+	return
+}
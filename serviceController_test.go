@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetServiceLoadBalancerConfig(t *testing.T) {
+
+	t.Run("ReturnsConfigFromAnnotations", func(t *testing.T) {
+
+		service := Service{Namespace: "default", Name: "api", Hostname: "api.example.com", Zone: "example.com", MonitorPath: "/liveness"}
+
+		// act
+		config, err := getServiceLoadBalancerConfig(service)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "api", config.Name)
+		assert.Equal(t, "example.com", config.Zone)
+		assert.Equal(t, "lb", config.Type)
+		assert.Equal(t, "Load balancer for service default/api", config.Description)
+		assert.Equal(t, "api-example-com", config.Pool.Name)
+		assert.Equal(t, "/liveness", config.Monitor.Path)
+		assert.Equal(t, &ObjectReference{Kind: "Service", Namespace: "default", Name: "api"}, config.Service)
+	})
+
+	tests := []struct {
+		name          string
+		service       Service
+		expectedError string
+	}{
+		{"ReturnsErrorWithoutHostname", Service{Namespace: "default", Name: "api", Zone: "example.com"}, "Annotations estafette.io/cloudflare-loadbalancer-hostname and estafette.io/cloudflare-loadbalancer-zone are required"},
+		{"ReturnsErrorWithoutZone", Service{Namespace: "default", Name: "api", Hostname: "api.example.com"}, "Annotations estafette.io/cloudflare-loadbalancer-hostname and estafette.io/cloudflare-loadbalancer-zone are required"},
+		{"ReturnsErrorForHostnameOutsideZone", Service{Namespace: "default", Name: "api", Hostname: "api.example.org", Zone: "example.com"}, "Hostname api.example.org is not in zone example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			_, err := getServiceLoadBalancerConfig(tt.service)
+
+			if assert.NotNil(t, err) {
+				assert.Equal(t, tt.expectedError, err.Error())
+			}
+		})
+	}
+}
+
+func TestGetServiceLoadBalancerConfigs(t *testing.T) {
+
+	t.Run("SkipsInvalidServicesAndHostnamesInUse", func(t *testing.T) {
+
+		k8sAPIClient := &fakeServicesAPIClient{services: []Service{
+			{Namespace: "default", Name: "api", Hostname: "api.example.com", Zone: "example.com", MonitorPath: "/liveness"},
+			{Namespace: "default", Name: "invalid", Hostname: "invalid.example.org", Zone: "example.com"},
+			{Namespace: "other", Name: "api", Hostname: "api.example.com", Zone: "example.com", MonitorPath: "/liveness"},
+			{Namespace: "other", Name: "www", Hostname: "www.example.com", Zone: "example.com", MonitorPath: "/liveness"},
+		}}
+
+		// act
+		configs, err := getServiceLoadBalancerConfigs(context.Background(), k8sAPIClient, NewHostnameRegistry(Config{LoadBalancers: []LoadBalancerConfig{{Name: "www", Zone: "example.com"}}}))
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(configs)) {
+			assert.Equal(t, "api.example.com", configs[0].Hostname())
+			assert.Equal(t, "default", configs[0].Service.Namespace)
+		}
+	})
+
+	t.Run("SkipsServicesWithPoolNameInUse", func(t *testing.T) {
+
+		k8sAPIClient := &fakeServicesAPIClient{services: []Service{
+			{Namespace: "default", Name: "shop", Hostname: "shop.example.com", Zone: "example.com", MonitorPath: "/liveness"},
+		}}
+		hostnames := NewHostnameRegistry(Config{LoadBalancers: []LoadBalancerConfig{{Name: "www", Zone: "example.com", Type: "lb", Pool: PoolConfig{Name: "shop-example-com"}}}})
+
+		// act
+		configs, err := getServiceLoadBalancerConfigs(context.Background(), k8sAPIClient, hostnames)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(configs))
+	})
+
+	t.Run("ReturnsErrorWhenServicesCanNotBeRetrieved", func(t *testing.T) {
+
+		k8sAPIClient := &fakeServicesAPIClient{servicesErr: fmt.Errorf("connection refused")}
+
+		// act
+		_, err := getServiceLoadBalancerConfigs(context.Background(), k8sAPIClient, NewHostnameRegistry(Config{}))
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestServiceControllerSync(t *testing.T) {
+
+	newTestServiceController := func(k8sAPIClient KubernetesAPIClient) *serviceControllerImpl {
+		return NewServiceController(k8sAPIClient, nil, NewHealthChecker(0, 0), &fakeEventRecorder{events: []string{}}, nil, NewHostnameRegistry(Config{}), nil, 0, &sync.WaitGroup{}).(*serviceControllerImpl)
+	}
+	serviceConfig, _ := getServiceLoadBalancerConfig(Service{Namespace: "default", Name: "api", Hostname: "api.example.com", Zone: "example.com", MonitorPath: "/liveness"})
+
+	t.Run("RemovesLoadBalancerOfDeletedService", func(t *testing.T) {
+
+		sc := newTestServiceController(&fakeServicesAPIClient{services: []Service{}})
+		controller := &fakeLoadBalancerController{}
+		sc.loadBalancers["default/api"] = &managedLoadBalancer{config: serviceConfig, controller: controller}
+
+		// act
+		sc.sync(context.Background())
+
+		assert.Equal(t, 1, controller.teardowns)
+		assert.Equal(t, 0, len(sc.loadBalancers))
+	})
+
+	t.Run("ReleasesHostnameOfDeletedService", func(t *testing.T) {
+
+		sc := newTestServiceController(&fakeServicesAPIClient{services: []Service{}})
+		sc.hostnames.Claim("api.example.com", "api-example-com", "service default/api")
+		sc.claimedHostnames["api.example.com"] = "service default/api"
+		sc.loadBalancers["default/api"] = &managedLoadBalancer{config: serviceConfig, controller: &fakeLoadBalancerController{}}
+
+		// act
+		sc.sync(context.Background())
+
+		assert.Nil(t, sc.hostnames.Claim("api.example.com", "api-example-com", "custom resource estafette/api"))
+	})
+
+	t.Run("KeepsLoadBalancerWhenTeardownFails", func(t *testing.T) {
+
+		eventRecorder := &fakeEventRecorder{events: []string{}}
+		sc := newTestServiceController(&fakeServicesAPIClient{services: []Service{}})
+		sc.eventRecorder = eventRecorder
+		controller := &fakeLoadBalancerController{teardownErr: fmt.Errorf("Cloudflare API error")}
+		sc.loadBalancers["default/api"] = &managedLoadBalancer{config: serviceConfig, controller: controller}
+
+		// act
+		sc.sync(context.Background())
+
+		assert.Equal(t, 1, controller.teardowns)
+		assert.Equal(t, 1, len(sc.loadBalancers))
+		assert.Equal(t, []string{"controller TeardownFailed: Removing load balancer api.example.com for service default/api failed: Cloudflare API error"}, eventRecorder.events)
+	})
+
+	t.Run("PublishesNoTeardownFailureInDryRun", func(t *testing.T) {
+
+		eventRecorder := &fakeEventRecorder{events: []string{}}
+		sc := newTestServiceController(&fakeServicesAPIClient{services: []Service{}})
+		sc.eventRecorder = eventRecorder
+		sc.planStore = NewPlanStore()
+		controller := &fakeLoadBalancerController{teardownErr: fmt.Errorf("Cloudflare API error")}
+		sc.loadBalancers["default/api"] = &managedLoadBalancer{config: serviceConfig, controller: controller}
+
+		// act
+		sc.sync(context.Background())
+
+		assert.Equal(t, 1, len(sc.loadBalancers))
+		assert.Empty(t, eventRecorder.events)
+	})
+
+	t.Run("KeepsLoadBalancersWhenServicesCanNotBeRetrieved", func(t *testing.T) {
+
+		sc := newTestServiceController(&fakeServicesAPIClient{servicesErr: fmt.Errorf("connection refused")})
+		controller := &fakeLoadBalancerController{}
+		sc.loadBalancers["default/api"] = &managedLoadBalancer{config: serviceConfig, controller: controller}
+
+		// act
+		sc.sync(context.Background())
+
+		assert.Equal(t, 0, controller.teardowns)
+		assert.Equal(t, 1, len(sc.loadBalancers))
+	})
+
+	t.Run("ReconcilesWhenEndpointsMoveToOtherNodes", func(t *testing.T) {
+
+		sc := newTestServiceController(&fakeServicesAPIClient{
+			services:  []Service{{Namespace: "default", Name: "api", Hostname: "api.example.com", Zone: "example.com", MonitorPath: "/liveness"}},
+			nodeNames: []string{"node-b"},
+		})
+		controller := &fakeLoadBalancerController{}
+		sc.loadBalancers["default/api"] = &managedLoadBalancer{config: serviceConfig, controller: controller, nodeNames: []string{"node-a"}, cancel: func() {}, waitGroup: &sync.WaitGroup{}}
+
+		// act
+		sc.sync(context.Background())
+
+		assert.Equal(t, []string{"service endpoints moved"}, controller.reconciles)
+		assert.Equal(t, []string{"node-b"}, sc.loadBalancers["default/api"].nodeNames)
+		assert.Equal(t, 0, controller.teardowns)
+	})
+}
+
+func TestGetNodesOfService(t *testing.T) {
+
+	t.Run("ReturnsNodesRunningEndpoints", func(t *testing.T) {
+
+		ctl := newTestLoadBalancerController()
+		ctl.config.Service = &ObjectReference{Kind: "Service", Namespace: "default", Name: "api"}
+		ctl.k8sAPIClient = &fakeServicesAPIClient{nodes: []Node{{Name: "node-a"}, {Name: "node-b"}, {Name: "node-c"}}, nodeNames: []string{"node-a", "node-c"}}
+
+		// act
+		nodes, clusterNodes, err := ctl.getNodes(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, []Node{{Name: "node-a"}, {Name: "node-c"}}, nodes)
+		assert.Equal(t, 3, len(clusterNodes))
+	})
+}
+
+// fakeServicesAPIClient returns fixed services, nodes and endpoint node names; calls unrelated to services aren't
+// supported
+type fakeServicesAPIClient struct {
+	KubernetesAPIClient
+
+	services    []Service
+	servicesErr error
+	nodes       []Node
+	nodeNames   []string
+}
+
+func (cl *fakeServicesAPIClient) GetServices(ctx context.Context) ([]Service, error) {
+	return cl.services, cl.servicesErr
+}
+
+func (cl *fakeServicesAPIClient) GetNodes(ctx context.Context) ([]Node, error) {
+	return cl.nodes, nil
+}
+
+func (cl *fakeServicesAPIClient) GetServiceNodeNames(ctx context.Context, namespace, name string) ([]string, error) {
+	return cl.nodeNames, nil
+}
+
+// fakeLoadBalancerController records the reconciles and teardowns requested by the service controller
+type fakeLoadBalancerController struct {
+	LoadBalancerController
+
+	reconciles  []string
+	teardowns   int
+	teardownErr error
+}
+
+func (ctl *fakeLoadBalancerController) EnqueueReconcile(reason string) {
+	ctl.reconciles = append(ctl.reconciles, reason)
+}
+
+func (ctl *fakeLoadBalancerController) Teardown(ctx context.Context) error {
+	ctl.teardowns++
+	return ctl.teardownErr
+}
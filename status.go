@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+)
+
+// LoadBalancerStatus describes the load balancer objects in Cloudflare next to the healthy Kubernetes nodes, and how
+// they differ from what the controller wants them to be
+type LoadBalancerStatus struct {
+	LoadBalancer   string              `json:"loadBalancer"`
+	LoadBalancerID string              `json:"loadBalancerID,omitempty"`
+	Type           string              `json:"type"`
+	Monitor        *MonitorStatus      `json:"monitor,omitempty"`
+	Pools          []PoolStatus        `json:"pools,omitempty"`
+	DefaultPools   []string            `json:"defaultPools,omitempty"`
+	FallbackPool   string              `json:"fallbackPool,omitempty"`
+	RegionPools    map[string][]string `json:"regionPools,omitempty"`
+	PopPools       map[string][]string `json:"popPools,omitempty"`
+	DNSRecords     []string            `json:"dnsRecords,omitempty"`
+	Nodes          []NodeStatus        `json:"nodes"`
+	Mismatches     []string            `json:"mismatches"`
+	lbExists       bool
+	poolNames      map[string]string
+	nodesByName    map[string]NodeStatus
+}
+
+// MonitorStatus describes the monitor checking the health of the origins
+type MonitorStatus struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Drifted     bool   `json:"drifted"`
+}
+
+// PoolStatus describes a pool and its origins
+type PoolStatus struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name"`
+	Enabled bool           `json:"enabled"`
+	Origins []OriginStatus `json:"origins"`
+}
+
+// OriginStatus describes an origin of a pool
+type OriginStatus struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Enabled bool   `json:"enabled"`
+}
+
+// NodeStatus describes a healthy node that should be an origin
+type NodeStatus struct {
+	Name       string `json:"name"`
+	ExternalIP string `json:"externalIP"`
+}
+
+// HasMismatches returns true if Cloudflare differs from what the controller wants it to be
+func (s LoadBalancerStatus) HasMismatches() bool {
+	return len(s.Mismatches) > 0
+}
+
+func (s *LoadBalancerStatus) addMismatch(format string, a ...interface{}) {
+	s.Mismatches = append(s.Mismatches, fmt.Sprintf(format, a...))
+}
+
+// getLoadBalancerStatus retrieves the current state of a load balancer from Cloudflare and Kubernetes without changing
+// anything
+func getLoadBalancerStatus(ctx context.Context, k8sAPIClient KubernetesAPIClient, cfAPIClient CloudflareAPIClient, config LoadBalancerConfig) (status LoadBalancerStatus, err error) {
+
+	status = LoadBalancerStatus{
+		LoadBalancer: config.Hostname(),
+		Type:         config.Type,
+		Nodes:        []NodeStatus{},
+		Mismatches:   []string{},
+		nodesByName:  map[string]NodeStatus{},
+	}
+
+	nodes, err := k8sAPIClient.GetHealthyNodes(ctx)
+	if err != nil {
+		return
+	}
+	if config.Service != nil {
+		var nodeNames []string
+		nodeNames, err = k8sAPIClient.GetServiceNodeNames(ctx, config.Service.Namespace, config.Service.Name)
+		if err != nil {
+			return
+		}
+		nodes = filterNodes(nodes, nodeNames)
+	}
+	for _, node := range nodes {
+		nodeStatus := NodeStatus{Name: node.Name, ExternalIP: node.ExternalIP}
+		status.Nodes = append(status.Nodes, nodeStatus)
+		status.nodesByName[node.Name] = nodeStatus
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool {
+		return status.Nodes[i].Name < status.Nodes[j].Name
+	})
+
+	if config.Type == "dns" {
+		err = status.addDNSRecords(ctx, cfAPIClient, config)
+		return
+	}
+
+	monitor, err := status.addMonitor(ctx, cfAPIClient, config)
+	if err != nil {
+		return
+	}
+
+	pools, err := status.addPools(ctx, cfAPIClient, config, monitor)
+	if err != nil {
+		return
+	}
+
+	err = status.addLoadBalancer(ctx, cfAPIClient, config, pools)
+
+	return
+}
+
+func (s *LoadBalancerStatus) addDNSRecords(ctx context.Context, cfAPIClient CloudflareAPIClient, config LoadBalancerConfig) (err error) {
+
+	records, err := cfAPIClient.GetDNSRecords(ctx, config.Name, config.Zone)
+	if err != nil {
+		return
+	}
+
+	s.DNSRecords = []string{}
+	for _, record := range records {
+		s.DNSRecords = append(s.DNSRecords, record.Content)
+	}
+	sort.Strings(s.DNSRecords)
+
+	nodeIPs := []string{}
+	for _, node := range s.Nodes {
+		if node.ExternalIP == "" {
+			continue
+		}
+		nodeIPs = append(nodeIPs, node.ExternalIP)
+		if !contains(s.DNSRecords, node.ExternalIP) {
+			s.addMismatch("Node %v has no dns record pointing to %v", node.Name, node.ExternalIP)
+		}
+	}
+	for _, ip := range s.DNSRecords {
+		if !contains(nodeIPs, ip) {
+			s.addMismatch("Dns record pointing to %v has no healthy node", ip)
+		}
+	}
+
+	return
+}
+
+func (s *LoadBalancerStatus) addMonitor(ctx context.Context, cfAPIClient CloudflareAPIClient, config LoadBalancerConfig) (monitor cloudflare.LoadBalancerMonitor, err error) {
+
+	monitor, exists, err := cfAPIClient.GetLoadBalancerMonitor(ctx, config.Pool.Name, config.Zone, config.Monitor.Path)
+	if err != nil {
+		return
+	}
+	if !exists {
+		s.addMismatch("Monitor %v.%v%v does not exist", config.Pool.Name, config.Zone, config.Monitor.Path)
+		return
+	}
+
+	// compare the same way as when reconciling, ignoring the fields that identify the existing monitor
+	desiredMonitor := config.Monitor.ToLoadBalancerMonitor()
+	desiredMonitor.ID = monitor.ID
+	desiredMonitor.CreatedOn = monitor.CreatedOn
+	desiredMonitor.ModifiedOn = monitor.ModifiedOn
+	desiredMonitor.Description = monitor.Description
+
+	s.Monitor = &MonitorStatus{
+		ID:          monitor.ID,
+		Description: monitor.Description,
+		Drifted:     !loadBalancerMonitorsEqual(monitor, desiredMonitor),
+	}
+	if s.Monitor.Drifted {
+		s.addMismatch("Monitor %v differs from its configuration", monitor.Description)
+	}
+
+	return
+}
+
+func (s *LoadBalancerStatus) addPools(ctx context.Context, cfAPIClient CloudflareAPIClient, config LoadBalancerConfig, monitor cloudflare.LoadBalancerMonitor) (pools []cloudflare.LoadBalancerPool, err error) {
+
+	pools, err = cfAPIClient.GetLoadBalancerPools(ctx, config.Pool.Name)
+	if err != nil {
+		return
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+
+	if len(pools) == 0 {
+		s.addMismatch("Pool %v does not exist", config.Pool.Name)
+	}
+
+	s.Pools = []PoolStatus{}
+	s.poolNames = map[string]string{}
+	enabledOrigins := map[string]bool{}
+	for _, pool := range pools {
+		s.poolNames[pool.ID] = pool.Name
+
+		poolStatus := PoolStatus{ID: pool.ID, Name: pool.Name, Enabled: pool.Enabled, Origins: []OriginStatus{}}
+		if monitor.ID != "" && pool.Monitor != monitor.ID {
+			s.addMismatch("Pool %v does not use monitor %v", pool.Name, monitor.Description)
+		}
+
+		for _, origin := range pool.Origins {
+			poolStatus.Origins = append(poolStatus.Origins, OriginStatus{Name: origin.Name, Address: origin.Address, Enabled: origin.Enabled})
+
+			node, isHealthy := s.nodesByName[origin.Name]
+			enabled := pool.Enabled && origin.Enabled
+			if enabled {
+				enabledOrigins[origin.Name] = true
+			}
+			if enabled && !isHealthy {
+				s.addMismatch("Origin %v in pool %v is enabled, but has no healthy node", origin.Name, pool.Name)
+			}
+			if isHealthy && node.ExternalIP != origin.Address {
+				s.addMismatch("Origin %v in pool %v has address %v, but its node has ip %v", origin.Name, pool.Name, origin.Address, node.ExternalIP)
+			}
+		}
+
+		s.Pools = append(s.Pools, poolStatus)
+	}
+
+	for _, node := range s.Nodes {
+		if !enabledOrigins[node.Name] {
+			s.addMismatch("Node %v is not an enabled origin in any pool", node.Name)
+		}
+	}
+
+	return
+}
+
+func (s *LoadBalancerStatus) addLoadBalancer(ctx context.Context, cfAPIClient CloudflareAPIClient, config LoadBalancerConfig, pools []cloudflare.LoadBalancerPool) (err error) {
+
+	loadBalancer, exists, err := cfAPIClient.GetLoadBalancer(ctx, config.Name, config.Zone)
+	if err != nil {
+		return
+	}
+	s.lbExists = exists
+	if !exists {
+		s.addMismatch("Load balancer %v does not exist", config.Hostname())
+		return
+	}
+
+	s.LoadBalancerID = loadBalancer.ID
+	s.DefaultPools = []string{}
+	for _, poolID := range loadBalancer.DefaultPools {
+		s.DefaultPools = append(s.DefaultPools, s.getPoolName(poolID))
+	}
+	s.FallbackPool = s.getPoolName(loadBalancer.FallbackPool)
+	s.RegionPools = s.getPoolNamesPerKey(loadBalancer.RegionPools)
+	s.PopPools = s.getPoolNamesPerKey(loadBalancer.PopPools)
+
+	for _, pool := range pools {
+		isDefaultPool := contains(loadBalancer.DefaultPools, pool.ID)
+		if isActivePool(pool) && !isDefaultPool {
+			s.addMismatch("Pool %v has enabled origins, but is not a default pool of load balancer %v", pool.Name, config.Hostname())
+		} else if !isActivePool(pool) && isDefaultPool {
+			s.addMismatch("Pool %v has no enabled origins, but is a default pool of load balancer %v", pool.Name, config.Hostname())
+		}
+
+		s.addSteeringMismatches(pool, "region", config.Steering.Regions, loadBalancer.RegionPools)
+		s.addSteeringMismatches(pool, "PoP", config.Steering.Pops, loadBalancer.PopPools)
+	}
+
+	return
+}
+
+// addSteeringMismatches checks that an active pool is a pool of each steered region or PoP, and that it isn't a pool of
+// any other region or PoP
+func (s *LoadBalancerStatus) addSteeringMismatches(pool cloudflare.LoadBalancerPool, kind string, steeredKeys []string, poolsPerKey map[string][]string) {
+
+	for _, key := range steeredKeys {
+		if isActivePool(pool) && !contains(poolsPerKey[key], pool.ID) {
+			s.addMismatch("Pool %v has enabled origins, but is not a pool of %v %v", pool.Name, kind, key)
+		}
+	}
+
+	for key, poolIDs := range poolsPerKey {
+		if !contains(poolIDs, pool.ID) {
+			continue
+		}
+		if !contains(steeredKeys, key) {
+			s.addMismatch("Pool %v is a pool of %v %v, which is not configured for steering", pool.Name, kind, key)
+		} else if !isActivePool(pool) {
+			s.addMismatch("Pool %v has no enabled origins, but is a pool of %v %v", pool.Name, kind, key)
+		}
+	}
+}
+
+// getPoolName returns the name of one of the load balancer's own pools, or the id for pools managed by anything else
+func (s *LoadBalancerStatus) getPoolName(poolID string) string {
+	if name, ok := s.poolNames[poolID]; ok {
+		return name
+	}
+	return poolID
+}
+
+// getPoolNamesPerKey returns the names of the pools of each region or PoP
+func (s *LoadBalancerStatus) getPoolNamesPerKey(poolsPerKey map[string][]string) (poolNames map[string][]string) {
+	poolNames = map[string][]string{}
+	for key, poolIDs := range poolsPerKey {
+		for _, poolID := range poolIDs {
+			poolNames[key] = append(poolNames[key], s.getPoolName(poolID))
+		}
+	}
+	return
+}
+
+// writeStatusText writes the statuses in a human readable form, marking mismatches with an exclamation mark
+func writeStatusText(w io.Writer, statuses []LoadBalancerStatus) {
+	for _, status := range statuses {
+		fmt.Fprintf(w, "Load balancer %v (%v)\n", status.LoadBalancer, status.Type)
+
+		if status.Type == "dns" {
+			fmt.Fprintf(w, "  Dns records:\n")
+			for _, ip := range status.DNSRecords {
+				fmt.Fprintf(w, "    %v\n", ip)
+			}
+		} else {
+			if status.Monitor != nil {
+				fmt.Fprintf(w, "  Monitor: %v (%v)\n", status.Monitor.Description, status.Monitor.ID)
+			}
+			for _, pool := range status.Pools {
+				fmt.Fprintf(w, "  Pool: %v (%v), %v\n", pool.Name, pool.ID, getEnabledText(pool.Enabled))
+				for _, origin := range pool.Origins {
+					fmt.Fprintf(w, "    %v %v, %v\n", origin.Name, origin.Address, getEnabledText(origin.Enabled))
+				}
+			}
+			if status.lbExists {
+				fmt.Fprintf(w, "  Default pools: %v\n", joinOrNone(status.DefaultPools))
+				fmt.Fprintf(w, "  Fallback pool: %v\n", status.FallbackPool)
+				writePoolsPerKeyText(w, "Region pools", status.RegionPools)
+				writePoolsPerKeyText(w, "PoP pools", status.PopPools)
+			}
+		}
+
+		fmt.Fprintf(w, "  Healthy nodes:\n")
+		for _, node := range status.Nodes {
+			fmt.Fprintf(w, "    %v %v\n", node.Name, node.ExternalIP)
+		}
+
+		if status.HasMismatches() {
+			fmt.Fprintf(w, "  Mismatches:\n")
+			for _, mismatch := range status.Mismatches {
+				fmt.Fprintf(w, "  ! %v\n", mismatch)
+			}
+		} else {
+			fmt.Fprintf(w, "  In sync\n")
+		}
+	}
+}
+
+// writePoolsPerKeyText writes the pools of each region or PoP in alphabetical order, if there are any
+func writePoolsPerKeyText(w io.Writer, title string, poolsPerKey map[string][]string) {
+
+	if len(poolsPerKey) == 0 {
+		return
+	}
+
+	keys := []string{}
+	for key := range poolsPerKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "  %v:\n", title)
+	for _, key := range keys {
+		fmt.Fprintf(w, "    %v: %v\n", key, joinOrNone(poolsPerKey[key]))
+	}
+}
+
+func getEnabledText(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func joinOrNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetLoadBalancerStatus(t *testing.T) {
+
+	config := LoadBalancerConfig{
+		Name: "www",
+		Zone: "example.com",
+		Pool: PoolConfig{
+			Name: "my-cluster",
+		},
+		Monitor: MonitorConfig{
+			Path: "/liveness",
+		},
+	}
+	config.SetDefaults()
+
+	monitor := config.Monitor.ToLoadBalancerMonitor()
+	monitor.ID = "monitor-1"
+	monitor.Description = "my-cluster.example.com/liveness - " + ownershipMarker
+
+	driftedMonitor := monitor
+	driftedMonitor.Interval = 15
+
+	pool := func(id, name, monitorID string, origins ...cloudflare.LoadBalancerOrigin) cloudflare.LoadBalancerPool {
+		return cloudflare.LoadBalancerPool{ID: id, Name: name, Description: ownershipMarker, Enabled: true, Monitor: monitorID, Origins: origins}
+	}
+	origin := func(name, address string, enabled bool) cloudflare.LoadBalancerOrigin {
+		return cloudflare.LoadBalancerOrigin{Name: name, Address: address, Enabled: enabled}
+	}
+	loadBalancer := func(defaultPools ...string) cloudflare.LoadBalancer {
+		return cloudflare.LoadBalancer{ID: "lb-1", Name: "www.example.com", DefaultPools: defaultPools, FallbackPool: defaultPools[0]}
+	}
+
+	tests := []struct {
+		name               string
+		monitors           []cloudflare.LoadBalancerMonitor
+		pools              []cloudflare.LoadBalancerPool
+		loadBalancers      []cloudflare.LoadBalancer
+		expectedMismatches []string
+	}{
+		{
+			"ReturnsNoMismatchesWhenInSync",
+			[]cloudflare.LoadBalancerMonitor{monitor},
+			[]cloudflare.LoadBalancerPool{pool("pool-1", "my-cluster", "monitor-1", origin("node-a", "10.0.0.1", true), origin("node-b", "10.0.0.2", true))},
+			[]cloudflare.LoadBalancer{loadBalancer("pool-1")},
+			[]string{},
+		},
+		{
+			"ReportsMissingObjects",
+			[]cloudflare.LoadBalancerMonitor{},
+			[]cloudflare.LoadBalancerPool{},
+			[]cloudflare.LoadBalancer{},
+			[]string{
+				"Monitor my-cluster.example.com/liveness does not exist",
+				"Pool my-cluster does not exist",
+				"Node node-a is not an enabled origin in any pool",
+				"Node node-b is not an enabled origin in any pool",
+				"Load balancer www.example.com does not exist",
+			},
+		},
+		{
+			"ReportsDriftedMonitorAndPoolUsingOtherMonitor",
+			[]cloudflare.LoadBalancerMonitor{driftedMonitor},
+			[]cloudflare.LoadBalancerPool{pool("pool-1", "my-cluster", "monitor-2", origin("node-a", "10.0.0.1", true), origin("node-b", "10.0.0.2", true))},
+			[]cloudflare.LoadBalancer{loadBalancer("pool-1")},
+			[]string{
+				"Monitor my-cluster.example.com/liveness - " + ownershipMarker + " differs from its configuration",
+				"Pool my-cluster does not use monitor my-cluster.example.com/liveness - " + ownershipMarker,
+			},
+		},
+		{
+			"ReportsOriginsThatDifferFromNodes",
+			[]cloudflare.LoadBalancerMonitor{monitor},
+			[]cloudflare.LoadBalancerPool{pool("pool-1", "my-cluster", "monitor-1", origin("node-a", "10.0.0.9", true), origin("node-b", "10.0.0.2", false), origin("node-c", "10.0.0.3", true))},
+			[]cloudflare.LoadBalancer{loadBalancer("pool-1")},
+			[]string{
+				"Origin node-a in pool my-cluster has address 10.0.0.9, but its node has ip 10.0.0.1",
+				"Origin node-c in pool my-cluster is enabled, but has no healthy node",
+				"Node node-b is not an enabled origin in any pool",
+			},
+		},
+		{
+			"ReportsActivePoolThatIsNotADefaultPool",
+			[]cloudflare.LoadBalancerMonitor{monitor},
+			[]cloudflare.LoadBalancerPool{
+				pool("pool-1", "my-cluster", "monitor-1", origin("node-a", "10.0.0.1", true)),
+				pool("pool-2", "my-cluster-2", "monitor-1", origin("node-b", "10.0.0.2", true)),
+			},
+			[]cloudflare.LoadBalancer{loadBalancer("pool-1")},
+			[]string{"Pool my-cluster-2 has enabled origins, but is not a default pool of load balancer www.example.com"},
+		},
+		{
+			"ReportsInactivePoolThatIsADefaultPool",
+			[]cloudflare.LoadBalancerMonitor{monitor},
+			[]cloudflare.LoadBalancerPool{
+				pool("pool-1", "my-cluster", "monitor-1", origin("node-a", "10.0.0.1", true), origin("node-b", "10.0.0.2", true)),
+				pool("pool-2", "my-cluster-2", "monitor-1", origin("node-c", "10.0.0.3", false)),
+			},
+			[]cloudflare.LoadBalancer{loadBalancer("pool-1", "pool-2")},
+			[]string{"Pool my-cluster-2 has no enabled origins, but is a default pool of load balancer www.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			api := &fakeCloudflareAPI{monitors: tt.monitors, pools: tt.pools, loadBalancers: tt.loadBalancers}
+			cl, server := newTestCloudflareAPIClient(api, "")
+			defer server.Close()
+			k8sAPIClient := &fakeNodesAPIClient{nodes: []Node{{Name: "node-a", ExternalIP: "10.0.0.1", Ready: true}, {Name: "node-b", ExternalIP: "10.0.0.2", Ready: true}, {Name: "node-c", ExternalIP: "10.0.0.3"}}}
+
+			// act
+			status, err := getLoadBalancerStatus(context.Background(), k8sAPIClient, cl, config)
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expectedMismatches, status.Mismatches)
+			assert.Equal(t, len(tt.expectedMismatches) > 0, status.HasMismatches())
+			assert.Equal(t, []NodeStatus{{Name: "node-a", ExternalIP: "10.0.0.1"}, {Name: "node-b", ExternalIP: "10.0.0.2"}}, status.Nodes)
+			assert.Nil(t, api.changes)
+		})
+	}
+
+	t.Run("NamesDefaultAndFallbackPools", func(t *testing.T) {
+
+		api := &fakeCloudflareAPI{
+			monitors: []cloudflare.LoadBalancerMonitor{monitor},
+			pools: []cloudflare.LoadBalancerPool{
+				pool("pool-2", "my-cluster-2", "monitor-1", origin("node-b", "10.0.0.2", true)),
+				pool("pool-1", "my-cluster", "monitor-1", origin("node-a", "10.0.0.1", true)),
+			},
+			loadBalancers: []cloudflare.LoadBalancer{loadBalancer("pool-1", "pool-2", "pool-of-other-cluster")},
+		}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		k8sAPIClient := &fakeNodesAPIClient{nodes: []Node{{Name: "node-a", ExternalIP: "10.0.0.1", Ready: true}, {Name: "node-b", ExternalIP: "10.0.0.2", Ready: true}}}
+
+		// act
+		status, err := getLoadBalancerStatus(context.Background(), k8sAPIClient, cl, config)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"my-cluster", "my-cluster-2", "pool-of-other-cluster"}, status.DefaultPools)
+		assert.Equal(t, "my-cluster", status.FallbackPool)
+		if assert.Equal(t, 2, len(status.Pools)) {
+			assert.Equal(t, "my-cluster", status.Pools[0].Name)
+			assert.Equal(t, "my-cluster-2", status.Pools[1].Name)
+		}
+	})
+
+	t.Run("ReportsSteeringMismatches", func(t *testing.T) {
+
+		steeredConfig := config
+		steeredConfig.Steering = SteeringConfig{Regions: []string{"WEU"}, Pops: []string{"AMS"}}
+		steeredLoadBalancer := loadBalancer("pool-1")
+		steeredLoadBalancer.RegionPools = map[string][]string{"ENAM": {"pool-1", "pool-of-other-cluster"}}
+		steeredLoadBalancer.PopPools = map[string][]string{"AMS": {"pool-1"}}
+		api := &fakeCloudflareAPI{
+			monitors:      []cloudflare.LoadBalancerMonitor{monitor},
+			pools:         []cloudflare.LoadBalancerPool{pool("pool-1", "my-cluster", "monitor-1", origin("node-a", "10.0.0.1", true))},
+			loadBalancers: []cloudflare.LoadBalancer{steeredLoadBalancer},
+		}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		k8sAPIClient := &fakeNodesAPIClient{nodes: []Node{{Name: "node-a", ExternalIP: "10.0.0.1", Ready: true}}}
+
+		// act
+		status, err := getLoadBalancerStatus(context.Background(), k8sAPIClient, cl, steeredConfig)
+
+		assert.Nil(t, err)
+		assert.Equal(t, map[string][]string{"ENAM": {"my-cluster", "pool-of-other-cluster"}}, status.RegionPools)
+		assert.Equal(t, map[string][]string{"AMS": {"my-cluster"}}, status.PopPools)
+		assert.Equal(t, []string{
+			"Pool my-cluster has enabled origins, but is not a pool of region WEU",
+			"Pool my-cluster is a pool of region ENAM, which is not configured for steering",
+		}, status.Mismatches)
+	})
+
+	t.Run("ComparesDNSRecordsWithNodes", func(t *testing.T) {
+
+		dnsConfig := LoadBalancerConfig{Name: "www", Zone: "example.com", Type: "dns"}
+		dnsConfig.SetDefaults()
+		api := &fakeCloudflareAPI{dnsRecords: []cloudflare.DNSRecord{
+			{ID: "record-1", Type: "A", Name: "www.example.com", Content: "10.0.0.1"},
+			{ID: "record-2", Type: "A", Name: "www.example.com", Content: "10.0.0.9"},
+			{ID: "marker-1", Type: "TXT", Name: "www.example.com", Content: ownershipMarker + " for 10.0.0.1"},
+			{ID: "marker-2", Type: "TXT", Name: "www.example.com", Content: ownershipMarker + " for 10.0.0.9"},
+		}}
+		cl, server := newTestCloudflareAPIClient(api, "")
+		defer server.Close()
+		k8sAPIClient := &fakeNodesAPIClient{nodes: []Node{{Name: "node-a", ExternalIP: "10.0.0.1", Ready: true}, {Name: "node-b", ExternalIP: "10.0.0.2", Ready: true}}}
+
+		// act
+		status, err := getLoadBalancerStatus(context.Background(), k8sAPIClient, cl, dnsConfig)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.9"}, status.DNSRecords)
+		assert.Equal(t, []string{"Node node-b has no dns record pointing to 10.0.0.2", "Dns record pointing to 10.0.0.9 has no healthy node"}, status.Mismatches)
+	})
+}
+
+func TestWriteStatusText(t *testing.T) {
+
+	t.Run("WritesLoadBalancerWithMismatches", func(t *testing.T) {
+
+		statuses := []LoadBalancerStatus{{
+			LoadBalancer: "www.example.com",
+			Type:         "lb",
+			Monitor:      &MonitorStatus{ID: "monitor-1", Description: "my-cluster.example.com/liveness"},
+			Pools: []PoolStatus{
+				{ID: "pool-1", Name: "my-cluster", Enabled: true, Origins: []OriginStatus{{Name: "node-a", Address: "10.0.0.1", Enabled: true}}},
+				{ID: "pool-2", Name: "my-cluster-2", Enabled: true, Origins: []OriginStatus{{Name: "node-b", Address: "10.0.0.2", Enabled: false}}},
+			},
+			DefaultPools: []string{"my-cluster"},
+			FallbackPool: "my-cluster",
+			Nodes:        []NodeStatus{{Name: "node-a", ExternalIP: "10.0.0.1"}},
+			Mismatches:   []string{"Origin node-c in pool my-cluster is enabled, but has no healthy node"},
+			lbExists:     true,
+		}}
+		var buffer bytes.Buffer
+
+		// act
+		writeStatusText(&buffer, statuses)
+
+		assert.Equal(t, `Load balancer www.example.com (lb)
+  Monitor: my-cluster.example.com/liveness (monitor-1)
+  Pool: my-cluster (pool-1), enabled
+    node-a 10.0.0.1, enabled
+  Pool: my-cluster-2 (pool-2), enabled
+    node-b 10.0.0.2, disabled
+  Default pools: my-cluster
+  Fallback pool: my-cluster
+  Healthy nodes:
+    node-a 10.0.0.1
+  Mismatches:
+  ! Origin node-c in pool my-cluster is enabled, but has no healthy node
+`, buffer.String())
+	})
+
+	t.Run("WritesRegionAndPopPoolsInAlphabeticalOrder", func(t *testing.T) {
+
+		statuses := []LoadBalancerStatus{{
+			LoadBalancer: "www.example.com",
+			Type:         "lb",
+			DefaultPools: []string{"my-cluster"},
+			FallbackPool: "my-cluster",
+			RegionPools:  map[string][]string{"WEU": {"my-cluster"}, "ENAM": {"pool-of-other-cluster", "my-cluster"}},
+			PopPools:     map[string][]string{"AMS": {"my-cluster"}},
+			Nodes:        []NodeStatus{},
+			Mismatches:   []string{},
+			lbExists:     true,
+		}}
+		var buffer bytes.Buffer
+
+		// act
+		writeStatusText(&buffer, statuses)
+
+		assert.Contains(t, buffer.String(), `  Fallback pool: my-cluster
+  Region pools:
+    ENAM: pool-of-other-cluster, my-cluster
+    WEU: my-cluster
+  PoP pools:
+    AMS: my-cluster
+`)
+	})
+
+	t.Run("WritesDNSRecordsInSync", func(t *testing.T) {
+
+		statuses := []LoadBalancerStatus{{
+			LoadBalancer: "www.example.com",
+			Type:         "dns",
+			DNSRecords:   []string{"10.0.0.1"},
+			Nodes:        []NodeStatus{{Name: "node-a", ExternalIP: "10.0.0.1"}},
+			Mismatches:   []string{},
+		}}
+		var buffer bytes.Buffer
+
+		// act
+		writeStatusText(&buffer, statuses)
+
+		assert.Equal(t, `Load balancer www.example.com (dns)
+  Dns records:
+    10.0.0.1
+  Healthy nodes:
+    node-a 10.0.0.1
+  In sync
+`, buffer.String())
+	})
+
+	t.Run("LeavesOutDefaultPoolsOfMissingLoadBalancer", func(t *testing.T) {
+
+		statuses := []LoadBalancerStatus{{
+			LoadBalancer: "www.example.com",
+			Type:         "lb",
+			Nodes:        []NodeStatus{},
+			Mismatches:   []string{"Load balancer www.example.com does not exist"},
+		}}
+		var buffer bytes.Buffer
+
+		// act
+		writeStatusText(&buffer, statuses)
+
+		assert.NotContains(t, buffer.String(), "Default pools")
+	})
+}
+
+func TestLoadBalancerStatusJSON(t *testing.T) {
+
+	t.Run("WritesExportedFieldsOnly", func(t *testing.T) {
+
+		status := LoadBalancerStatus{
+			LoadBalancer: "www.example.com",
+			Type:         "lb",
+			Pools:        []PoolStatus{{ID: "pool-1", Name: "my-cluster", Enabled: true, Origins: []OriginStatus{{Name: "node-a", Address: "10.0.0.1", Enabled: true}}}},
+			DefaultPools: []string{"my-cluster"},
+			FallbackPool: "my-cluster",
+			Nodes:        []NodeStatus{{Name: "node-a", ExternalIP: "10.0.0.1"}},
+			Mismatches:   []string{},
+			lbExists:     true,
+			poolNames:    map[string]string{"pool-1": "my-cluster"},
+		}
+
+		// act
+		bytes, err := json.Marshal(status)
+
+		assert.Nil(t, err)
+		assert.Equal(t, `{"loadBalancer":"www.example.com","type":"lb","pools":[{"id":"pool-1","name":"my-cluster","enabled":true,"origins":[{"name":"node-a","address":"10.0.0.1","enabled":true}]}],"defaultPools":["my-cluster"],"fallbackPool":"my-cluster","nodes":[{"name":"node-a","externalIP":"10.0.0.1"}],"mismatches":[]}`, string(bytes))
+	})
+}